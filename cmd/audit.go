@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/iosmanthus/learner-recover/components/audit"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	auditHead string
+
+	auditCmd = &cobra.Command{
+		Use:   "audit",
+		Short: "Inspect the audit log of the commands run by recover",
+	}
+
+	auditVerifyCmd = &cobra.Command{
+		Use:   "verify <file>",
+		Short: "Verify the hash chain of an audit log",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			n, head, err := audit.Verify(args[0])
+			if err != nil {
+				return err
+			}
+			if auditHead != "" && head != auditHead {
+				return fmt.Errorf("audit log %s ends at %s, expect %s, entries may be removed", args[0], head, auditHead)
+			}
+
+			cmd.Printf("%s is intact: %d entries, head %s\n", args[0], n, head)
+			return nil
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+	auditCmd.AddCommand(auditVerifyCmd)
+	auditVerifyCmd.Flags().StringVar(&auditHead, "head", "", "expected hash of the last entry, as logged at the end of recover")
+}
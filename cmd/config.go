@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/iosmanthus/learner-recover/components/fetcher"
+	"github.com/iosmanthus/learner-recover/components/recover"
+	"github.com/iosmanthus/learner-recover/components/rpo"
+	"github.com/iosmanthus/learner-recover/schema"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Validate the config files and print their schemas",
+	}
+
+	configValidateCmd = &cobra.Command{
+		Use:       "validate <recover|info|rpo|learner-recover> <file>",
+		Short:     "Validate a config file and the files it references",
+		Args:      cobra.ExactArgs(2),
+		ValidArgs: schema.Kinds,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			kind, path := args[0], args[1]
+
+			var err error
+			switch kind {
+			case schema.KindRecover:
+				_, err = recover.NewConfig(path)
+			case schema.KindInfo:
+				_, err = fetcher.NewConfig(path)
+			case schema.KindRPO:
+				_, err = rpo.NewConfig(path)
+			case schema.KindUnified:
+				if _, err = fetcher.NewConfig(path); err != nil {
+					return fmt.Errorf("fetch: %v", err)
+				}
+				if _, err = recover.NewConfig(path); err != nil {
+					return fmt.Errorf("recover: %v", err)
+				}
+				if _, err = rpo.NewConfig(path); err != nil {
+					return fmt.Errorf("rpo: %v", err)
+				}
+			default:
+				_, err = schema.Get(kind)
+			}
+			if err != nil {
+				return err
+			}
+
+			cmd.Printf("%s is a valid %s config\n", path, kind)
+			return nil
+		},
+	}
+
+	configSchemaCmd = &cobra.Command{
+		Use:       "schema <recover|info|rpo|learner-recover>",
+		Short:     "Print the JSON Schema of a config file",
+		Args:      cobra.ExactValidArgs(1),
+		ValidArgs: schema.Kinds,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := schema.Get(args[0])
+			if err != nil {
+				return err
+			}
+			_, err = cmd.OutOrStdout().Write(data)
+			return err
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configSchemaCmd)
+}
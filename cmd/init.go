@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/iosmanthus/learner-recover/components/generate"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	initOptions       = &generate.Options{}
+	initLearnerGroups []string
+	initCmd           = &cobra.Command{
+		Use:   "init",
+		Short: "Generate the configs and topologies from the old topology",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			initOptions.LearnerGroups = make(map[string]string)
+			for _, group := range initLearnerGroups {
+				kv := strings.SplitN(group, "=", 2)
+				if len(kv) != 2 || kv[0] == "" {
+					return fmt.Errorf("invalid learner group %q, expect name=selector", group)
+				}
+				initOptions.LearnerGroups[kv[0]] = kv[1]
+			}
+			return generate.Generate(initOptions)
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(initCmd)
+	flags := initCmd.Flags()
+	flags.StringVarP(&initOptions.OldTopology, "topology", "t", "", "path of the topology of the whole cluster")
+	flags.StringVar(&initOptions.ClusterName, "cluster-name", "", "name of the recovered cluster")
+	flags.StringVar(&initOptions.ClusterVersion, "cluster-version", "", "version of the recovered cluster")
+	flags.StringVar(&initOptions.LearnerLabels, "learner-labels", "", "label selector of the learners, e.g. \"zone=backup\"")
+	flags.StringArrayVar(&initLearnerGroups, "learner-group", nil, "named learner group as name=selector, repeatable")
+	flags.StringSliceVar(&initOptions.PDHosts, "pd-hosts", nil, "hosts of the rebuilt PD servers")
+	flags.StringVar(&initOptions.MonitorHost, "monitor-host", "", "host of the new Prometheus and Grafana, defaults to the first PD host")
+	flags.IntVar(&initOptions.PortOffset, "port-offset", 0, "offset added to the ports of the new cluster")
+	flags.StringVar(&initOptions.TiKVCtlSrc, "tikv-ctl", "bin/tikv-ctl", "local path of tikv-ctl")
+	flags.StringVar(&initOptions.TiKVCtlDest, "tikv-ctl-dest", "/tmp/tikv-ctl", "path tikv-ctl is copied to on the learner hosts")
+	flags.StringVar(&initOptions.PDRecoverPath, "pd-recover", "bin/pd-recover", "local path of pd-recover")
+	flags.StringVar(&initOptions.InfoFile, "recover-info", "bin/recover-info.json", "path of the recover info")
+	flags.StringVar(&initOptions.HistoryPath, "history", "bin/history", "directory of the RPO history")
+	flags.StringVar(&initOptions.RPOFile, "rpo", "bin/rpo.json", "path of the RPO output")
+	flags.StringVarP(&initOptions.Output, "output", "o", "config", "directory of the generated files")
+	flags.BoolVarP(&initOptions.Force, "force", "f", false, "overwrite the existing files")
+	for _, flag := range []string{"topology", "cluster-name", "cluster-version", "pd-hosts"} {
+		_ = initCmd.MarkFlagRequired(flag)
+	}
+}
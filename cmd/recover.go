@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/iosmanthus/learner-recover/components/recover"
 	log "github.com/sirupsen/logrus"
@@ -9,8 +11,10 @@ import (
 )
 
 var (
-	recoverConfig string
-	recoverCmd    = &cobra.Command{
+	recoverConfig      string
+	recoverFailureTime string
+	recoverYes         bool
+	recoverCmd         = &cobra.Command{
 		Use:   "recover",
 		Short: "Recover TiKV cluster",
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -18,6 +22,12 @@ var (
 			if err != nil {
 				return err
 			}
+			if recoverFailureTime != "" {
+				if config.FailureTime, err = time.Parse(time.RFC3339, recoverFailureTime); err != nil {
+					return fmt.Errorf("invalid --failure-time: %v", err)
+				}
+			}
+			config.AssumeYes = recoverYes
 			rescuer := recover.NewClusterRescuer(config)
 			err = rescuer.Execute(context.Background())
 			if err != nil {
@@ -33,5 +43,7 @@ var (
 
 func init() {
 	rootCmd.AddCommand(recoverCmd)
-	recoverCmd.Flags().StringVarP(&recoverConfig, "config", "c", "", "path of example file")
+	recoverCmd.Flags().StringVarP(&recoverConfig, "config", "c", "", "path of the config file, defaults to $LEARNER_RECOVER_CONFIG or learner-recover.yaml")
+	recoverCmd.Flags().StringVar(&recoverFailureTime, "failure-time", "", "RFC3339 time of the failure to estimate the data loss at, overrides failure-time of the config")
+	recoverCmd.Flags().BoolVarP(&recoverYes, "yes", "y", false, "promote the learners without confirming the estimated data loss")
 }
@@ -4,17 +4,38 @@ import (
 	"errors"
 	"os"
 
+	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/components/unified"
+
 	"github.com/spf13/cobra"
 )
 
+var logOptions = &common.LogOptions{}
+
 var rootCmd = &cobra.Command{
 	Use:   "learner-recover",
 	Short: "learner-recover is a tool to recover TiKV cluster from learner stores",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return common.SetupLog(logOptions)
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return errors.New("missing subcommand")
 	},
 }
 
+func init() {
+	rootCmd.PersistentFlags().StringArrayVar(&unified.Overrides, "set", nil,
+		"override a config key, e.g. --set rpo.last-for=5m, repeatable")
+
+	flags := rootCmd.PersistentFlags()
+	flags.StringVar(&logOptions.Level, "log-level", "info", "log level: trace, debug, info, warn or error")
+	flags.StringVar(&logOptions.Format, "log-format", common.LogFormatText, "log format: text or json")
+	flags.StringVar(&logOptions.File, "log-file", "", "also write the logs to the file, rotated by size")
+	flags.IntVar(&logOptions.MaxSize, "log-max-size", 100, "size in megabytes of the log file before it is rotated")
+	flags.IntVar(&logOptions.MaxBackups, "log-max-backups", 10, "number of the rotated log files to keep, 0 keeps all")
+	flags.IntVar(&logOptions.MaxAge, "log-max-age", 30, "days to keep the rotated log files, 0 keeps them forever")
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
@@ -1,7 +1,15 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/iosmanthus/learner-recover/common"
 	"github.com/iosmanthus/learner-recover/components/rpo"
 
 	"github.com/gofrs/flock"
@@ -25,13 +33,198 @@ var (
 			log.Warnf("Acquiring lock for %s", lock)
 			fileLock.Lock()
 			defer fileLock.Unlock()
-			gen := rpo.NewGenerator(c)
+			gen, err := rpo.NewGenerator(c)
+			if err != nil {
+				return err
+			}
 			return gen.Gen(context.Background())
 		},
 	}
+
+	breakdownGroup  string
+	breakdownTop    int
+	breakdownStore  string
+	breakdownRegion uint64
+	breakdownCmd    = &cobra.Command{
+		Use:   "breakdown",
+		Short: "Show the per-region and per-store RPO lag",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := rpo.NewConfig(rpoConfig)
+			if err != nil {
+				return err
+			}
+			if c.Breakdown == "" {
+				return errors.New("breakdown is not configured")
+			}
+
+			if breakdownGroup == "" && len(c.Groups) > 1 {
+				return errors.New("--group is required with multiple learner groups")
+			}
+			breakdown, err := rpo.BreakdownFromFile(c.GroupPath(c.Breakdown, breakdownGroup))
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			defer w.Flush()
+
+			var regions []*rpo.RegionLag
+			switch {
+			case breakdownRegion != 0:
+				region := breakdown.Region(common.RegionId(breakdownRegion))
+				if region == nil {
+					return fmt.Errorf("region %v not found", breakdownRegion)
+				}
+				regions = append(regions, region)
+			case breakdownStore != "":
+				regions = breakdown.Store(breakdownStore)
+			default:
+				fmt.Fprintln(w, "STORE\tREGIONS\tMAX LAG\tAVG LAG\tWORST REGION")
+				for _, store := range breakdown.Stores {
+					fmt.Fprintf(w, "%s\t%v\t%v\t%v\t%v\n",
+						store.Store, store.Regions, store.MaxLag, store.AvgLag, store.WorstRegion)
+				}
+				fmt.Fprintln(w)
+				if len(breakdown.Tables) > 0 {
+					fmt.Fprintln(w, "TABLE\tID\tREGIONS\tMAX LAG\tWORST REGION")
+					for _, table := range breakdown.WorstTables(breakdownTop) {
+						fmt.Fprintf(w, "%s\t%v\t%v\t%v\t%v\n",
+							table.Table, table.TableID, table.Regions, table.MaxLag, table.WorstRegion)
+					}
+					fmt.Fprintln(w)
+				}
+				regions = breakdown.Worst(breakdownTop)
+			}
+
+			fmt.Fprintln(w, "REGION\tDATA\tSTORE\tLEARNER APPLIED\tLEARNER COMMIT\tVOTER APPLIED\tLAG\tLAG RANGE")
+			for _, region := range regions {
+				fmt.Fprintf(w, "%v\t%s\t%s\t%v\t%v\t%v\t%v\t[%v, %v]\n",
+					region.RegionId, region.Range(), region.Store,
+					region.LearnerAppliedIndex, region.LearnerCommitIndex, region.VoterAppliedIndex, region.Lag,
+					region.LagLower, region.LagUpper)
+			}
+			return nil
+		},
+	}
+)
+
+var (
+	queryAddr   string
+	queryGroup  string
+	queryAt     string
+	queryRegion string
+	queryIndex  string
+	queryTop    string
+	queryStore  string
+	queryCmd    = &cobra.Command{
+		Use:       "query <rpo|regions|safe-time|history>",
+		Short:     "Query the HTTP API of a running rpo command",
+		Args:      cobra.ExactValidArgs(1),
+		ValidArgs: []string{"rpo", "regions", "safe-time", "history"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			addr := queryAddr
+			if addr == "" {
+				c, err := rpo.NewConfig(rpoConfig)
+				if err != nil {
+					return err
+				}
+				if c.Listen == "" {
+					return errors.New("listen is not configured, please specify --addr")
+				}
+				addr = c.Listen
+			}
+
+			params := make(map[string]string)
+			for k, v := range map[string]string{
+				"group":  queryGroup,
+				"at":     queryAt,
+				"region": queryRegion,
+				"index":  queryIndex,
+				"top":    queryTop,
+				"store":  queryStore,
+			} {
+				if v != "" {
+					params[k] = v
+				}
+			}
+
+			path := map[string]string{
+				"rpo":       rpo.PathRPO,
+				"regions":   rpo.PathRegions,
+				"safe-time": rpo.PathSafeTime,
+				"history":   rpo.PathHistory,
+			}[args[0]]
+
+			data, err := rpo.NewClient(addr).Query(context.Background(), path, params)
+			if err != nil {
+				return err
+			}
+
+			out := &bytes.Buffer{}
+			if err = json.Indent(out, data, "", "  "); err != nil {
+				return err
+			}
+			cmd.Println(out.String())
+			return nil
+		},
+	}
+)
+
+var (
+	replayOutput string
+	replayCmd    = &cobra.Command{
+		Use:   "replay <file>",
+		Short: "Replay the recorded samples and print the RPO of every learner sample",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c := rpo.DefaultConfig()
+			if rpoConfig != "" {
+				var err error
+				if c, err = rpo.NewConfig(rpoConfig); err != nil {
+					return err
+				}
+			}
+
+			samples, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer samples.Close()
+
+			out := cmd.OutOrStdout()
+			if replayOutput != "" {
+				f, err := os.Create(replayOutput)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				out = f
+			}
+
+			return rpo.Replay(context.Background(), c, samples, out)
+		},
+	}
 )
 
 func init() {
 	rootCmd.AddCommand(rpoCmd)
-	rpoCmd.Flags().StringVarP(&rpoConfig, "config", "c", "", "path of example file")
+	rpoCmd.PersistentFlags().StringVarP(&rpoConfig, "config", "c", "", "path of the config file, defaults to $LEARNER_RECOVER_CONFIG or learner-recover.yaml")
+
+	rpoCmd.AddCommand(breakdownCmd)
+	breakdownCmd.Flags().StringVarP(&breakdownGroup, "group", "g", "", "learner group to show")
+	breakdownCmd.Flags().IntVarP(&breakdownTop, "top", "n", 10, "number of the worst regions to show")
+	breakdownCmd.Flags().StringVar(&breakdownStore, "store", "", "only show the regions whose freshest learner is on the store")
+	breakdownCmd.Flags().Uint64Var(&breakdownRegion, "region", 0, "only show the region")
+
+	rpoCmd.AddCommand(replayCmd)
+	replayCmd.Flags().StringVarP(&replayOutput, "output", "o", "", "path of the replay output, defaults to stdout")
+
+	rpoCmd.AddCommand(queryCmd)
+	queryCmd.Flags().StringVar(&queryAddr, "addr", "", "address of the rpo API, defaults to listen of the config")
+	queryCmd.Flags().StringVar(&queryGroup, "group", "", "learner group of the query, required with multiple groups except for rpo")
+	queryCmd.Flags().StringVar(&queryAt, "at", "", "time of the safe-time query in RFC3339")
+	queryCmd.Flags().StringVar(&queryRegion, "region", "", "region of the regions and history queries")
+	queryCmd.Flags().StringVar(&queryIndex, "index", "", "applied index of the history query")
+	queryCmd.Flags().StringVar(&queryTop, "top", "", "number of the worst regions of the regions query")
+	queryCmd.Flags().StringVar(&queryStore, "store", "", "learner store of the regions query")
 }
@@ -1,29 +1,51 @@
 package common
 
 import (
+	"fmt"
+	"os"
 	"os/exec"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func IsLabelsMatch(labels map[string]string, match map[string]string) bool {
-	for k, v := range labels {
-		if get, ok := match[k]; !ok || get != v {
-			return false
-		}
-	}
-	return true
-}
+// Run runs the command and logs it with the fields of the logger, the output
+// is only logged at debug level unless the command fails.
+func Run(logger *log.Entry, cmd *exec.Cmd) (string, error) {
+	logger = logger.WithField(FieldCommand, strings.Join(cmd.Args, " "))
+	logger.Debug("Running command")
 
-func Run(cmd *exec.Cmd) (string, error) {
+	start := time.Now()
 	output, err := cmd.CombinedOutput()
 	out := string(output)
+	logger = logger.WithField(FieldDuration, time.Since(start).String())
 
 	if err != nil {
-		log.Warnf("%s: %v", out, err)
+		logger.WithError(err).Warn(out)
 	} else {
-		log.Info(out)
+		logger.Info("Command finished")
+		logger.Debug(out)
 	}
 
 	return out, err
 }
+
+// CheckRequired returns an error naming the first empty field, the fields are
+// given as key, value pairs.
+func CheckRequired(fields ...string) error {
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i+1] == "" {
+			return fmt.Errorf("%s is required", fields[i])
+		}
+	}
+	return nil
+}
+
+// CheckFileExists returns an error if the file referenced by the key is missing.
+func CheckFileExists(key, path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DefaultLearnerGroup names the group configured by the legacy single label map.
+const DefaultLearnerGroup = "default"
+
+// LearnerGroup is a named set of learner stores chosen by their labels,
+// e.g. the learners of a backup data center.
+type LearnerGroup struct {
+	Name     string
+	Selector *Selector
+}
+
+// NewLearnerGroups builds the learner groups from either the legacy label
+// selector or the named groups, the groups are ordered by name. Both accept
+// the forms of NewSelector.
+func NewLearnerGroups(legacy interface{}, groups map[string]interface{}) ([]*LearnerGroup, error) {
+	selector, err := NewSelector(legacy)
+	if err != nil {
+		return nil, err
+	}
+	if selector != nil && len(groups) > 0 {
+		return nil, errors.New("learner labels and learner groups can't be configured at the same time")
+	}
+
+	if len(groups) == 0 {
+		if selector == nil {
+			return nil, errors.New("no learner labels or learner groups configured")
+		}
+		return []*LearnerGroup{{Name: DefaultLearnerGroup, Selector: selector}}, nil
+	}
+
+	var names []string
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var learnerGroups []*LearnerGroup
+	for _, name := range names {
+		selector, err := NewSelector(groups[name])
+		if err != nil {
+			return nil, fmt.Errorf("learner group %s: %v", name, err)
+		}
+		if selector == nil {
+			return nil, fmt.Errorf("learner group %s has no labels", name)
+		}
+		learnerGroups = append(learnerGroups, &LearnerGroup{Name: name, Selector: selector})
+	}
+	return learnerGroups, nil
+}
+
+// MatchLearnerGroup returns the group matching the labels of a store, nil if
+// the store is not a learner. A store matching more than one group is an
+// error, the groups would report the lag of each other's learners.
+func MatchLearnerGroup(groups []*LearnerGroup, labels map[string]string) (*LearnerGroup, error) {
+	var matched *LearnerGroup
+	for _, group := range groups {
+		if !group.Selector.Matches(labels) {
+			continue
+		}
+		if matched != nil {
+			return nil, fmt.Errorf("TiKV node with labels {%s} matches both learner group %s (%s) and %s (%s), please make the groups disjoint",
+				formatLabels(labels), matched.Name, matched.Selector, group.Name, group.Selector)
+		}
+		matched = group
+	}
+	return matched, nil
+}
+
+func formatLabels(labels map[string]string) string {
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+func FindLearnerGroup(groups []*LearnerGroup, name string) *LearnerGroup {
+	for _, group := range groups {
+		if group.Name == name {
+			return group
+		}
+	}
+	return nil
+}
+
+// CheckLearnerGroups returns an error if a store matches more than one group
+// or a group matches none of the stores, given by their labels. A group
+// without learners would report no lag at all.
+func CheckLearnerGroups(groups []*LearnerGroup, stores []map[string]string) error {
+	learners := make(map[string]int)
+	for _, labels := range stores {
+		group, err := MatchLearnerGroup(groups, labels)
+		if err != nil {
+			return err
+		}
+		if group != nil {
+			learners[group.Name]++
+		}
+	}
+	for _, group := range groups {
+		if learners[group.Name] == 0 {
+			return fmt.Errorf("learner group %s (%s) matches no TiKV node, please check the topology file", group.Name, group.Selector)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewLearnerGroups(t *testing.T) {
+	groups, err := NewLearnerGroups(nil, map[string]interface{}{"zone-b": "zone=b", "zone-a": "zone=a"})
+	if err != nil || len(groups) != 2 || groups[0].Name != "zone-a" {
+		t.Fatalf("unexpected groups %v %v", groups, err)
+	}
+	groups, err = NewLearnerGroups(map[string]interface{}{"zone": "backup"}, nil)
+	if err != nil || len(groups) != 1 || groups[0].Name != DefaultLearnerGroup {
+		t.Fatalf("unexpected legacy group %v %v", groups, err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		legacy interface{}
+		groups map[string]interface{}
+		err    string
+	}{
+		{"none", nil, nil, "no learner labels or learner groups"},
+		{"both", "zone=a", map[string]interface{}{"a": "zone=a"}, "at the same time"},
+		{"no labels", nil, map[string]interface{}{"a": nil}, "learner group a has no labels"},
+		{"invalid", nil, map[string]interface{}{"a": "zone in"}, "learner group a: invalid label selector"},
+	} {
+		if _, err := NewLearnerGroups(c.legacy, c.groups); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("%s: expect %q, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestCheckLearnerGroups(t *testing.T) {
+	stores := []map[string]string{
+		{"zone": "primary", "host": "h1"},
+		{"zone": "backup-a", "host": "h2"},
+		{"zone": "backup-b", "host": "h3"},
+	}
+	for _, c := range []struct {
+		name   string
+		groups map[string]interface{}
+		err    string
+	}{
+		{"disjoint", map[string]interface{}{"a": "zone=backup-a", "b": "zone=backup-b"}, ""},
+		{"empty", map[string]interface{}{"a": "zone=backup-a", "c": "zone=backup-c"}, "learner group c (zone = backup-c) matches no TiKV node"},
+		// b takes no store of its own, a store would be reported by either group.
+		{"overlap", map[string]interface{}{"a": "zone in (backup-a, backup-b)", "b": "zone=backup-b"}, "matches both learner group a"},
+		{"shadowed", map[string]interface{}{"all": "zone", "a": "zone=backup-a"}, "{host=h2, zone=backup-a} matches both"},
+	} {
+		groups, err := NewLearnerGroups(nil, c.groups)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = CheckLearnerGroups(groups, stores)
+		if c.err == "" {
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("%s: expect %q, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestMatchLearnerGroup(t *testing.T) {
+	groups, err := NewLearnerGroups(nil, map[string]interface{}{"a": "zone=a, !witness", "b": "zone=b || witness"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		labels map[string]string
+		want   string
+		err    bool
+	}{
+		{map[string]string{"zone": "a"}, "a", false},
+		{map[string]string{"zone": "a", "witness": "true"}, "b", false},
+		{map[string]string{"zone": "primary"}, "", false},
+		{map[string]string{"zone": "b"}, "b", false},
+	} {
+		group, err := MatchLearnerGroup(groups, c.labels)
+		if (err != nil) != c.err {
+			t.Fatalf("%v: unexpected error %v", c.labels, err)
+		}
+		got := ""
+		if group != nil {
+			got = group.Name
+		}
+		if got != c.want {
+			t.Fatalf("%v: got group %q, want %q", c.labels, got, c.want)
+		}
+	}
+
+	// A store of both groups is refused rather than given to the first one.
+	groups, _ = NewLearnerGroups(nil, map[string]interface{}{"a": "zone=a", "b": "rack=r1"})
+	if _, err = MatchLearnerGroup(groups, map[string]string{"zone": "a", "rack": "r1"}); err == nil {
+		t.Fatal("expect the overlap refused")
+	}
+}
@@ -0,0 +1,72 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Structured log fields shared by all commands.
+const (
+	FieldStep     = "step"
+	FieldHost     = "host"
+	FieldPort     = "port"
+	FieldRegionID = "region_id"
+	FieldCommand  = "command"
+	FieldDuration = "duration"
+	FieldGroup    = "group"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+type LogOptions struct {
+	Level  string
+	Format string
+	// File receives the logs besides stderr, rotated once it reaches MaxSize
+	// megabytes. Rotated files are removed after MaxAge days or once there are
+	// more than MaxBackups of them.
+	File       string
+	MaxSize    int
+	MaxBackups int
+	MaxAge     int
+}
+
+// SetupLog configures the global logger.
+func SetupLog(o *LogOptions) error {
+	level, err := log.ParseLevel(o.Level)
+	if err != nil {
+		return fmt.Errorf("invalid log level: %v", err)
+	}
+	log.SetLevel(level)
+
+	switch o.Format {
+	case LogFormatText:
+		log.SetFormatter(&log.TextFormatter{
+			PadLevelText:  true,
+			FullTimestamp: true,
+		})
+	case LogFormatJSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log format %q, expect %s or %s", o.Format, LogFormatText, LogFormatJSON)
+	}
+
+	var out io.Writer = os.Stderr
+	if o.File != "" {
+		out = io.MultiWriter(os.Stderr, &lumberjack.Logger{
+			Filename:   o.File,
+			MaxSize:    o.MaxSize,
+			MaxBackups: o.MaxBackups,
+			MaxAge:     o.MaxAge,
+			LocalTime:  true,
+		})
+	}
+	log.SetOutput(out)
+	return nil
+}
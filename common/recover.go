@@ -4,8 +4,116 @@ type RecoverInfo struct {
 	StoreIDs  []uint64 `json:"storeIDs"`
 	ClusterID string   `json:"clusterID"`
 	AllocID   uint64   `json:"allocID"`
+	// LearnerStoreIDs maps the learner groups to their stores.
+	LearnerStoreIDs map[string][]uint64 `json:"learnerStoreIDs,omitempty"`
+	// Replication, PlacementRules and ReplicationMode are the settings of the
+	// old PD, replayed into the rebuilt one.
+	Replication     *ReplicationConfig `json:"replication,omitempty"`
+	PlacementRules  []*PlacementRule   `json:"placementRules,omitempty"`
+	ReplicationMode *ReplicationMode   `json:"replicationMode,omitempty"`
 }
 
 func (i *RecoverInfo) IsEmpty() bool {
 	return len(i.StoreIDs) == 0 && i.ClusterID == "" && i.AllocID == 0
 }
+
+// ReplicationConfig is the part of /pd/api/v1/config/replicate kept.
+type ReplicationConfig struct {
+	MaxReplicas uint64 `json:"max-replicas"`
+	// LocationLabels are the label keys separated by commas.
+	LocationLabels       string `json:"location-labels"`
+	IsolationLevel       string `json:"isolation-level,omitempty"`
+	EnablePlacementRules string `json:"enable-placement-rules,omitempty"`
+}
+
+// PlacementEnabled reports whether the placement rules are enabled.
+func (c *ReplicationConfig) PlacementEnabled() bool {
+	return c != nil && c.EnablePlacementRules == "true"
+}
+
+// Roles of the placement rules.
+const (
+	RuleRoleVoter    = "voter"
+	RuleRoleLeader   = "leader"
+	RuleRoleFollower = "follower"
+	RuleRoleLearner  = "learner"
+)
+
+// PlacementRule is a rule of /pd/api/v1/config/rules.
+type PlacementRule struct {
+	GroupID          string             `json:"group_id"`
+	ID               string             `json:"id"`
+	Index            int                `json:"index,omitempty"`
+	Override         bool               `json:"override,omitempty"`
+	StartKeyHex      string             `json:"start_key"`
+	EndKeyHex        string             `json:"end_key"`
+	Role             string             `json:"role"`
+	Count            int                `json:"count"`
+	LabelConstraints []*LabelConstraint `json:"label_constraints,omitempty"`
+	LocationLabels   []string           `json:"location_labels,omitempty"`
+	IsolationLevel   string             `json:"isolation_level,omitempty"`
+}
+
+// IsVoter reports whether the peers of the rule vote, learners do not.
+func (r *PlacementRule) IsVoter() bool {
+	return r.Role != RuleRoleLearner
+}
+
+// Matches reports whether a store of the labels satisfies the constraints.
+func (r *PlacementRule) Matches(labels map[string]string) bool {
+	for _, c := range r.LabelConstraints {
+		if !c.Requirement().Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *PlacementRule) String() string {
+	return r.GroupID + "/" + r.ID
+}
+
+// LabelConstraint is a label constraint of a placement rule, its ops are
+// in, notIn, exists and notExists.
+type LabelConstraint struct {
+	Key    string   `json:"key"`
+	Op     string   `json:"op"`
+	Values []string `json:"values,omitempty"`
+}
+
+// Requirement returns the constraint as a label requirement.
+func (c *LabelConstraint) Requirement() *Requirement {
+	op := OpIn
+	switch c.Op {
+	case "notIn":
+		op = OpNotIn
+	case "exists":
+		op = OpExists
+	case "notExists":
+		op = OpNotExists
+	}
+	return &Requirement{Key: c.Key, Op: op, Values: c.Values}
+}
+
+// Replication modes of PD.
+const (
+	ModeMajority   = "majority"
+	ModeDRAutoSync = "dr-auto-sync"
+)
+
+// ReplicationMode is /pd/api/v1/config/replication-mode.
+type ReplicationMode struct {
+	Mode       string      `json:"replication-mode"`
+	DRAutoSync *DRAutoSync `json:"dr-auto-sync,omitempty"`
+}
+
+// DRAutoSync is the setting of the dr-auto-sync mode, the data centers are
+// told apart by the values of the label key.
+type DRAutoSync struct {
+	LabelKey         string `json:"label-key"`
+	Primary          string `json:"primary"`
+	DR               string `json:"dr"`
+	PrimaryReplicas  int    `json:"primary-replicas"`
+	DRReplicas       int    `json:"dr-replicas"`
+	WaitStoreTimeout string `json:"wait-store-timeout,omitempty"`
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -11,6 +12,8 @@ type RegionId uint64
 
 type RegionInfos struct {
 	StateMap map[RegionId]*RegionState
+	// Tombstones counts the tombstoned regions left out of StateMap.
+	Tombstones int
 }
 
 func NewRegionInfos() *RegionInfos {
@@ -36,7 +39,10 @@ func (r *RegionInfos) UnmarshalJSON(data []byte) error {
 	r.StateMap = tmp["region_infos"]
 
 	for id, state := range r.StateMap {
-		if state.ApplyState.AppliedIndex == 0 {
+		if state.Tombstone() {
+			r.Tombstones++
+			delete(r.StateMap, id)
+		} else if state.ApplyState.AppliedIndex == 0 {
 			delete(r.StateMap, id)
 		}
 	}
@@ -44,25 +50,148 @@ func (r *RegionInfos) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// Roles of the peers.
+const (
+	RoleVoter         = "Voter"
+	RoleLearner       = "Learner"
+	RoleIncomingVoter = "IncomingVoter"
+	RoleDemotingVoter = "DemotingVoter"
+)
+
+// PeerRole is printed by name by tikv-ctl and by number in older versions.
+type PeerRole string
+
+func (r *PeerRole) UnmarshalJSON(data []byte) error {
+	s, err := unmarshalEnum(data, []string{RoleVoter, RoleLearner, RoleIncomingVoter, RoleDemotingVoter})
+	*r = PeerRole(s)
+	return err
+}
+
+// States of the region replicas.
+const (
+	StateNormal    = "Normal"
+	StateApplying  = "Applying"
+	StateTombstone = "Tombstone"
+	StateMerging   = "Merging"
+)
+
+// PeerState is the state of a region replica, printed like PeerRole.
+type PeerState string
+
+func (s *PeerState) UnmarshalJSON(data []byte) error {
+	state, err := unmarshalEnum(data, []string{StateNormal, StateApplying, StateTombstone, StateMerging})
+	*s = PeerState(state)
+	return err
+}
+
+// unmarshalEnum returns the name of a protobuf enum given by name or by
+// number.
+func unmarshalEnum(data []byte, names []string) (string, error) {
+	var n int
+	if err := json.Unmarshal(data, &n); err == nil {
+		if n < 0 || n >= len(names) {
+			return "", fmt.Errorf("unknown enum value %v", n)
+		}
+		return names[n], nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		if strings.EqualFold(s, name) {
+			return name, nil
+		}
+	}
+	return s, nil
+}
+
+type Peer struct {
+	ID      uint64   `json:"id"`
+	StoreID uint64   `json:"store_id"`
+	Role    PeerRole `json:"role"`
+}
+
+// IsLearner reports whether the peer is a learner, the empty role of a
+// default protobuf field is a voter.
+func (p *Peer) IsLearner() bool {
+	return p.Role == RoleLearner
+}
+
 type RegionState struct {
-	RegionId   RegionId `json:"region_id"`
-	Host       string
-	DataDir    string
+	RegionId RegionId `json:"region_id"`
+	Host     string
+	DataDir  string
+	// Group is the learner group of the store, set when recovering.
+	Group     string
+	RaftState struct {
+		HardState struct {
+			Term   uint64 `json:"term"`
+			Vote   uint64 `json:"vote"`
+			Commit uint64 `json:"commit"`
+		} `json:"hard_state"`
+		LastIndex uint64 `json:"last_index"`
+	} `json:"raft_local_state"`
 	ApplyState struct {
-		AppliedIndex uint64    `json:"applied_index"`
-		Timestamp    time.Time `json:"timestamp"`
+		AppliedIndex uint64 `json:"applied_index"`
+		// The applied index is observed at some moment between Timestamp,
+		// when the request is sent, and Received, when the response arrives.
+		Timestamp time.Time `json:"timestamp"`
+		Received  time.Time `json:"received"`
 	} `json:"raft_apply_state"`
 	LocalState struct {
 		Region struct {
+			ID          uint64 `json:"id"`
 			StartKey    string `json:"start_key"`
 			EndKey      string `json:"end_key"`
 			RegionEpoch struct {
-				Version int `json:"version"`
+				ConfVer uint64 `json:"conf_ver"`
+				Version int    `json:"version"`
 			} `json:"region_epoch"`
+			Peers []*Peer `json:"peers"`
 		} `json:"region"`
+		State PeerState `json:"state"`
 	} `json:"region_local_state"`
 }
 
+// Tombstone reports whether the replica is destroyed, e.g. moved out of the
+// store or merged.
+func (s *RegionState) Tombstone() bool {
+	return s.LocalState.State == StateTombstone
+}
+
+// Applying reports whether the replica is applying a snapshot, its data is
+// incomplete until then.
+func (s *RegionState) Applying() bool {
+	return s.LocalState.State == StateApplying
+}
+
+// CommitIndex returns the commit index of the raft state, which is the
+// applied index if it is missing.
+func (s *RegionState) CommitIndex() uint64 {
+	if commit := s.RaftState.HardState.Commit; commit > s.ApplyState.AppliedIndex {
+		return commit
+	}
+	return s.ApplyState.AppliedIndex
+}
+
+// Unapplied returns the number of entries committed but not applied yet.
+func (s *RegionState) Unapplied() uint64 {
+	return s.CommitIndex() - s.ApplyState.AppliedIndex
+}
+
+// Roles counts the voters and the learners of the region.
+func (s *RegionState) Roles() (voters, learners int) {
+	for _, peer := range s.LocalState.Region.Peers {
+		if peer.IsLearner() {
+			learners++
+		} else {
+			voters++
+		}
+	}
+	return
+}
+
 type Aggregator interface {
 	Merge(a *RegionInfos, b *RegionInfos) *RegionInfos
 }
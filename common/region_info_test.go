@@ -0,0 +1,77 @@
+package common
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const testRegionInfos = `{
+  "region_infos": {
+    "2": {
+      "region_id": 2,
+      "raft_local_state": {"hard_state": {"term": 6, "vote": 4, "commit": 105}, "last_index": 106},
+      "raft_apply_state": {"applied_index": 100},
+      "region_local_state": {
+        "region": {
+          "id": 2, "start_key": "", "end_key": "7480000000000000FF1500000000000000F8",
+          "region_epoch": {"conf_ver": 5, "version": 3},
+          "peers": [
+            {"id": 3, "store_id": 1},
+            {"id": 4, "store_id": 4, "role": "Voter"},
+            {"id": 5, "store_id": 6, "role": "Learner"}
+          ]
+        },
+        "state": "Normal"
+      }
+    },
+    "7": {
+      "region_id": 7,
+      "raft_apply_state": {"applied_index": 30},
+      "region_local_state": {
+        "region": {"id": 7, "region_epoch": {"conf_ver": 2, "version": 1}, "peers": [{"id": 8, "store_id": 6, "role": 1}]},
+        "state": 2
+      }
+    },
+    "9": {
+      "region_id": 9,
+      "raft_apply_state": {"applied_index": 40},
+      "region_local_state": {"region": {"id": 9}, "state": "applying"}
+    }
+  }
+}`
+
+func TestRegionInfosUnmarshal(t *testing.T) {
+	infos := &RegionInfos{}
+	if err := json.Unmarshal([]byte(testRegionInfos), infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos.StateMap) != 2 || infos.Tombstones != 1 {
+		t.Fatalf("unexpected regions %v, %v tombstones", infos.StateMap, infos.Tombstones)
+	}
+
+	state := infos.StateMap[2]
+	if state.CommitIndex() != 105 || state.Unapplied() != 5 {
+		t.Fatalf("unexpected commit index %v", state.CommitIndex())
+	}
+	if epoch := state.LocalState.Region.RegionEpoch; epoch.ConfVer != 5 || epoch.Version != 3 {
+		t.Fatalf("unexpected epoch %+v", epoch)
+	}
+	if voters, learners := state.Roles(); voters != 2 || learners != 1 {
+		t.Fatalf("unexpected roles %v voters, %v learners", voters, learners)
+	}
+
+	// The raft state is missing.
+	if state = infos.StateMap[9]; !state.Applying() || state.CommitIndex() != 40 || state.Unapplied() != 0 {
+		t.Fatalf("unexpected region %+v", state)
+	}
+}
+
+func TestPeerRoleUnmarshal(t *testing.T) {
+	var role PeerRole
+	if err := json.Unmarshal([]byte(`1`), &role); err != nil || role != RoleLearner {
+		t.Fatalf("unexpected role %v, %v", role, err)
+	}
+	if err := json.Unmarshal([]byte(`4`), &role); err == nil {
+		t.Fatalf("unexpected role %v", role)
+	}
+}
@@ -0,0 +1,326 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	OpEquals    = "="
+	OpNotEquals = "!="
+	OpIn        = "in"
+	OpNotIn     = "notin"
+	OpExists    = "exists"
+	OpNotExists = "!"
+)
+
+// Requirement is a single condition on a label.
+type Requirement struct {
+	Key    string
+	Op     string
+	Values []string
+}
+
+func (r *Requirement) Matches(labels map[string]string) bool {
+	value, ok := labels[r.Key]
+	switch r.Op {
+	case OpExists:
+		return ok
+	case OpNotExists:
+		return !ok
+	case OpEquals, OpIn:
+		return ok && r.has(value)
+	case OpNotEquals, OpNotIn:
+		return !ok || !r.has(value)
+	}
+	return false
+}
+
+func (r *Requirement) has(value string) bool {
+	for _, v := range r.Values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Requirement) String() string {
+	switch r.Op {
+	case OpExists:
+		return r.Key
+	case OpNotExists:
+		return "!" + r.Key
+	case OpIn, OpNotIn:
+		return fmt.Sprintf("%s %s (%s)", r.Key, r.Op, strings.Join(r.Values, ", "))
+	}
+	return fmt.Sprintf("%s %s %s", r.Key, r.Op, r.Values[0])
+}
+
+// Selector chooses stores by their labels like the Kubernetes label
+// selectors: requirements separated by commas are ANDed, terms separated by
+// "||" are ORed, e.g. "zone in (backup-a, backup-b), rack != r3 || backup".
+type Selector struct {
+	Terms [][]*Requirement
+}
+
+func (s *Selector) Matches(labels map[string]string) bool {
+	for _, term := range s.Terms {
+		matched := true
+		for _, r := range term {
+			if !r.Matches(labels) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Selector) String() string {
+	var terms []string
+	for _, term := range s.Terms {
+		var requirements []string
+		for _, r := range term {
+			requirements = append(requirements, r.String())
+		}
+		terms = append(terms, strings.Join(requirements, ", "))
+	}
+	return strings.Join(terms, " || ")
+}
+
+// SelectorFromLabels returns the selector matching all the labels, as the
+// label maps of older configs did.
+func SelectorFromLabels(labels map[string]string) *Selector {
+	var keys []string
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var term []*Requirement
+	for _, k := range keys {
+		term = append(term, &Requirement{Key: k, Op: OpEquals, Values: []string{labels[k]}})
+	}
+	return &Selector{Terms: [][]*Requirement{term}}
+}
+
+// NewSelector decodes a selector written in a config file, which is either a
+// label map, a selector expression or a list of expressions ORed together.
+func NewSelector(v interface{}) (*Selector, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return ParseSelector(v)
+	case []interface{}:
+		s := &Selector{}
+		for _, item := range v {
+			expr, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid label selector %v: expect a string", item)
+			}
+			term, err := ParseSelector(expr)
+			if err != nil {
+				return nil, err
+			}
+			s.Terms = append(s.Terms, term.Terms...)
+		}
+		if len(s.Terms) == 0 {
+			return nil, nil
+		}
+		return s, nil
+	case map[string]interface{}:
+		if len(v) == 0 {
+			return nil, nil
+		}
+		labels := make(map[string]string)
+		for k, value := range v {
+			labels[k] = fmt.Sprintf("%v", value)
+		}
+		return SelectorFromLabels(labels), nil
+	case map[interface{}]interface{}:
+		if len(v) == 0 {
+			return nil, nil
+		}
+		labels := make(map[string]string)
+		for k, value := range v {
+			labels[fmt.Sprintf("%v", k)] = fmt.Sprintf("%v", value)
+		}
+		return SelectorFromLabels(labels), nil
+	}
+	return nil, fmt.Errorf("invalid label selector %v: expect a label map, an expression or a list of expressions", v)
+}
+
+// ParseSelector parses a selector expression.
+func ParseSelector(expr string) (*Selector, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label selector %q: %v", expr, err)
+	}
+
+	p := &selectorParser{tokens: tokens}
+	s, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid label selector %q: %v", expr, err)
+	}
+	return s, nil
+}
+
+func isSelectorChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '-' || c == '_' || c == '.' || c == '/'
+}
+
+func tokenize(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == ',' || c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case strings.HasPrefix(expr[i:], "||"), strings.HasPrefix(expr[i:], "!="), strings.HasPrefix(expr[i:], "=="):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		case c == '=' || c == '!':
+			tokens = append(tokens, string(c))
+			i++
+		case isSelectorChar(c):
+			j := i
+			for j < len(expr) && isSelectorChar(expr[j]) {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+		}
+	}
+	return tokens, nil
+}
+
+type selectorParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *selectorParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *selectorParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *selectorParser) identifier(what string) (string, error) {
+	token := p.next()
+	if token == "" {
+		return "", fmt.Errorf("missing %s", what)
+	}
+	if !isSelectorChar(token[0]) {
+		return "", fmt.Errorf("expect %s, got %q", what, token)
+	}
+	return token, nil
+}
+
+func (p *selectorParser) parse() (*Selector, error) {
+	s := &Selector{}
+	for {
+		var term []*Requirement
+		for {
+			r, err := p.requirement()
+			if err != nil {
+				return nil, err
+			}
+			term = append(term, r)
+			if p.peek() != "," {
+				break
+			}
+			p.next()
+		}
+		s.Terms = append(s.Terms, term)
+
+		switch token := p.next(); token {
+		case "":
+			return s, nil
+		case "||":
+		default:
+			return nil, fmt.Errorf("unexpected %q", token)
+		}
+	}
+}
+
+func (p *selectorParser) requirement() (*Requirement, error) {
+	if p.peek() == "!" {
+		p.next()
+		key, err := p.identifier("label key")
+		if err != nil {
+			return nil, err
+		}
+		return &Requirement{Key: key, Op: OpNotExists}, nil
+	}
+
+	key, err := p.identifier("label key")
+	if err != nil {
+		return nil, err
+	}
+
+	switch op := p.peek(); op {
+	case "", ",", "||":
+		return &Requirement{Key: key, Op: OpExists}, nil
+	case "=", "==", "!=":
+		p.next()
+		value, err := p.identifier(fmt.Sprintf("value of %s", key))
+		if err != nil {
+			return nil, err
+		}
+		if op == "==" {
+			op = OpEquals
+		}
+		return &Requirement{Key: key, Op: op, Values: []string{value}}, nil
+	case OpIn, OpNotIn:
+		p.next()
+		values, err := p.values(key)
+		if err != nil {
+			return nil, err
+		}
+		return &Requirement{Key: key, Op: op, Values: values}, nil
+	default:
+		return nil, fmt.Errorf("unknown operator %q after %s", op, key)
+	}
+}
+
+func (p *selectorParser) values(key string) ([]string, error) {
+	if token := p.next(); token != "(" {
+		return nil, fmt.Errorf("expect ( after %s, got %q", key, token)
+	}
+
+	var values []string
+	for {
+		value, err := p.identifier(fmt.Sprintf("value of %s", key))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		switch token := p.next(); token {
+		case ")":
+			return values, nil
+		case ",":
+		default:
+			return nil, fmt.Errorf("expect , or ) in the values of %s, got %q", key, token)
+		}
+	}
+}
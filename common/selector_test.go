@@ -0,0 +1,108 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	for _, c := range []struct {
+		expr string
+		// want is the normalized selector, err a part of the error.
+		want string
+		err  string
+	}{
+		{expr: "zone=backup", want: "zone = backup"},
+		{expr: "zone == backup", want: "zone = backup"},
+		{expr: "zone!=backup", want: "zone != backup"},
+		{expr: "zone in (backup-a, backup-b)", want: "zone in (backup-a, backup-b)"},
+		{expr: "zone notin (a)", want: "zone notin (a)"},
+		{expr: "backup, !witness", want: "backup, !witness"},
+		{expr: "zone in (a,b), rack != r3 || backup", want: "zone in (a, b), rack != r3 || backup"},
+		{expr: "topology.kubernetes.io/zone=us-east-1a", want: "topology.kubernetes.io/zone = us-east-1a"},
+
+		{expr: "", err: "missing label key"},
+		{expr: "zone=", err: "missing value of zone"},
+		{expr: "zone in a", err: "expect ( after zone"},
+		{expr: "zone in (a b)", err: "expect , or ) in the values of zone"},
+		{expr: "zone in (a,", err: "missing value of zone"},
+		{expr: "zone >= a", err: "unexpected character '>'"},
+		{expr: "zone like a", err: "unknown operator \"like\""},
+		{expr: "zone=a ||", err: "missing label key"},
+		{expr: "zone=a b", err: "unexpected \"b\""},
+		{expr: "(zone)", err: "expect label key"},
+	} {
+		s, err := ParseSelector(c.expr)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%q: expect error %q, got %v", c.expr, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", c.expr, err)
+		}
+		if got := s.String(); got != c.want {
+			t.Fatalf("%q: got %q, want %q", c.expr, got, c.want)
+		}
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]string{"zone": "backup-a", "rack": "r1", "host": "h1"}
+	for _, c := range []struct {
+		expr string
+		want bool
+	}{
+		{"zone=backup-a", true},
+		{"zone!=backup-a", false},
+		{"dc!=bj", true},
+		{"zone in (backup-a, backup-b)", true},
+		{"zone notin (backup-a)", false},
+		{"dc notin (bj)", true},
+		{"rack", true},
+		{"!rack", false},
+		{"!dc", true},
+		{"zone=backup-a, rack=r2", false},
+		{"zone=backup-b || rack=r1", true},
+	} {
+		s, err := ParseSelector(c.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Matches(labels); got != c.want {
+			t.Fatalf("%q: got %v, want %v", c.expr, got, c.want)
+		}
+	}
+}
+
+func TestNewSelector(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		value interface{}
+		want  string
+		err   bool
+	}{
+		{name: "nil", value: nil},
+		{name: "label map", value: map[string]interface{}{"zone": "backup", "rack": 1}, want: "rack = 1, zone = backup"},
+		{name: "yaml v2 map", value: map[interface{}]interface{}{"zone": "backup"}, want: "zone = backup"},
+		{name: "empty map", value: map[string]interface{}{}},
+		{name: "expression", value: "zone=backup", want: "zone = backup"},
+		{name: "list", value: []interface{}{"zone=a", "zone=b, rack"}, want: "zone = a || zone = b, rack"},
+		{name: "empty list", value: []interface{}{}},
+		{name: "list of numbers", value: []interface{}{1}, err: true},
+		{name: "number", value: 1, err: true},
+	} {
+		s, err := NewSelector(c.value)
+		if (err != nil) != c.err {
+			t.Fatalf("%s: unexpected error %v", c.name, err)
+		}
+		got := ""
+		if s != nil {
+			got = s.String()
+		}
+		if got != c.want {
+			t.Fatalf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// Package audit keeps an append-only, hash-chained log of the commands run
+// against the cluster. Every entry carries the hash of the previous one, so
+// editing or removing an entry breaks the chain from there on. A command is
+// logged as an intent before it runs and as a result once it returns, so a
+// command which hangs or is killed leaves its intent behind.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LocalHost is recorded for the commands run on the local machine.
+const LocalHost = "local"
+
+const (
+	PhaseIntent = "intent"
+	PhaseResult = "result"
+)
+
+type Entry struct {
+	Seq      uint64   `json:"seq"`
+	Time     string   `json:"time"`
+	Operator string   `json:"operator"`
+	Host     string   `json:"host"`
+	Step     string   `json:"step,omitempty"`
+	Argv     []string `json:"argv"`
+	ExitCode int      `json:"exit_code"`
+	Duration string   `json:"duration"`
+	// OutputSHA256 is the digest of the combined output of the command.
+	OutputSHA256 string `json:"output_sha256"`
+	Error        string `json:"error,omitempty"`
+	Prev         string `json:"prev"`
+	Hash         string `json:"hash,omitempty"`
+	// Phase is either PhaseIntent or PhaseResult, empty in the entries
+	// written by older versions which record the results only.
+	Phase string `json:"phase,omitempty"`
+	// Intent is the seq of the intent entry of a result.
+	Intent uint64 `json:"intent,omitempty"`
+}
+
+// digest returns the hash of the entry, which covers all the fields but the
+// hash itself.
+func (e *Entry) digest() (string, error) {
+	c := *e
+	c.Hash = ""
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+type Log struct {
+	mu       sync.Mutex
+	file     *os.File
+	operator string
+	seq      uint64
+	head     string
+}
+
+// Operator returns the user running the tool, the user behind sudo if any,
+// with the hostname of the local machine.
+func Operator() string {
+	name := os.Getenv("SUDO_USER")
+	if name == "" {
+		if u, err := user.Current(); err == nil {
+			name = u.Username
+		}
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s@%s", name, host)
+}
+
+// Open verifies the existing chain of the audit log and opens it for
+// appending, the log is created if missing. A broken chain is an error,
+// nothing is appended to an untrusted log. A torn last line left by a crash
+// is truncated.
+func Open(path string) (*Log, error) {
+	var (
+		seq  uint64
+		head string
+		tail *tail
+	)
+	if _, err := os.Stat(path); err == nil {
+		if seq, head, tail, err = verify(path); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	if tail != nil {
+		err = file.Truncate(tail.size)
+		if err == nil && !tail.terminated {
+			_, err = file.Write([]byte{'\n'})
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return &Log{file: file, operator: Operator(), seq: seq, head: head}, nil
+}
+
+// Head returns the hash of the last entry, keep it elsewhere to detect a
+// truncated log with `audit verify --head`.
+func (l *Log) Head() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.head
+}
+
+// Begin appends the intent of a command or API request given by its argv
+// before it's done, the seq of the intent is passed to Finish. A nil log
+// records nothing.
+func (l *Log) Begin(host, step string, argv []string, start time.Time) (uint64, error) {
+	if l == nil {
+		return 0, nil
+	}
+	if host == "" {
+		host = LocalHost
+	}
+
+	e := &Entry{
+		Time:     start.Format(time.RFC3339Nano),
+		Operator: l.operator,
+		Host:     host,
+		Step:     step,
+		Phase:    PhaseIntent,
+		Argv:     argv,
+	}
+	if err := l.append(e); err != nil {
+		return 0, err
+	}
+	return e.Seq, nil
+}
+
+// Finish appends the result of the command begun as intent.
+func (l *Log) Finish(intent uint64, host, step string, argv []string, start time.Time, output []byte, err error) error {
+	if l == nil {
+		return nil
+	}
+	if host == "" {
+		host = LocalHost
+	}
+
+	sum := sha256.Sum256(output)
+	e := &Entry{
+		Time:         start.Format(time.RFC3339Nano),
+		Operator:     l.operator,
+		Host:         host,
+		Step:         step,
+		Phase:        PhaseResult,
+		Intent:       intent,
+		Argv:         argv,
+		ExitCode:     exitCode(err),
+		Duration:     time.Since(start).String(),
+		OutputSHA256: hex.EncodeToString(sum[:]),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return l.append(e)
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	// The command didn't start or was killed.
+	return -1
+}
+
+func (l *Log) append(e *Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Seq = l.seq + 1
+	e.Prev = l.head
+	hash, err := e.digest()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err = l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err = l.file.Sync(); err != nil {
+		return err
+	}
+
+	l.seq, l.head = e.Seq, e.Hash
+	return nil
+}
+
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// Verify checks the chain of the audit log, it returns the number of entries
+// and the hash of the last one. A torn last line is ignored with a warning.
+func Verify(path string) (uint64, string, error) {
+	seq, head, _, err := verify(path)
+	return seq, head, err
+}
+
+// tail is the end of the verified entries when the log is not ended by a
+// complete line.
+type tail struct {
+	size       int64
+	terminated bool
+}
+
+func verify(path string) (uint64, string, *tail, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	defer file.Close()
+
+	var (
+		seq  uint64
+		head string
+		size int64
+	)
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return 0, "", nil, fmt.Errorf("audit log %s: %v", path, err)
+		}
+		if len(data) == 0 {
+			return seq, head, nil, nil
+		}
+
+		e := &Entry{}
+		if err := json.Unmarshal(data, e); err != nil {
+			// Only the last line may be torn by a crash in the middle of a write.
+			if data[len(data)-1] != '\n' {
+				log.Warnf("Ignoring the torn last line %d of audit log %s", line, path)
+				return seq, head, &tail{size: size, terminated: true}, nil
+			}
+			return 0, "", nil, fmt.Errorf("audit log %s line %d: %v", path, line, err)
+		}
+		if e.Seq != seq+1 {
+			return 0, "", nil, fmt.Errorf("audit log %s line %d: expect seq %d, got %d", path, line, seq+1, e.Seq)
+		}
+		if e.Prev != head {
+			return 0, "", nil, fmt.Errorf("audit log %s line %d: chain broken, previous hash mismatch", path, line)
+		}
+		hash, err := e.digest()
+		if err != nil {
+			return 0, "", nil, err
+		}
+		if hash != e.Hash {
+			return 0, "", nil, fmt.Errorf("audit log %s line %d: entry modified, hash mismatch", path, line)
+		}
+		seq, head = e.Seq, e.Hash
+		size += int64(len(data))
+
+		// The entry is complete but its newline is lost.
+		if data[len(data)-1] != '\n' {
+			return seq, head, &tail{size: size, terminated: false}, nil
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeLog writes a log of n commands, each of an intent and a result.
+func writeLog(t *testing.T, path string, n int) string {
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < n; i++ {
+		argv := []string{"tikv-ctl", "unsafe-recover", "remove-fail-stores"}
+		intent, err := l.Begin("10.0.2.1", "unsafe-recover", argv, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = l.Finish(intent, "10.0.2.1", "unsafe-recover", argv, time.Now(), []byte("success"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return l.Head()
+}
+
+func readLines(t *testing.T, path string) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.SplitAfter(string(data), "\n")
+}
+
+func TestBeginFinish(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	head := writeLog(t, path, 2)
+
+	n, got, err := Verify(path)
+	if err != nil || n != 4 || got != head {
+		t.Fatalf("unexpected verification %v %v %v", n, got, err)
+	}
+
+	var entries []*Entry
+	for _, line := range readLines(t, path) {
+		if line == "" {
+			continue
+		}
+		e := &Entry{}
+		if err = json.Unmarshal([]byte(line), e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	intent, result := entries[2], entries[3]
+	if intent.Phase != PhaseIntent || intent.OutputSHA256 != "" || result.Phase != PhaseResult || result.Intent != intent.Seq {
+		t.Fatalf("unexpected entries %+v %+v", intent, result)
+	}
+
+	// Reopened, the chain goes on.
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.Begin("", "rebuild-pd", []string{"pd-recover"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if n, _, err = Verify(path); err != nil || n != 5 {
+		t.Fatalf("unexpected verification %v %v", n, err)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	if code := exitCode(nil); code != 0 {
+		t.Fatalf("unexpected exit code %v", code)
+	}
+	if code := exitCode(errors.New("killed")); code != -1 {
+		t.Fatalf("unexpected exit code %v", code)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		tamper func(lines []string) []string
+		want   string
+	}{
+		{"modified", func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], "remove-fail-stores", "remove-fail-stores -s 1", 1)
+			return lines
+		}, "line 2: entry modified"},
+		{"removed", func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		}, "line 2: expect seq 2"},
+		{"reordered", func(lines []string) []string {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, "line 2: expect seq 2"},
+		{"rechained", func(lines []string) []string {
+			e := &Entry{}
+			json.Unmarshal([]byte(lines[1]), e)
+			e.Prev = strings.Repeat("0", 64)
+			e.Hash, _ = e.digest()
+			data, _ := json.Marshal(e)
+			lines[1] = string(data) + "\n"
+			return lines
+		}, "line 2: chain broken"},
+		{"garbage", func(lines []string) []string {
+			lines[1] = "not an entry\n"
+			return lines
+		}, "line 2"},
+	} {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		writeLog(t, path, 2)
+		lines := c.tamper(readLines(t, path))
+		if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "")), 0640); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := Verify(path); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Fatalf("%s: expect %q, got %v", c.name, c.want, err)
+		}
+		// Nothing is appended to a tampered log.
+		if _, err := Open(path); err == nil {
+			t.Fatalf("%s: a tampered log is opened", c.name)
+		}
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		// cut is the number of bytes cut off the end of the log.
+		cut int
+	}{
+		{"torn entry", 20},
+		{"newline lost", 1},
+	} {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		writeLog(t, path, 2)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, data[:len(data)-c.cut], 0640); err != nil {
+			t.Fatal(err)
+		}
+
+		want := uint64(3)
+		if c.cut == 1 {
+			want = 4
+		}
+		if n, _, err := Verify(path); err != nil || n != want {
+			t.Fatalf("%s: unexpected verification %v %v", c.name, n, err)
+		}
+
+		// The torn line is dropped, the log goes on from the last entry.
+		l, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = l.Begin("", "join", []string{"tiup", "cluster", "scale-out"}, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+		n, _, err := Verify(path)
+		if err != nil || n != want+1 {
+			t.Fatalf("%s: unexpected verification after appending %v %v", c.name, n, err)
+		}
+		if data, _ = ioutil.ReadFile(path); !bytes.HasSuffix(data, []byte("\n")) || bytes.Count(data, []byte("\n")) != int(want+1) {
+			t.Fatalf("%s: unexpected log %s", c.name, data)
+		}
+	}
+
+	// A torn line in the middle is not left by a crash.
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeLog(t, path, 1)
+	lines := readLines(t, path)
+	lines[0] = lines[0][:20] + "\n"
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "")), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Fatal("a log torn in the middle is opened")
+	}
+}
@@ -0,0 +1,184 @@
+// Package cluster deploys and operates the TiDB clusters rebuilt by the
+// recovery, and confirms every operation from the state of the cluster.
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pingcap/tiup/pkg/cluster/spec"
+	log "github.com/sirupsen/logrus"
+)
+
+// Manager operates the clusters by their names.
+type Manager interface {
+	// Deploy deploys the cluster of the topology file without starting it.
+	Deploy(ctx context.Context, name, version, topology string) error
+	Start(ctx context.Context, name string) error
+	Restart(ctx context.Context, name string) error
+	// ScaleOut adds the instances of the topology file to the cluster.
+	ScaleOut(ctx context.Context, name, topology string) error
+	Display(ctx context.Context, name string) (*Cluster, error)
+}
+
+type Cluster struct {
+	Name      string
+	Version   string
+	Instances []*Instance
+}
+
+type Instance struct {
+	// ID is host:port, the port is the client port of PD.
+	ID        string
+	Role      string
+	Host      string
+	Status    string
+	DataDir   string
+	DeployDir string
+}
+
+// Up reports whether the instance is serving, the status of a PD leader is
+// Up|L for example.
+func (i *Instance) Up() bool {
+	return i.Status == "Up" || strings.HasPrefix(i.Status, "Up|")
+}
+
+// Instance returns the instance with the ID, nil if missing.
+func (c *Cluster) Instance(id string) *Instance {
+	for _, inst := range c.Instances {
+		if inst.ID == id {
+			return inst
+		}
+	}
+	return nil
+}
+
+// TopologyInstances returns the instances of the topology file, with their
+// IDs as displayed by tiup.
+func TopologyInstances(topology string) ([]*Instance, error) {
+	topo := &spec.Specification{}
+	if err := spec.ParseTopologyYaml(topology, topo); err != nil {
+		return nil, err
+	}
+	var instances []*Instance
+	topo.IterInstance(func(inst spec.Instance) {
+		instances = append(instances, &Instance{
+			ID:        inst.ID(),
+			Role:      inst.Role(),
+			Host:      inst.GetHost(),
+			DataDir:   inst.DataDir(),
+			DeployDir: inst.DeployDir(),
+		})
+	})
+	return instances, nil
+}
+
+// Check returns an error naming the first instance of the topology file
+// missing in the cluster, or not up if up is set.
+func Check(c *Cluster, topology string, up bool) error {
+	instances, err := TopologyInstances(topology)
+	if err != nil {
+		return err
+	}
+	for _, expect := range instances {
+		inst := c.Instance(expect.ID)
+		if inst == nil {
+			return fmt.Errorf("%s %s is missing in cluster %s", expect.Role, expect.ID, c.Name)
+		}
+		if up && !inst.Up() {
+			return fmt.Errorf("%s %s of cluster %s is %s", inst.Role, inst.ID, c.Name, inst.Status)
+		}
+	}
+	return nil
+}
+
+// checkUp returns an error naming the instances of the cluster not up.
+func checkUp(c *Cluster) error {
+	var down []string
+	for _, inst := range c.Instances {
+		if !inst.Up() {
+			down = append(down, fmt.Sprintf("%s %s is %s", inst.Role, inst.ID, inst.Status))
+		}
+	}
+	if len(down) > 0 {
+		sort.Strings(down)
+		return fmt.Errorf("cluster %s: %s", c.Name, strings.Join(down, ", "))
+	}
+	return nil
+}
+
+// verified confirms the operations of the manager from Display.
+type verified struct {
+	Manager
+	timeout  time.Duration
+	interval time.Duration
+}
+
+// Verify wraps the manager to confirm every operation from Display: the
+// deployed instances are listed, the started ones are up. The cluster may
+// take a while to converge, it is displayed until timeout.
+func Verify(m Manager, timeout, interval time.Duration) Manager {
+	return &verified{Manager: m, timeout: timeout, interval: interval}
+}
+
+// confirm displays the cluster until check passes or the timeout expires.
+func (v *verified) confirm(ctx context.Context, op, name string, check func(c *Cluster) error) error {
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+
+	logger := log.WithField("cluster", name)
+	for {
+		c, err := v.Display(ctx, name)
+		if err == nil {
+			if err = check(c); err == nil {
+				logger.Infof("Confirmed %s", op)
+				return nil
+			}
+		}
+		logger.WithError(err).Debugf("Waiting for %s to take effect", op)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s of cluster %s didn't take effect: %v", op, name, err)
+		case <-time.After(v.interval):
+		}
+	}
+}
+
+func (v *verified) Deploy(ctx context.Context, name, version, topology string) error {
+	if err := v.Manager.Deploy(ctx, name, version, topology); err != nil {
+		return err
+	}
+	return v.confirm(ctx, "deploy", name, func(c *Cluster) error {
+		if c.Version != version {
+			return fmt.Errorf("cluster %s is %s, expect %s", name, c.Version, version)
+		}
+		return Check(c, topology, false)
+	})
+}
+
+func (v *verified) Start(ctx context.Context, name string) error {
+	if err := v.Manager.Start(ctx, name); err != nil {
+		return err
+	}
+	return v.confirm(ctx, "start", name, checkUp)
+}
+
+func (v *verified) Restart(ctx context.Context, name string) error {
+	if err := v.Manager.Restart(ctx, name); err != nil {
+		return err
+	}
+	return v.confirm(ctx, "restart", name, checkUp)
+}
+
+func (v *verified) ScaleOut(ctx context.Context, name, topology string) error {
+	if err := v.Manager.ScaleOut(ctx, name, topology); err != nil {
+		return err
+	}
+	return v.confirm(ctx, "scale-out", name, func(c *Cluster) error {
+		return Check(c, topology, true)
+	})
+}
@@ -0,0 +1,172 @@
+package cluster_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/components/cluster"
+	"github.com/iosmanthus/learner-recover/components/cluster/clusterfake"
+)
+
+const (
+	newTopology  = "../../config/new.yaml"
+	joinTopology = "../../config/join.yaml"
+)
+
+const display = `Starting component ` + "`cluster`" + `: /root/.tiup/components/cluster/v1.5.5/tiup-cluster display backup --format json
+{
+  "cluster_meta": {
+    "cluster_type": "tidb",
+    "cluster_name": "backup",
+    "cluster_version": "v5.1.0",
+    "deploy_user": "root",
+    "ssh_type": "builtin",
+    "tls_enabled": false
+  },
+  "instances": [
+    {"id": "172.16.4.193:13000", "role": "grafana", "host": "172.16.4.193", "ports": "13000", "status": "Up", "data_dir": "-", "deploy_dir": "/root/deploy/grafana-new"},
+    {"id": "172.16.5.161:2379", "role": "pd", "host": "172.16.5.161", "ports": "2379/2380", "status": "Up|L|UI", "data_dir": "/root/data/pd-new", "deploy_dir": "/root/deploy/pd-new"},
+    {"id": "172.16.4.193:19090", "role": "prometheus", "host": "172.16.4.193", "ports": "19090", "status": "Down", "data_dir": "/root/data/prometheus-new", "deploy_dir": "/root/deploy/prometheus-new"}
+  ]
+}
+`
+
+func TestParseDisplay(t *testing.T) {
+	c, err := cluster.ParseDisplay(display)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "backup" || c.Version != "v5.1.0" || len(c.Instances) != 3 {
+		t.Fatalf("unexpected cluster %+v", c)
+	}
+	if pd := c.Instance("172.16.5.161:2379"); pd == nil || pd.Role != "pd" || !pd.Up() {
+		t.Fatalf("unexpected PD %+v", pd)
+	}
+	if c.Instance("172.16.4.193:19090").Up() {
+		t.Fatal("prometheus is down")
+	}
+
+	if err = cluster.Check(c, newTopology, false); err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Check(c, newTopology, true); err == nil || !strings.Contains(err.Error(), "prometheus") {
+		t.Fatalf("expect prometheus down, got %v", err)
+	}
+	if err = cluster.Check(c, joinTopology, false); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("expect missing TiKV, got %v", err)
+	}
+
+	if _, err = cluster.ParseDisplay("Error: Cluster backup not found"); err == nil {
+		t.Fatal("expect an error without JSON")
+	}
+}
+
+// TestTiUP runs a fake tiup printing the display above.
+func TestTiUP(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "display.json"), []byte(display), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := `#!/bin/sh
+echo "$@" >> ` + filepath.Join(dir, "args") + `
+if [ "$2" = display ]; then cat ` + filepath.Join(dir, "display.json") + `; fi
+`
+	tiup := filepath.Join(dir, "tiup")
+	if err := ioutil.WriteFile(tiup, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	m := cluster.Verify(&cluster.TiUP{Path: tiup}, time.Second, 10*time.Millisecond)
+	ctx := context.Background()
+	if err := m.Deploy(ctx, "backup", "v5.1.0", newTopology); err != nil {
+		t.Fatal(err)
+	}
+	// prometheus stays down.
+	err := m.Start(ctx, "backup")
+	if err == nil || !strings.Contains(err.Error(), "didn't take effect") {
+		t.Fatalf("expect start to fail, got %v", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if lines[0] != "cluster deploy -y backup v5.1.0 "+newTopology || lines[1] != "cluster display backup --format json" {
+		t.Fatalf("unexpected tiup calls %v", lines)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	fake := clusterfake.New()
+	m := cluster.Verify(fake, 100*time.Millisecond, 10*time.Millisecond)
+	ctx := context.Background()
+
+	if err := m.Deploy(ctx, "backup", "v5.1.0", newTopology); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(ctx, "backup"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ScaleOut(ctx, "backup", joinTopology); err != nil {
+		t.Fatal(err)
+	}
+	c, err := m.Display(ctx, "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Check(c, joinTopology, true); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.Fail[clusterfake.OpScaleOut] = errors.New("ssh: connect to host 172.16.4.193 port 22: Connection refused")
+	if err = m.ScaleOut(ctx, "backup", joinTopology); err == nil || !strings.Contains(err.Error(), "Connection refused") {
+		t.Fatalf("expect scale-out to fail, got %v", err)
+	}
+	if err = m.Deploy(ctx, "backup", "v5.1.0", newTopology); err == nil {
+		t.Fatal("expect deploying a duplicated cluster to fail")
+	}
+}
+
+func TestVerifyNoEffect(t *testing.T) {
+	// A start reporting success while the cluster stays down.
+	fake := clusterfake.New()
+	fake.NoEffect[clusterfake.OpStart] = true
+	m := cluster.Verify(fake, 100*time.Millisecond, 10*time.Millisecond)
+	ctx := context.Background()
+
+	if err := m.Deploy(ctx, "backup", "v5.1.0", newTopology); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(ctx, "backup"); err == nil || !strings.Contains(err.Error(), "is Down") {
+		t.Fatalf("expect start not taking effect, got %v", err)
+	}
+	if calls := fake.Calls(); calls[0] != "deploy backup" || calls[2] != "start backup" {
+		t.Fatalf("unexpected calls %v", calls)
+	}
+}
+
+func TestTopologyInstances(t *testing.T) {
+	instances, err := cluster.TopologyInstances(joinTopology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, inst := range instances {
+		ids = append(ids, inst.Role+" "+inst.ID)
+	}
+	expect := "tikv 172.16.4.193:21163,tikv 172.16.4.193:21164,tikv 172.16.4.193:21165"
+	if got := strings.Join(ids, ","); got != expect {
+		t.Fatalf("expect %s, got %s", expect, got)
+	}
+
+	if _, err = cluster.TopologyInstances(filepath.Join(os.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("expect an error for a missing topology")
+	}
+}
@@ -0,0 +1,157 @@
+// Package clusterfake is an in-memory cluster manager, for tests.
+package clusterfake
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/iosmanthus/learner-recover/components/cluster"
+)
+
+// Operations of the manager, the keys of Fail and NoEffect.
+const (
+	OpDeploy   = "deploy"
+	OpStart    = "start"
+	OpRestart  = "restart"
+	OpScaleOut = "scale-out"
+	OpDisplay  = "display"
+)
+
+// Fake keeps the clusters in memory, the instances come from the topology
+// files.
+type Fake struct {
+	// Fail fails the operations with the errors.
+	Fail map[string]error
+	// NoEffect lists the operations reporting success without doing
+	// anything, like a tiup command that exits 0 but doesn't start a node.
+	NoEffect map[string]bool
+
+	mu       sync.Mutex
+	clusters map[string]*cluster.Cluster
+	calls    []string
+}
+
+func New() *Fake {
+	return &Fake{
+		Fail:     make(map[string]error),
+		NoEffect: make(map[string]bool),
+		clusters: make(map[string]*cluster.Cluster),
+	}
+}
+
+// Calls returns the operations done so far, e.g. "start backup".
+func (f *Fake) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.calls...)
+}
+
+// begin records the operation, it returns false if the operation is to be
+// skipped.
+func (f *Fake) begin(op, name string) (bool, error) {
+	f.calls = append(f.calls, op+" "+name)
+	if err := f.Fail[op]; err != nil {
+		return false, err
+	}
+	return !f.NoEffect[op], nil
+}
+
+func (f *Fake) setStatus(name, status string) error {
+	c, ok := f.clusters[name]
+	if !ok {
+		return fmt.Errorf("cluster %s not found", name)
+	}
+	for _, inst := range c.Instances {
+		inst.Status = status
+	}
+	return nil
+}
+
+func (f *Fake) Deploy(_ context.Context, name, version, topology string) error {
+	instances, err := cluster.TopologyInstances(topology)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ok, err := f.begin(OpDeploy, name)
+	if !ok {
+		return err
+	}
+	if _, exists := f.clusters[name]; exists {
+		return fmt.Errorf("cluster name %s is duplicated", name)
+	}
+	for _, inst := range instances {
+		inst.Status = "Down"
+	}
+	f.clusters[name] = &cluster.Cluster{Name: name, Version: version, Instances: instances}
+	return nil
+}
+
+func (f *Fake) Start(_ context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ok, err := f.begin(OpStart, name)
+	if !ok {
+		return err
+	}
+	return f.setStatus(name, "Up")
+}
+
+func (f *Fake) Restart(_ context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ok, err := f.begin(OpRestart, name)
+	if !ok {
+		return err
+	}
+	return f.setStatus(name, "Up")
+}
+
+func (f *Fake) ScaleOut(_ context.Context, name, topology string) error {
+	instances, err := cluster.TopologyInstances(topology)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ok, err := f.begin(OpScaleOut, name)
+	if !ok {
+		return err
+	}
+	c, exists := f.clusters[name]
+	if !exists {
+		return fmt.Errorf("cluster %s not found", name)
+	}
+	for _, inst := range instances {
+		if c.Instance(inst.ID) != nil {
+			return fmt.Errorf("%s %s already exists in cluster %s", inst.Role, inst.ID, name)
+		}
+		inst.Status = "Up"
+		c.Instances = append(c.Instances, inst)
+	}
+	return nil
+}
+
+func (f *Fake) Display(_ context.Context, name string) (*cluster.Cluster, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, OpDisplay+" "+name)
+	if err := f.Fail[OpDisplay]; err != nil {
+		return nil, err
+	}
+	c, ok := f.clusters[name]
+	if !ok {
+		return nil, fmt.Errorf("cluster %s not found", name)
+	}
+
+	copied := &cluster.Cluster{Name: c.Name, Version: c.Version}
+	for _, inst := range c.Instances {
+		i := *inst
+		copied.Instances = append(copied.Instances, &i)
+	}
+	return copied, nil
+}
@@ -0,0 +1,105 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/iosmanthus/learner-recover/common"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RunFunc runs the command and returns its combined output.
+type RunFunc func(cmd *exec.Cmd) (string, error)
+
+// TiUP operates the clusters with tiup cluster.
+type TiUP struct {
+	// Path of tiup, defaults to tiup in $PATH.
+	Path string
+	// Run runs the tiup commands, defaults to common.Run.
+	Run RunFunc
+}
+
+func (t *TiUP) run(ctx context.Context, args ...string) (string, error) {
+	path := t.Path
+	if path == "" {
+		path = "tiup"
+	}
+	cmd := exec.CommandContext(ctx, path, append([]string{"cluster"}, args...)...)
+	if t.Run == nil {
+		return common.Run(log.NewEntry(log.StandardLogger()), cmd)
+	}
+	return t.Run(cmd)
+}
+
+func (t *TiUP) Deploy(ctx context.Context, name, version, topology string) error {
+	_, err := t.run(ctx, "deploy", "-y", name, version, topology)
+	return err
+}
+
+func (t *TiUP) Start(ctx context.Context, name string) error {
+	_, err := t.run(ctx, "start", "-y", name)
+	return err
+}
+
+func (t *TiUP) Restart(ctx context.Context, name string) error {
+	_, err := t.run(ctx, "restart", "-y", name)
+	return err
+}
+
+func (t *TiUP) ScaleOut(ctx context.Context, name, topology string) error {
+	_, err := t.run(ctx, "scale-out", "-y", name, topology)
+	return err
+}
+
+func (t *TiUP) Display(ctx context.Context, name string) (*Cluster, error) {
+	out, err := t.run(ctx, "display", name, "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	return ParseDisplay(out)
+}
+
+// ParseDisplay parses the output of tiup cluster display --format json,
+// the lines tiup prints before the JSON are skipped.
+func ParseDisplay(out string) (*Cluster, error) {
+	start := strings.Index(out, "{")
+	if start < 0 {
+		return nil, errors.New("no JSON in the output of tiup cluster display")
+	}
+
+	display := &struct {
+		Meta struct {
+			Name    string `json:"cluster_name"`
+			Version string `json:"cluster_version"`
+		} `json:"cluster_meta"`
+		Instances []struct {
+			ID        string `json:"id"`
+			Role      string `json:"role"`
+			Host      string `json:"host"`
+			Status    string `json:"status"`
+			DataDir   string `json:"data_dir"`
+			DeployDir string `json:"deploy_dir"`
+		} `json:"instances"`
+	}{}
+	if err := json.NewDecoder(strings.NewReader(out[start:])).Decode(display); err != nil {
+		return nil, fmt.Errorf("invalid output of tiup cluster display: %v", err)
+	}
+
+	c := &Cluster{Name: display.Meta.Name, Version: display.Meta.Version}
+	for _, inst := range display.Instances {
+		c.Instances = append(c.Instances, &Instance{
+			ID:        inst.ID,
+			Role:      inst.Role,
+			Host:      inst.Host,
+			Status:    inst.Status,
+			DataDir:   inst.DataDir,
+			DeployDir: inst.DeployDir,
+		})
+	}
+	return c, nil
+}
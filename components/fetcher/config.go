@@ -1,9 +1,14 @@
 package fetcher
 
 import (
-	"io/ioutil"
+	"bytes"
+	"fmt"
+	"io"
 	"time"
 
+	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/components/unified"
+
 	"github.com/pingcap/tiup/pkg/cluster/spec"
 	"gopkg.in/yaml.v3"
 )
@@ -11,44 +16,57 @@ import (
 type Config struct {
 	Save          string
 	Topology      *spec.Specification
-	LearnerLabels map[string]string
+	LearnerGroups []*common.LearnerGroup
 	LastFor       time.Duration
 	Interval      time.Duration
 	Timeout       time.Duration
 }
 
-func NewConfig(path string) (*Config, error) {
-	type _Config struct {
-		Save          string            `yaml:"save"`
-		Topology      string            `yaml:"topology"`
-		LearnerLabels map[string]string `yaml:"learner-labels"`
-		LastFor       string            `yaml:"last-for"`
-		Interval      string            `yaml:"interval"`
-		Timeout       string            `yaml:"timeout"`
-	}
+// _Config is the YAML of the config file.
+type _Config struct {
+	Save          string                 `yaml:"save"`
+	Topology      string                 `yaml:"topology"`
+	LearnerLabels interface{}            `yaml:"learner-labels"`
+	LearnerGroups map[string]interface{} `yaml:"learner-groups"`
+	LastFor       string                 `yaml:"last-for"`
+	Interval      string                 `yaml:"interval"`
+	Timeout       string                 `yaml:"timeout"`
+}
 
+func NewConfig(path string) (*Config, error) {
 	c := &_Config{}
 
-	data, err := ioutil.ReadFile(path)
+	data, err := unified.Load(path, unified.CommandFetch)
 	if err != nil {
 		return nil, err
 	}
 
-	if err = yaml.Unmarshal(data, c); err != nil {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(c); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if err = common.CheckRequired("save", c.Save, "topology", c.Topology); err != nil {
 		return nil, err
 	}
 
 	lastFor, err := time.ParseDuration(c.LastFor)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid last-for: %v", err)
 	}
 
 	interval, err := time.ParseDuration(c.Interval)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid interval: %v", err)
 	}
 
 	timeout, err := time.ParseDuration(c.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeout: %v", err)
+	}
+
+	learnerGroups, err := common.NewLearnerGroups(c.LearnerLabels, c.LearnerGroups)
 	if err != nil {
 		return nil, err
 	}
@@ -58,10 +76,22 @@ func NewConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	var stores []map[string]string
+	for _, tikv := range topo.TiKVServers {
+		labels, err := tikv.Labels()
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, labels)
+	}
+	if err = common.CheckLearnerGroups(learnerGroups, stores); err != nil {
+		return nil, err
+	}
+
 	return &Config{
 		Save:          c.Save,
 		Topology:      topo,
-		LearnerLabels: c.LearnerLabels,
+		LearnerGroups: learnerGroups,
 		LastFor:       lastFor,
 		Interval:      interval,
 		Timeout:       timeout,
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math"
+	"net/http"
 	"time"
 
 	"github.com/iosmanthus/learner-recover/common"
@@ -26,12 +27,12 @@ type Fetcher interface {
 type RecoverInfoFetcher struct {
 	pdServers     []*spec.PDSpec
 	promDriver    promapi.API
-	learnerLabels map[string]string
+	learnerGroups []*common.LearnerGroup
 	timeout       time.Duration
 }
 
 func NewRecoverInfoFetcher(
-	topology *spec.Specification, learnerLabels map[string]string, timeout time.Duration,
+	topology *spec.Specification, learnerGroups []*common.LearnerGroup, timeout time.Duration,
 ) (*RecoverInfoFetcher, error) {
 	if len(topology.PDServers) == 0 || len(topology.TiKVServers) == 0 || len(topology.Monitors) == 0 {
 		return nil, errors.New("invalid topology")
@@ -48,7 +49,7 @@ func NewRecoverInfoFetcher(
 	return &RecoverInfoFetcher{
 		pdServers:     topology.PDServers,
 		promDriver:    promapi.NewAPI(client),
-		learnerLabels: learnerLabels,
+		learnerGroups: learnerGroups,
 		timeout:       timeout,
 	}, nil
 }
@@ -93,7 +94,8 @@ func (g *getStores) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-func (f *RecoverInfoFetcher) fetchStoreIDs(ctx context.Context) ([]uint64, error) {
+// fetchStoreIDs returns the voter stores and the stores of each learner group.
+func (f *RecoverInfoFetcher) fetchStoreIDs(ctx context.Context) ([]uint64, map[string][]uint64, error) {
 	client := resty.New()
 	firstPD := f.pdServers[0]
 
@@ -101,22 +103,71 @@ func (f *RecoverInfoFetcher) fetchStoreIDs(ctx context.Context) ([]uint64, error
 		SetContext(ctx).Get(fmt.Sprintf("http://%s:%v/pd/api/v1/stores", firstPD.Host, firstPD.ClientPort))
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	stores := &getStores{}
 	if err = json.Unmarshal(resp.Body(), stores); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	storeIDs := make([]uint64, 0, len(stores.Stores))
+	learnerStoreIDs := make(map[string][]uint64)
+	for _, group := range f.learnerGroups {
+		learnerStoreIDs[group.Name] = []uint64{}
+	}
 	for _, store := range stores.Stores {
-		if !common.IsLabelsMatch(f.learnerLabels, store.Labels) {
+		group, err := common.MatchLearnerGroup(f.learnerGroups, store.Labels)
+		if err != nil {
+			return nil, nil, err
+		}
+		if group != nil {
+			learnerStoreIDs[group.Name] = append(learnerStoreIDs[group.Name], store.ID)
+		} else {
 			storeIDs = append(storeIDs, store.ID)
 		}
 	}
 
-	return storeIDs, nil
+	return storeIDs, learnerStoreIDs, nil
+}
+
+// placement is the replication settings of PD.
+type placement struct {
+	replication *common.ReplicationConfig
+	rules       []*common.PlacementRule
+	mode        *common.ReplicationMode
+}
+
+// fetchPlacement returns the replication config, the placement rules if
+// they are enabled and the replication mode.
+func (f *RecoverInfoFetcher) fetchPlacement(ctx context.Context) (*placement, error) {
+	client := resty.New()
+	firstPD := f.pdServers[0]
+	get := func(path string, v interface{}) error {
+		resp, err := client.R().
+			SetContext(ctx).Get(fmt.Sprintf("http://%s:%v/pd/api/v1%s", firstPD.Host, firstPD.ClientPort, path))
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode() != http.StatusOK {
+			return fmt.Errorf("GET %s: %s", path, resp.Status())
+		}
+		return json.Unmarshal(resp.Body(), v)
+	}
+
+	p := &placement{replication: &common.ReplicationConfig{}, mode: &common.ReplicationMode{}}
+	if err := get("/config/replicate", p.replication); err != nil {
+		return nil, err
+	}
+	if p.replication.PlacementEnabled() {
+		if err := get("/config/rules", &p.rules); err != nil {
+			return nil, err
+		}
+	}
+	if err := get("/config/replication-mode", p.mode); err != nil {
+		return nil, err
+	}
+	return p, nil
 }
 
 func (f *RecoverInfoFetcher) fetchClusterID(ctx context.Context) (string, error) {
@@ -166,7 +217,7 @@ func (e Error) Error() string {
 }
 func (f *RecoverInfoFetcher) Fetch(ctx context.Context) (*common.RecoverInfo, error) {
 	e := Error{}
-	storeIDs, err := f.fetchStoreIDs(ctx)
+	storeIDs, learnerStoreIDs, err := f.fetchStoreIDs(ctx)
 	if err != nil {
 		e.Append(err)
 	}
@@ -181,14 +232,24 @@ func (f *RecoverInfoFetcher) Fetch(ctx context.Context) (*common.RecoverInfo, er
 		e.Append(err)
 	}
 
+	p, err := f.fetchPlacement(ctx)
+	if err != nil {
+		e.Append(err)
+		p = &placement{}
+	}
+
 	if len(e.Errors) > 0 {
 		err = e
 	}
 
 	return &common.RecoverInfo{
-		StoreIDs:  storeIDs,
-		ClusterID: clusterID,
-		AllocID:   allocID,
+		StoreIDs:        storeIDs,
+		ClusterID:       clusterID,
+		AllocID:         allocID,
+		LearnerStoreIDs: learnerStoreIDs,
+		Replication:     p.replication,
+		PlacementRules:  p.rules,
+		ReplicationMode: p.mode,
 	}, err
 }
 
@@ -208,7 +269,7 @@ type RecoverInfoUpdater struct {
 }
 
 func NewRecoverInfoUpdater(config *Config) (*RecoverInfoUpdater, error) {
-	fetcher, err := NewRecoverInfoFetcher(config.Topology, config.LearnerLabels, config.Timeout)
+	fetcher, err := NewRecoverInfoFetcher(config.Topology, config.LearnerGroups, config.Timeout)
 	if err != nil {
 		return nil, err
 	}
@@ -226,7 +287,7 @@ func NewRecoverInfoUpdater(config *Config) (*RecoverInfoUpdater, error) {
 func (u *RecoverInfoUpdater) Init() error {
 	data, err := ioutil.ReadFile(u.path)
 	if err != nil {
-		log.Warnf("%v is not exist", u.path)
+		log.WithField(common.FieldStep, "fetch").Warnf("%v is not exist", u.path)
 		return nil
 	}
 
@@ -251,7 +312,7 @@ func (u *RecoverInfoUpdater) Update(ctx context.Context) error {
 			timeout, cancel := context.WithTimeout(ctx, u.timeout)
 			info, err := u.fetcher.Fetch(timeout)
 			if err != nil {
-				log.Error(err)
+				log.WithField(common.FieldStep, "fetch").WithError(err).Error("Fail to fetch recover info")
 			}
 
 			if info.ClusterID != "" {
@@ -263,12 +324,24 @@ func (u *RecoverInfoUpdater) Update(ctx context.Context) error {
 			if info.StoreIDs != nil {
 				u.state.StoreIDs = info.StoreIDs
 			}
+			if info.LearnerStoreIDs != nil {
+				u.state.LearnerStoreIDs = info.LearnerStoreIDs
+			}
+			// The rules are kept only with the replication config they
+			// are fetched with.
+			if info.Replication != nil {
+				u.state.Replication = info.Replication
+				u.state.PlacementRules = info.PlacementRules
+			}
+			if info.ReplicationMode != nil {
+				u.state.ReplicationMode = info.ReplicationMode
+			}
 
 			if !info.IsEmpty() {
 				data, _ := json.Marshal(u.state)
 
 				ioutil.WriteFile(u.path, data, 0644)
-				log.Infof("sync recover info successfully, saved to %v", u.path)
+				log.WithField(common.FieldStep, "fetch").Infof("sync recover info successfully, saved to %v", u.path)
 			}
 			cancel()
 		}
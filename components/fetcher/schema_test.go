@@ -0,0 +1,39 @@
+package fetcher
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/iosmanthus/learner-recover/schema"
+)
+
+func TestSchema(t *testing.T) {
+	diff, err := schema.Diff(schema.KindInfo, reflect.TypeOf(_Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff) != 0 {
+		t.Fatalf("the schema drifts from the config:\n%v", diff)
+	}
+}
+
+func TestConfigUnknownKeys(t *testing.T) {
+	for _, c := range []struct {
+		config, err string
+	}{
+		{"save: info.json\nintreval: 1s\n", "field intreval not found"},
+		// The unified config is checked as well.
+		{"cluster:\n  topology: old.yaml\nfetch:\n  sav: info.json\n", "field sav not found"},
+	} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := ioutil.WriteFile(path, []byte(c.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewConfig(path); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("expect %q, got %v", c.err, err)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package generate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/components/fetcher"
+	"github.com/iosmanthus/learner-recover/components/recover"
+	"github.com/iosmanthus/learner-recover/components/rpo"
+
+	"github.com/pingcap/tiup/pkg/cluster/spec"
+	log "github.com/sirupsen/logrus"
+	yaml2 "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	RecoverFile = "recover.yaml"
+	InfoFile    = "info.yaml"
+	RPOFile     = "rpo.yaml"
+	NewFile     = "new.yaml"
+	JoinFile    = "join.yaml"
+)
+
+// Options describes the cluster to recover, the generated configs are derived
+// from the old topology.
+type Options struct {
+	OldTopology    string
+	ClusterName    string
+	ClusterVersion string
+	// LearnerLabels is a label selector of the learners, exclusive with
+	// LearnerGroups which maps the group names to their selectors.
+	LearnerLabels string
+	LearnerGroups map[string]string
+	PDHosts       []string
+	// MonitorHost runs the Prometheus and Grafana of the new cluster,
+	// defaults to the first PD host.
+	MonitorHost string
+	// PortOffset is added to the ports of the new cluster. The learners keep
+	// their ports by default, an offset avoids conflicts with the old cluster
+	// if it is still managed by the same tiup.
+	PortOffset int
+
+	TiKVCtlSrc    string
+	TiKVCtlDest   string
+	PDRecoverPath string
+	InfoFile      string
+	HistoryPath   string
+	RPOFile       string
+
+	Output string
+	Force  bool
+}
+
+type recoverConfig struct {
+	ClusterVersion  string            `yaml:"cluster-version"`
+	ClusterName     string            `yaml:"cluster-name"`
+	OldTopology     string            `yaml:"old-topology"`
+	NewTopology     string            `yaml:"new-topology"`
+	JoinTopology    string            `yaml:"join-topology"`
+	RecoverInfoFile string            `yaml:"recover-info-file"`
+	ZoneLabels      string            `yaml:"zone-labels,omitempty"`
+	LearnerGroups   map[string]string `yaml:"learner-groups,omitempty"`
+	TiKVCtl         struct {
+		Src  string `yaml:"src"`
+		Dest string `yaml:"dest"`
+	} `yaml:"tikv-ctl"`
+	PDRecoverPath string `yaml:"pd-recover-path"`
+}
+
+type infoConfig struct {
+	Save          string            `yaml:"save"`
+	Topology      string            `yaml:"topology"`
+	LearnerLabels string            `yaml:"learner-labels,omitempty"`
+	LearnerGroups map[string]string `yaml:"learner-groups,omitempty"`
+	Interval      string            `yaml:"interval"`
+	LastFor       string            `yaml:"last-for"`
+	Timeout       string            `yaml:"timeout"`
+}
+
+type rpoConfig struct {
+	Topology      string            `yaml:"topology"`
+	LearnerLabels string            `yaml:"learner-labels,omitempty"`
+	LearnerGroups map[string]string `yaml:"learner-groups,omitempty"`
+	Source        string            `yaml:"source"`
+	TikvCtlPath   string            `yaml:"tikv-ctl"`
+	LastFor       string            `yaml:"last-for"`
+	HistoryPath   string            `yaml:"history-path"`
+	Save          string            `yaml:"save"`
+}
+
+func (o *Options) learnerGroups() ([]*common.LearnerGroup, error) {
+	var legacy interface{}
+	if o.LearnerLabels != "" {
+		legacy = o.LearnerLabels
+	}
+	groups := make(map[string]interface{})
+	for name, selector := range o.LearnerGroups {
+		groups[name] = selector
+	}
+	return common.NewLearnerGroups(legacy, groups)
+}
+
+// newTopology returns the topology deployed to rebuild PD, with fresh PD
+// and monitoring servers.
+func (o *Options) newTopology(old *spec.Specification) *spec.Specification {
+	topo := &spec.Specification{
+		GlobalOptions:    old.GlobalOptions,
+		MonitoredOptions: old.MonitoredOptions,
+		ServerConfigs:    old.ServerConfigs,
+	}
+	topo.MonitoredOptions.NodeExporterPort += o.PortOffset
+	topo.MonitoredOptions.BlackboxExporterPort += o.PortOffset
+	// Directories of the monitored agents are derived from the new ports.
+	topo.MonitoredOptions.DeployDir = ""
+	topo.MonitoredOptions.DataDir = ""
+	topo.MonitoredOptions.LogDir = ""
+
+	for _, host := range o.PDHosts {
+		topo.PDServers = append(topo.PDServers, &spec.PDSpec{
+			Host:       host,
+			ClientPort: 2379 + o.PortOffset,
+			PeerPort:   2380 + o.PortOffset,
+		})
+	}
+
+	monitor := o.MonitorHost
+	if monitor == "" {
+		monitor = o.PDHosts[0]
+	}
+	topo.Monitors = []*spec.PrometheusSpec{{Host: monitor, Port: 9090 + o.PortOffset}}
+	topo.Grafanas = []*spec.GrafanaSpec{{Host: monitor, Port: 3000 + o.PortOffset}}
+
+	return topo
+}
+
+// joinTopology returns the learners scaled out to the new cluster. They keep
+// their directories and labels, only the ports are shifted by the offset.
+func (o *Options) joinTopology(learners []*spec.TiKVSpec) *spec.Specification {
+	topo := &spec.Specification{}
+	for _, learner := range learners {
+		tikv := *learner
+		tikv.Port += o.PortOffset
+		tikv.StatusPort += o.PortOffset
+		topo.TiKVServers = append(topo.TiKVServers, &tikv)
+	}
+	return topo
+}
+
+func marshal(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), encoder.Close()
+}
+
+func (o *Options) path(file string) string {
+	return filepath.Join(o.Output, file)
+}
+
+func (o *Options) write(file string, v interface{}, marshal func(interface{}) ([]byte, error)) error {
+	path := o.path(file)
+	if _, err := os.Stat(path); err == nil && !o.Force {
+		return fmt.Errorf("%s already exists, use --force to overwrite it", path)
+	}
+
+	data, err := marshal(v)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	log.Infof("Generated %s", path)
+	return nil
+}
+
+// Generate writes recover.yaml, info.yaml, rpo.yaml, new.yaml and join.yaml
+// to the output directory and validates them.
+func Generate(o *Options) error {
+	if len(o.PDHosts) == 0 {
+		return errors.New("no PD hosts given")
+	}
+
+	old := &spec.Specification{}
+	if err := spec.ParseTopologyYaml(o.OldTopology, old); err != nil {
+		return err
+	}
+
+	groups, err := o.learnerGroups()
+	if err != nil {
+		return err
+	}
+
+	var (
+		learners []*spec.TiKVSpec
+		stores   []map[string]string
+	)
+	for _, tikv := range old.TiKVServers {
+		labels, err := tikv.Labels()
+		if err != nil {
+			return err
+		}
+		stores = append(stores, labels)
+		if group, _ := common.MatchLearnerGroup(groups, labels); group != nil {
+			learners = append(learners, tikv)
+		}
+	}
+	if err = common.CheckLearnerGroups(groups, stores); err != nil {
+		return err
+	}
+	if len(learners) == len(old.TiKVServers) {
+		return errors.New("all TiKV nodes are learners, please check the learner labels")
+	}
+
+	if err = os.MkdirAll(o.Output, 0755); err != nil {
+		return err
+	}
+
+	recoverC := &recoverConfig{
+		ClusterVersion:  o.ClusterVersion,
+		ClusterName:     o.ClusterName,
+		OldTopology:     o.OldTopology,
+		NewTopology:     o.path(NewFile),
+		JoinTopology:    o.path(JoinFile),
+		RecoverInfoFile: o.InfoFile,
+		ZoneLabels:      o.LearnerLabels,
+		LearnerGroups:   o.LearnerGroups,
+		PDRecoverPath:   o.PDRecoverPath,
+	}
+	recoverC.TiKVCtl.Src = o.TiKVCtlSrc
+	recoverC.TiKVCtl.Dest = o.TiKVCtlDest
+
+	infoC := &infoConfig{
+		Save:          o.InfoFile,
+		Topology:      o.OldTopology,
+		LearnerLabels: o.LearnerLabels,
+		LearnerGroups: o.LearnerGroups,
+		Interval:      "1s",
+		LastFor:       "1m",
+		Timeout:       "2s",
+	}
+
+	rpoC := &rpoConfig{
+		Topology:      o.OldTopology,
+		LearnerLabels: o.LearnerLabels,
+		LearnerGroups: o.LearnerGroups,
+		Source:        rpo.SourceTiKVCtl,
+		TikvCtlPath:   o.TiKVCtlSrc,
+		LastFor:       "1m",
+		HistoryPath:   o.HistoryPath,
+		Save:          o.RPOFile,
+	}
+
+	for _, f := range []struct {
+		file    string
+		v       interface{}
+		marshal func(interface{}) ([]byte, error)
+	}{
+		{NewFile, o.newTopology(old), yaml2.Marshal},
+		{JoinFile, o.joinTopology(learners), yaml2.Marshal},
+		{RecoverFile, recoverC, marshal},
+		{InfoFile, infoC, marshal},
+		{RPOFile, rpoC, marshal},
+	} {
+		if err = o.write(f.file, f.v, f.marshal); err != nil {
+			return err
+		}
+	}
+
+	return o.validate()
+}
+
+// validate parses the generated files back. The recover and rpo configs
+// reference the binaries and the recover info, they are checked only once
+// these files exist.
+func (o *Options) validate() error {
+	for _, file := range []string{NewFile, JoinFile} {
+		if err := spec.ParseTopologyYaml(o.path(file), &spec.Specification{}); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fetcher.NewConfig(o.path(InfoFile)); err != nil {
+		return fmt.Errorf("%s: %v", o.path(InfoFile), err)
+	}
+
+	for _, c := range []struct {
+		file     string
+		requires []string
+		validate func(path string) error
+	}{
+		{RecoverFile, []string{o.TiKVCtlSrc, o.PDRecoverPath, o.InfoFile}, func(path string) error {
+			_, err := recover.NewConfig(path)
+			return err
+		}},
+		{RPOFile, []string{o.TiKVCtlSrc}, func(path string) error {
+			_, err := rpo.NewConfig(path)
+			return err
+		}},
+	} {
+		missing := ""
+		for _, required := range c.requires {
+			if _, err := os.Stat(required); err != nil {
+				missing = required
+				break
+			}
+		}
+		if missing != "" {
+			log.Warnf("%s is not validated as %s doesn't exist yet, run config validate later", o.path(c.file), missing)
+			continue
+		}
+		if err := c.validate(o.path(c.file)); err != nil {
+			return fmt.Errorf("%s: %v", o.path(c.file), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package generate
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/components/fetcher"
+	"github.com/iosmanthus/learner-recover/components/recover"
+	"github.com/iosmanthus/learner-recover/components/rpo"
+
+	"github.com/pingcap/tiup/pkg/cluster/spec"
+)
+
+const oldTopology = `global:
+  user: tidb
+pd_servers:
+  - host: 10.0.1.1
+tikv_servers:
+  - host: 10.0.1.1
+    config:
+      server.labels: {zone: primary}
+  - host: 10.0.2.1
+    config:
+      server.labels: {zone: backup-a}
+  - host: 10.0.2.2
+    config:
+      server.labels: {zone: backup-b}
+`
+
+// testOptions writes the old topology, the binaries and the recover info to
+// a directory, the configs are generated to its output subdirectory.
+func testOptions(t *testing.T) *Options {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	return &Options{
+		OldTopology:    write("old.yaml", oldTopology),
+		ClusterName:    "backup",
+		ClusterVersion: "v5.1.0",
+		LearnerGroups:  map[string]string{"a": "zone=backup-a", "b": "zone=backup-b"},
+		PDHosts:        []string{"10.0.2.1"},
+		PortOffset:     10000,
+		TiKVCtlSrc:     write("tikv-ctl", "#!/bin/sh\n"),
+		TiKVCtlDest:    "/root/tikv-ctl",
+		PDRecoverPath:  write("pd-recover", "#!/bin/sh\n"),
+		InfoFile:       write("info.json", `{"storeIDs": [1], "clusterID": "1", "allocID": 1000, "learnerStoreIDs": {"a": [4], "b": [5]}}`),
+		HistoryPath:    filepath.Join(dir, "history"),
+		RPOFile:        filepath.Join(dir, "rpo.json"),
+		Output:         filepath.Join(dir, "output"),
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	o := testOptions(t)
+	if err := Generate(o); err != nil {
+		t.Fatal(err)
+	}
+
+	// The generated configs load through the strict loaders of the commands.
+	info, err := fetcher.NewConfig(o.path(InfoFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Save != o.InfoFile || len(info.LearnerGroups) != 2 || info.LastFor != time.Minute || info.Timeout != 2*time.Second {
+		t.Fatalf("unexpected fetch config %+v", info)
+	}
+
+	c, err := recover.NewConfig(o.path(RecoverFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Groups) != 2 || c.Groups[0].Nodes[0].Host != "10.0.2.1" || c.Groups[1].Nodes[0].Host != "10.0.2.2" {
+		t.Fatalf("unexpected learner groups %+v", c.Groups)
+	}
+	if len(c.NewTopology.PDServers) != 1 || c.NewTopology.PDServers[0].ClientPort != 12379 || c.TiKVCtl.Dest != "/root/tikv-ctl" {
+		t.Fatalf("unexpected recover config %+v", c)
+	}
+
+	r, err := rpo.NewConfig(o.path(RPOFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Groups) != 2 || len(r.Voters) != 1 || r.HistoryPath != o.HistoryPath || r.Save != o.RPOFile {
+		t.Fatalf("unexpected rpo config %+v", r)
+	}
+
+	// The learners join with their ports shifted.
+	join := &spec.Specification{}
+	if err = spec.ParseTopologyYaml(o.path(JoinFile), join); err != nil {
+		t.Fatal(err)
+	}
+	if len(join.TiKVServers) != 2 || join.TiKVServers[0].Port != 30160 || join.TiKVServers[0].StatusPort != 30180 {
+		t.Fatalf("unexpected join topology %+v", join.TiKVServers)
+	}
+
+	// The files are kept unless forced.
+	if err = Generate(o); err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Fatalf("expect the files kept, got %v", err)
+	}
+	o.Force = true
+	if err = Generate(o); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGenerateLearnerLabels(t *testing.T) {
+	o := testOptions(t)
+	o.LearnerGroups, o.LearnerLabels = nil, "zone in (backup-a, backup-b)"
+	if err := Generate(o); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := recover.NewConfig(o.path(RecoverFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Groups) != 1 || c.Groups[0].Name != common.DefaultLearnerGroup || len(c.Groups[0].Nodes) != 2 {
+		t.Fatalf("unexpected learner groups %+v", c.Groups)
+	}
+	if _, err = fetcher.NewConfig(o.path(InfoFile)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rpo.NewConfig(o.path(RPOFile)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		apply func(o *Options)
+		err   string
+	}{
+		{"no PD", func(o *Options) { o.PDHosts = nil }, "no PD hosts"},
+		{"all learners", func(o *Options) {
+			o.LearnerGroups = nil
+			o.LearnerLabels = "zone"
+		}, "all TiKV nodes are learners"},
+		{"overlap", func(o *Options) { o.LearnerGroups["c"] = "zone in (backup-a)" }, "matches both"},
+		{"empty group", func(o *Options) { o.LearnerGroups["c"] = "zone=backup-c" }, "matches no TiKV node"},
+	} {
+		o := testOptions(t)
+		c.apply(o)
+		if err := Generate(o); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("%s: expect %q, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestGenerateMissingBinaries(t *testing.T) {
+	o := testOptions(t)
+	o.TiKVCtlSrc = filepath.Join(filepath.Dir(o.TiKVCtlSrc), "bin", "tikv-ctl")
+	// The recover and rpo configs are left to config validate.
+	if err := Generate(o); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := recover.NewConfig(o.path(RecoverFile)); err == nil || !strings.Contains(err.Error(), "tikv-ctl.src") {
+		t.Fatalf("expect the missing tikv-ctl reported, got %v", err)
+	}
+}
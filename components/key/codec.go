@@ -0,0 +1,78 @@
+package key
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	encGroupSize = 8
+	encMarker    = byte(0xFF)
+	signMask     = uint64(0x8000000000000000)
+)
+
+var (
+	errInsufficient = errors.New("insufficient bytes to decode")
+	errMarker       = errors.New("invalid marker byte")
+	errPadding      = errors.New("invalid padding byte")
+)
+
+// DecodeBytes decodes the memcomparable bytes TiKV stores the keys in, every
+// group of 8 bytes is followed by a marker counting the padding of the last
+// group. It returns the rest of b.
+func DecodeBytes(b []byte) ([]byte, []byte, error) {
+	data := make([]byte, 0, len(b))
+	for {
+		if len(b) < encGroupSize+1 {
+			return nil, nil, errInsufficient
+		}
+		group := b[:encGroupSize]
+		marker := b[encGroupSize]
+		b = b[encGroupSize+1:]
+
+		pad := encMarker - marker
+		if pad > encGroupSize {
+			return nil, nil, errMarker
+		}
+		n := encGroupSize - int(pad)
+		data = append(data, group[:n]...)
+		if pad == 0 {
+			continue
+		}
+		for _, c := range group[n:] {
+			if c != 0 {
+				return nil, nil, errPadding
+			}
+		}
+		return data, b, nil
+	}
+}
+
+// DecodeInt decodes a memcomparable int64, the big endian bytes with the
+// sign bit flipped.
+func DecodeInt(b []byte) (int64, []byte, error) {
+	if len(b) < 8 {
+		return 0, nil, errInsufficient
+	}
+	u := binary.BigEndian.Uint64(b)
+	return int64(u ^ signMask), b[8:], nil
+}
+
+// EncodeBytes is the reverse of DecodeBytes.
+func EncodeBytes(data []byte) []byte {
+	b := make([]byte, 0, (len(data)/encGroupSize+1)*(encGroupSize+1))
+	for i := 0; i <= len(data); i += encGroupSize {
+		group := make([]byte, encGroupSize)
+		n := copy(group, data[i:])
+		b = append(b, group...)
+		b = append(b, encMarker-byte(encGroupSize-n))
+	}
+	return b
+}
+
+// EncodeInt is the reverse of DecodeInt.
+func EncodeInt(b []byte, v int64) []byte {
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], uint64(v)^signMask)
+	return append(b, data[:]...)
+}
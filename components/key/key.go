@@ -0,0 +1,124 @@
+// Package key parses the region boundaries printed by tikv-ctl and decodes
+// them into TiDB tables, indexes and rows.
+package key
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+// Parse returns the raw bytes of a key printed by tikv-ctl, either in upper
+// case hex or escaped. A key of upper case hex digits only is taken as hex,
+// TiDB keys never look like that escaped since they start with 't' or 'm'.
+func Parse(s string) ([]byte, error) {
+	if isHex(s) {
+		return ParseHex(s)
+	}
+	return ParseEscaped(s)
+}
+
+func isHex(s string) bool {
+	if s == "" || len(s)%2 != 0 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func ParseHex(s string) ([]byte, error) {
+	k, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed hex key %q: %v", s, err)
+	}
+	return k, nil
+}
+
+// ParseEscaped reverses Escape, \xHH escapes are accepted as well.
+func ParseEscaped(s string) ([]byte, error) {
+	k := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			k = append(k, c)
+			continue
+		}
+		if i++; i == len(s) {
+			return nil, fmt.Errorf("malformed key %q: trailing backslash", s)
+		}
+		switch c = s[i]; c {
+		case 'n':
+			k = append(k, '\n')
+		case 'r':
+			k = append(k, '\r')
+		case 't':
+			k = append(k, '\t')
+		case '\\', '"', '\'':
+			k = append(k, c)
+		case 'x':
+			if i+2 >= len(s) {
+				return nil, fmt.Errorf("malformed key %q: short \\x escape", s)
+			}
+			b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("malformed key %q: %v", s, err)
+			}
+			k = append(k, byte(b))
+			i += 2
+		default:
+			if i+2 >= len(s) {
+				return nil, fmt.Errorf("malformed key %q: short octal escape", s)
+			}
+			b, err := strconv.ParseUint(s[i:i+3], 8, 8)
+			if err != nil {
+				return nil, fmt.Errorf("malformed key %q: %v", s, err)
+			}
+			k = append(k, byte(b))
+			i += 2
+		}
+	}
+	return k, nil
+}
+
+// Escape formats a raw key the way tikv-ctl prints it.
+func Escape(key []byte) string {
+	s := make([]byte, 0, len(key))
+	for _, c := range key {
+		switch {
+		case c == '\n':
+			s = append(s, '\\', 'n')
+		case c == '\r':
+			s = append(s, '\\', 'r')
+		case c == '\t':
+			s = append(s, '\\', 't')
+		case c == '\\' || c == '"':
+			s = append(s, '\\', c)
+		case c >= 0x20 && c < 0x7f:
+			s = append(s, c)
+		default:
+			s = append(s, []byte(fmt.Sprintf("\\%03o", c))...)
+		}
+	}
+	return string(s)
+}
+
+// Compare compares two keys printed by tikv-ctl by their raw bytes. The
+// empty key is the smallest, callers treat an empty end key as the largest.
+// It only orders keys in the reports, a malformed key is compared as its
+// text.
+func Compare(a, b string) int {
+	return bytes.Compare(parseText(a), parseText(b))
+}
+
+// parseText is Parse falling back to the text of a malformed key.
+func parseText(s string) []byte {
+	if k, err := Parse(s); err == nil {
+		return k
+	}
+	return []byte(s)
+}
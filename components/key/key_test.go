@@ -0,0 +1,105 @@
+package key
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func recordKey(tableID, handle int64) []byte {
+	k := EncodeInt([]byte("t"), tableID)
+	k = append(k, "_r"...)
+	return EncodeBytes(EncodeInt(k, handle))
+}
+
+func TestParse(t *testing.T) {
+	raw := recordKey(45, 1000)
+	for _, s := range []string{Escape(raw), strings.ToUpper(hex.EncodeToString(raw))} {
+		k, err := Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(k, raw) {
+			t.Fatalf("parse %s: got %x, want %x", s, k, raw)
+		}
+	}
+
+	if k, err := ParseEscaped(`a\x7f\n\"`); err != nil || string(k) != "a\x7f\n\"" {
+		t.Fatalf("unexpected key %q, %v", k, err)
+	}
+	for _, s := range []string{`t\`, `t\20`, `t\400`, `t\xz1`} {
+		if _, err := Parse(s); err == nil {
+			t.Fatalf("expect %s to be malformed", s)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	// \200 is larger than any printable character escaped.
+	if Compare(`t\200`, "t~") <= 0 || Compare(Escape(recordKey(45, 1)), Escape(recordKey(45, 2))) >= 0 {
+		t.Fatal("keys are not compared by their bytes")
+	}
+}
+
+func TestDecodeBytes(t *testing.T) {
+	for _, n := range []int{0, 1, 7, 8, 9, 17} {
+		data := bytes.Repeat([]byte{'x'}, n)
+		decoded, rest, err := DecodeBytes(append(EncodeBytes(data), 'r'))
+		if err != nil || !bytes.Equal(decoded, data) || string(rest) != "r" {
+			t.Fatalf("decode %v bytes: got %q, rest %q, %v", n, decoded, rest, err)
+		}
+	}
+	if _, _, err := DecodeBytes([]byte("t\x80")); err == nil {
+		t.Fatal("expect insufficient bytes")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	index := EncodeInt([]byte("t"), 45)
+	index = append(index, "_i"...)
+	index = EncodeBytes(append(EncodeInt(index, 2), 0x01, 'a'))
+
+	for _, c := range []struct {
+		key  []byte
+		want string
+	}{
+		{recordKey(45, -3), "table 45, row -3"},
+		{index, "table 45, index 2"},
+		{EncodeBytes(EncodeInt([]byte("t"), 46)), "table 46"},
+		{EncodeBytes([]byte("mDB:1")), "meta"},
+		// Not a TiDB key.
+		{[]byte("m"), "meta"},
+		{[]byte("g"), "g"},
+	} {
+		if got := Decode(Escape(c.key)).String(); got != c.want {
+			t.Fatalf("decode %q: got %s, want %s", c.key, got, c.want)
+		}
+	}
+}
+
+func TestDescribeRange(t *testing.T) {
+	table := func(id int64) string {
+		return Escape(EncodeBytes(EncodeInt([]byte("t"), id)))
+	}
+	row := func(id, handle int64) string {
+		return Escape(recordKey(id, handle))
+	}
+	for _, c := range []struct {
+		start, end string
+		want       string
+	}{
+		{"", "", "whole key space"},
+		{row(123, 1000), row(123, 2000), "table 123, rows 1000-2000"},
+		{table(123), table(124), "table 123"},
+		{row(123, 1000), table(124), "table 123, rows from 1000"},
+		{table(123), row(123, 1000), "table 123, rows before 1000"},
+		{"", table(123), "-∞ to table 123"},
+		{row(123, 1000), "", "table 123, row 1000 to ∞"},
+		{table(123), table(200), "table 123 to table 200"},
+	} {
+		if got := DescribeRange(c.start, c.end); got != c.want {
+			t.Fatalf("describe [%s, %s): got %s, want %s", c.start, c.end, got, c.want)
+		}
+	}
+}
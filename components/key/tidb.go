@@ -0,0 +1,126 @@
+package key
+
+import (
+	"bytes"
+	"fmt"
+)
+
+type Kind int
+
+const (
+	KindUnknown Kind = iota
+	// KindMeta is the key of the TiDB meta data, the schemas and the IDs.
+	KindMeta
+	// KindTable is the prefix of a table, without the record or the index.
+	KindTable
+	KindRecord
+	KindIndex
+)
+
+var (
+	tablePrefix  = []byte{'t'}
+	metaPrefix   = []byte{'m'}
+	recordPrefix = []byte("_r")
+	indexPrefix  = []byte("_i")
+)
+
+// Key is a region boundary decoded into the TiDB data it splits.
+type Key struct {
+	// Raw is the key stored in TiKV.
+	Raw     []byte
+	Kind    Kind
+	TableID int64
+	IndexID int64
+	// Handle is the row of a record key, it is set only for an integer
+	// handle. A clustered index has a common handle instead.
+	Handle    int64
+	HasHandle bool
+}
+
+// Decode decodes a key printed by tikv-ctl. The key is memcomparable encoded
+// in TiKV, a key not encoded, e.g. a raw KV key, is decoded as it is, and a
+// malformed key as its text.
+func Decode(s string) *Key {
+	k := &Key{Raw: parseText(s)}
+	b := k.Raw
+	if data, _, err := DecodeBytes(b); err == nil {
+		b = data
+	}
+
+	if bytes.HasPrefix(b, metaPrefix) {
+		k.Kind = KindMeta
+		return k
+	}
+	if !bytes.HasPrefix(b, tablePrefix) {
+		return k
+	}
+	tableID, b, err := DecodeInt(b[len(tablePrefix):])
+	if err != nil {
+		return k
+	}
+	k.Kind, k.TableID = KindTable, tableID
+
+	switch {
+	case bytes.HasPrefix(b, recordPrefix):
+		k.Kind = KindRecord
+		if b = b[len(recordPrefix):]; len(b) == 8 {
+			k.Handle, _, _ = DecodeInt(b)
+			k.HasHandle = true
+		}
+	case bytes.HasPrefix(b, indexPrefix):
+		if indexID, _, err := DecodeInt(b[len(indexPrefix):]); err == nil {
+			k.Kind, k.IndexID = KindIndex, indexID
+		}
+	}
+	return k
+}
+
+func (k *Key) String() string {
+	switch k.Kind {
+	case KindMeta:
+		return "meta"
+	case KindTable:
+		return fmt.Sprintf("table %d", k.TableID)
+	case KindRecord:
+		if k.HasHandle {
+			return fmt.Sprintf("table %d, row %d", k.TableID, k.Handle)
+		}
+		return fmt.Sprintf("table %d, rows", k.TableID)
+	case KindIndex:
+		return fmt.Sprintf("table %d, index %d", k.TableID, k.IndexID)
+	}
+	return Escape(k.Raw)
+}
+
+// DescribeRange describes the TiDB data in a key range printed by tikv-ctl,
+// e.g. "table 123, rows 1000-2000". An empty key is the start or the end of
+// the key space.
+func DescribeRange(start, end string) string {
+	if start == "" && end == "" {
+		return "whole key space"
+	}
+	s, e := Decode(start), Decode(end)
+
+	// The next table starts right after the last row of the table.
+	endOfTable := end != "" && e.Kind == KindTable && e.TableID == s.TableID+1
+	switch {
+	case start == "" || end == "":
+	case s.Kind == KindRecord && e.Kind == KindRecord && s.TableID == e.TableID && s.HasHandle && e.HasHandle:
+		return fmt.Sprintf("table %d, rows %d-%d", s.TableID, s.Handle, e.Handle)
+	case s.Kind == KindTable && endOfTable:
+		return fmt.Sprintf("table %d", s.TableID)
+	case s.Kind == KindRecord && s.HasHandle && endOfTable:
+		return fmt.Sprintf("table %d, rows from %d", s.TableID, s.Handle)
+	case s.Kind == KindTable && e.Kind == KindRecord && s.TableID == e.TableID && e.HasHandle:
+		return fmt.Sprintf("table %d, rows before %d", s.TableID, e.Handle)
+	}
+
+	from, to := "-∞", "∞"
+	if start != "" {
+		from = s.String()
+	}
+	if end != "" {
+		to = e.String()
+	}
+	return from + " to " + to
+}
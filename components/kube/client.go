@@ -0,0 +1,240 @@
+// Package kube talks to the Kubernetes API server and runs commands in pods
+// for the clusters managed by TiDB Operator.
+package kube
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	// InClusterTokenFile and InClusterCAFile are mounted into the pods with a
+	// service account.
+	InClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	InClusterCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+	// Labels set by TiDB Operator on the pods of a TidbCluster.
+	LabelInstance  = "app.kubernetes.io/instance"
+	LabelComponent = "app.kubernetes.io/component"
+
+	ComponentPD   = "pd"
+	ComponentTiKV = "tikv"
+
+	// AnnotationRunMode set to RunModeDebug keeps TiDB Operator's start script
+	// from starting the server after the container restarts.
+	AnnotationRunMode = "runmode"
+	RunModeDebug      = "debug"
+	// PodInfoAnnotations is the downward API file the start script reads the
+	// run mode from. The kubelet updates it some time after the annotations
+	// are patched.
+	PodInfoAnnotations = "/etc/podinfo/annotations"
+
+	mergePatch = "application/merge-patch+json"
+)
+
+type Config struct {
+	// Server is the URL of the API server, defaults to the in-cluster one.
+	Server   string
+	Token    string
+	CAFile   string
+	Insecure bool
+	Timeout  time.Duration
+}
+
+// InCluster returns the server of the API server from the environment of a
+// pod, empty if not running in a pod.
+func InCluster() string {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return ""
+	}
+	return "https://" + strings.Join([]string{host, port}, ":")
+}
+
+// StatusError is a failed request, carrying the Status returned by the API
+// server.
+type StatusError struct {
+	Method  string
+	Path    string
+	Code    int
+	Reason  string
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s: %s", e.Method, e.Path, e.Code, e.Reason, e.Message)
+}
+
+func IsNotFound(err error) bool {
+	var e *StatusError
+	return errors.As(err, &e) && e.Code == http.StatusNotFound
+}
+
+func IsAlreadyExists(err error) bool {
+	var e *StatusError
+	return errors.As(err, &e) && e.Code == http.StatusConflict
+}
+
+type Client struct {
+	client *resty.Client
+}
+
+func NewClient(c *Config) (*Client, error) {
+	server := c.Server
+	if server == "" {
+		if server = InCluster(); server == "" {
+			return nil, errors.New("no Kubernetes API server is given and not running in a pod")
+		}
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.Insecure}
+	if c.CAFile != "" {
+		data, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	client := resty.New().
+		SetHostURL(strings.TrimSuffix(server, "/")).
+		SetTLSClientConfig(tlsConfig).
+		SetHeader("Accept", "application/json")
+	if c.Token != "" {
+		client.SetAuthToken(c.Token)
+	}
+	if c.Timeout > 0 {
+		client.SetTimeout(c.Timeout)
+	}
+	return &Client{client: client}, nil
+}
+
+// do sends the request and decodes the response into result if not nil.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, contentType string, body, result interface{}) error {
+	req := c.client.R().SetContext(ctx)
+	if query != nil {
+		req.SetQueryParamsFromValues(query)
+	}
+	if body != nil {
+		req.SetHeader("Content-Type", contentType).SetBody(body)
+	}
+
+	resp, err := req.Execute(method, path)
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		status := &struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		}{}
+		if json.Unmarshal(resp.Body(), status) != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(string(resp.Body()))
+		}
+		return &StatusError{
+			Method:  method,
+			Path:    path,
+			Code:    resp.StatusCode(),
+			Reason:  status.Reason,
+			Message: status.Message,
+		}
+	}
+	if result != nil {
+		return json.Unmarshal(resp.Body(), result)
+	}
+	return nil
+}
+
+func podPath(namespace, name string) string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", namespace, name)
+}
+
+func jobPath(namespace, name string) string {
+	return fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs/%s", namespace, name)
+}
+
+// TidbClusterPath is the path of the TidbCluster custom resource.
+func TidbClusterPath(namespace, name string) string {
+	return fmt.Sprintf("/apis/pingcap.com/v1alpha1/namespaces/%s/tidbclusters/%s", namespace, name)
+}
+
+// ListPods lists the pods of the namespace matching the label selector.
+func (c *Client) ListPods(ctx context.Context, namespace, selector string) ([]*Pod, error) {
+	list := &struct {
+		Items []*Pod `json:"items"`
+	}{}
+	query := url.Values{}
+	if selector != "" {
+		query.Set("labelSelector", selector)
+	}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods", namespace)
+	if err := c.do(ctx, http.MethodGet, path, query, "", nil, list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (c *Client) GetPod(ctx context.Context, namespace, name string) (*Pod, error) {
+	pod := &Pod{}
+	if err := c.do(ctx, http.MethodGet, podPath(namespace, name), nil, "", nil, pod); err != nil {
+		return nil, err
+	}
+	return pod, nil
+}
+
+// PatchPod applies the JSON merge patch to the pod.
+func (c *Client) PatchPod(ctx context.Context, namespace, name string, patch interface{}) error {
+	return c.do(ctx, http.MethodPatch, podPath(namespace, name), nil, mergePatch, patch, nil)
+}
+
+func (c *Client) DeletePod(ctx context.Context, namespace, name string) error {
+	return c.do(ctx, http.MethodDelete, podPath(namespace, name), nil, "", nil, nil)
+}
+
+func (c *Client) GetNode(ctx context.Context, name string) (*Node, error) {
+	node := &Node{}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/nodes/"+name, nil, "", nil, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// PatchTidbCluster applies the JSON merge patch to the TidbCluster.
+func (c *Client) PatchTidbCluster(ctx context.Context, namespace, name string, patch interface{}) error {
+	return c.do(ctx, http.MethodPatch, TidbClusterPath(namespace, name), nil, mergePatch, patch, nil)
+}
+
+func (c *Client) CreateJob(ctx context.Context, namespace string, job *Job) error {
+	path := fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs", namespace)
+	return c.do(ctx, http.MethodPost, path, nil, "application/json", job, nil)
+}
+
+func (c *Client) GetJob(ctx context.Context, namespace, name string) (*Job, error) {
+	job := &Job{}
+	if err := c.do(ctx, http.MethodGet, jobPath(namespace, name), nil, "", nil, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// DeleteJob deletes the job with its pods.
+func (c *Client) DeleteJob(ctx context.Context, namespace, name string) error {
+	query := url.Values{"propagationPolicy": {"Background"}}
+	return c.do(ctx, http.MethodDelete, jobPath(namespace, name), query, "", nil, nil)
+}
@@ -0,0 +1,204 @@
+package kube_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/iosmanthus/learner-recover/components/kube"
+	"github.com/iosmanthus/learner-recover/components/kube/kubefake"
+)
+
+func newClient(t *testing.T) (*kube.Client, *kubefake.Server) {
+	t.Helper()
+	server := kubefake.NewServer()
+	server.Token = "secret"
+	t.Cleanup(server.Close)
+
+	client, err := kube.NewClient(&kube.Config{Server: server.URL, Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func putPod(server *kubefake.Server, name, component string) {
+	server.Put(kubefake.PodPath("tidb", name), map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": "tidb",
+			"labels": map[string]string{
+				kube.LabelInstance:  "backup",
+				kube.LabelComponent: component,
+			},
+		},
+		"spec": map[string]interface{}{"nodeName": "node-1"},
+	})
+}
+
+func TestListPods(t *testing.T) {
+	client, server := newClient(t)
+	putPod(server, "backup-tikv-0", kube.ComponentTiKV)
+	putPod(server, "backup-tikv-1", kube.ComponentTiKV)
+	putPod(server, "backup-pd-0", kube.ComponentPD)
+
+	pods, err := client.ListPods(context.Background(), "tidb", kube.LabelInstance+"=backup,"+kube.LabelComponent+"=tikv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods) != 2 || pods[0].Metadata.Name != "backup-tikv-0" || pods[1].Metadata.Name != "backup-tikv-1" {
+		t.Fatalf("unexpected pods %+v", pods)
+	}
+	if pods[0].Spec.NodeName != "node-1" {
+		t.Fatalf("expect node-1, got %s", pods[0].Spec.NodeName)
+	}
+
+	pods, err = client.ListPods(context.Background(), "other", "")
+	if err != nil || len(pods) != 0 {
+		t.Fatalf("expect no pods, got %v, %v", pods, err)
+	}
+}
+
+func TestPatchAndDeletePod(t *testing.T) {
+	client, server := newClient(t)
+	putPod(server, "backup-tikv-0", kube.ComponentTiKV)
+	ctx := context.Background()
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{kube.AnnotationRunMode: kube.RunModeDebug},
+		},
+	}
+	if err := client.PatchPod(ctx, "tidb", "backup-tikv-0", patch); err != nil {
+		t.Fatal(err)
+	}
+	pod, err := client.GetPod(ctx, "tidb", "backup-tikv-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pod.Metadata.Annotations[kube.AnnotationRunMode] != kube.RunModeDebug {
+		t.Fatalf("annotation is not patched: %+v", pod.Metadata)
+	}
+	if pod.Metadata.Labels[kube.LabelComponent] != kube.ComponentTiKV {
+		t.Fatalf("labels are lost by the patch: %+v", pod.Metadata)
+	}
+
+	// A null removes the annotation.
+	patch = map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{kube.AnnotationRunMode: nil},
+		},
+	}
+	if err = client.PatchPod(ctx, "tidb", "backup-tikv-0", patch); err != nil {
+		t.Fatal(err)
+	}
+	if pod, err = client.GetPod(ctx, "tidb", "backup-tikv-0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pod.Metadata.Annotations[kube.AnnotationRunMode]; ok {
+		t.Fatalf("annotation is not removed: %+v", pod.Metadata)
+	}
+
+	if err = client.DeletePod(ctx, "tidb", "backup-tikv-0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.GetPod(ctx, "tidb", "backup-tikv-0"); !kube.IsNotFound(err) {
+		t.Fatalf("expect not found, got %v", err)
+	}
+}
+
+func TestJob(t *testing.T) {
+	client, server := newClient(t)
+	ctx := context.Background()
+
+	job := kube.NewJob("tidb", "backup-pd-recover", nil, "pingcap/pd:v5.1.0", "/pd-recover", "-alloc-id", "100")
+	if err := client.CreateJob(ctx, "tidb", job); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CreateJob(ctx, "tidb", job); !kube.IsAlreadyExists(err) {
+		t.Fatalf("expect already exists, got %v", err)
+	}
+
+	server.Update(kubefake.JobPath("tidb", "backup-pd-recover"), func(obj map[string]interface{}) {
+		obj["status"] = map[string]interface{}{"succeeded": 1}
+	})
+	got, err := client.GetJob(ctx, "tidb", "backup-pd-recover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Succeeded != 1 {
+		t.Fatalf("expect a succeeded job, got %+v", got.Status)
+	}
+	containers := got.Spec.Template.Spec.Containers
+	if len(containers) != 1 || strings.Join(containers[0].Command, " ") != "/pd-recover -alloc-id 100" {
+		t.Fatalf("unexpected containers %+v", containers)
+	}
+
+	if err = client.DeleteJob(ctx, "tidb", "backup-pd-recover"); err != nil {
+		t.Fatal(err)
+	}
+	requests := server.Requests()
+	if last := requests[len(requests)-1]; last.Query != "propagationPolicy=Background" {
+		t.Fatalf("expect background propagation, got %q", last.Query)
+	}
+}
+
+func TestPatchTidbCluster(t *testing.T) {
+	client, server := newClient(t)
+	path := kubefake.TidbClusterPath("tidb", "backup")
+	server.Put(path, `{"metadata":{"name":"backup"},"spec":{"version":"v5.0.0","pdAddresses":["http://pd:2379"],"tikv":{"replicas":3}}}`)
+
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"version":     "v5.1.0",
+			"pdAddresses": nil,
+			"pd":          map[string]interface{}{"replicas": 3},
+		},
+	}
+	if err := client.PatchTidbCluster(context.Background(), "tidb", "backup", patch); err != nil {
+		t.Fatal(err)
+	}
+
+	tc := &struct {
+		Spec map[string]interface{} `json:"spec"`
+	}{}
+	server.Get(path, tc)
+	if tc.Spec["version"] != "v5.1.0" || tc.Spec["pd"] == nil || tc.Spec["tikv"] == nil {
+		t.Fatalf("unexpected spec %+v", tc.Spec)
+	}
+	if _, ok := tc.Spec["pdAddresses"]; ok {
+		t.Fatalf("pdAddresses is not removed: %+v", tc.Spec)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	server := kubefake.NewServer()
+	server.Token = "secret"
+	defer server.Close()
+
+	client, err := kube.NewClient(&kube.Config{Server: server.URL, Token: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetNode(context.Background(), "node-1")
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expect unauthorized, got %v", err)
+	}
+}
+
+func TestKubectl(t *testing.T) {
+	k := &kube.Kubectl{Path: "/usr/bin/kubectl", Context: "dr"}
+	cmd := k.Command(context.Background(), "tidb", "backup-tikv-0", "tikv", "/tikv-ctl", "--db", "/var/lib/tikv/db", "bad-regions")
+	expect := "/usr/bin/kubectl --context dr exec -n tidb backup-tikv-0 -c tikv -- /tikv-ctl --db /var/lib/tikv/db bad-regions"
+	if got := strings.Join(cmd.Args, " "); got != expect {
+		t.Fatalf("expect %q, got %q", expect, got)
+	}
+}
+
+func TestParsePodInfo(t *testing.T) {
+	data := []byte("kubernetes.io/config.seen=\"2021-08-01T10:00:00Z\"\nrunmode=\"debug\"\nnote=\"a \\\"quoted\\\" = value\"\nbroken\n")
+	info := kube.ParsePodInfo(data)
+	if len(info) != 3 || info[kube.AnnotationRunMode] != kube.RunModeDebug || info["note"] != `a "quoted" = value` {
+		t.Fatalf("unexpected pod info %q", info)
+	}
+}
@@ -0,0 +1,55 @@
+package kube
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Executor builds the commands run in the containers of pods. The commands
+// are plain exec.Cmd, so they are run, logged and audited like the others.
+type Executor interface {
+	Command(ctx context.Context, namespace, pod, container string, argv ...string) *exec.Cmd
+}
+
+// Kubectl runs the commands with kubectl exec.
+type Kubectl struct {
+	// Path of kubectl, defaults to kubectl in $PATH.
+	Path       string
+	Kubeconfig string
+	Context    string
+}
+
+func (k *Kubectl) Command(ctx context.Context, namespace, pod, container string, argv ...string) *exec.Cmd {
+	path := k.Path
+	if path == "" {
+		path = "kubectl"
+	}
+
+	var args []string
+	if k.Kubeconfig != "" {
+		args = append(args, "--kubeconfig", k.Kubeconfig)
+	}
+	if k.Context != "" {
+		args = append(args, "--context", k.Context)
+	}
+	args = append(args, "exec", "-n", namespace, pod, "-c", container, "--")
+	return exec.CommandContext(ctx, path, append(args, argv...)...)
+}
+
+// ParsePodInfo parses a downward API file of annotations or labels, made of
+// lines like key="value" with the values quoted as Go strings.
+func ParsePodInfo(data []byte) map[string]string {
+	info := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if v, err := strconv.Unquote(kv[1]); err == nil {
+			info[kv[0]] = v
+		}
+	}
+	return info
+}
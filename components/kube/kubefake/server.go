@@ -0,0 +1,307 @@
+// Package kubefake is an in-memory Kubernetes API server serving the objects
+// used by the recovery, for tests.
+package kubefake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Request is a request received by the server.
+type Request struct {
+	Method string
+	Path   string
+	Query  string
+	Body   string
+}
+
+// Server stores the objects by their paths, e.g. /api/v1/namespaces/ns/pods/p.
+// Pods, nodes, TidbClusters and jobs are supported, lists are supported for
+// the collections with equality label selectors.
+type Server struct {
+	*httptest.Server
+	// Token is the expected bearer token, any token is accepted if empty.
+	Token string
+	// Hook is called after an object is created, patched or deleted.
+	Hook func(method, path string)
+
+	mu       sync.Mutex
+	objects  map[string]map[string]interface{}
+	requests []Request
+}
+
+func NewServer() *Server {
+	s := &Server{objects: make(map[string]map[string]interface{})}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func PodPath(namespace, name string) string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", namespace, name)
+}
+
+func NodePath(name string) string {
+	return "/api/v1/nodes/" + name
+}
+
+func JobPath(namespace, name string) string {
+	return fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs/%s", namespace, name)
+}
+
+func TidbClusterPath(namespace, name string) string {
+	return fmt.Sprintf("/apis/pingcap.com/v1alpha1/namespaces/%s/tidbclusters/%s", namespace, name)
+}
+
+// Put stores the object, given as a Go value or JSON text, at the path.
+func (s *Server) Put(path string, obj interface{}) {
+	var data []byte
+	switch v := obj.(type) {
+	case string:
+		data = []byte(v)
+	default:
+		var err error
+		if data, err = json.Marshal(v); err != nil {
+			panic(err)
+		}
+	}
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(data, &m); err != nil {
+		panic(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[path] = m
+}
+
+// Get decodes the object at the path into v, it reports whether the object
+// exists.
+func (s *Server) Get(path string, v interface{}) bool {
+	s.mu.Lock()
+	obj, ok := s.objects[path]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	data, _ := json.Marshal(obj)
+	if err := json.Unmarshal(data, v); err != nil {
+		panic(err)
+	}
+	return true
+}
+
+// Update changes the object at the path in place, it reports whether the
+// object exists.
+func (s *Server) Update(path string, f func(obj map[string]interface{})) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[path]
+	if ok {
+		f(obj)
+	}
+	return ok
+}
+
+// Delete removes the object at the path.
+func (s *Server) Delete(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, path)
+}
+
+// Requests returns the requests received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+func (s *Server) serve(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	path := strings.TrimSuffix(req.URL.Path, "/")
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{Method: req.Method, Path: path, Query: req.URL.RawQuery, Body: string(body)})
+	s.mu.Unlock()
+
+	if s.Token != "" && req.Header.Get("Authorization") != "Bearer "+s.Token {
+		status(w, http.StatusUnauthorized, "Unauthorized", "invalid bearer token")
+		return
+	}
+
+	changed := false
+	switch req.Method {
+	case http.MethodGet:
+		s.get(w, path, req.URL.Query().Get("labelSelector"))
+	case http.MethodPost:
+		changed = s.create(w, path, body)
+	case http.MethodPatch:
+		if req.Header.Get("Content-Type") != "application/merge-patch+json" {
+			status(w, http.StatusUnsupportedMediaType, "UnsupportedMediaType", "only merge patches are supported")
+			return
+		}
+		changed = s.patch(w, path, body)
+	case http.MethodDelete:
+		changed = s.delete(w, path)
+	default:
+		status(w, http.StatusMethodNotAllowed, "MethodNotAllowed", req.Method)
+	}
+
+	if changed && s.Hook != nil {
+		s.Hook(req.Method, path)
+	}
+}
+
+func (s *Server) get(w http.ResponseWriter, path, selector string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if obj, ok := s.objects[path]; ok {
+		reply(w, http.StatusOK, obj)
+		return
+	}
+
+	// A collection, list the objects right under it.
+	var names []string
+	for p, obj := range s.objects {
+		if strings.HasPrefix(p, path+"/") && !strings.Contains(p[len(path)+1:], "/") && matches(obj, selector) {
+			names = append(names, p)
+		}
+	}
+	if len(names) == 0 && !isCollection(path) {
+		status(w, http.StatusNotFound, "NotFound", fmt.Sprintf("%s not found", path))
+		return
+	}
+	sort.Strings(names)
+	items := []interface{}{}
+	for _, p := range names {
+		items = append(items, s.objects[p])
+	}
+	reply(w, http.StatusOK, map[string]interface{}{"items": items})
+}
+
+func isCollection(path string) bool {
+	for _, kind := range []string{"pods", "nodes", "jobs", "tidbclusters"} {
+		if strings.HasSuffix(path, "/"+kind) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) create(w http.ResponseWriter, path string, body []byte) bool {
+	obj := make(map[string]interface{})
+	if err := json.Unmarshal(body, &obj); err != nil {
+		status(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return false
+	}
+	meta, _ := obj["metadata"].(map[string]interface{})
+	name, _ := meta["name"].(string)
+	if name == "" {
+		status(w, http.StatusUnprocessableEntity, "Invalid", "metadata.name is required")
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path = path + "/" + name
+	if _, ok := s.objects[path]; ok {
+		status(w, http.StatusConflict, "AlreadyExists", fmt.Sprintf("%s already exists", name))
+		return false
+	}
+	s.objects[path] = obj
+	reply(w, http.StatusCreated, obj)
+	return true
+}
+
+func (s *Server) patch(w http.ResponseWriter, path string, body []byte) bool {
+	var patch interface{}
+	if err := json.Unmarshal(body, &patch); err != nil {
+		status(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[path]
+	if !ok {
+		status(w, http.StatusNotFound, "NotFound", fmt.Sprintf("%s not found", path))
+		return false
+	}
+	obj = MergePatch(obj, patch).(map[string]interface{})
+	s.objects[path] = obj
+	reply(w, http.StatusOK, obj)
+	return true
+}
+
+func (s *Server) delete(w http.ResponseWriter, path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[path]
+	if !ok {
+		status(w, http.StatusNotFound, "NotFound", fmt.Sprintf("%s not found", path))
+		return false
+	}
+	delete(s.objects, path)
+	reply(w, http.StatusOK, obj)
+	return true
+}
+
+// MergePatch applies the JSON merge patch of RFC 7386 to the document.
+func MergePatch(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	d, ok := doc.(map[string]interface{})
+	if !ok {
+		d = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+			continue
+		}
+		d[k] = MergePatch(d[k], v)
+	}
+	return d
+}
+
+// matches reports whether the labels of the object match the selector of
+// comma separated key=value requirements.
+func matches(obj map[string]interface{}, selector string) bool {
+	if selector == "" {
+		return true
+	}
+	meta, _ := obj["metadata"].(map[string]interface{})
+	labels, _ := meta["labels"].(map[string]interface{})
+	for _, req := range strings.Split(selector, ",") {
+		kv := strings.SplitN(req, "=", 2)
+		if len(kv) != 2 || labels[kv[0]] != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+func reply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func status(w http.ResponseWriter, code int, reason, message string) {
+	reply(w, code, map[string]interface{}{
+		"kind":    "Status",
+		"status":  "Failure",
+		"reason":  reason,
+		"message": message,
+		"code":    code,
+	})
+}
@@ -0,0 +1,111 @@
+package kube
+
+// The types below keep the fields of the Kubernetes objects used by the
+// recovery only.
+
+type ObjectMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace,omitempty"`
+	UID         string            `json:"uid,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type Pod struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		NodeName string `json:"nodeName,omitempty"`
+	} `json:"spec"`
+	Status PodStatus `json:"status"`
+}
+
+type PodStatus struct {
+	Phase             string            `json:"phase,omitempty"`
+	PodIP             string            `json:"podIP,omitempty"`
+	Conditions        []PodCondition    `json:"conditions,omitempty"`
+	ContainerStatuses []ContainerStatus `json:"containerStatuses,omitempty"`
+}
+
+type PodCondition struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+type ContainerStatus struct {
+	Name         string `json:"name"`
+	Ready        bool   `json:"ready"`
+	RestartCount int    `json:"restartCount"`
+	State        struct {
+		Running *struct {
+			StartedAt string `json:"startedAt,omitempty"`
+		} `json:"running,omitempty"`
+	} `json:"state"`
+}
+
+// Ready reports whether the Ready condition of the pod is true.
+func (p *Pod) Ready() bool {
+	for _, c := range p.Status.Conditions {
+		if c.Type == "Ready" {
+			return c.Status == "True"
+		}
+	}
+	return false
+}
+
+// Container returns the status of the container, nil if missing.
+func (p *Pod) Container(name string) *ContainerStatus {
+	for i := range p.Status.ContainerStatuses {
+		if p.Status.ContainerStatuses[i].Name == name {
+			return &p.Status.ContainerStatuses[i]
+		}
+	}
+	return nil
+}
+
+type Node struct {
+	Metadata ObjectMeta `json:"metadata"`
+}
+
+type Job struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   ObjectMeta `json:"metadata"`
+	Spec       JobSpec    `json:"spec"`
+	Status     struct {
+		Active    int `json:"active,omitempty"`
+		Succeeded int `json:"succeeded,omitempty"`
+		Failed    int `json:"failed,omitempty"`
+	} `json:"status"`
+}
+
+type JobSpec struct {
+	BackoffLimit *int `json:"backoffLimit,omitempty"`
+	Template     struct {
+		Metadata ObjectMeta `json:"metadata"`
+		Spec     struct {
+			RestartPolicy string      `json:"restartPolicy"`
+			Containers    []Container `json:"containers"`
+		} `json:"spec"`
+	} `json:"template"`
+}
+
+type Container struct {
+	Name    string   `json:"name"`
+	Image   string   `json:"image"`
+	Command []string `json:"command,omitempty"`
+}
+
+// NewJob returns a job running the command once in a container of the image.
+func NewJob(namespace, name string, labels map[string]string, image string, command ...string) *Job {
+	backoff := 0
+	job := &Job{
+		APIVersion: "batch/v1",
+		Kind:       "Job",
+		Metadata:   ObjectMeta{Name: name, Namespace: namespace, Labels: labels},
+	}
+	job.Spec.BackoffLimit = &backoff
+	job.Spec.Template.Metadata.Labels = labels
+	job.Spec.Template.Spec.RestartPolicy = "Never"
+	job.Spec.Template.Spec.Containers = []Container{{Name: name, Image: image, Command: command}}
+	return job
+}
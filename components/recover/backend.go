@@ -0,0 +1,116 @@
+package recover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+
+	"github.com/iosmanthus/learner-recover/common"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// BackendTiUP recovers a cluster deployed by tiup over SSH.
+	BackendTiUP = "tiup"
+	// BackendKubernetes recovers a TidbCluster managed by TiDB Operator.
+	BackendKubernetes = "kubernetes"
+)
+
+// Node is a TiKV learner node recovered from, a host of the tiup topology or
+// a pod of the TidbCluster.
+type Node struct {
+	Host string
+	Port int
+	// DataDir is the data directory of TiKV, the db is DataDir/db.
+	DataDir string
+	Labels  map[string]string
+}
+
+// Backend carries out the steps of the recovery depending on how the
+// cluster is deployed.
+type Backend interface {
+	// Discover finds the learner nodes of the groups recovered from if they
+	// are not known from the config.
+	Discover(ctx context.Context) error
+	// Prepare makes tikv-ctl available to the node.
+	Prepare(ctx context.Context, logger *log.Entry, node *Node) error
+	// StopTiKV stops the TiKV server of the node and keeps it down.
+	StopTiKV(ctx context.Context, logger *log.Entry, node *Node) error
+	// TiKVCtl returns the command running tikv-ctl against the db of the node.
+	TiKVCtl(ctx context.Context, node *Node, args ...string) *exec.Cmd
+	// RebuildPD deploys new PD servers and recovers the cluster ID and the
+	// allocated ID.
+	RebuildPD(ctx context.Context) error
+	// Join brings the recovered TiKV servers back into the cluster.
+	Join(ctx context.Context) error
+}
+
+// Runner runs and records the operations of a backend, see ClusterRescuer.
+type Runner interface {
+	// Run runs the command against the host.
+	Run(logger *log.Entry, host string, cmd *exec.Cmd) (string, error)
+	// Begin records the intent of an operation done without a command, e.g. a
+	// request to the Kubernetes API server, given by its argv. The operation
+	// is done only if it succeeds, its result is recorded by finish.
+	Begin(logger *log.Entry, host string, argv []string) (finish func(output []byte, err error) error, err error)
+}
+
+func newBackend(c *Config, run Runner) (Backend, error) {
+	switch c.Backend {
+	case BackendTiUP:
+		return &tiupBackend{config: c, run: run}, nil
+	case BackendKubernetes:
+		return newKubeBackend(c, run)
+	default:
+		return nil, fmt.Errorf("unknown backend %q", c.Backend)
+	}
+}
+
+// groupNodes picks the nodes of the learner groups recovered from, where
+// tells where the nodes come from in errors.
+func groupNodes(learnerGroups []*common.LearnerGroup, recoverFrom []string, all []*Node, where string) ([]*Node, []*Group, error) {
+	groups := make(map[string]*Group)
+	for _, name := range recoverFrom {
+		groups[name] = &Group{Name: name}
+	}
+
+	var nodes []*Node
+	for _, node := range all {
+		group, err := common.MatchLearnerGroup(learnerGroups, node.Labels)
+		if err != nil {
+			return nil, nil, err
+		}
+		if group == nil || groups[group.Name] == nil {
+			continue
+		}
+		groups[group.Name].Nodes = append(groups[group.Name].Nodes, node)
+		nodes = append(nodes, node)
+	}
+	if len(nodes) == 0 {
+		return nil, nil, fmt.Errorf("no TiKV nodes in the cluster, please check %s", where)
+	}
+
+	var recoverGroups []*Group
+	for _, name := range recoverFrom {
+		group := groups[name]
+		if len(group.Nodes) == 0 {
+			return nil, nil, fmt.Errorf("no TiKV nodes in learner group %s, please check %s", name, where)
+		}
+		recoverGroups = append(recoverGroups, group)
+	}
+	return nodes, recoverGroups, nil
+}
+
+// checkNodes checks the learner groups against the labels of all the nodes.
+func checkNodes(learnerGroups []*common.LearnerGroup, all []*Node) error {
+	if len(all) == 0 {
+		return errors.New("no TiKV nodes in the cluster")
+	}
+	var stores []map[string]string
+	for _, node := range all {
+		stores = append(stores, node.Labels)
+	}
+	return common.CheckLearnerGroups(learnerGroups, stores)
+}
@@ -1,23 +1,70 @@
 package recover
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"strings"
+	"time"
 
 	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/components/kube"
+	"github.com/iosmanthus/learner-recover/components/tables"
+	"github.com/iosmanthus/learner-recover/components/unified"
 
 	"github.com/pingcap/tiup/pkg/cluster/spec"
 	"gopkg.in/yaml.v3"
 )
 
+// Group is a learner group recovered from.
+type Group struct {
+	Name  string
+	Nodes []*Node
+}
+
+// KubernetesConfig locates the TidbCluster recovered by the kubernetes
+// backend.
+type KubernetesConfig struct {
+	Client      kube.Config
+	Kubectl     kube.Kubectl
+	Namespace   string
+	TidbCluster string
+	// TiKVCtl is the path of tikv-ctl in the TiKV image.
+	TiKVCtl string
+	// DataDir is the data directory of TiKV in its container.
+	DataDir    string
+	PDImage    string
+	PDReplicas int
+	PDStorage  string
+	// TiKVReplicas scales out the TiKV servers when joining, unchanged if 0.
+	TiKVReplicas int
+	// Timeout bounds the wait for the pods and the jobs.
+	Timeout time.Duration
+}
+
 type Config struct {
+	// Backend is either BackendTiUP or BackendKubernetes.
+	Backend        string
 	ClusterVersion string
 	ClusterName    string
 	User           string
 	SSHPort        int
-	Nodes          []*spec.TiKVSpec
-	NewTopology    struct {
+	// Nodes are the learner nodes of the groups recovered from, they are
+	// discovered by the kubernetes backend when preparing.
+	Nodes []*Node
+	// LearnerGroups are all the configured learner groups.
+	LearnerGroups []*common.LearnerGroup
+	// RecoverFrom names the learner groups recovered from.
+	RecoverFrom []string
+	// Groups are the learner groups recovered from in the order of preference.
+	Groups []*Group
+	// FailedStores are the voter stores and the learner stores of the groups
+	// not recovered from.
+	FailedStores []uint64
+	NewTopology  struct {
 		Path      string
 		PDServers []*spec.PDSpec
 	}
@@ -28,42 +75,131 @@ type Config struct {
 		Dest string
 	}
 	PDRecoverPath string
+	// ClusterTimeout bounds the wait for the tiup operations to take effect.
+	ClusterTimeout time.Duration
+	// PDAddress is the client address of the rebuilt PD, host:port.
+	PDAddress  string
+	Kubernetes *KubernetesConfig
+	// AuditLog records every command run against the cluster.
+	AuditLog string
+	// Report is the path of the recovery report without the extension, it is
+	// written as Markdown and HTML.
+	Report string
+	// RPOOutput is the save path of the rpo command, its last RPO estimates
+	// the data lost at the failure.
+	RPOOutput string
+	// RPOHistory is the history path of the rpo command, the data likely lost
+	// at FailureTime is estimated from it and confirmed before the promotion.
+	RPOHistory  string
+	FailureTime time.Time
+	// SchemaSource names the tables affected in the report if set.
+	SchemaSource *tables.Source
+	// ReplayPlacement replays the replication settings kept in the recover
+	// info into the rebuilt PD.
+	ReplayPlacement bool
+	// AssumeYes skips the confirmation.
+	AssumeYes bool
+}
+
+// _Config is the YAML of the config file.
+type _Config struct {
+	Backend         string                 `yaml:"backend"`
+	ClusterVersion  string                 `yaml:"cluster-version"`
+	ClusterName     string                 `yaml:"cluster-name"`
+	OldTopology     string                 `yaml:"old-topology"`
+	NewTopology     string                 `yaml:"new-topology"`
+	JoinTopology    string                 `yaml:"join-topology"`
+	RecoverInfoFile string                 `yaml:"recover-info-file"`
+	ZoneLabels      interface{}            `yaml:"zone-labels"`
+	LearnerGroups   map[string]interface{} `yaml:"learner-groups"`
+	RecoverFrom     []string               `yaml:"recover-from"`
+	TiKVCtl         struct {
+		Src  string `yaml:"src"`
+		Dest string `yaml:"dest"`
+	} `yaml:"tikv-ctl"`
+	PDRecoverPath string `yaml:"pd-recover-path"`
+	AuditLog      string `yaml:"audit-log"`
+	Report        string `yaml:"report"`
+	RPOOutput     string `yaml:"rpo-output"`
+	RPOHistory    string `yaml:"rpo-history"`
+	FailureTime   string `yaml:"failure-time"`
+	// ReplayPlacement replays the placement rules, the replication config
+	// and the replication mode of the old PD.
+	ReplayPlacement bool `yaml:"replay-placement"`
+	SchemaSource    *struct {
+		TiDB string `yaml:"tidb"`
+		Dump string `yaml:"dump"`
+	} `yaml:"schema-source"`
+	// SSH overrides the user and port in the global section of the old
+	// topology.
+	SSH struct {
+		User string `yaml:"user"`
+		Port int    `yaml:"port"`
+	} `yaml:"ssh"`
+	// ClusterTimeout bounds the wait for the tiup operations to show in
+	// tiup cluster display.
+	ClusterTimeout string `yaml:"cluster-timeout"`
+	Kubernetes     struct {
+		Server                string `yaml:"server"`
+		TokenFile             string `yaml:"token-file"`
+		CAFile                string `yaml:"ca-file"`
+		InsecureSkipTLSVerify bool   `yaml:"insecure-skip-tls-verify"`
+		Kubectl               string `yaml:"kubectl"`
+		Kubeconfig            string `yaml:"kubeconfig"`
+		Context               string `yaml:"context"`
+		Namespace             string `yaml:"namespace"`
+		TidbCluster           string `yaml:"tidb-cluster"`
+		TiKVCtl               string `yaml:"tikv-ctl"`
+		DataDir               string `yaml:"data-dir"`
+		PD                    struct {
+			Image    string `yaml:"image"`
+			Replicas int    `yaml:"replicas"`
+			Storage  string `yaml:"storage"`
+			Address  string `yaml:"address"`
+		} `yaml:"pd"`
+		TiKVReplicas int    `yaml:"tikv-replicas"`
+		Timeout      string `yaml:"timeout"`
+	} `yaml:"kubernetes"`
 }
 
 func NewConfig(path string) (*Config, error) {
-	type _Config struct {
-		ClusterVersion  string            `yaml:"cluster-version"`
-		ClusterName     string            `yaml:"cluster-name"`
-		OldTopology     string            `yaml:"old-topology"`
-		NewTopology     string            `yaml:"new-topology"`
-		JoinTopology    string            `yaml:"join-topology"`
-		RecoverInfoFile string            `yaml:"recover-info-file"`
-		ZoneLabels      map[string]string `yaml:"zone-labels"`
-		TiKVCtl         struct {
-			Src  string `yaml:"src"`
-			Dest string `yaml:"dest"`
-		} `yaml:"tikv-ctl"`
-		PDRecoverPath string `yaml:"pd-recover-path"`
-	}
-
-	data, err := ioutil.ReadFile(path)
+	data, err := unified.Load(path, unified.CommandRecover)
 	if err != nil {
 		return nil, err
 	}
 
-	c := &_Config{}
-	if err = yaml.Unmarshal(data, c); err != nil {
-		return nil, err
+	c := &_Config{Backend: BackendTiUP, AuditLog: "audit.log", Report: "recover-report", ClusterTimeout: "5m"}
+	c.Kubernetes.TiKVCtl = "/tikv-ctl"
+	c.Kubernetes.DataDir = "/var/lib/tikv"
+	c.Kubernetes.PD.Image = "pingcap/pd"
+	c.Kubernetes.PD.Replicas = 3
+	c.Kubernetes.PD.Storage = "10Gi"
+	c.Kubernetes.Timeout = "10m"
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(c); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %v", path, err)
 	}
 
-	topo := &spec.Specification{}
-	if err := spec.ParseTopologyYaml(c.OldTopology, topo); err != nil {
+	err = common.CheckRequired(
+		"cluster-version", c.ClusterVersion,
+		"cluster-name", c.ClusterName,
+		"recover-info-file", c.RecoverInfoFile,
+	)
+	if err != nil {
 		return nil, err
 	}
 
+	var failureTime time.Time
+	if c.FailureTime != "" {
+		if failureTime, err = time.Parse(time.RFC3339, c.FailureTime); err != nil {
+			return nil, fmt.Errorf("invalid failure-time: %v", err)
+		}
+	}
+
 	data, err = ioutil.ReadFile(c.RecoverInfoFile)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("recover-info-file: %v", err)
 	}
 
 	info := &common.RecoverInfo{}
@@ -71,44 +207,200 @@ func NewConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
-	var nodes []*spec.TiKVSpec
-	for _, tikv := range topo.TiKVServers {
-		serverLabels, err := tikv.Labels()
-		if err != nil {
-			return nil, err
+	learnerGroups, err := common.NewLearnerGroups(c.ZoneLabels, c.LearnerGroups)
+	if err != nil {
+		return nil, err
+	}
+
+	// All groups are recovered from by default.
+	recoverFrom := c.RecoverFrom
+	if len(recoverFrom) == 0 {
+		for _, group := range learnerGroups {
+			recoverFrom = append(recoverFrom, group.Name)
 		}
-		if common.IsLabelsMatch(c.ZoneLabels, serverLabels) {
-			nodes = append(nodes, tikv)
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range recoverFrom {
+		if selected[name] {
+			return nil, fmt.Errorf("learner group %s is duplicated in recover-from", name)
 		}
+		selected[name] = true
 	}
-	if len(nodes) == 0 {
-		return nil, errors.New("no TiKV nodes in the cluster, please check the topology file")
+	for _, name := range recoverFrom {
+		if common.FindLearnerGroup(learnerGroups, name) == nil {
+			return nil, fmt.Errorf("unknown learner group %s in recover-from", name)
+		}
 	}
 
-	newTopo := &spec.Specification{}
-	if err := spec.ParseTopologyYaml(c.NewTopology, newTopo); err != nil {
-		return nil, err
+	// Stores of the groups not recovered from are removed like the voters.
+	failedStores := append([]uint64{}, info.StoreIDs...)
+	for _, group := range learnerGroups {
+		if selected[group.Name] {
+			continue
+		}
+		stores, ok := info.LearnerStoreIDs[group.Name]
+		if !ok {
+			return nil, fmt.Errorf("stores of learner group %s are missing in the recover info, please fetch it with the same learner groups", group.Name)
+		}
+		failedStores = append(failedStores, stores...)
 	}
 
-	return &Config{
-		ClusterVersion: c.ClusterVersion,
-		ClusterName:    c.ClusterName,
-		User:           topo.GlobalOptions.User,
-		SSHPort:        topo.GlobalOptions.SSHPort,
-		Nodes:          nodes,
-		NewTopology: struct {
-			Path      string
-			PDServers []*spec.PDSpec
-		}{c.NewTopology, newTopo.PDServers},
+	config := &Config{
+		Backend:         c.Backend,
+		ClusterVersion:  c.ClusterVersion,
+		ClusterName:     c.ClusterName,
+		LearnerGroups:   learnerGroups,
+		RecoverFrom:     recoverFrom,
+		FailedStores:    failedStores,
 		JoinTopology:    c.JoinTopology,
 		RecoverInfoFile: info,
-		TiKVCtl: struct {
-			Src  string
-			Dest string
-		}{
-			Src:  c.TiKVCtl.Src,
-			Dest: c.TiKVCtl.Dest,
-		},
-		PDRecoverPath: c.PDRecoverPath,
-	}, nil
+		PDRecoverPath:   c.PDRecoverPath,
+		AuditLog:        c.AuditLog,
+		Report:          c.Report,
+		RPOOutput:       c.RPOOutput,
+		RPOHistory:      c.RPOHistory,
+		FailureTime:     failureTime,
+		ReplayPlacement: c.ReplayPlacement,
+	}
+	config.TiKVCtl.Src, config.TiKVCtl.Dest = c.TiKVCtl.Src, c.TiKVCtl.Dest
+	if source := c.SchemaSource; source != nil {
+		config.SchemaSource = &tables.Source{TiDB: source.TiDB, Dump: source.Dump}
+	}
+
+	switch c.Backend {
+	case BackendTiUP:
+		err = common.CheckRequired(
+			"old-topology", c.OldTopology,
+			"new-topology", c.NewTopology,
+			"join-topology", c.JoinTopology,
+			"tikv-ctl.src", c.TiKVCtl.Src,
+			"tikv-ctl.dest", c.TiKVCtl.Dest,
+			"pd-recover-path", c.PDRecoverPath,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range [][2]string{
+			{"join-topology", c.JoinTopology},
+			{"tikv-ctl.src", c.TiKVCtl.Src},
+			{"pd-recover-path", c.PDRecoverPath},
+		} {
+			if err = common.CheckFileExists(file[0], file[1]); err != nil {
+				return nil, err
+			}
+		}
+
+		topo := &spec.Specification{}
+		if err := spec.ParseTopologyYaml(c.OldTopology, topo); err != nil {
+			return nil, err
+		}
+
+		var all []*Node
+		for _, tikv := range topo.TiKVServers {
+			labels, err := tikv.Labels()
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, &Node{
+				Host:    tikv.Host,
+				Port:    tikv.Port,
+				DataDir: fmt.Sprintf("%s/%s", tikv.DeployDir, tikv.DataDir),
+				Labels:  labels,
+			})
+		}
+		if err = checkNodes(learnerGroups, all); err != nil {
+			return nil, err
+		}
+		if config.Nodes, config.Groups, err = groupNodes(learnerGroups, recoverFrom, all, "the topology file"); err != nil {
+			return nil, err
+		}
+
+		newTopo := &spec.Specification{}
+		if err := spec.ParseTopologyYaml(c.NewTopology, newTopo); err != nil {
+			return nil, err
+		}
+		if len(newTopo.PDServers) == 0 {
+			return nil, errors.New("no PD servers in the new topology")
+		}
+		config.NewTopology.Path = c.NewTopology
+		config.NewTopology.PDServers = newTopo.PDServers
+		pd := newTopo.PDServers[0]
+		config.PDAddress = fmt.Sprintf("%s:%v", pd.Host, pd.ClientPort)
+
+		if config.ClusterTimeout, err = time.ParseDuration(c.ClusterTimeout); err != nil {
+			return nil, fmt.Errorf("invalid cluster-timeout: %v", err)
+		}
+
+		config.User, config.SSHPort = topo.GlobalOptions.User, topo.GlobalOptions.SSHPort
+		if c.SSH.User != "" {
+			config.User = c.SSH.User
+		}
+		if c.SSH.Port != 0 {
+			config.SSHPort = c.SSH.Port
+		}
+	case BackendKubernetes:
+		k := &c.Kubernetes
+		err = common.CheckRequired(
+			"kubernetes.namespace", k.Namespace,
+			"kubernetes.tidb-cluster", k.TidbCluster,
+		)
+		if err != nil {
+			return nil, err
+		}
+		timeout, err := time.ParseDuration(k.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid kubernetes.timeout: %v", err)
+		}
+
+		// The service account of the pod is used without a server.
+		tokenFile, caFile := k.TokenFile, k.CAFile
+		if k.Server == "" {
+			if tokenFile == "" {
+				tokenFile = kube.InClusterTokenFile
+			}
+			if caFile == "" {
+				caFile = kube.InClusterCAFile
+			}
+		}
+		var token string
+		if tokenFile != "" {
+			data, err := ioutil.ReadFile(tokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("kubernetes.token-file: %v", err)
+			}
+			token = strings.TrimSpace(string(data))
+		}
+
+		config.Kubernetes = &KubernetesConfig{
+			Client: kube.Config{
+				Server:   k.Server,
+				Token:    token,
+				CAFile:   caFile,
+				Insecure: k.InsecureSkipTLSVerify,
+			},
+			Kubectl: kube.Kubectl{
+				Path:       k.Kubectl,
+				Kubeconfig: k.Kubeconfig,
+				Context:    k.Context,
+			},
+			Namespace:    k.Namespace,
+			TidbCluster:  k.TidbCluster,
+			TiKVCtl:      k.TiKVCtl,
+			DataDir:      k.DataDir,
+			PDImage:      k.PD.Image,
+			PDReplicas:   k.PD.Replicas,
+			PDStorage:    k.PD.Storage,
+			TiKVReplicas: k.TiKVReplicas,
+			Timeout:      timeout,
+		}
+		config.PDAddress = k.PD.Address
+		if config.PDAddress == "" {
+			config.PDAddress = fmt.Sprintf("%s-pd.%s:2379", k.TidbCluster, k.Namespace)
+		}
+	default:
+		return nil, fmt.Errorf("unknown backend %q, expect %s or %s", c.Backend, BackendTiUP, BackendKubernetes)
+	}
+
+	return config, nil
 }
@@ -0,0 +1,430 @@
+package recover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/components/kube"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	tikvContainer = "tikv"
+	tikvPort      = 20160
+	pdClientPort  = 2379
+)
+
+// kubeBackend recovers a TidbCluster managed by TiDB Operator. The learner
+// pods are kept down in the debug run mode of the operator while tikv-ctl
+// runs in their containers, PD is rebuilt by patching the TidbCluster and
+// running pd-recover in a job.
+type kubeBackend struct {
+	config   *Config
+	k        *KubernetesConfig
+	run      Runner
+	client   *kube.Client
+	exec     kube.Executor
+	interval time.Duration
+}
+
+func newKubeBackend(c *Config, run Runner) (*kubeBackend, error) {
+	client, err := kube.NewClient(&c.Kubernetes.Client)
+	if err != nil {
+		return nil, err
+	}
+	return &kubeBackend{
+		config:   c,
+		k:        c.Kubernetes,
+		run:      run,
+		client:   client,
+		exec:     &c.Kubernetes.Kubectl,
+		interval: 2 * time.Second,
+	}, nil
+}
+
+func (b *kubeBackend) selector(component string) string {
+	return fmt.Sprintf("%s=%s,%s=%s", kube.LabelInstance, b.k.TidbCluster, kube.LabelComponent, component)
+}
+
+// call sends a request to the API server and records it as argv, the host
+// is the pod or the TidbCluster.
+func (b *kubeBackend) call(logger *log.Entry, host string, argv []string, f func() error) error {
+	argv = append([]string{"kube"}, argv...)
+	logger = logger.WithField(common.FieldCommand, strings.Join(argv, " "))
+
+	finish, err := b.run.Begin(logger, host, argv)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = f()
+	logger = logger.WithField(common.FieldDuration, time.Since(start).String())
+	if err != nil {
+		logger.WithError(err).Warn("Kubernetes API request failed")
+	} else {
+		logger.Info("Kubernetes API request finished")
+	}
+
+	if recordErr := finish(nil, err); recordErr != nil {
+		return recordErr
+	}
+	return err
+}
+
+func (b *kubeBackend) patchPod(ctx context.Context, logger *log.Entry, name string, patch interface{}) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	return b.call(logger, name, []string{"patch", "pod", b.k.Namespace + "/" + name, string(data)}, func() error {
+		return b.client.PatchPod(ctx, b.k.Namespace, name, patch)
+	})
+}
+
+func (b *kubeBackend) deletePod(ctx context.Context, logger *log.Entry, name string) error {
+	return b.call(logger, name, []string{"delete", "pod", b.k.Namespace + "/" + name}, func() error {
+		return b.client.DeletePod(ctx, b.k.Namespace, name)
+	})
+}
+
+func runModePatch(mode interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{kube.AnnotationRunMode: mode},
+		},
+	}
+}
+
+// poll calls f until it's done or the timeout expires.
+func (b *kubeBackend) poll(ctx context.Context, what string, f func() (bool, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, b.k.Timeout)
+	defer cancel()
+
+	for {
+		done, err := f()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timeout waiting for %s: %v", what, ctx.Err())
+		case <-time.After(b.interval):
+		}
+	}
+}
+
+// Discover lists the TiKV pods of the TidbCluster. The learner groups match
+// the labels of the pods with the labels of their Kubernetes nodes, which
+// carry the topology labels like topology.kubernetes.io/zone.
+func (b *kubeBackend) Discover(ctx context.Context) error {
+	c := b.config
+
+	pods, err := b.client.ListPods(ctx, b.k.Namespace, b.selector(kube.ComponentTiKV))
+	if err != nil {
+		return err
+	}
+
+	nodeLabels := make(map[string]map[string]string)
+	var all []*Node
+	for _, pod := range pods {
+		labels := make(map[string]string)
+		if name := pod.Spec.NodeName; name != "" {
+			if _, ok := nodeLabels[name]; !ok {
+				node, err := b.client.GetNode(ctx, name)
+				if err != nil {
+					return err
+				}
+				nodeLabels[name] = node.Metadata.Labels
+			}
+			for k, v := range nodeLabels[name] {
+				labels[k] = v
+			}
+		}
+		for k, v := range pod.Metadata.Labels {
+			labels[k] = v
+		}
+		all = append(all, &Node{
+			Host:    pod.Metadata.Name,
+			Port:    tikvPort,
+			DataDir: b.k.DataDir,
+			Labels:  labels,
+		})
+	}
+
+	where := fmt.Sprintf("the TiKV pods of TidbCluster %s/%s", b.k.Namespace, b.k.TidbCluster)
+	if err = checkNodes(c.LearnerGroups, all); err != nil {
+		return fmt.Errorf("%s: %v", where, err)
+	}
+	c.Nodes, c.Groups, err = groupNodes(c.LearnerGroups, c.RecoverFrom, all, where)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range c.Groups {
+		for _, node := range group.Nodes {
+			stepLog(StepPrepare).WithFields(log.Fields{
+				common.FieldHost:  node.Host,
+				common.FieldGroup: group.Name,
+			}).Info("Found TiKV learner pod")
+		}
+	}
+	return nil
+}
+
+// Prepare checks tikv-ctl shipped in the TiKV image.
+func (b *kubeBackend) Prepare(ctx context.Context, logger *log.Entry, node *Node) error {
+	cmd := b.exec.Command(ctx, b.k.Namespace, node.Host, tikvContainer, b.k.TiKVCtl, "--version")
+	_, err := b.run.Run(logger, node.Host, cmd)
+	return err
+}
+
+// StopTiKV switches the pod into the debug run mode and kills TiKV once the
+// container sees the mode, the container is restarted without starting TiKV.
+func (b *kubeBackend) StopTiKV(ctx context.Context, logger *log.Entry, node *Node) error {
+	pod, err := b.client.GetPod(ctx, b.k.Namespace, node.Host)
+	if err != nil {
+		return err
+	}
+	container := pod.Container(tikvContainer)
+	if container == nil {
+		return fmt.Errorf("no %s container in pod %s", tikvContainer, node.Host)
+	}
+	restarts := container.RestartCount
+
+	if err = b.patchPod(ctx, logger, node.Host, runModePatch(kube.RunModeDebug)); err != nil {
+		return err
+	}
+
+	// TiKV killed before the kubelet updates the downward API file would be
+	// started again by the start script in the normal mode.
+	err = b.poll(ctx, fmt.Sprintf("pod %s to see the debug run mode", node.Host), func() (bool, error) {
+		cmd := b.exec.Command(ctx, b.k.Namespace, node.Host, tikvContainer, "cat", kube.PodInfoAnnotations)
+		out, err := cmd.Output()
+		if err != nil {
+			logger.WithError(err).Debugf("Failed to read %s", kube.PodInfoAnnotations)
+			return false, nil
+		}
+		return kube.ParsePodInfo(out)[kube.AnnotationRunMode] == kube.RunModeDebug, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The exec session dies with TiKV, so the result is told by the restart.
+	cmd := b.exec.Command(ctx, b.k.Namespace, node.Host, tikvContainer, "kill", "-SIGTERM", "1")
+	if _, err = b.run.Run(logger, node.Host, cmd); err != nil {
+		logger.WithError(err).Warn("kill exits abnormally, waiting for the container to restart")
+	}
+
+	return b.poll(ctx, fmt.Sprintf("pod %s to restart in debug mode", node.Host), func() (bool, error) {
+		pod, err := b.client.GetPod(ctx, b.k.Namespace, node.Host)
+		if err != nil {
+			return false, err
+		}
+		container := pod.Container(tikvContainer)
+		return container != nil && container.RestartCount > restarts && container.State.Running != nil, nil
+	})
+}
+
+func (b *kubeBackend) TiKVCtl(ctx context.Context, node *Node, args ...string) *exec.Cmd {
+	argv := append([]string{b.k.TiKVCtl, "--db", fmt.Sprintf("%s/db", node.DataDir)}, args...)
+	return b.exec.Command(ctx, b.k.Namespace, node.Host, tikvContainer, argv...)
+}
+
+// waitReady waits for the replicas of the component to be ready.
+func (b *kubeBackend) waitReady(ctx context.Context, logger *log.Entry, component string, replicas int) error {
+	logger.Infof("Waiting for %d %s pods to be ready", replicas, component)
+	return b.poll(ctx, fmt.Sprintf("%d %s pods to be ready", replicas, component), func() (bool, error) {
+		pods, err := b.client.ListPods(ctx, b.k.Namespace, b.selector(component))
+		if err != nil {
+			return false, err
+		}
+		ready := 0
+		for _, pod := range pods {
+			if pod.Ready() {
+				ready++
+			}
+		}
+		return ready >= replicas, nil
+	})
+}
+
+// restartPods deletes the named pods of the component, all of them if
+// names is nil, and waits for the operator to recreate them.
+func (b *kubeBackend) restartPods(ctx context.Context, logger *log.Entry, component string, names []string) error {
+	pods, err := b.client.ListPods(ctx, b.k.Namespace, b.selector(component))
+	if err != nil {
+		return err
+	}
+	restart := make(map[string]bool)
+	for _, name := range names {
+		restart[name] = true
+	}
+
+	// The recreated pods keep their names but not their UIDs.
+	deleted := make(map[string]string)
+	for _, pod := range pods {
+		name := pod.Metadata.Name
+		if names != nil && !restart[name] {
+			continue
+		}
+		if err = b.deletePod(ctx, logger.WithField(common.FieldHost, name), name); err != nil {
+			return err
+		}
+		deleted[name] = pod.Metadata.UID
+	}
+
+	logger.Infof("Waiting for %d %s pods to be recreated", len(deleted), component)
+	return b.poll(ctx, fmt.Sprintf("%d %s pods to be recreated", len(deleted), component), func() (bool, error) {
+		for name, uid := range deleted {
+			pod, err := b.client.GetPod(ctx, b.k.Namespace, name)
+			if kube.IsNotFound(err) {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			if pod.Metadata.UID == uid || !pod.Ready() {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+}
+
+// RebuildPD deploys the PD of the TidbCluster, recovers it with a
+// pd-recover job and restarts it.
+func (b *kubeBackend) RebuildPD(ctx context.Context) error {
+	c := b.config
+	tc := b.k.TidbCluster
+
+	logger := stepLog(StepRebuildPD).WithField(common.FieldHost, tc)
+	logger.Info("Rebuilding PD server")
+
+	// The PD of the failed cluster is dropped in favor of a new one.
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"version":     c.ClusterVersion,
+			"pdAddresses": nil,
+			"pd": map[string]interface{}{
+				"baseImage": b.k.PDImage,
+				"replicas":  b.k.PDReplicas,
+				"requests":  map[string]interface{}{"storage": b.k.PDStorage},
+			},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	err = b.call(logger, tc, []string{"patch", "tidbcluster", b.k.Namespace + "/" + tc, string(data)}, func() error {
+		return b.client.PatchTidbCluster(ctx, b.k.Namespace, tc, patch)
+	})
+	if err != nil {
+		return err
+	}
+	if err = b.waitReady(ctx, logger, kube.ComponentPD, b.k.PDReplicas); err != nil {
+		return err
+	}
+
+	if err = b.recoverPD(ctx, logger); err != nil {
+		return err
+	}
+
+	logger.Info("Restarting PD server")
+	return b.restartPods(ctx, logger, kube.ComponentPD, nil)
+}
+
+// recoverPD runs pd-recover in a job, a job left by a former run is
+// replaced.
+func (b *kubeBackend) recoverPD(ctx context.Context, logger *log.Entry) error {
+	c := b.config
+	ns, name := b.k.Namespace, b.k.TidbCluster+"-pd-recover"
+
+	labels := map[string]string{
+		kube.LabelInstance:  b.k.TidbCluster,
+		kube.LabelComponent: "pd-recover",
+	}
+	image := fmt.Sprintf("%s:%s", b.k.PDImage, c.ClusterVersion)
+	job := kube.NewJob(ns, name, labels, image,
+		"/pd-recover",
+		"-endpoints", fmt.Sprintf("http://%s-pd:%v", b.k.TidbCluster, pdClientPort),
+		"-cluster-id", c.RecoverInfoFile.ClusterID,
+		"-alloc-id", fmt.Sprintf("%v", c.RecoverInfoFile.AllocID))
+
+	err := b.call(logger, name, []string{"delete", "job", ns + "/" + name}, func() error {
+		if err := b.client.DeleteJob(ctx, ns, name); err != nil && !kube.IsNotFound(err) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	argv := append([]string{"create", "job", ns + "/" + name, image}, job.Spec.Template.Spec.Containers[0].Command...)
+	if err = b.call(logger, name, argv, func() error { return b.client.CreateJob(ctx, ns, job) }); err != nil {
+		return err
+	}
+
+	logger.WithField("job", name).Info("Waiting for pd-recover")
+	return b.poll(ctx, fmt.Sprintf("job %s to complete", name), func() (bool, error) {
+		job, err := b.client.GetJob(ctx, ns, name)
+		if err != nil {
+			return false, err
+		}
+		if job.Status.Failed > 0 {
+			return false, fmt.Errorf("job %s failed, check the logs of its pod", name)
+		}
+		return job.Status.Succeeded > 0, nil
+	})
+}
+
+// Join leaves the debug run mode and restarts the learner pods, TiKV is
+// scaled out if required.
+func (b *kubeBackend) Join(ctx context.Context) error {
+	c := b.config
+	logger := stepLog(StepJoin)
+	logger.Info("Joining the TiKV servers")
+
+	var names []string
+	for _, node := range c.Nodes {
+		if err := b.patchPod(ctx, logger.WithField(common.FieldHost, node.Host), node.Host, runModePatch(nil)); err != nil {
+			return err
+		}
+		names = append(names, node.Host)
+	}
+	if err := b.restartPods(ctx, logger, kube.ComponentTiKV, names); err != nil {
+		return err
+	}
+
+	if b.k.TiKVReplicas == 0 {
+		return nil
+	}
+	tc := b.k.TidbCluster
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"tikv": map[string]interface{}{"replicas": b.k.TiKVReplicas},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	err = b.call(logger, tc, []string{"patch", "tidbcluster", b.k.Namespace + "/" + tc, string(data)}, func() error {
+		return b.client.PatchTidbCluster(ctx, b.k.Namespace, tc, patch)
+	})
+	if err != nil {
+		return err
+	}
+	return b.waitReady(ctx, logger, kube.ComponentTiKV, b.k.TiKVReplicas)
+}
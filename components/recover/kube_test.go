@@ -0,0 +1,377 @@
+package recover
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/components/kube"
+	"github.com/iosmanthus/learner-recover/components/kube/kubefake"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	testNamespace = "tidb"
+	testCluster   = "backup"
+)
+
+// fakeRunner records the operations instead of auditing them.
+type fakeRunner struct {
+	mu   sync.Mutex
+	argv []string
+}
+
+func (r *fakeRunner) Run(logger *log.Entry, host string, cmd *exec.Cmd) (string, error) {
+	finish, _ := r.Begin(logger, host, cmd.Args)
+	out, err := cmd.CombinedOutput()
+	return string(out), finish(out, err)
+}
+
+func (r *fakeRunner) Begin(_ *log.Entry, host string, argv []string) (func([]byte, error) error, error) {
+	return func(_ []byte, err error) error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.argv = append(r.argv, host+": "+strings.Join(argv, " "))
+		return err
+	}, nil
+}
+
+func (r *fakeRunner) contains(s string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, argv := range r.argv {
+		if strings.Contains(argv, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeExecutor runs nothing but restarts the container killed in the fake
+// API server and serves the downward API file of the annotations, like the
+// kubelet does.
+type fakeExecutor struct {
+	server *kubefake.Server
+	mu     sync.Mutex
+	argv   [][]string
+	// stale is the number of reads of the downward API file before the
+	// kubelet updates it, it's never updated if negative.
+	stale int
+	// frozen keeps the killed container from restarting.
+	frozen bool
+}
+
+func (e *fakeExecutor) Command(ctx context.Context, namespace, pod, container string, argv ...string) *exec.Cmd {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.argv = append(e.argv, append([]string{pod, container}, argv...))
+
+	switch {
+	case argv[0] == "kill" && !e.frozen:
+		e.server.Update(kubefake.PodPath(namespace, pod), func(obj map[string]interface{}) {
+			status := obj["status"].(map[string]interface{})
+			c := status["containerStatuses"].([]interface{})[0].(map[string]interface{})
+			c["restartCount"] = c["restartCount"].(float64) + 1
+		})
+	case argv[0] == "cat" && argv[1] == kube.PodInfoAnnotations:
+		info := ""
+		if e.stale == 0 {
+			p := &kube.Pod{}
+			e.server.Get(kubefake.PodPath(namespace, pod), p)
+			for k, v := range p.Metadata.Annotations {
+				info += fmt.Sprintf("%s=%q\n", k, v)
+			}
+		} else if e.stale > 0 {
+			e.stale--
+		}
+		return exec.CommandContext(ctx, "printf", "%s", info)
+	}
+	return exec.CommandContext(ctx, "true", argv...)
+}
+
+// commands returns the commands run in the containers.
+func (e *fakeExecutor) commands() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var commands []string
+	for _, argv := range e.argv {
+		commands = append(commands, strings.Join(argv, " "))
+	}
+	return commands
+}
+
+var uids = 0
+
+func putPod(server *kubefake.Server, name, component, node string) {
+	uids++
+	server.Put(kubefake.PodPath(testNamespace, name), fmt.Sprintf(`{
+		"metadata": {
+			"name": %q, "namespace": %q, "uid": "uid-%d",
+			"labels": {%q: %q, %q: %q}
+		},
+		"spec": {"nodeName": %q},
+		"status": {
+			"conditions": [{"type": "Ready", "status": "True"}],
+			"containerStatuses": [{"name": %q, "ready": true, "restartCount": 0, "state": {"running": {}}}]
+		}
+	}`, name, testNamespace, uids, kube.LabelInstance, testCluster, kube.LabelComponent, component, node, component))
+}
+
+// newFakeCluster serves a TidbCluster with TiKV pods in the zones backup and
+// primary, TiDB Operator is simulated by the hook.
+func newFakeCluster(t *testing.T) *kubefake.Server {
+	server := kubefake.NewServer()
+	t.Cleanup(server.Close)
+
+	server.Put(kubefake.NodePath("node-a"), `{"metadata": {"name": "node-a", "labels": {"topology.kubernetes.io/zone": "backup"}}}`)
+	server.Put(kubefake.NodePath("node-b"), `{"metadata": {"name": "node-b", "labels": {"topology.kubernetes.io/zone": "primary"}}}`)
+	putPod(server, "backup-tikv-0", kube.ComponentTiKV, "node-a")
+	putPod(server, "backup-tikv-1", kube.ComponentTiKV, "node-a")
+	putPod(server, "backup-tikv-2", kube.ComponentTiKV, "node-b")
+	server.Put(kubefake.TidbClusterPath(testNamespace, testCluster),
+		`{"metadata": {"name": "backup"}, "spec": {"version": "v5.0.0", "pdAddresses": ["http://primary-pd:2379"]}}`)
+
+	server.Hook = func(method, path string) {
+		switch {
+		case method == "PATCH" && strings.Contains(path, "/tidbclusters/"):
+			for i := 0; i < 3; i++ {
+				putPod(server, fmt.Sprintf("backup-pd-%d", i), kube.ComponentPD, "node-a")
+			}
+		case method == "POST" && strings.HasSuffix(path, "/jobs"):
+			server.Update(kubefake.JobPath(testNamespace, "backup-pd-recover"), func(obj map[string]interface{}) {
+				obj["status"] = map[string]interface{}{"succeeded": 1}
+			})
+		case method == "DELETE" && strings.Contains(path, "/pods/"):
+			// The StatefulSet recreates the pod.
+			name := path[strings.LastIndex(path, "/")+1:]
+			component := kube.ComponentTiKV
+			if strings.Contains(name, "-pd-") {
+				component = kube.ComponentPD
+			}
+			putPod(server, name, component, "node-a")
+		}
+	}
+	return server
+}
+
+func newTestKubeBackend(t *testing.T, server *kubefake.Server) (*kubeBackend, *fakeRunner, *fakeExecutor) {
+	groups, err := common.NewLearnerGroups(nil, map[string]interface{}{
+		"backup": "topology.kubernetes.io/zone = backup",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{
+		Backend:         BackendKubernetes,
+		ClusterVersion:  "v5.1.0",
+		ClusterName:     testCluster,
+		LearnerGroups:   groups,
+		RecoverFrom:     []string{"backup"},
+		RecoverInfoFile: &common.RecoverInfo{ClusterID: "6990", AllocID: 4000},
+		Kubernetes: &KubernetesConfig{
+			Client:      kube.Config{Server: server.URL},
+			Namespace:   testNamespace,
+			TidbCluster: testCluster,
+			TiKVCtl:     "/tikv-ctl",
+			DataDir:     "/var/lib/tikv",
+			PDImage:     "pingcap/pd",
+			PDReplicas:  3,
+			PDStorage:   "1Gi",
+			Timeout:     5 * time.Second,
+		},
+	}
+
+	run := &fakeRunner{}
+	b, err := newKubeBackend(c, run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	executor := &fakeExecutor{server: server}
+	b.exec, b.interval = executor, 10*time.Millisecond
+	return b, run, executor
+}
+
+func TestKubeDiscover(t *testing.T) {
+	server := newFakeCluster(t)
+	b, _, _ := newTestKubeBackend(t, server)
+
+	if err := b.Discover(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c := b.config
+	if len(c.Nodes) != 2 || c.Nodes[0].Host != "backup-tikv-0" || c.Nodes[1].Host != "backup-tikv-1" {
+		t.Fatalf("unexpected nodes %+v", c.Nodes)
+	}
+	if len(c.Groups) != 1 || len(c.Groups[0].Nodes) != 2 {
+		t.Fatalf("unexpected groups %+v", c.Groups)
+	}
+
+	b.TiKVCtl(context.Background(), c.Nodes[0], "raft", "region", "--all-regions")
+	expect := "backup-tikv-0 tikv /tikv-ctl --db /var/lib/tikv/db raft region --all-regions"
+	if got := strings.Join(b.exec.(*fakeExecutor).argv[0], " "); got != expect {
+		t.Fatalf("expect %q, got %q", expect, got)
+	}
+}
+
+func TestKubeDiscoverNoLearners(t *testing.T) {
+	server := newFakeCluster(t)
+	server.Delete(kubefake.PodPath(testNamespace, "backup-tikv-0"))
+	server.Delete(kubefake.PodPath(testNamespace, "backup-tikv-1"))
+	b, _, _ := newTestKubeBackend(t, server)
+
+	err := b.Discover(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "backup") {
+		t.Fatalf("expect an error about the backup group, got %v", err)
+	}
+}
+
+func TestKubeStopTiKV(t *testing.T) {
+	server := newFakeCluster(t)
+	b, run, executor := newTestKubeBackend(t, server)
+	executor.stale = 2
+
+	node := &Node{Host: "backup-tikv-0", DataDir: "/var/lib/tikv"}
+	if err := b.StopTiKV(context.Background(), log.NewEntry(log.StandardLogger()), node); err != nil {
+		t.Fatal(err)
+	}
+
+	pod := &kube.Pod{}
+	server.Get(kubefake.PodPath(testNamespace, "backup-tikv-0"), pod)
+	if pod.Metadata.Annotations[kube.AnnotationRunMode] != kube.RunModeDebug {
+		t.Fatalf("pod is not in debug mode: %+v", pod.Metadata)
+	}
+	if pod.Container("tikv").RestartCount != 1 {
+		t.Fatalf("container is not restarted: %+v", pod.Status)
+	}
+	// TiKV is killed after the kubelet updates the run mode of the pod.
+	read := "backup-tikv-0 tikv cat " + kube.PodInfoAnnotations
+	expect := []string{read, read, read, "backup-tikv-0 tikv kill -SIGTERM 1"}
+	if got := executor.commands(); strings.Join(got, "\n") != strings.Join(expect, "\n") {
+		t.Fatalf("unexpected commands %q", got)
+	}
+	if !run.contains("kube patch pod tidb/backup-tikv-0") {
+		t.Fatalf("patch is not recorded: %v", run.argv)
+	}
+}
+
+func TestKubeStopTiKVTimeout(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		stale  int
+		frozen bool
+		killed bool
+	}{
+		{name: "stale run mode", stale: -1},
+		{name: "no restart", frozen: true, killed: true},
+	} {
+		server := newFakeCluster(t)
+		b, _, executor := newTestKubeBackend(t, server)
+		b.k.Timeout = 50 * time.Millisecond
+		executor.stale, executor.frozen = c.stale, c.frozen
+
+		node := &Node{Host: "backup-tikv-0", DataDir: "/var/lib/tikv"}
+		err := b.StopTiKV(context.Background(), log.NewEntry(log.StandardLogger()), node)
+		if err == nil || !strings.Contains(err.Error(), "timeout") {
+			t.Fatalf("%s: expect timeout, got %v", c.name, err)
+		}
+		commands := executor.commands()
+		if killed := strings.Contains(commands[len(commands)-1], "kill"); killed != c.killed {
+			t.Fatalf("%s: unexpected commands %q", c.name, commands)
+		}
+	}
+}
+
+func TestKubeRebuildPD(t *testing.T) {
+	server := newFakeCluster(t)
+	b, run, _ := newTestKubeBackend(t, server)
+
+	if err := b.RebuildPD(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tc := &struct {
+		Spec map[string]interface{} `json:"spec"`
+	}{}
+	server.Get(kubefake.TidbClusterPath(testNamespace, testCluster), tc)
+	if tc.Spec["version"] != "v5.1.0" {
+		t.Fatalf("version is not patched: %+v", tc.Spec)
+	}
+	if _, ok := tc.Spec["pdAddresses"]; ok {
+		t.Fatalf("pdAddresses is not removed: %+v", tc.Spec)
+	}
+	pd := tc.Spec["pd"].(map[string]interface{})
+	if pd["replicas"] != float64(3) || pd["baseImage"] != "pingcap/pd" {
+		t.Fatalf("unexpected pd spec %+v", pd)
+	}
+
+	job := &kube.Job{}
+	if !server.Get(kubefake.JobPath(testNamespace, "backup-pd-recover"), job) {
+		t.Fatal("pd-recover job is not created")
+	}
+	container := job.Spec.Template.Spec.Containers[0]
+	expect := "/pd-recover -endpoints http://backup-pd:2379 -cluster-id 6990 -alloc-id 4000"
+	if got := strings.Join(container.Command, " "); got != expect || container.Image != "pingcap/pd:v5.1.0" {
+		t.Fatalf("unexpected job container %+v", container)
+	}
+
+	// The PD pods are restarted after pd-recover.
+	deleted := 0
+	for _, req := range server.Requests() {
+		if req.Method == "DELETE" && strings.Contains(req.Path, "/pods/backup-pd-") {
+			deleted++
+		}
+	}
+	if deleted != 3 {
+		t.Fatalf("expect 3 PD pods restarted, got %d", deleted)
+	}
+	if !run.contains("kube create job tidb/backup-pd-recover") {
+		t.Fatalf("job is not recorded: %v", run.argv)
+	}
+}
+
+func TestKubeJoin(t *testing.T) {
+	server := newFakeCluster(t)
+	b, _, _ := newTestKubeBackend(t, server)
+	b.k.TiKVReplicas = 3
+	ctx := context.Background()
+
+	if err := b.Discover(ctx); err != nil {
+		t.Fatal(err)
+	}
+	logger := log.NewEntry(log.StandardLogger())
+	for _, node := range b.config.Nodes {
+		if err := b.StopTiKV(ctx, logger, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Join(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"backup-tikv-0", "backup-tikv-1"} {
+		pod := &kube.Pod{}
+		server.Get(kubefake.PodPath(testNamespace, name), pod)
+		if _, ok := pod.Metadata.Annotations[kube.AnnotationRunMode]; ok {
+			t.Fatalf("pod %s is still in debug mode", name)
+		}
+	}
+
+	tc := &struct {
+		Spec struct {
+			TiKV struct {
+				Replicas int `json:"replicas"`
+			} `json:"tikv"`
+		} `json:"spec"`
+	}{}
+	server.Get(kubefake.TidbClusterPath(testNamespace, testCluster), tc)
+	if tc.Spec.TiKV.Replicas != 3 {
+		t.Fatalf("TiKV is not scaled out: %+v", tc.Spec)
+	}
+}
@@ -0,0 +1,190 @@
+package recover
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/components/key"
+	"github.com/iosmanthus/learner-recover/components/rpo"
+)
+
+// RegionLoss is the committed data of a region the learners are likely to
+// miss, measured in raft entries and in time.
+type RegionLoss struct {
+	RegionID common.RegionId
+	StartKey string
+	EndKey   string
+	Host     string
+	Group    string
+	// LearnerIndex is the applied index kept on the learner, VoterIndex the
+	// applied index the voters reached at the failure.
+	LearnerIndex uint64
+	VoterIndex   uint64
+	Entries      uint64
+	// Since is when the voters were last seen at the learner index, the
+	// writes committed from then on until the failure may be lost.
+	Since  time.Time
+	Window time.Duration
+}
+
+// LossEstimate is the data likely lost by recovering from the learners at
+// the failure time, derived from the apply history of the rpo command.
+type LossEstimate struct {
+	FailureTime time.Time
+	// Regions are the regions with lost entries, the largest window first.
+	Regions     []*RegionLoss
+	Examined    int
+	LostEntries uint64
+	MaxWindow   time.Duration
+	// Unknown counts the regions without voter history before the failure.
+	Unknown    int
+	SafePoints []*rpo.SafePoint
+}
+
+// Since returns the start of the overall loss window, zero if nothing is lost.
+func (e *LossEstimate) Since() time.Time {
+	if len(e.Regions) == 0 {
+		return time.Time{}
+	}
+	return e.FailureTime.Add(-e.MaxWindow)
+}
+
+// lastVoterTime returns when the voters were last observed, the default
+// failure time.
+func lastVoterTime(history *rpo.ApplyHistory) time.Time {
+	var last time.Time
+	for _, states := range history.History {
+		if n := len(states); n > 0 && states[n-1].ApplyState.Timestamp.After(last) {
+			last = states[n-1].ApplyState.Timestamp
+		}
+	}
+	return last
+}
+
+// EstimateLoss compares the regions kept on the learners with the voter
+// history at the failure time. A zero failure time stands for the last
+// observation of the voters.
+func EstimateLoss(history *rpo.ApplyHistory, kept []*common.RegionState, groups []string, failure time.Time) *LossEstimate {
+	if failure.IsZero() {
+		failure = lastVoterTime(history)
+	}
+	e := &LossEstimate{FailureTime: failure, Examined: len(kept)}
+
+	for _, state := range kept {
+		learnerIndex := state.ApplyState.AppliedIndex
+		// The voters are last seen at or below the learner index by base, the
+		// writes since then may be lost. An entry holds the latest sighting
+		// of its index.
+		var voter, base *common.RegionState
+		for _, s := range history.History[state.RegionId] {
+			if s.ApplyState.Timestamp.After(failure) {
+				break
+			}
+			voter = s
+			if s.ApplyState.AppliedIndex <= learnerIndex {
+				base = s
+			}
+		}
+		if voter == nil {
+			e.Unknown++
+			continue
+		}
+
+		if voter.ApplyState.AppliedIndex <= learnerIndex {
+			continue
+		}
+
+		// Ahead of the history kept, the voters may pass it since the birth.
+		since := history.Birth
+		if base != nil {
+			since = base.ApplyState.Timestamp
+		}
+		window := failure.Sub(since)
+		if window < 0 {
+			window = 0
+		}
+		loss := &RegionLoss{
+			RegionID:     state.RegionId,
+			StartKey:     state.LocalState.Region.StartKey,
+			EndKey:       state.LocalState.Region.EndKey,
+			Host:         state.Host,
+			Group:        state.Group,
+			LearnerIndex: learnerIndex,
+			VoterIndex:   voter.ApplyState.AppliedIndex,
+			Entries:      voter.ApplyState.AppliedIndex - learnerIndex,
+			Since:        since,
+			Window:       window,
+		}
+		e.Regions = append(e.Regions, loss)
+		e.LostEntries += loss.Entries
+		if window > e.MaxWindow {
+			e.MaxWindow = window
+		}
+	}
+	sort.Slice(e.Regions, func(i, j int) bool {
+		a, b := e.Regions[i], e.Regions[j]
+		if a.Window != b.Window {
+			return a.Window > b.Window
+		}
+		return a.RegionID < b.RegionID
+	})
+
+	for _, group := range groups {
+		if point := history.SafePointAt(group, failure); point != nil {
+			e.SafePoints = append(e.SafePoints, point)
+		}
+	}
+	return e
+}
+
+// Print writes the overall estimate and the worst regions.
+func (e *LossEstimate) Print(w io.Writer, top int) {
+	fmt.Fprintf(w, "Estimated data loss at the failure time %s:\n", e.FailureTime.Format(time.RFC3339))
+	fmt.Fprintf(w, "  %d of %d regions miss %d committed raft entries", len(e.Regions), e.Examined, e.LostEntries)
+	if len(e.Regions) > 0 {
+		fmt.Fprintf(w, ", writes since %s (%s) may be lost", e.Since().Format(time.RFC3339), e.MaxWindow.Round(time.Millisecond))
+	}
+	fmt.Fprintln(w)
+	if e.Unknown > 0 {
+		fmt.Fprintf(w, "  %d regions have no voter history before the failure, their loss is unknown\n", e.Unknown)
+	}
+	for _, point := range e.SafePoints {
+		fmt.Fprintf(w, "  learner group %s was safe up to %s (lag upper bound %s)\n",
+			point.Group, point.SafeTime.Format(time.RFC3339), point.LagUpper)
+	}
+
+	if len(e.Regions) == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  REGION\tDATA\tHOST\tGROUP\tLEARNER INDEX\tVOTER INDEX\tLOST ENTRIES\tWINDOW")
+	for i, r := range e.Regions {
+		if i == top {
+			fmt.Fprintf(tw, "  ... %d more regions\n", len(e.Regions)-top)
+			break
+		}
+		fmt.Fprintf(tw, "  %v\t%s\t%s\t%s\t%v\t%v\t%v\t%s\n",
+			r.RegionID, key.DescribeRange(r.StartKey, r.EndKey), r.Host, r.Group, r.LearnerIndex, r.VoterIndex, r.Entries, r.Window.Round(time.Millisecond))
+	}
+	tw.Flush()
+}
+
+// confirm asks the operator to type yes.
+func confirm(in io.Reader, out io.Writer, prompt string) error {
+	fmt.Fprintf(out, "%s [yes/no]: ", prompt)
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if strings.TrimSpace(strings.ToLower(answer)) != "yes" {
+		return errors.New("promotion is not confirmed, rerun with --yes to skip the confirmation")
+	}
+	return nil
+}
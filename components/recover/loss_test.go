@@ -0,0 +1,153 @@
+package recover
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/components/rpo"
+)
+
+var lossEpoch = time.Unix(1600000000, 0)
+
+// voterAt returns the voter state of the region sampled at lossEpoch+sec.
+func voterAt(id common.RegionId, index uint64, sec int) *common.RegionInfos {
+	state := testRegion(id, "voter", "", "", 1, index)
+	state.ApplyState.Timestamp = lossEpoch.Add(time.Duration(sec) * time.Second)
+	return testInfos(state)
+}
+
+// voterHistory samples region 1 reaching 10, 20 and 30 at 1s, 5s and 9s,
+// seen at every index for another second.
+func voterHistory(h *rpo.ApplyHistory) {
+	h.Birth = lossEpoch
+	for _, sample := range []struct {
+		index uint64
+		sec   int
+	}{{10, 1}, {10, 2}, {20, 5}, {20, 6}, {30, 9}, {30, 10}} {
+		h.Update(voterAt(1, sample.index, sample.sec))
+	}
+}
+
+func TestEstimateLoss(t *testing.T) {
+	h := rpo.NewApplyHistory()
+	voterHistory(h)
+	failure := lossEpoch.Add(12 * time.Second)
+
+	for _, c := range []struct {
+		name    string
+		index   uint64
+		entries uint64
+		// since is the start of the loss window in seconds, negative if
+		// nothing is lost.
+		since int
+	}{
+		// Behind the voters, the writes since they were last seen at 10.
+		{"between", 15, 15, 2},
+		{"behind", 10, 20, 2},
+		// Passed by the voters right after they are last seen at 20.
+		{"one behind", 20, 10, 6},
+		{"equal", 30, 0, -1},
+		{"ahead", 35, 0, -1},
+		// Behind the whole history, since the birth of the history.
+		{"before history", 5, 25, 0},
+	} {
+		e := EstimateLoss(h, []*common.RegionState{testRegion(1, "a", "", "", 1, c.index)}, nil, failure)
+		if c.since < 0 {
+			if len(e.Regions) != 0 || e.LostEntries != 0 || !e.Since().IsZero() {
+				t.Fatalf("%s: unexpected loss %+v", c.name, e.Regions[0])
+			}
+			continue
+		}
+		if len(e.Regions) != 1 {
+			t.Fatalf("%s: unexpected loss %+v", c.name, e)
+		}
+		since := lossEpoch.Add(time.Duration(c.since) * time.Second)
+		if r := e.Regions[0]; r.Entries != c.entries || r.VoterIndex != 30 || !r.Since.Equal(since) || r.Window != failure.Sub(since) {
+			t.Fatalf("%s: unexpected loss %+v", c.name, r)
+		}
+		if !e.Since().Equal(since) {
+			t.Fatalf("%s: unexpected loss window since %v", c.name, e.Since())
+		}
+	}
+
+	// At an earlier failure the voters only reached 20.
+	e := EstimateLoss(h, []*common.RegionState{testRegion(1, "a", "", "", 1, 10)}, nil, lossEpoch.Add(7*time.Second))
+	if len(e.Regions) != 1 || e.Regions[0].VoterIndex != 20 || e.Regions[0].Window != 5*time.Second {
+		t.Fatalf("unexpected loss at the earlier failure %+v", e.Regions)
+	}
+
+	// The failure defaults to the last observation of the voters.
+	e = EstimateLoss(h, []*common.RegionState{testRegion(1, "a", "", "", 1, 20), testRegion(2, "a", "", "", 1, 7)}, nil, time.Time{})
+	if !e.FailureTime.Equal(lossEpoch.Add(10*time.Second)) || e.Unknown != 1 || e.Examined != 2 || e.Regions[0].Window != 4*time.Second {
+		t.Fatalf("unexpected estimate %+v", e)
+	}
+}
+
+func TestEstimateLossEmptyHistory(t *testing.T) {
+	kept := []*common.RegionState{testRegion(1, "a", "", "", 1, 10), testRegion(2, "a", "", "", 1, 10)}
+	e := EstimateLoss(rpo.NewApplyHistory(), kept, []string{"backup"}, time.Time{})
+	if len(e.Regions) != 0 || e.Unknown != 2 || len(e.SafePoints) != 0 {
+		t.Fatalf("unexpected estimate %+v", e)
+	}
+
+	out := &bytes.Buffer{}
+	e.Print(out, 10)
+	if !strings.Contains(out.String(), "2 regions have no voter history") {
+		t.Fatalf("unexpected output %s", out)
+	}
+}
+
+func TestConfirmLoss(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "history")
+	h, err := rpo.OpenApplyHistory(dir, []string{"backup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	voterHistory(h)
+	h.AddSafePoint(&rpo.SafePoint{Group: "backup", Timestamp: lossEpoch.Add(8 * time.Second), SafeTime: lossEpoch.Add(6 * time.Second)}, time.Hour)
+	if err = h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		RPOHistory:    dir,
+		LearnerGroups: []*common.LearnerGroup{{Name: "backup"}, {Name: "standby"}},
+	}
+	kept := []*common.RegionState{testRegion(1, "a", "", "", 1, 20)}
+	for _, c := range []struct {
+		answer    string
+		assumeYes bool
+		ok        bool
+	}{
+		{"yes\n", false, true},
+		{" YES ", false, true},
+		{"no\n", false, false},
+		{"", false, false},
+		{"", true, true},
+	} {
+		config.AssumeYes = c.assumeYes
+		r := &ClusterRescuer{config: config, report: &Report{}}
+		out := &bytes.Buffer{}
+		err := r.confirmLoss(strings.NewReader(c.answer), out, kept, []string{"backup"})
+		if (err == nil) != c.ok {
+			t.Fatalf("answer %q: unexpected result %v", c.answer, err)
+		}
+		if r.report.Loss == nil || r.report.Loss.LostEntries != 10 {
+			t.Fatalf("answer %q: the loss is not reported %+v", c.answer, r.report.Loss)
+		}
+		if got := out.String(); !strings.Contains(got, "learner group backup was safe up to") ||
+			strings.Contains(got, "[yes/no]") == c.assumeYes {
+			t.Fatalf("answer %q: unexpected output %s", c.answer, got)
+		}
+	}
+
+	config.RPOHistory = filepath.Join(dir, "missing")
+	r := &ClusterRescuer{config: config}
+	if err = r.confirmLoss(strings.NewReader("yes\n"), &bytes.Buffer{}, kept, nil); err == nil || !strings.Contains(err.Error(), "rpo-history") {
+		t.Fatalf("expect the missing history reported, got %v", err)
+	}
+}
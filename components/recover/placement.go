@@ -0,0 +1,243 @@
+package recover
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/iosmanthus/learner-recover/common"
+
+	"gopkg.in/resty.v1"
+)
+
+// StepPlacement replays the replication settings of the old PD.
+const StepPlacement = "replay-placement"
+
+// Placement is the replication settings of the old PD rewritten for the
+// learner groups recovered from, replayed into the rebuilt PD.
+type Placement struct {
+	Replication *common.ReplicationConfig
+	Rules       []*common.PlacementRule
+	Mode        *common.ReplicationMode
+	// Changes tell how the settings are rewritten.
+	Changes []string
+	// Error is the first request refused by the rebuilt PD.
+	Error string
+}
+
+// rewritePlacement places the voters of the old settings on the nodes
+// recovered from, the rest of the cluster is gone:
+//
+//   - The voter rules matching none of the nodes are moved to them by
+//     rewriting their label constraints.
+//   - The learner rules are dropped, their stores are either promoted to
+//     voters or gone.
+//   - The isolation levels no longer satisfiable are dropped.
+//   - The max-replicas and the counts of the voter rules are clamped to the
+//     nodes able to hold the replicas.
+//   - The data center recovered from becomes the primary of dr-auto-sync, the
+//     majority mode is replayed until a new DR data center is built.
+func rewritePlacement(info *common.RecoverInfo, nodes []*Node) *Placement {
+	p := &Placement{}
+	changef := func(format string, args ...interface{}) {
+		p.Changes = append(p.Changes, fmt.Sprintf(format, args...))
+	}
+
+	if r := info.Replication; r != nil {
+		replication := *r
+		if level := replication.IsolationLevel; level != "" && len(labelValues(nodes, level)) < 2 {
+			changef("isolation-level %s dropped, the nodes recovered from share one %s", level, level)
+			replication.IsolationLevel = ""
+		}
+		if n := uint64(len(nodes)); n > 0 && replication.MaxReplicas > n {
+			changef("max-replicas clamped from %d to %d, the nodes recovered from", replication.MaxReplicas, n)
+			replication.MaxReplicas = n
+		}
+		p.Replication = &replication
+	}
+
+	if info.Replication.PlacementEnabled() {
+		for _, r := range info.PlacementRules {
+			rule := *r
+			switch {
+			case !rule.IsVoter():
+				changef("rule %s of %d learners dropped", &rule, rule.Count)
+				continue
+			case !matchesAny(&rule, nodes):
+				old := describeConstraints(rule.LabelConstraints)
+				rule.LabelConstraints = retarget(rule.LabelConstraints, nodes)
+				changef("rule %s of %d %ss moved from %s to %s", &rule, rule.Count, rule.Role, old, describeConstraints(rule.LabelConstraints))
+			}
+			if level := rule.IsolationLevel; level != "" && len(labelValues(nodes, level)) < 2 {
+				changef("isolation level %s of rule %s dropped", level, &rule)
+				rule.IsolationLevel = ""
+			}
+			if n := countMatches(&rule, nodes); n > 0 && rule.Count > n {
+				changef("rule %s clamped from %d to %d %ss, the nodes it matches", &rule, rule.Count, n, rule.Role)
+				rule.Count = n
+			}
+			p.Rules = append(p.Rules, &rule)
+		}
+	}
+
+	if m := info.ReplicationMode; m != nil {
+		mode := *m
+		if sync := m.DRAutoSync; sync != nil && sync.LabelKey != "" {
+			dr := *sync
+			if values := labelValues(nodes, sync.LabelKey); len(values) == 1 && values[0] == sync.DR {
+				dr.Primary, dr.DR = sync.DR, sync.Primary
+				dr.PrimaryReplicas, dr.DRReplicas = sync.DRReplicas, sync.PrimaryReplicas
+				changef("dr-auto-sync primary switched from %s to %s", sync.Primary, dr.Primary)
+			}
+			mode.DRAutoSync = &dr
+		}
+		if mode.Mode == common.ModeDRAutoSync {
+			changef("replication mode switched from %s to %s", mode.Mode, common.ModeMajority)
+			mode.Mode = common.ModeMajority
+		}
+		p.Mode = &mode
+	}
+	return p
+}
+
+// labelValues returns the distinct values of the label on the nodes.
+func labelValues(nodes []*Node, key string) []string {
+	seen := make(map[string]bool)
+	var values []string
+	for _, node := range nodes {
+		if v, ok := node.Labels[key]; ok && !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+func matchesAny(rule *common.PlacementRule, nodes []*Node) bool {
+	return countMatches(rule, nodes) > 0
+}
+
+func countMatches(rule *common.PlacementRule, nodes []*Node) int {
+	n := 0
+	for _, node := range nodes {
+		if rule.Matches(node.Labels) {
+			n++
+		}
+	}
+	return n
+}
+
+// retarget rewrites the constraints to match all the nodes: the values of
+// an in constraint are replaced by the values of the nodes, the other
+// constraints not matching them are dropped.
+func retarget(constraints []*common.LabelConstraint, nodes []*Node) []*common.LabelConstraint {
+	var rewritten []*common.LabelConstraint
+	for _, c := range constraints {
+		matched := true
+		for _, node := range nodes {
+			if !c.Requirement().Matches(node.Labels) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			rewritten = append(rewritten, c)
+			continue
+		}
+		if c.Op == "in" && allLabeled(nodes, c.Key) {
+			rewritten = append(rewritten, &common.LabelConstraint{Key: c.Key, Op: c.Op, Values: labelValues(nodes, c.Key)})
+		}
+	}
+	return rewritten
+}
+
+func allLabeled(nodes []*Node, key string) bool {
+	for _, node := range nodes {
+		if _, ok := node.Labels[key]; !ok {
+			return false
+		}
+	}
+	return len(nodes) > 0
+}
+
+func describeConstraints(constraints []*common.LabelConstraint) string {
+	if len(constraints) == 0 {
+		return "any store"
+	}
+	var s []string
+	for _, c := range constraints {
+		s = append(s, c.Requirement().String())
+	}
+	return strings.Join(s, ", ")
+}
+
+// replayPlacement rewrites the settings kept in the recover info and posts
+// them to the rebuilt PD, every request is recorded like a command.
+func (r *ClusterRescuer) replayPlacement(ctx context.Context) error {
+	c := r.config
+	logger := stepLog(StepPlacement)
+	info := c.RecoverInfoFile
+	if info.Replication == nil {
+		return errors.New("replay-placement is enabled but the recover info carries no replication settings, fetch them again or disable it")
+	}
+
+	p := rewritePlacement(info, c.Nodes)
+	r.report.Placement = p
+	for _, change := range p.Changes {
+		logger.Info("Rewrite placement: " + change)
+	}
+
+	client := resty.New()
+	post := func(path string, body interface{}) error {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		argv := []string{"pd", http.MethodPost, "/pd/api/v1" + path, string(data)}
+		finish, err := r.Begin(logger, c.PDAddress, argv)
+		if err != nil {
+			return err
+		}
+		resp, err := client.R().SetContext(ctx).
+			SetHeader("Content-Type", "application/json").
+			SetBody(data).
+			Post(fmt.Sprintf("http://%s/pd/api/v1%s", c.PDAddress, path))
+		var out []byte
+		if err == nil {
+			out = resp.Body()
+			if resp.StatusCode() != http.StatusOK {
+				err = fmt.Errorf("POST %s: %s %s", path, resp.Status(), strings.TrimSpace(string(out)))
+			}
+		}
+		if recordErr := finish(out, err); recordErr != nil {
+			return recordErr
+		}
+		return err
+	}
+
+	err := func() error {
+		if p.Replication != nil {
+			if err := post("/config/replicate", p.Replication); err != nil {
+				return err
+			}
+		}
+		if len(p.Rules) > 0 {
+			if err := post("/config/rules", p.Rules); err != nil {
+				return err
+			}
+		}
+		if p.Mode != nil {
+			return post("/config/replication-mode", p.Mode)
+		}
+		return nil
+	}()
+	if err != nil {
+		p.Error = err.Error()
+	}
+	return err
+}
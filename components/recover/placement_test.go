@@ -0,0 +1,185 @@
+package recover
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/iosmanthus/learner-recover/common"
+)
+
+func TestRewritePlacement(t *testing.T) {
+	nodes := []*Node{
+		{Host: "10.0.2.1", Labels: map[string]string{"dc": "bj", "zone": "bj-1", "host": "h1"}},
+		{Host: "10.0.2.2", Labels: map[string]string{"dc": "bj", "zone": "bj-2", "host": "h2"}},
+	}
+	info := &common.RecoverInfo{
+		Replication: &common.ReplicationConfig{
+			MaxReplicas:          3,
+			LocationLabels:       "dc,zone,host",
+			IsolationLevel:       "dc",
+			EnablePlacementRules: "true",
+		},
+		PlacementRules: []*common.PlacementRule{
+			{GroupID: "pd", ID: "default", Role: common.RuleRoleVoter, Count: 3, LabelConstraints: []*common.LabelConstraint{
+				{Key: "dc", Op: "in", Values: []string{"sh"}},
+				{Key: "zone", Op: "notIn", Values: []string{"bj-1"}},
+				{Key: "host", Op: "exists"},
+			}},
+			// Matching the nodes already.
+			{GroupID: "tidb", ID: "table-45", Role: common.RuleRoleLeader, Count: 1, IsolationLevel: "zone", LabelConstraints: []*common.LabelConstraint{
+				{Key: "dc", Op: "in", Values: []string{"sh", "bj"}},
+			}},
+			{GroupID: "pd", ID: "backup", Role: common.RuleRoleLearner, Count: 2, LabelConstraints: []*common.LabelConstraint{
+				{Key: "dc", Op: "in", Values: []string{"bj"}},
+			}},
+		},
+		ReplicationMode: &common.ReplicationMode{
+			Mode:       common.ModeDRAutoSync,
+			DRAutoSync: &common.DRAutoSync{LabelKey: "dc", Primary: "sh", DR: "bj", PrimaryReplicas: 3, DRReplicas: 2},
+		},
+	}
+
+	p := rewritePlacement(info, nodes)
+	if p.Replication.IsolationLevel != "" || info.Replication.IsolationLevel != "dc" {
+		t.Fatalf("unexpected isolation level %q", p.Replication.IsolationLevel)
+	}
+	if len(p.Rules) != 2 {
+		t.Fatalf("unexpected rules %v", p.Rules)
+	}
+	if got := describeConstraints(p.Rules[0].LabelConstraints); got != "dc in (bj), host" {
+		t.Fatalf("unexpected constraints %s", got)
+	}
+	// Several zones are left, the isolation level of the rule is kept.
+	if p.Rules[1].IsolationLevel != "zone" || len(p.Rules[1].LabelConstraints[0].Values) != 2 {
+		t.Fatalf("unexpected rule %+v", p.Rules[1])
+	}
+	if m := p.Mode; m.Mode != common.ModeMajority || m.DRAutoSync.Primary != "bj" || m.DRAutoSync.PrimaryReplicas != 2 {
+		t.Fatalf("unexpected replication mode %+v", m.DRAutoSync)
+	}
+	if info.ReplicationMode.DRAutoSync.Primary != "sh" {
+		t.Fatal("the recover info is rewritten")
+	}
+	if got := strings.Join(p.Changes, "\n"); !strings.Contains(got, "rule pd/backup of 2 learners dropped") {
+		t.Fatalf("unexpected changes\n%s", got)
+	}
+
+	// The replicas are clamped to the two nodes left.
+	if p.Replication.MaxReplicas != 2 || p.Rules[0].Count != 2 || p.Rules[1].Count != 1 || info.Replication.MaxReplicas != 3 {
+		t.Fatalf("unexpected replicas %d, %d, %d", p.Replication.MaxReplicas, p.Rules[0].Count, p.Rules[1].Count)
+	}
+	for _, change := range []string{"max-replicas clamped from 3 to 2", "rule pd/default clamped from 3 to 2 voters"} {
+		if got := strings.Join(p.Changes, "\n"); !strings.Contains(got, change) {
+			t.Fatalf("expect %q in the changes\n%s", change, got)
+		}
+	}
+
+	// The rules are not replayed if they are disabled.
+	info.Replication.EnablePlacementRules = "false"
+	if p = rewritePlacement(info, nodes); len(p.Rules) != 0 {
+		t.Fatalf("unexpected rules %v", p.Rules)
+	}
+}
+
+func TestRewritePlacementClamp(t *testing.T) {
+	nodes := []*Node{
+		{Host: "10.0.2.1", Labels: map[string]string{"zone": "bj-1"}},
+		{Host: "10.0.2.2", Labels: map[string]string{"zone": "bj-2"}},
+		{Host: "10.0.2.3", Labels: map[string]string{"zone": "bj-2"}},
+	}
+	voters := func(count int, zones ...string) *common.PlacementRule {
+		rule := &common.PlacementRule{GroupID: "pd", ID: "default", Role: common.RuleRoleVoter, Count: count}
+		if len(zones) > 0 {
+			rule.LabelConstraints = []*common.LabelConstraint{{Key: "zone", Op: "in", Values: zones}}
+		}
+		return rule
+	}
+	for _, c := range []struct {
+		name        string
+		maxReplicas uint64
+		rule        *common.PlacementRule
+		// The replicas replayed and the changes made.
+		replicas uint64
+		count    int
+		changes  int
+	}{
+		{"kept", 3, voters(3), 3, 3, 0},
+		{"fewer", 1, voters(1), 1, 1, 0},
+		{"max-replicas", 5, voters(3), 3, 3, 1},
+		{"rule", 3, voters(5), 3, 3, 1},
+		// The rule is clamped to the nodes it matches.
+		{"matched", 3, voters(3, "bj-2"), 3, 2, 1},
+		// Moved to all the nodes, then clamped.
+		{"moved", 5, voters(5, "sh-1"), 3, 3, 3},
+	} {
+		info := &common.RecoverInfo{
+			Replication:    &common.ReplicationConfig{MaxReplicas: c.maxReplicas, EnablePlacementRules: "true"},
+			PlacementRules: []*common.PlacementRule{c.rule},
+		}
+		p := rewritePlacement(info, nodes)
+		if p.Replication.MaxReplicas != c.replicas || p.Rules[0].Count != c.count || len(p.Changes) != c.changes {
+			t.Fatalf("%s: unexpected replicas %d, count %d, changes %q", c.name, p.Replication.MaxReplicas, p.Rules[0].Count, p.Changes)
+		}
+	}
+}
+
+// rebuildOnly is a backend which only rebuilds PD.
+type rebuildOnly struct {
+	Backend
+}
+
+func (rebuildOnly) RebuildPD(context.Context) error {
+	return nil
+}
+
+func TestRebuildPDReplay(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		posted []string
+		status = http.StatusOK
+	)
+	pd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		posted = append(posted, r.URL.Path)
+		w.WriteHeader(status)
+	}))
+	defer pd.Close()
+
+	info := &common.RecoverInfo{
+		Replication:     &common.ReplicationConfig{MaxReplicas: 3, EnablePlacementRules: "true"},
+		PlacementRules:  []*common.PlacementRule{{GroupID: "pd", ID: "default", Role: common.RuleRoleVoter, Count: 3}},
+		ReplicationMode: &common.ReplicationMode{Mode: common.ModeMajority},
+	}
+	rebuild := func(replay bool, info *common.RecoverInfo) (*ClusterRescuer, error) {
+		posted = nil
+		config := &Config{PDAddress: strings.TrimPrefix(pd.URL, "http://"), RecoverInfoFile: info, ReplayPlacement: replay}
+		r := &ClusterRescuer{config: config, backend: rebuildOnly{}, report: &Report{}}
+		return r, r.RebuildPD(context.Background())
+	}
+
+	// Opt-in, nothing is written to PD by default.
+	if _, err := rebuild(false, info); err != nil || len(posted) != 0 {
+		t.Fatalf("unexpected replay %v %v", err, posted)
+	}
+	r, err := rebuild(true, info)
+	if err != nil || strings.Join(posted, ",") != "/pd/api/v1/config/replicate,/pd/api/v1/config/rules,/pd/api/v1/config/replication-mode" {
+		t.Fatalf("unexpected replay %v %v", err, posted)
+	}
+	if r.report.Placement == nil || r.report.Placement.Error != "" {
+		t.Fatalf("unexpected report %+v", r.report.Placement)
+	}
+
+	// Without the settings captured, or rejected by PD, the recovery stops.
+	if _, err = rebuild(true, &common.RecoverInfo{}); err == nil || len(posted) != 0 {
+		t.Fatalf("expect the missing settings refused, got %v %v", err, posted)
+	}
+	status = http.StatusInternalServerError
+	r, err = rebuild(true, info)
+	if err == nil || len(posted) != 1 || r.report.Placement.Error == "" {
+		t.Fatalf("expect the failed replay returned, got %v %v", err, posted)
+	}
+}
@@ -3,16 +3,38 @@ package recover
 import (
 	"context"
 	"fmt"
-	"net/http"
 	"os/exec"
 	"sync"
 	"time"
 
 	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/components/audit"
+	"github.com/iosmanthus/learner-recover/components/tables"
+
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/resty.v1"
 )
 
+// Steps of the recovery, logged as the step field.
+const (
+	StepPrepare   = "prepare"
+	StepStop      = "stop"
+	StepUnsafe    = "unsafe-recover"
+	StepDropLogs  = "drop-raft-logs"
+	StepFetch     = "fetch-regions"
+	StepResolve   = "resolve-conflicts"
+	StepPromote   = "promote-learners"
+	StepRebuildPD = "rebuild-pd"
+	StepJoin      = "join"
+)
+
+func stepLog(step string) *log.Entry {
+	return log.WithField(common.FieldStep, step)
+}
+
+func nodeLog(step string, host string, port int) *log.Entry {
+	return stepLog(step).WithFields(log.Fields{common.FieldHost: host, common.FieldPort: port})
+}
+
 type Recover interface {
 	UnsafeRecover
 
@@ -28,80 +50,72 @@ type UnsafeRecover interface {
 }
 
 type ClusterRescuer struct {
-	config *Config
+	config  *Config
+	backend Backend
+	audit   *audit.Log
+	report  *Report
 }
 
 func NewClusterRescuer(config *Config) Recover {
-	return &ClusterRescuer{config}
+	return &ClusterRescuer{config: config}
 }
 
-func (r *ClusterRescuer) Prepare(ctx context.Context) error {
-	config := r.config
-
-	ch := make(chan error, len(config.Nodes))
-
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	wg := &sync.WaitGroup{}
-	wg.Add(len(config.Nodes))
-	defer wg.Wait()
-
-	for _, node := range config.Nodes {
-		go func(host string) {
-			defer wg.Done()
-
-			path := fmt.Sprintf("%s@%s:%s", config.User, host, config.TiKVCtl.Dest)
-
-			log.Infof("Sending tikv-ctl to %s", host)
-			cmd := exec.CommandContext(ctx, "scp",
-				"-P",
-				fmt.Sprintf("%v", config.SSHPort),
-				config.TiKVCtl.Src,
-				path)
-			err := cmd.Run()
-			ch <- err
-		}(node.Host)
+// Run runs the command against the host and records it in the audit log, the
+// step is taken from the logger.
+func (r *ClusterRescuer) Run(logger *log.Entry, host string, cmd *exec.Cmd) (string, error) {
+	finish, err := r.Begin(logger, host, cmd.Args)
+	if err != nil {
+		return "", err
 	}
+	out, err := common.Run(logger, cmd)
+	if auditErr := finish([]byte(out), err); auditErr != nil {
+		return out, auditErr
+	}
+	return out, err
+}
 
-	for _, node := range config.Nodes {
-		if err := <-ch; err != nil {
-			log.Errorf("Fail to send tikv-ctl to %s", node.Host)
-			return err
-		}
+// Begin records the intent of the operation in the audit log, finish records
+// its result in the report and the audit log.
+func (r *ClusterRescuer) Begin(logger *log.Entry, host string, argv []string) (func(output []byte, err error) error, error) {
+	step, _ := logger.Data[common.FieldStep].(string)
+	start := time.Now()
+	intent, err := r.audit.Begin(host, step, argv, start)
+	if err != nil {
+		return nil, fmt.Errorf("fail to write audit log: %v", err)
 	}
 
-	return nil
+	return func(output []byte, err error) error {
+		r.report.addCommand(step, host, argv, start, err)
+		if auditErr := r.audit.Finish(intent, host, step, argv, start, output, err); auditErr != nil {
+			return fmt.Errorf("fail to write audit log: %v", auditErr)
+		}
+		return nil
+	}, nil
 }
 
-func (r *ClusterRescuer) Stop(ctx context.Context) error {
-	config := r.config
+// forEachNode runs f on all the nodes in parallel, the first error is
+// returned and cancels the others.
+func (r *ClusterRescuer) forEachNode(ctx context.Context, f func(ctx context.Context, node *Node) error) error {
+	nodes := r.config.Nodes
 
-	ch := make(chan error, len(config.Nodes))
+	ch := make(chan error, len(nodes))
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	wg := &sync.WaitGroup{}
-	wg.Add(len(config.Nodes))
+	wg.Add(len(nodes))
 	defer wg.Wait()
 
-	for _, node := range config.Nodes {
-		go func(host string, port int) {
+	for _, node := range nodes {
+		go func(node *Node) {
 			defer wg.Done()
-
-			log.Infof("Stoping TiKV server on %s:%v", host, port)
-			cmd := exec.CommandContext(ctx,
-				"ssh", "-p", fmt.Sprintf("%v", config.SSHPort), fmt.Sprintf("%s@%s", config.User, host),
-				"sudo", "systemctl", "disable", "--now", fmt.Sprintf("tikv-%v.service", port))
-			err := cmd.Run()
-			ch <- err
-		}(node.Host, node.Port)
+			ch <- f(ctx, node)
+		}(node)
 	}
 
-	for _, node := range config.Nodes {
+	for range nodes {
 		if err := <-ch; err != nil {
-			log.Errorf("Fail to stop TiKV server on %s:%v: %v", node.Host, node.Port, err)
 			return err
 		}
 	}
@@ -109,83 +123,133 @@ func (r *ClusterRescuer) Stop(ctx context.Context) error {
 	return nil
 }
 
-func (r *ClusterRescuer) RebuildPD(ctx context.Context) error {
-	c := r.config
-
-	log.Info("Rebuilding PD server")
-
-	cmd := exec.CommandContext(ctx, "tiup", "cluster", "deploy", "-y", c.ClusterName, c.ClusterVersion, c.NewTopology.Path)
-	common.Run(cmd)
-
-	cmd = exec.CommandContext(ctx, "tiup", "cluster", "start", "-y", c.ClusterName)
-	_, err := common.Run(cmd)
-	if err != nil {
+func (r *ClusterRescuer) Prepare(ctx context.Context) error {
+	if err := r.backend.Discover(ctx); err != nil {
 		return err
 	}
 
-	// PDRecover
-	pdServer := c.NewTopology.PDServers[0]
-	cmd = exec.CommandContext(ctx, c.PDRecoverPath,
-		"-endpoints", fmt.Sprintf("http://%s:%v", pdServer.Host, pdServer.ClientPort),
-		"-cluster-id", c.RecoverInfoFile.ClusterID, "-alloc-id", fmt.Sprintf("%v", c.RecoverInfoFile.AllocID))
-	_, err = common.Run(cmd)
-
-	if err != nil {
+	return r.forEachNode(ctx, func(ctx context.Context, node *Node) error {
+		logger := nodeLog(StepPrepare, node.Host, node.Port)
+		logger.Info("Sending tikv-ctl")
+		err := r.backend.Prepare(ctx, logger, node)
+		if err != nil {
+			logger.WithError(err).Error("Fail to send tikv-ctl")
+		}
 		return err
-	}
+	})
+}
 
-	cmd = exec.CommandContext(ctx, "tiup", "cluster", "restart", "-y", c.ClusterName)
-	common.Run(cmd)
+func (r *ClusterRescuer) Stop(ctx context.Context) error {
+	return r.forEachNode(ctx, func(ctx context.Context, node *Node) error {
+		logger := nodeLog(StepStop, node.Host, node.Port)
+		logger.Info("Stopping TiKV server")
+		err := r.backend.StopTiKV(ctx, logger, node)
+		if err != nil {
+			logger.WithError(err).Error("Fail to stop TiKV server")
+		}
+		return err
+	})
+}
 
-	if err != nil {
+// RebuildPD rebuilds PD and replays the replication settings of the old PD
+// into it if enabled. A failed replay stops the recovery before the learners
+// join, otherwise PD moves the data by its default rules.
+func (r *ClusterRescuer) RebuildPD(ctx context.Context) error {
+	if err := r.backend.RebuildPD(ctx); err != nil {
 		return err
 	}
-
-	client := resty.New()
-	for {
-		log.Info("Waiting PD server online")
-		resp, err := client.R().SetContext(ctx).Get(fmt.Sprintf("http://%s:%v/pd/api/v1/config/replicate", pdServer.Host, pdServer.ClientPort))
-		if err == nil && resp.StatusCode() == http.StatusOK {
-			break
-		}
-		time.Sleep(time.Second * 1)
+	if !r.config.ReplayPlacement {
+		return nil
+	}
+	if err := r.replayPlacement(ctx); err != nil {
+		stepLog(StepPlacement).WithError(err).Error("Fail to replay the replication settings, fix them in the rebuilt PD before rerunning the recovery")
+		return fmt.Errorf("replay replication settings: %v", err)
 	}
-
 	return nil
 }
 
 func (r *ClusterRescuer) Finish(ctx context.Context) error {
-	c := r.config
-	log.Info("Joining the TiKV servers")
-	cmd := exec.CommandContext(ctx, "tiup", "cluster", "scale-out", "-y", c.ClusterName, c.JoinTopology)
-	err := cmd.Run()
+	return r.backend.Join(ctx)
+}
+
+// step runs a step of the recovery and records its timing in the report.
+func (r *ClusterRescuer) step(ctx context.Context, name string, f func(ctx context.Context) error) error {
+	start := time.Now()
+	err := f(ctx)
+	r.report.addStep(name, start, err)
 	return err
 }
 
 func (r *ClusterRescuer) Execute(ctx context.Context) error {
-	err := r.Prepare(ctx)
+	var err error
+	if r.backend, err = newBackend(r.config, r); err != nil {
+		return err
+	}
+	if r.audit, err = audit.Open(r.config.AuditLog); err != nil {
+		return err
+	}
+	defer func() {
+		log.WithField("audit_log", r.config.AuditLog).Infof("Audit log head %s", r.audit.Head())
+		r.audit.Close()
+	}()
+
+	r.report = NewReport(r.config)
+	if r.config.RPOOutput != "" {
+		r.report.RPO = loadRPO(r.config)
+	}
+	// The tables are reported by their IDs if the schema is not loaded, which
+	// never fails the recovery.
+	if r.report.Catalog, err = tables.Load(ctx, r.config.SchemaSource); err != nil {
+		log.WithError(err).Warn("Fail to load the schema from schema-source")
+		err = nil
+	}
+	defer r.writeReport(ctx, &err)
+
+	err = r.step(ctx, StepPrepare, r.Prepare)
 	if err != nil {
-		log.Error("Fail to prepare tikv-ctl for TiKV learner nodes")
+		stepLog(StepPrepare).Error("Fail to prepare tikv-ctl for TiKV learner nodes")
 		return err
 	}
 
-	err = r.Stop(ctx)
+	err = r.step(ctx, StepStop, r.Stop)
 	if err != nil {
-		log.Error("Fail to stop the TiKV learner nodes")
+		stepLog(StepStop).Error("Fail to stop the TiKV learner nodes")
 		return err
 	}
 
-	err = r.UnsafeRecover(ctx)
+	err = r.step(ctx, StepUnsafe, r.UnsafeRecover)
 	if err != nil {
-		log.Error("Fail to recover the TiKV servers")
+		stepLog(StepUnsafe).Error("Fail to recover the TiKV servers")
 		return err
 	}
 
-	err = r.RebuildPD(ctx)
+	err = r.step(ctx, StepRebuildPD, r.RebuildPD)
 	if err != nil {
-		log.Error("Fail to rebuild PD")
+		stepLog(StepRebuildPD).Error("Fail to rebuild PD")
 		return err
 	}
 
-	return r.Finish(ctx)
+	err = r.step(ctx, StepJoin, r.Finish)
+	return err
+}
+
+// writeReport checks the health of the cluster if PD is rebuilt and writes
+// the report, failed recoveries included.
+func (r *ClusterRescuer) writeReport(ctx context.Context, err *error) {
+	rep := r.report
+	for _, step := range rep.Steps {
+		if step.Name == StepRebuildPD && step.Error == "" {
+			rep.Health = pdHealth(ctx, r.config)
+		}
+	}
+	rep.Finished = time.Now()
+	if *err != nil {
+		rep.Error = (*err).Error()
+	}
+
+	if werr := rep.Write(r.config.Report); werr != nil {
+		log.Errorf("Fail to write the recovery report: %v", werr)
+		return
+	}
+	log.Infof("Recovery report is written to %s.md and %s.html", r.config.Report, r.config.Report)
 }
@@ -0,0 +1,473 @@
+package recover
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/components/key"
+	"github.com/iosmanthus/learner-recover/components/rpo"
+	"github.com/iosmanthus/learner-recover/components/tables"
+
+	"gopkg.in/resty.v1"
+)
+
+// Reasons of the conflict decisions.
+const (
+	ReasonApplying     = "the other is applying a snapshot"
+	ReasonEpoch        = "newer region epoch"
+	ReasonAppliedIndex = "larger applied index"
+	ReasonRecoverFrom  = "earlier in recover-from"
+	ReasonTie          = "tie"
+)
+
+type RegionSummary struct {
+	RegionID     common.RegionId
+	Host         string
+	Group        string
+	StartKey     string
+	EndKey       string
+	Version      int
+	ConfVer      uint64
+	State        common.PeerState
+	AppliedIndex uint64
+	CommitIndex  uint64
+	Voters       int
+	Learners     int
+}
+
+func summarize(state *common.RegionState) *RegionSummary {
+	region := state.LocalState.Region
+	voters, learners := state.Roles()
+	return &RegionSummary{
+		RegionID:     state.RegionId,
+		Host:         state.Host,
+		Group:        state.Group,
+		StartKey:     region.StartKey,
+		EndKey:       region.EndKey,
+		Version:      region.RegionEpoch.Version,
+		ConfVer:      region.RegionEpoch.ConfVer,
+		State:        state.LocalState.State,
+		AppliedIndex: state.ApplyState.AppliedIndex,
+		CommitIndex:  state.CommitIndex(),
+		Voters:       voters,
+		Learners:     learners,
+	}
+}
+
+// Describe formats the replica for the report.
+func (s *RegionSummary) Describe() string {
+	d := fmt.Sprintf("region %v (%s) on %s (%s), version %v, conf_ver %v, applied %v",
+		s.RegionID, key.DescribeRange(s.StartKey, s.EndKey), s.Host, s.Group, s.Version, s.ConfVer, s.AppliedIndex)
+	if s.CommitIndex > s.AppliedIndex {
+		d += fmt.Sprintf(" of commit %v", s.CommitIndex)
+	}
+	if s.State != "" && s.State != common.StateNormal {
+		d += ", " + strings.ToLower(string(s.State))
+	}
+	if s.Voters+s.Learners > 0 {
+		d += fmt.Sprintf(", %v voters, %v learners", s.Voters, s.Learners)
+	}
+	return d
+}
+
+// ConflictDecision is an overlap of two regions, the dropped one is
+// tombstoned.
+type ConflictDecision struct {
+	Kept    *RegionSummary
+	Dropped *RegionSummary
+	Reason  string
+}
+
+type KeyRange struct {
+	StartKey string
+	EndKey   string
+}
+
+type GroupCoverage struct {
+	Group   string
+	Regions int
+}
+
+// Coverage tells whether the regions kept cover the whole key space, the
+// gaps are the data held by none of the learners recovered from.
+type Coverage struct {
+	Regions int
+	Groups  []*GroupCoverage
+	Gaps    []*KeyRange
+	// Tombstones counts the tombstoned replicas skipped.
+	Tombstones int
+	// Unapplied are the regions kept with entries committed but not
+	// applied, which are dropped with the raft logs.
+	Unapplied []*RegionSummary
+}
+
+// UnappliedEntries returns the number of committed entries dropped.
+func (c *Coverage) UnappliedEntries() uint64 {
+	var n uint64
+	for _, region := range c.Unapplied {
+		n += region.CommitIndex - region.AppliedIndex
+	}
+	return n
+}
+
+func (c *Coverage) Complete() bool {
+	return len(c.Gaps) == 0
+}
+
+func newCoverage(kept []*common.RegionState) *Coverage {
+	c := &Coverage{Regions: len(kept)}
+
+	groups := make(map[string]int)
+	for _, state := range kept {
+		groups[state.Group]++
+	}
+	for group, n := range groups {
+		c.Groups = append(c.Groups, &GroupCoverage{Group: group, Regions: n})
+	}
+	sort.Slice(c.Groups, func(i, j int) bool {
+		return c.Groups[i].Group < c.Groups[j].Group
+	})
+
+	sort.Slice(kept, func(i, j int) bool {
+		return key.Compare(kept[i].LocalState.Region.StartKey, kept[j].LocalState.Region.StartKey) < 0
+	})
+	for _, state := range kept {
+		if state.Unapplied() > 0 {
+			c.Unapplied = append(c.Unapplied, summarize(state))
+		}
+	}
+	// An empty end key is the end of the key space.
+	cursor, done := "", false
+	for _, state := range kept {
+		region := state.LocalState.Region
+		if key.Compare(region.StartKey, cursor) > 0 {
+			c.Gaps = append(c.Gaps, &KeyRange{StartKey: cursor, EndKey: region.StartKey})
+		}
+		if region.EndKey == "" {
+			done = true
+			break
+		}
+		if key.Compare(region.EndKey, cursor) > 0 {
+			cursor = region.EndKey
+		}
+	}
+	if !done {
+		c.Gaps = append(c.Gaps, &KeyRange{StartKey: cursor})
+	}
+	return c
+}
+
+type StepResult struct {
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+	Error    string
+}
+
+type CommandResult struct {
+	Step     string
+	Host     string
+	Command  string
+	Duration time.Duration
+	Error    string
+}
+
+type HostResult struct {
+	Host     string
+	Commands []*CommandResult
+	Failed   int
+}
+
+// GroupRPO is the last RPO of a learner group saved by the rpo command.
+type GroupRPO struct {
+	Group    string
+	Lag      string
+	LagUpper string
+	P99      string
+	SafeTime time.Time
+	Error    string
+}
+
+type StoreHealth struct {
+	ID          uint64
+	Address     string
+	State       string
+	RegionCount int
+	LeaderCount int
+}
+
+type MemberHealth struct {
+	Name    string
+	URLs    string
+	Healthy bool
+}
+
+// Health is the state of the cluster reported by PD after the recovery.
+type Health struct {
+	Members []*MemberHealth
+	Stores  []*StoreHealth
+	Error   string
+}
+
+// Report collects what happened during a recovery for the postmortem.
+type Report struct {
+	mu sync.Mutex
+
+	Started   time.Time
+	Finished  time.Time
+	Error     string
+	Config    *Config
+	Steps     []*StepResult
+	Commands  []*CommandResult
+	Conflicts []*ConflictDecision
+	Coverage  *Coverage
+	RPO       []*GroupRPO
+	Loss      *LossEstimate
+	Health    *Health
+	// Placement is the replication settings replayed, nil if not replayed.
+	Placement *Placement
+	// Catalog names the affected tables, nil without a schema source.
+	Catalog *tables.Catalog
+}
+
+// Kinds of the key ranges of the affected tables.
+const (
+	AffectedDropped   = "dropped"
+	AffectedGap       = "gap"
+	AffectedUnapplied = "unapplied"
+	AffectedLoss      = "loss"
+)
+
+// AffectedTables returns the tables of the replicas dropped, the key ranges
+// lost, the committed entries dropped and the estimated loss.
+func (rep *Report) AffectedTables() []*tables.AffectedTable {
+	affected := tables.NewAffected(rep.Catalog)
+	for _, c := range rep.Conflicts {
+		affected.Add(AffectedDropped, c.Dropped.StartKey, c.Dropped.EndKey)
+	}
+	if c := rep.Coverage; c != nil {
+		for _, gap := range c.Gaps {
+			affected.Add(AffectedGap, gap.StartKey, gap.EndKey)
+		}
+		for _, region := range c.Unapplied {
+			affected.Add(AffectedUnapplied, region.StartKey, region.EndKey)
+		}
+	}
+	if rep.Loss != nil {
+		for _, region := range rep.Loss.Regions {
+			affected.Add(AffectedLoss, region.StartKey, region.EndKey)
+		}
+	}
+	return affected.Tables()
+}
+
+func NewReport(config *Config) *Report {
+	return &Report{Started: time.Now(), Config: config}
+}
+
+func (rep *Report) addStep(name string, start time.Time, err error) {
+	if rep == nil {
+		return
+	}
+	step := &StepResult{Name: name, Start: start, Duration: time.Since(start)}
+	if err != nil {
+		step.Error = err.Error()
+	}
+
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.Steps = append(rep.Steps, step)
+}
+
+func (rep *Report) addCommand(step, host string, argv []string, start time.Time, err error) {
+	if rep == nil {
+		return
+	}
+	result := &CommandResult{
+		Step:     step,
+		Host:     host,
+		Command:  strings.Join(argv, " "),
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.Commands = append(rep.Commands, result)
+}
+
+func (rep *Report) setResolution(decisions []*ConflictDecision, coverage *Coverage) {
+	if rep == nil {
+		return
+	}
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.Conflicts = decisions
+	rep.Coverage = coverage
+}
+
+func (rep *Report) setLoss(loss *LossEstimate) {
+	if rep == nil {
+		return
+	}
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.Loss = loss
+}
+
+// Hosts groups the commands by the hosts they run against.
+func (rep *Report) Hosts() []*HostResult {
+	hosts := make(map[string]*HostResult)
+	var names []string
+	for _, cmd := range rep.Commands {
+		host := cmd.Host
+		if host == "" {
+			host = "local"
+		}
+		if _, ok := hosts[host]; !ok {
+			hosts[host] = &HostResult{Host: host}
+			names = append(names, host)
+		}
+		hosts[host].Commands = append(hosts[host].Commands, cmd)
+		if cmd.Error != "" {
+			hosts[host].Failed++
+		}
+	}
+	sort.Strings(names)
+
+	var results []*HostResult
+	for _, name := range names {
+		results = append(results, hosts[name])
+	}
+	return results
+}
+
+func (rep *Report) Duration() time.Duration {
+	return rep.Finished.Sub(rep.Started)
+}
+
+// loadRPO reads the last RPO of every learner group saved by the rpo command.
+func loadRPO(c *Config) []*GroupRPO {
+	var groups []*GroupRPO
+	for _, group := range c.LearnerGroups {
+		r := &GroupRPO{Group: group.Name}
+		groups = append(groups, r)
+
+		path := rpo.GroupPath(c.RPOOutput, group.Name, len(c.LearnerGroups))
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			r.Error = err.Error()
+			continue
+		}
+
+		output := struct {
+			Lag         string    `json:"lag"`
+			LagUpper    string    `json:"lag-upper"`
+			SafeTime    time.Time `json:"safe-time"`
+			Percentiles struct {
+				P99 string `json:"p99"`
+			} `json:"percentiles"`
+		}{}
+		if err = json.Unmarshal(data, &output); err != nil {
+			r.Error = fmt.Sprintf("%s: %v", path, err)
+			continue
+		}
+		r.Lag, r.LagUpper, r.P99, r.SafeTime = output.Lag, output.LagUpper, output.Percentiles.P99, output.SafeTime
+	}
+	return groups
+}
+
+// pdHealth queries the members and the stores of the rebuilt cluster.
+func pdHealth(ctx context.Context, c *Config) *Health {
+	h := &Health{}
+	if c.PDAddress == "" {
+		h.Error = "no address of the rebuilt PD"
+		return h
+	}
+	endpoint := fmt.Sprintf("http://%s/pd/api/v1", c.PDAddress)
+	client := resty.New().SetTimeout(5 * time.Second)
+
+	get := func(path string, v interface{}) error {
+		resp, err := client.R().SetContext(ctx).Get(endpoint + path)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode() != http.StatusOK {
+			return fmt.Errorf("GET %s: %s", path, resp.Status())
+		}
+		return json.Unmarshal(resp.Body(), v)
+	}
+
+	var members []struct {
+		Name       string   `json:"name"`
+		ClientURLs []string `json:"client_urls"`
+		Health     bool     `json:"health"`
+	}
+	if err := get("/health", &members); err != nil {
+		h.Error = err.Error()
+		return h
+	}
+	for _, m := range members {
+		h.Members = append(h.Members, &MemberHealth{Name: m.Name, URLs: strings.Join(m.ClientURLs, ", "), Healthy: m.Health})
+	}
+
+	var stores struct {
+		Stores []struct {
+			Store struct {
+				ID        uint64 `json:"id"`
+				Address   string `json:"address"`
+				StateName string `json:"state_name"`
+			} `json:"store"`
+			Status struct {
+				RegionCount int `json:"region_count"`
+				LeaderCount int `json:"leader_count"`
+			} `json:"status"`
+		} `json:"stores"`
+	}
+	if err := get("/stores", &stores); err != nil {
+		h.Error = err.Error()
+		return h
+	}
+	for _, s := range stores.Stores {
+		h.Stores = append(h.Stores, &StoreHealth{
+			ID:          s.Store.ID,
+			Address:     s.Store.Address,
+			State:       s.Store.StateName,
+			RegionCount: s.Status.RegionCount,
+			LeaderCount: s.Status.LeaderCount,
+		})
+	}
+	return h
+}
+
+// Write writes the report to path.md and path.html.
+func (rep *Report) Write(path string) error {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+
+	doc := rep.document()
+	buf := &bytes.Buffer{}
+	if err := markdownTemplate.Execute(buf, doc); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".md", buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	buf.Reset()
+	if err := htmlTemplate.Execute(buf, doc); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+".html", buf.Bytes(), 0644)
+}
@@ -0,0 +1,556 @@
+package recover
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/components/key"
+)
+
+// reportSpan is a run of text in the report, a span of a class is colored
+// in HTML and emphasized in Markdown.
+type reportSpan struct {
+	Text string
+	// Code is a command, a path or a key.
+	Code  bool
+	Class string
+}
+
+const (
+	classOK     = "ok"
+	classFailed = "failed"
+)
+
+// reportText is a paragraph, a heading, a list item or a table cell.
+type reportText []reportSpan
+
+// reportBlock is either a heading, a paragraph, a list or a table.
+type reportBlock struct {
+	Heading reportText
+	Text    reportText
+	Items   []reportText
+	Header  []string
+	Rows    [][]reportText
+}
+
+type reportSection struct {
+	Title  string
+	Blocks []*reportBlock
+}
+
+// reportDocument is the report laid out in sections, the templates only
+// tell how the blocks are written in Markdown and in HTML.
+type reportDocument struct {
+	Title    string
+	Summary  []reportText
+	Sections []*reportSection
+}
+
+func plain(format string, args ...interface{}) reportSpan {
+	return reportSpan{Text: fmt.Sprintf(format, args...)}
+}
+
+func code(s string) reportSpan {
+	return reportSpan{Text: s, Code: true}
+}
+
+func failed(format string, args ...interface{}) reportSpan {
+	return reportSpan{Text: fmt.Sprintf(format, args...), Class: classFailed}
+}
+
+func succeeded(s string) reportSpan {
+	return reportSpan{Text: s, Class: classOK}
+}
+
+// result is ok or the error.
+func result(err string) reportText {
+	if err == "" {
+		return reportText{succeeded("ok")}
+	}
+	return reportText{failed("failed"), plain(": %s", err)}
+}
+
+func (s *reportSection) heading(spans ...reportSpan) {
+	s.Blocks = append(s.Blocks, &reportBlock{Heading: spans})
+}
+
+func (s *reportSection) paragraph(spans ...reportSpan) {
+	s.Blocks = append(s.Blocks, &reportBlock{Text: spans})
+}
+
+func (s *reportSection) list(items []reportText) {
+	if len(items) != 0 {
+		s.Blocks = append(s.Blocks, &reportBlock{Items: items})
+	}
+}
+
+func (s *reportSection) table(header ...string) *reportBlock {
+	b := &reportBlock{Header: header}
+	s.Blocks = append(s.Blocks, b)
+	return b
+}
+
+// row adds a row of cells, a cell is a reportText, a span or anything
+// printed as plain text.
+func (b *reportBlock) row(cells ...interface{}) {
+	var row []reportText
+	for _, cell := range cells {
+		switch c := cell.(type) {
+		case reportText:
+			row = append(row, c)
+		case reportSpan:
+			row = append(row, reportText{c})
+		default:
+			row = append(row, reportText{plain("%v", c)})
+		}
+	}
+	b.Rows = append(b.Rows, row)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
+
+func formatKey(k string) string {
+	if k == "" {
+		return "∞"
+	}
+	return k
+}
+
+// formatHexRange describes the hex keys of a placement rule.
+func formatHexRange(start, end string) string {
+	s, err := key.ParseHex(start)
+	if err != nil {
+		return start + " to " + end
+	}
+	e, err := key.ParseHex(end)
+	if err != nil {
+		return start + " to " + end
+	}
+	return key.DescribeRange(key.Escape(s), key.Escape(e))
+}
+
+func formatIDs(ids []uint64) string {
+	var s []string
+	for _, id := range ids {
+		s = append(s, fmt.Sprintf("%v", id))
+	}
+	return strings.Join(s, ", ")
+}
+
+func (rep *Report) document() *reportDocument {
+	c := rep.Config
+	doc := &reportDocument{Title: "Recovery report of " + c.ClusterName}
+
+	outcome := reportText{plain("Result: "), succeeded("succeeded")}
+	if rep.Error != "" {
+		outcome = reportText{plain("Result: "), failed("failed"), plain(": %s", rep.Error)}
+	}
+	doc.Summary = []reportText{
+		{plain("Started: %s", formatTime(rep.Started))},
+		{plain("Finished: %s (%s)", formatTime(rep.Finished), formatDuration(rep.Duration()))},
+		outcome,
+	}
+
+	for _, section := range []func(*reportSection){
+		rep.configSection,
+		rep.infoSection,
+		rep.stepSection,
+		rep.hostSection,
+		rep.conflictSection,
+		rep.coverageSection,
+		rep.rpoSection,
+		rep.lossSection,
+		rep.tableSection,
+		rep.placementSection,
+		rep.healthSection,
+	} {
+		s := &reportSection{}
+		section(s)
+		doc.Sections = append(doc.Sections, s)
+	}
+	return doc
+}
+
+func (rep *Report) configSection(s *reportSection) {
+	c := rep.Config
+	s.Title = "Configuration"
+
+	backend := plain("%s", c.Backend)
+	if k := c.Kubernetes; k != nil {
+		backend = plain("%s, TidbCluster %s/%s", c.Backend, k.Namespace, k.TidbCluster)
+	}
+	t := s.table("Key", "Value")
+	t.row("Cluster", plain("%s %s", c.ClusterName, c.ClusterVersion))
+	t.row("Backend", backend)
+	t.row("New topology", code(c.NewTopology.Path))
+	t.row("Join topology", code(c.JoinTopology))
+	t.row("SSH", plain("%s, port %d", c.User, c.SSHPort))
+	t.row("tikv-ctl", reportText{code(c.TiKVCtl.Src), plain(" → "), code(c.TiKVCtl.Dest)})
+	t.row("pd-recover", code(c.PDRecoverPath))
+	t.row("Audit log", code(c.AuditLog))
+	for _, group := range c.LearnerGroups {
+		t.row("Learner group "+group.Name, code(group.Selector.String()))
+	}
+
+	s.paragraph(plain("Learners recovered from, in the order of preference:"))
+	var learners []reportText
+	for _, group := range c.Groups {
+		for _, node := range group.Nodes {
+			learners = append(learners, reportText{plain("%s:%v (%s)", node.Host, node.Port, group.Name)})
+		}
+	}
+	s.list(learners)
+}
+
+func (rep *Report) infoSection(s *reportSection) {
+	s.Title = "Recover info"
+	info := rep.Config.RecoverInfoFile
+	if info == nil {
+		s.paragraph(plain("Not loaded."))
+		return
+	}
+
+	t := s.table("Key", "Value")
+	t.row("Cluster ID", info.ClusterID)
+	t.row("Alloc ID", info.AllocID)
+	t.row("Voter stores", formatIDs(info.StoreIDs))
+	var groups []string
+	for group := range info.LearnerStoreIDs {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		t.row("Learner stores of "+group, formatIDs(info.LearnerStoreIDs[group]))
+	}
+	t.row("Stores removed as failed", formatIDs(rep.Config.FailedStores))
+}
+
+func (rep *Report) stepSection(s *reportSection) {
+	s.Title = "Steps"
+	if len(rep.Steps) == 0 {
+		s.paragraph(plain("No step is run."))
+		return
+	}
+	t := s.table("Step", "Started", "Duration", "Result")
+	for _, step := range rep.Steps {
+		t.row(step.Name, formatTime(step.Start), formatDuration(step.Duration), result(step.Error))
+	}
+}
+
+func (rep *Report) hostSection(s *reportSection) {
+	s.Title = "Hosts"
+	hosts := rep.Hosts()
+	if len(hosts) == 0 {
+		s.paragraph(plain("No command is run."))
+		return
+	}
+	for _, host := range hosts {
+		if host.Failed > 0 {
+			s.heading(plain("%s ", host.Host), failed("(%d failed)", host.Failed))
+		} else {
+			s.heading(plain("%s", host.Host))
+		}
+		t := s.table("Step", "Command", "Duration", "Result")
+		for _, cmd := range host.Commands {
+			t.row(cmd.Step, code(cmd.Command), formatDuration(cmd.Duration), result(cmd.Error))
+		}
+	}
+}
+
+func (rep *Report) conflictSection(s *reportSection) {
+	s.Title = "Conflict resolution"
+	if len(rep.Conflicts) == 0 {
+		s.paragraph(plain("No conflicting regions."))
+		return
+	}
+	t := s.table("Kept", "Dropped", "Reason")
+	for _, conflict := range rep.Conflicts {
+		t.row(conflict.Kept.Describe(), conflict.Dropped.Describe(), conflict.Reason)
+	}
+}
+
+func (rep *Report) coverageSection(s *reportSection) {
+	s.Title = "Coverage"
+	c := rep.Coverage
+	if c == nil {
+		s.paragraph(plain("Not analyzed, the regions were not collected."))
+		return
+	}
+
+	kept := fmt.Sprintf("%d regions kept", c.Regions)
+	for _, group := range c.Groups {
+		kept += fmt.Sprintf(", %d from %s", group.Regions, group.Group)
+	}
+	if c.Tombstones > 0 {
+		kept += fmt.Sprintf(", %d tombstoned replicas skipped", c.Tombstones)
+	}
+	s.paragraph(plain("%s.", kept))
+
+	if c.Complete() {
+		s.paragraph(succeeded("The whole key space is covered."))
+	} else {
+		s.paragraph(failed("The key ranges below are held by none of the learners, their data is lost:"))
+		t := s.table("Start key", "End key", "Data")
+		for _, gap := range c.Gaps {
+			t.row(code(formatKey(gap.StartKey)), code(formatKey(gap.EndKey)), key.DescribeRange(gap.StartKey, gap.EndKey))
+		}
+	}
+
+	if len(c.Unapplied) != 0 {
+		s.paragraph(plain("%d entries committed but not applied by the learners kept are dropped with the raft logs:", c.UnappliedEntries()))
+		t := s.table("Region", "Data", "Host", "Group", "Applied", "Commit", "Dropped entries")
+		for _, r := range c.Unapplied {
+			t.row(r.RegionID, key.DescribeRange(r.StartKey, r.EndKey), r.Host, r.Group, r.AppliedIndex, r.CommitIndex, r.CommitIndex-r.AppliedIndex)
+		}
+	}
+}
+
+func (rep *Report) rpoSection(s *reportSection) {
+	s.Title = "Estimated RPO at failure"
+	if len(rep.RPO) == 0 {
+		s.paragraph(plain("Not available, rpo-output is not configured."))
+		return
+	}
+	t := s.table("Group", "Lag", "Lag upper bound", "P99", "Safe time")
+	for _, g := range rep.RPO {
+		if g.Error != "" {
+			t.row(g.Group, reportText{failed("unavailable"), plain(": %s", g.Error)}, "", "", "")
+			continue
+		}
+		t.row(g.Group, g.Lag, g.LagUpper, g.P99, formatTime(g.SafeTime))
+	}
+}
+
+func (rep *Report) lossSection(s *reportSection) {
+	s.Title = "Estimated data loss"
+	e := rep.Loss
+	if e == nil {
+		s.paragraph(plain("Not estimated, rpo-history is not configured."))
+		return
+	}
+
+	text := reportText{plain("At the failure time %s, %d of %d regions miss %d committed raft entries",
+		formatTime(e.FailureTime), len(e.Regions), e.Examined, e.LostEntries)}
+	if len(e.Regions) != 0 {
+		text = append(text, plain(", "), failed("the writes since %s (%s) may be lost", formatTime(e.Since()), formatDuration(e.MaxWindow)))
+	}
+	text = append(text, plain("."))
+	if e.Unknown > 0 {
+		text = append(text, plain(" %d regions have no voter history before the failure, their loss is unknown.", e.Unknown))
+	}
+	s.paragraph(text...)
+
+	var safePoints []reportText
+	for _, p := range e.SafePoints {
+		safePoints = append(safePoints, reportText{plain("Learner group %s was safe up to %s, lag upper bound %s", p.Group, formatTime(p.SafeTime), p.LagUpper)})
+	}
+	s.list(safePoints)
+
+	if len(e.Regions) != 0 {
+		t := s.table("Region", "Data", "Host", "Group", "Learner index", "Voter index", "Lost entries", "Window")
+		for _, r := range e.Regions {
+			t.row(r.RegionID, key.DescribeRange(r.StartKey, r.EndKey), r.Host, r.Group, r.LearnerIndex, r.VoterIndex, r.Entries, formatDuration(r.Window))
+		}
+	}
+}
+
+func (rep *Report) tableSection(s *reportSection) {
+	s.Title = "Affected tables"
+	affected := rep.AffectedTables()
+	if len(affected) == 0 {
+		s.paragraph(plain("No table is affected."))
+		return
+	}
+	t := s.table("Table", "ID", "Replicas dropped", "Key ranges lost", "Regions with entries dropped", "Regions losing writes")
+	for _, table := range affected {
+		name := "unknown"
+		if table.Known() {
+			name = table.String()
+		}
+		t.row(name, table.ID, table.Ranges[AffectedDropped], table.Ranges[AffectedGap], table.Ranges[AffectedUnapplied], table.Ranges[AffectedLoss])
+	}
+}
+
+func (rep *Report) placementSection(s *reportSection) {
+	s.Title = "Placement"
+	p := rep.Placement
+	if p == nil {
+		s.paragraph(plain("Not replayed, the rebuilt PD keeps its defaults."))
+		return
+	}
+
+	if p.Error != "" {
+		s.paragraph(failed("Fail to replay: %s", p.Error))
+	}
+	if r := p.Replication; r != nil {
+		labels := r.LocationLabels
+		if labels == "" {
+			labels = "none"
+		}
+		text := fmt.Sprintf("max-replicas %d, location-labels %s", r.MaxReplicas, labels)
+		if r.IsolationLevel != "" {
+			text += ", isolation-level " + r.IsolationLevel
+		}
+		enabled := "disabled"
+		if r.PlacementEnabled() {
+			enabled = "enabled"
+		}
+		s.paragraph(plain("%s, placement rules %s.", text, enabled))
+	}
+	if m := p.Mode; m != nil {
+		text := "Replication mode " + m.Mode
+		if d := m.DRAutoSync; d != nil {
+			text += fmt.Sprintf(", dr-auto-sync primary %s (%d replicas), dr %s (%d replicas) by %s", d.Primary, d.PrimaryReplicas, d.DR, d.DRReplicas, d.LabelKey)
+		}
+		s.paragraph(plain("%s.", text))
+	}
+	if len(p.Rules) != 0 {
+		t := s.table("Rule", "Role", "Count", "Constraints", "Keys")
+		for _, rule := range p.Rules {
+			t.row(rule.String(), rule.Role, rule.Count, describeConstraints(rule.LabelConstraints), formatHexRange(rule.StartKeyHex, rule.EndKeyHex))
+		}
+	}
+	var changes []reportText
+	for _, change := range p.Changes {
+		changes = append(changes, reportText{plain("%s", change)})
+	}
+	s.list(changes)
+}
+
+func (rep *Report) healthSection(s *reportSection) {
+	s.Title = "Cluster health"
+	h := rep.Health
+	if h == nil {
+		s.paragraph(plain("Not checked, PD was not rebuilt."))
+		return
+	}
+
+	if h.Error != "" {
+		s.paragraph(failed("Fail to query PD: %s", h.Error))
+	}
+	if len(h.Members) != 0 {
+		t := s.table("PD member", "Client URLs", "Healthy")
+		for _, m := range h.Members {
+			healthy := succeeded("yes")
+			if !m.Healthy {
+				healthy = failed("no")
+			}
+			t.row(m.Name, m.URLs, healthy)
+		}
+	}
+	if len(h.Stores) != 0 {
+		t := s.table("Store", "Address", "State", "Regions", "Leaders")
+		for _, store := range h.Stores {
+			t.row(store.ID, store.Address, store.State, store.RegionCount, store.LeaderCount)
+		}
+	}
+}
+
+var reportFuncs = map[string]interface{}{
+	// cell escapes the pipes of a Markdown table cell.
+	"cell": func(s reportSpan) reportSpan {
+		s.Text = strings.ReplaceAll(s.Text, "|", "\\|")
+		return s
+	},
+}
+
+// The partials write a block of the document in their format.
+const markdownReport = `
+{{- define "span"}}{{if .Code}}` + "`{{.Text}}`" + `{{else if eq .Class "failed"}}**{{.Text}}**{{else}}{{.Text}}{{end}}{{end}}
+{{- define "text"}}{{range .}}{{template "span" .}}{{end}}{{end}}
+{{- define "cell"}}{{range .}}{{template "span" (cell .)}}{{end}}{{end}}
+{{- define "block"}}
+{{- if .Heading}}### {{template "text" .Heading}}
+{{else if .Text}}{{template "text" .Text}}
+{{else if .Items}}{{range .Items}}- {{template "text" .}}
+{{end}}
+{{- else}}|{{range .Header}} {{.}} |{{end}}
+|{{range .Header}} --- |{{end}}
+{{range .Rows}}|{{range .}} {{template "cell" .}} |{{end}}
+{{end}}
+{{- end}}
+{{- end -}}
+
+# {{.Title}}
+
+{{range .Summary}}- {{template "text" .}}
+{{end}}
+{{- range .Sections}}
+## {{.Title}}
+{{range .Blocks}}
+{{template "block" .}}
+{{- end}}
+{{- end}}`
+
+const htmlReport = `
+{{- define "span"}}{{if .Code}}<code>{{.Text}}</code>{{else if .Class}}<span class="{{.Class}}">{{.Text}}</span>{{else}}{{.Text}}{{end}}{{end}}
+{{- define "text"}}{{range .}}{{template "span" .}}{{end}}{{end}}
+{{- define "block"}}
+{{- if .Heading}}
+<h3>{{template "text" .Heading}}</h3>
+{{- else if .Text}}
+<p>{{template "text" .Text}}</p>
+{{- else if .Items}}
+<ul>
+{{- range .Items}}
+<li>{{template "text" .}}</li>
+{{- end}}
+</ul>
+{{- else}}
+<table>
+<tr>{{range .Header}}<th>{{.}}</th>{{end}}</tr>
+{{- range .Rows}}
+<tr>{{range .}}<td>{{template "text" .}}</td>{{end}}</tr>
+{{- end}}
+</table>
+{{- end}}
+{{- end -}}
+
+<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em auto; max-width: 1100px; color: #24292e; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { border: 1px solid #d0d7de; padding: 4px 10px; text-align: left; vertical-align: top; }
+th { background: #f6f8fa; }
+code { font-family: SFMono-Regular, Consolas, monospace; font-size: 90%; word-break: break-all; }
+.failed { color: #cf222e; font-weight: bold; }
+.ok { color: #1a7f37; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<ul>
+{{- range .Summary}}
+<li>{{template "text" .}}</li>
+{{- end}}
+</ul>
+{{- range .Sections}}
+
+<h2>{{.Title}}</h2>
+{{- range .Blocks}}{{template "block" .}}{{end}}
+{{- end}}
+</body>
+</html>
+`
+
+var (
+	markdownTemplate = template.Must(template.New("report").Funcs(reportFuncs).Parse(markdownReport))
+	htmlTemplate     = htmltemplate.Must(htmltemplate.New("report").Parse(htmlReport))
+)
@@ -0,0 +1,179 @@
+package recover
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/components/key"
+	"github.com/iosmanthus/learner-recover/components/rpo"
+	"github.com/iosmanthus/learner-recover/components/tables"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+var reportEpoch = time.Date(2021, 8, 1, 10, 0, 0, 0, time.UTC)
+
+func reportAt(sec int) time.Time {
+	return reportEpoch.Add(time.Duration(sec) * time.Second)
+}
+
+func tableKey(id int64) string {
+	return key.Escape(key.EncodeBytes(key.EncodeInt([]byte("t"), id)))
+}
+
+func rowKey(id, handle int64) string {
+	k := append(key.EncodeInt([]byte("t"), id), "_r"...)
+	return key.Escape(key.EncodeBytes(key.EncodeInt(k, handle)))
+}
+
+// testReport fills every section of a report, a | in the cells and a <
+// in the text tell the escaping of the formats.
+func testReport(t *testing.T) *Report {
+	dump := filepath.Join(t.TempDir(), "tables.tsv")
+	err := ioutil.WriteFile(dump, []byte("TABLE_SCHEMA\tTABLE_NAME\tTIDB_TABLE_ID\n"+
+		"shop\tusers\t30\n"+
+		"shop\torders\t45\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := tables.FromDump(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := common.NewLearnerGroups(nil, map[string]interface{}{"backup": "zone in (backup-a, backup-b)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		Backend:        BackendKubernetes,
+		ClusterVersion: "v5.1.0",
+		ClusterName:    "backup",
+		User:           "tidb",
+		SSHPort:        22,
+		LearnerGroups:  groups,
+		Groups: []*Group{{Name: "backup", Nodes: []*Node{
+			{Host: "10.0.2.1", Port: 20160},
+			{Host: "10.0.2.2", Port: 20160},
+		}}},
+		FailedStores: []uint64{1, 2, 3},
+		JoinTopology: "join.yaml",
+		RecoverInfoFile: &common.RecoverInfo{
+			StoreIDs:        []uint64{1, 2, 3},
+			ClusterID:       "6994532093271186954",
+			AllocID:         5000,
+			LearnerStoreIDs: map[string][]uint64{"backup": {4, 5}},
+		},
+		PDRecoverPath: "bin/pd-recover",
+		Kubernetes:    &KubernetesConfig{Namespace: "tidb", TidbCluster: "backup"},
+		AuditLog:      "audit.log",
+	}
+	c.NewTopology.Path = "new.yaml"
+	c.TiKVCtl.Src, c.TiKVCtl.Dest = "bin/tikv-ctl", "/root/tikv-ctl"
+
+	kept := &RegionSummary{RegionID: 3, Host: "10.0.2.1", Group: "backup", StartKey: rowKey(45, 1000), Version: 5, ConfVer: 3, AppliedIndex: 90, CommitIndex: 95, Voters: 3, Learners: 2}
+	dropped := &RegionSummary{RegionID: 2, Host: "10.0.2.2", Group: "backup", StartKey: tableKey(30), EndKey: tableKey(31), Version: 4, ConfVer: 3, AppliedIndex: 80}
+	rep := &Report{
+		Started:  reportEpoch,
+		Finished: reportAt(75),
+		Config:   c,
+		Steps: []*StepResult{
+			{Name: StepPrepare, Start: reportAt(0), Duration: 2 * time.Second},
+			{Name: StepRebuildPD, Start: reportAt(2), Duration: 1500 * time.Millisecond, Error: "pd-recover | exit 1"},
+		},
+		Commands: []*CommandResult{
+			{Step: StepPrepare, Host: "10.0.2.1", Command: "tikv-ctl --version", Duration: time.Second},
+			{Step: StepRebuildPD, Host: "10.0.1.1", Command: "pd-recover -endpoints http://10.0.1.1:2379 | tee", Duration: time.Second, Error: "exit status 1"},
+		},
+		Conflicts: []*ConflictDecision{{Kept: kept, Dropped: dropped, Reason: ReasonEpoch}},
+		Coverage: &Coverage{
+			Regions:    4,
+			Groups:     []*GroupCoverage{{Group: "backup", Regions: 4}},
+			Gaps:       []*KeyRange{{StartKey: tableKey(30), EndKey: rowKey(30, 7)}},
+			Tombstones: 1,
+			Unapplied:  []*RegionSummary{kept},
+		},
+		RPO: []*GroupRPO{
+			{Group: "backup", Lag: "1.5s", LagUpper: "2s", P99: "1.8s", SafeTime: reportAt(-2)},
+			{Group: "standby", Error: "no sample"},
+		},
+		Loss: &LossEstimate{
+			FailureTime: reportAt(-1),
+			Regions: []*RegionLoss{
+				{RegionID: 3, StartKey: rowKey(45, 1000), Host: "10.0.2.1", Group: "backup", LearnerIndex: 90, VoterIndex: 100, Entries: 10, Since: reportAt(-4), Window: 3 * time.Second},
+			},
+			Examined:    4,
+			LostEntries: 10,
+			MaxWindow:   3 * time.Second,
+			Unknown:     1,
+			SafePoints:  []*rpo.SafePoint{{Group: "backup", SafeTime: reportAt(-3), LagUpper: 2 * time.Second}},
+		},
+		Health: &Health{
+			Members: []*MemberHealth{{Name: "pd-0", URLs: "http://10.0.1.1:2379", Healthy: true}, {Name: "pd-1", URLs: "http://10.0.1.2:2379"}},
+			Stores:  []*StoreHealth{{ID: 4, Address: "10.0.2.1:20160", State: "Up", RegionCount: 4, LeaderCount: 4}},
+		},
+		Placement: &Placement{
+			Replication: &common.ReplicationConfig{MaxReplicas: 3, LocationLabels: "zone,host", IsolationLevel: "zone"},
+			Mode: &common.ReplicationMode{Mode: common.ModeDRAutoSync, DRAutoSync: &common.DRAutoSync{
+				LabelKey: "zone", Primary: "backup-a", DR: "backup-b", PrimaryReplicas: 2, DRReplicas: 1,
+			}},
+			Rules: []*common.PlacementRule{{
+				GroupID: "pd", ID: "default", Role: "voter", Count: 3,
+				LabelConstraints: []*common.LabelConstraint{{Key: "zone", Op: "in", Values: []string{"backup-a", "backup-b"}}},
+			}},
+			Changes: []string{"rule pd/backup of 3 learners dropped"},
+			Error:   "rules <refused>",
+		},
+		Catalog: catalog,
+	}
+	return rep
+}
+
+// emptyReport is a recovery failed before collecting anything.
+func emptyReport() *Report {
+	rep := NewReport(&Config{ClusterName: "backup", Backend: BackendTiUP, RecoverInfoFile: &common.RecoverInfo{}})
+	rep.Started, rep.Finished = reportEpoch, reportAt(1)
+	rep.Error = errors.New("no learner <left>").Error()
+	return rep
+}
+
+func TestReportGolden(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range []struct {
+		name   string
+		report *Report
+	}{
+		{"full", testReport(t)},
+		{"empty", emptyReport()},
+	} {
+		path := filepath.Join(dir, c.name)
+		if err := c.report.Write(path); err != nil {
+			t.Fatal(err)
+		}
+		for _, ext := range []string{".md", ".html"} {
+			got, err := ioutil.ReadFile(path + ext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", "report-"+c.name+ext+".golden")
+			if *update {
+				if err = ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Fatalf("%s%s differs from %s, rerun with -update if expected:\n%s", c.name, ext, golden, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package recover
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/iosmanthus/learner-recover/schema"
+)
+
+func TestSchema(t *testing.T) {
+	diff, err := schema.Diff(schema.KindRecover, reflect.TypeOf(_Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff) != 0 {
+		t.Fatalf("the schema drifts from the config:\n%v", diff)
+	}
+}
+
+func TestConfigUnknownKeys(t *testing.T) {
+	for _, c := range []struct {
+		config, err string
+	}{
+		{"cluster-name: backup\nclustre-version: v5.1.0\n", "field clustre-version not found"},
+		{"cluster-name: backup\ntikv-ctl:\n  source: bin/tikv-ctl\n", "field source not found"},
+		{"backend: kubernetes\nkubernetes:\n  pd:\n    replica: 3\n", "field replica not found"},
+	} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := ioutil.WriteFile(path, []byte(c.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewConfig(path); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("expect %q, got %v", c.err, err)
+		}
+	}
+}
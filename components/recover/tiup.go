@@ -0,0 +1,120 @@
+package recover
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/components/cluster"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/resty.v1"
+)
+
+// tiupBackend runs tikv-ctl and systemctl over SSH and rebuilds the cluster
+// with tiup cluster, every tiup operation is confirmed by tiup cluster display.
+type tiupBackend struct {
+	config *Config
+	run    Runner
+}
+
+// Discover does nothing, the nodes are taken from the old topology.
+func (b *tiupBackend) Discover(_ context.Context) error {
+	return nil
+}
+
+func (b *tiupBackend) ssh(ctx context.Context, host string, args ...string) *exec.Cmd {
+	c := b.config
+	args = append([]string{"-p", fmt.Sprintf("%v", c.SSHPort), fmt.Sprintf("%s@%s", c.User, host)}, args...)
+	return exec.CommandContext(ctx, "ssh", args...)
+}
+
+func (b *tiupBackend) Prepare(ctx context.Context, logger *log.Entry, node *Node) error {
+	c := b.config
+	path := fmt.Sprintf("%s@%s:%s", c.User, node.Host, c.TiKVCtl.Dest)
+	cmd := exec.CommandContext(ctx, "scp",
+		"-P",
+		fmt.Sprintf("%v", c.SSHPort),
+		c.TiKVCtl.Src,
+		path)
+	_, err := b.run.Run(logger, node.Host, cmd)
+	return err
+}
+
+func (b *tiupBackend) StopTiKV(ctx context.Context, logger *log.Entry, node *Node) error {
+	cmd := b.ssh(ctx, node.Host, "sudo", "systemctl", "disable", "--now", fmt.Sprintf("tikv-%v.service", node.Port))
+	_, err := b.run.Run(logger, node.Host, cmd)
+	return err
+}
+
+func (b *tiupBackend) TiKVCtl(ctx context.Context, node *Node, args ...string) *exec.Cmd {
+	args = append([]string{b.config.TiKVCtl.Dest, "--db", fmt.Sprintf("%s/db", node.DataDir)}, args...)
+	return b.ssh(ctx, node.Host, args...)
+}
+
+// clusterManager returns the manager of the rebuilt cluster, the tiup commands are
+// run by the runner with the logger.
+func (b *tiupBackend) clusterManager(logger *log.Entry) cluster.Manager {
+	tiup := &cluster.TiUP{Run: func(cmd *exec.Cmd) (string, error) {
+		return b.run.Run(logger, "", cmd)
+	}}
+	return cluster.Verify(tiup, b.config.ClusterTimeout, 5*time.Second)
+}
+
+func (b *tiupBackend) RebuildPD(ctx context.Context) error {
+	c := b.config
+
+	logger := stepLog(StepRebuildPD)
+	logger.Info("Rebuilding PD server")
+	manager := b.clusterManager(logger)
+
+	// The cluster deployed by a former run is kept.
+	if deployed, err := manager.Display(ctx, c.ClusterName); err == nil && cluster.Check(deployed, c.NewTopology.Path, false) == nil {
+		logger.WithField("cluster", c.ClusterName).Warn("Cluster is already deployed, skip deploying")
+	} else if err = manager.Deploy(ctx, c.ClusterName, c.ClusterVersion, c.NewTopology.Path); err != nil {
+		return err
+	}
+
+	err := manager.Start(ctx, c.ClusterName)
+	if err != nil {
+		return err
+	}
+
+	// PDRecover
+	pdServer := c.NewTopology.PDServers[0]
+	pdLog := logger.WithFields(log.Fields{common.FieldHost: pdServer.Host, common.FieldPort: pdServer.ClientPort})
+	cmd := exec.CommandContext(ctx, c.PDRecoverPath,
+		"-endpoints", fmt.Sprintf("http://%s:%v", pdServer.Host, pdServer.ClientPort),
+		"-cluster-id", c.RecoverInfoFile.ClusterID, "-alloc-id", fmt.Sprintf("%v", c.RecoverInfoFile.AllocID))
+	_, err = b.run.Run(pdLog, pdServer.Host, cmd)
+
+	if err != nil {
+		return err
+	}
+
+	if err = manager.Restart(ctx, c.ClusterName); err != nil {
+		return err
+	}
+
+	client := resty.New()
+	for {
+		pdLog.Info("Waiting PD server online")
+		resp, err := client.R().SetContext(ctx).Get(fmt.Sprintf("http://%s/pd/api/v1/config/replicate", c.PDAddress))
+		if err == nil && resp.StatusCode() == http.StatusOK {
+			break
+		}
+		time.Sleep(time.Second * 1)
+	}
+
+	return nil
+}
+
+func (b *tiupBackend) Join(ctx context.Context) error {
+	c := b.config
+	logger := stepLog(StepJoin)
+	logger.Info("Joining the TiKV servers")
+	return b.clusterManager(logger).ScaleOut(ctx, c.ClusterName, c.JoinTopology)
+}
@@ -1,45 +1,118 @@
 package recover
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/google/btree"
-	"github.com/pingcap/tiup/pkg/cluster/spec"
-	"os/exec"
+	"io"
+	"os"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/components/audit"
+	"github.com/iosmanthus/learner-recover/components/key"
+	"github.com/iosmanthus/learner-recover/components/rpo"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type ResolveConflicts struct {
 	conflicts []*common.RegionState
+	decisions []*ConflictDecision
 	index     *btree.BTree
+	// tombstones counts the tombstoned replicas skipped.
+	tombstones int
+	// priority ranks the learner groups, the lower the more preferred.
+	priority map[string]int
+	// err is the first region failing to be merged.
+	err error
 }
 
-func NewResolveConflicts() *ResolveConflicts {
-	return &ResolveConflicts{index: btree.New(2)}
+func NewResolveConflicts(groups []string) *ResolveConflicts {
+	priority := make(map[string]int)
+	for i, group := range groups {
+		priority[group] = i
+	}
+	return &ResolveConflicts{index: btree.New(2), priority: priority}
+}
+
+// prefer reports whether the item a is kept over the overlapping item b,
+// and why. A replica applying a snapshot loses, then the newer version wins,
+// as a split or a merge bumps the version of the regions it leaves. The
+// conf_ver and the applied index only compare replicas of the same region.
+// Ties are broken by the order of recover-from.
+func (r *ResolveConflicts) prefer(a, b *Item) (bool, string) {
+	if a.Applying() != b.Applying() {
+		return b.Applying(), ReasonApplying
+	}
+	epoch1 := a.LocalState.Region.RegionEpoch
+	epoch2 := b.LocalState.Region.RegionEpoch
+	if epoch1.Version != epoch2.Version {
+		return epoch1.Version > epoch2.Version, ReasonEpoch
+	}
+	if a.RegionId == b.RegionId {
+		if epoch1.ConfVer != epoch2.ConfVer {
+			return epoch1.ConfVer > epoch2.ConfVer, ReasonEpoch
+		}
+		if a.ApplyState.AppliedIndex != b.ApplyState.AppliedIndex {
+			return a.ApplyState.AppliedIndex > b.ApplyState.AppliedIndex, ReasonAppliedIndex
+		}
+	}
+	if a.Group != b.Group {
+		return r.priority[a.Group] < r.priority[b.Group], ReasonRecoverFrom
+	}
+	return true, ReasonTie
+}
+
+// Err returns the error of the first region failing to be merged.
+func (r *ResolveConflicts) Err() error {
+	return r.err
+}
+
+// Decisions returns the resolved conflicts in the order they are met.
+func (r *ResolveConflicts) Decisions() []*ConflictDecision {
+	return r.decisions
 }
 
-func (r *ResolveConflicts) ResolveConflicts(ctx context.Context, c *Config) error {
+// Kept returns the regions left after resolving the conflicts.
+func (r *ResolveConflicts) Kept() []*common.RegionState {
+	var kept []*common.RegionState
+	r.index.Ascend(func(i btree.Item) bool {
+		kept = append(kept, i.(*Item).RegionState)
+		return true
+	})
+	return kept
+}
+
+// Coverage returns the regions kept and the key ranges none of them covers.
+func (r *ResolveConflicts) Coverage() *Coverage {
+	c := newCoverage(r.Kept())
+	c.Tombstones = r.tombstones
+	return c
+}
+
+func (r *ResolveConflicts) ResolveConflicts(ctx context.Context, rescuer *ClusterRescuer) error {
 	type Target struct {
-		DataDir string
-		IDs     []common.RegionId
+		Node *Node
+		IDs  []common.RegionId
 	}
 
+	var targets []string
 	conflicts := make(map[string]*Target)
 	for _, conflict := range r.conflicts {
-		target := fmt.Sprintf("%s@%s", c.User, conflict.Host)
+		target := fmt.Sprintf("%s:%s", conflict.Host, conflict.DataDir)
 		if _, ok := conflicts[target]; !ok {
-			conflicts[target] = &Target{DataDir: conflict.DataDir}
+			conflicts[target] = &Target{Node: &Node{Host: conflict.Host, DataDir: conflict.DataDir}}
+			targets = append(targets, target)
 		}
 		conflicts[target].IDs = append(conflicts[target].IDs, conflict.RegionId)
 	}
 
-	for target, conflict := range conflicts {
+	for _, target := range targets {
+		conflict := conflicts[target]
 		s := ""
 		for i, id := range conflict.IDs {
 			if i == 0 {
@@ -49,11 +122,13 @@ func (r *ResolveConflicts) ResolveConflicts(ctx context.Context, c *Config) erro
 			}
 		}
 
-		cmd := exec.CommandContext(ctx,
-			"ssh", "-p", fmt.Sprintf("%v", c.SSHPort), target,
-			c.TiKVCtl.Dest, "--db", fmt.Sprintf("%s/db", conflict.DataDir), "tombstone", "--force", "-r", s)
+		logger := stepLog(StepResolve).WithField(common.FieldHost, conflict.Node.Host)
+		for _, id := range conflict.IDs {
+			logger.WithField(common.FieldRegionID, id).Info("Tombstoning conflicting region")
+		}
+		cmd := rescuer.backend.TiKVCtl(ctx, conflict.Node, "tombstone", "--force", "-r", s)
 
-		_, err := common.Run(cmd)
+		_, err := rescuer.Run(logger, conflict.Node.Host, cmd)
 		if err != nil {
 			return err
 		}
@@ -61,176 +136,188 @@ func (r *ResolveConflicts) ResolveConflicts(ctx context.Context, c *Config) erro
 	return nil
 }
 
-//func isOverlap(a *common.RegionState, b *common.RegionState) bool {
-//	m, n := a.LocalState.Region.StartKey, a.LocalState.Region.EndKey
-//	p, q := b.LocalState.Region.StartKey, b.LocalState.Region.EndKey
-//	return (n == "" || strings.Compare(n, p) > 0) && (q == "" || strings.Compare(q, m) > 0)
-//}
-
+// Item is a kept region in the index, in the descending order of the start
+// keys. The keys are parsed from tikv-ctl, an empty end key is nil.
 type Item struct {
-	SortKey string
+	SortKey []byte
+	EndKey  []byte
 	*common.RegionState
 }
 
+// newItem parses the boundaries of the region. A key failing to parse is an
+// error rather than compared as text, since the order of the keys decides
+// the replicas tombstoned.
+func newItem(state *common.RegionState) (*Item, error) {
+	start, err := key.Parse(state.LocalState.Region.StartKey)
+	if err != nil {
+		return nil, fmt.Errorf("region %v on %s: start key: %v", state.RegionId, state.Host, err)
+	}
+	item := &Item{SortKey: start, RegionState: state}
+	if end := state.LocalState.Region.EndKey; end != "" {
+		if item.EndKey, err = key.Parse(end); err != nil {
+			return nil, fmt.Errorf("region %v on %s: end key: %v", state.RegionId, state.Host, err)
+		}
+	}
+	return item, nil
+}
+
 func (i *Item) Less(than btree.Item) bool {
 	v := than.(*Item)
-	return strings.Compare(i.SortKey, v.SortKey) >= 0
+	return bytes.Compare(i.SortKey, v.SortKey) > 0
 }
 
-func (r *ResolveConflicts) Merge(_ *common.RegionInfos, b *common.RegionInfos) *common.RegionInfos {
-	if r.index.Len() == 0 {
-		for _, state := range b.StateMap {
-			r.index.ReplaceOrInsert(&Item{
-				SortKey:     state.LocalState.Region.StartKey,
-				RegionState: state,
-			})
+// overlaps returns the kept regions overlapping the item. The kept regions
+// never overlap, so their end keys descend with their start keys.
+func (r *ResolveConflicts) overlaps(item *Item) []*Item {
+	start, end := item.SortKey, item.EndKey
+
+	var items []*Item
+	visit := func(i btree.Item) bool {
+		other := i.(*Item)
+		if end != nil && bytes.Compare(other.SortKey, end) >= 0 {
+			return true
 		}
-		return nil
+		if other.EndKey != nil && bytes.Compare(other.EndKey, start) <= 0 {
+			return false
+		}
+		items = append(items, other)
+		return true
 	}
+	if end == nil {
+		r.index.Ascend(visit)
+	} else {
+		r.index.AscendGreaterOrEqual(&Item{SortKey: end}, visit)
+	}
+	return items
+}
 
+func (r *ResolveConflicts) decide(kept, dropped *common.RegionState, reason string) {
+	r.decisions = append(r.decisions, &ConflictDecision{
+		Kept:    summarize(kept),
+		Dropped: summarize(dropped),
+		Reason:  reason,
+	})
+	r.conflicts = append(r.conflicts, dropped)
+	if kept.Group != dropped.Group {
+		stepLog(StepResolve).WithFields(log.Fields{
+			common.FieldRegionID: kept.RegionId,
+			common.FieldGroup:    kept.Group,
+			common.FieldHost:     kept.Host,
+			"dropped_region_id":  dropped.RegionId,
+			"dropped_group":      dropped.Group,
+			"dropped_host":       dropped.Host,
+		}).Info("Resolved region conflict across learner groups")
+	}
+}
+
+// Merge adds the regions of b to the index. A region is kept only if it is
+// preferred over all the kept regions it overlaps, which are dropped then.
+// Tombstoned replicas are already left out of b. Once a region fails to be
+// indexed, the rest are ignored and Err returns the failure.
+func (r *ResolveConflicts) Merge(_ *common.RegionInfos, b *common.RegionInfos) *common.RegionInfos {
+	if r.err != nil {
+		return nil
+	}
+	r.tombstones += b.Tombstones
 	for _, state := range b.StateMap {
-		var other *Item
-		if state.LocalState.Region.EndKey == "" {
-			other = r.index.Min().(*Item)
-		} else {
-			item := &Item{
-				SortKey: state.LocalState.Region.EndKey,
-			}
-			r.index.AscendGreaterOrEqual(item, func(i btree.Item) bool {
-				other = i.(*Item)
-				return false
-			})
+		item, err := newItem(state)
+		if err != nil {
+			r.err = err
+			return nil
 		}
-
-		if other != nil &&
-			(other.LocalState.Region.EndKey == "" ||
-				strings.Compare(other.LocalState.Region.EndKey, state.LocalState.Region.StartKey) > 0) {
-			// resolve conflicts
-			version1 := state.LocalState.Region.RegionEpoch.Version
-			version2 := other.LocalState.Region.RegionEpoch.Version
-			if version1 > version2 ||
-				(version1 == version2 && state.ApplyState.AppliedIndex >= other.ApplyState.AppliedIndex) {
-
-				r.conflicts = append(r.conflicts, other.RegionState)
-				r.index.Delete(other)
-				r.index.ReplaceOrInsert(&Item{
-					SortKey:     state.LocalState.Region.StartKey,
-					RegionState: state,
-				})
-			} else {
-				r.conflicts = append(r.conflicts, state)
+		overlaps := r.overlaps(item)
+
+		var winner *common.RegionState
+		var reason string
+		for _, other := range overlaps {
+			if keep, why := r.prefer(item, other); !keep {
+				winner, reason = other.RegionState, why
+				break
 			}
-		} else {
-			r.index.ReplaceOrInsert(&Item{
-				SortKey:     state.LocalState.Region.StartKey,
-				RegionState: state,
-			})
+		}
+		if winner != nil {
+			r.decide(winner, state, reason)
+			continue
 		}
 
+		for _, other := range overlaps {
+			_, why := r.prefer(item, other)
+			r.decide(state, other.RegionState, why)
+			r.index.Delete(other)
+		}
+		r.index.ReplaceOrInsert(item)
 	}
 	return nil
 }
 
 func (r *ClusterRescuer) dropLogs(ctx context.Context) error {
-	config := r.config
-
-	ch := make(chan error, len(config.Nodes))
-
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	wg := &sync.WaitGroup{}
-	wg.Add(len(config.Nodes))
-	defer wg.Wait()
-
-	for _, node := range config.Nodes {
-		go func(node *spec.TiKVSpec) {
-			defer wg.Done()
-
-			path := fmt.Sprintf("%s/%s/db", node.DeployDir, node.DataDir)
-			log.Infof("Dropping raft logs of TiKV server on %s:%v:%s", node.Host, node.Port, path)
-			cmd := exec.CommandContext(ctx,
-				"ssh", "-p", fmt.Sprintf("%v", config.SSHPort), fmt.Sprintf("%s@%s", config.User, node.Host),
-				config.TiKVCtl.Dest, "--db", path, "unsafe-recover", "drop-unapplied-raftlog", "--all-regions")
-			_, err := common.Run(cmd)
-			ch <- err
-		}(node)
-	}
-
-	for i := 0; i < len(config.Nodes); i++ {
-		if err := <-ch; err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return r.forEachNode(ctx, func(ctx context.Context, node *Node) error {
+		logger := nodeLog(StepDropLogs, node.Host, node.Port).WithField("db", fmt.Sprintf("%s/db", node.DataDir))
+		logger.Info("Dropping raft logs of TiKV server")
+		cmd := r.backend.TiKVCtl(ctx, node, "unsafe-recover", "drop-unapplied-raftlog", "--all-regions")
+		_, err := r.Run(logger, node.Host, cmd)
+		return err
+	})
 }
 
 func (r *ClusterRescuer) promoteLearner(ctx context.Context) error {
 	config := r.config
 
-	ch := make(chan error, len(config.Nodes))
-
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	wg := &sync.WaitGroup{}
-	wg.Add(len(config.Nodes))
-	defer wg.Wait()
-
-	for _, node := range config.Nodes {
-		go func(node *spec.TiKVSpec) {
-			defer wg.Done()
-
-			// remove-fail-stores --promote-learner --all-regions
-			log.Infof("Promoting learners of TiKV server on %s:%v", node.Host, node.Port)
-
-			var stores string
-			for i, store := range config.RecoverInfoFile.StoreIDs {
-				if i == 0 {
-					stores += fmt.Sprintf("%v", store)
-				} else {
-					stores += fmt.Sprintf(",%v", store)
-				}
-			}
+	var stores string
+	for i, store := range config.FailedStores {
+		if i == 0 {
+			stores += fmt.Sprintf("%v", store)
+		} else {
+			stores += fmt.Sprintf(",%v", store)
+		}
+	}
 
-			path := fmt.Sprintf("%s/%s/db", node.DeployDir, node.DataDir)
-			cmd := exec.CommandContext(ctx,
-				"ssh", "-p", fmt.Sprintf("%v", config.SSHPort), fmt.Sprintf("%s@%s", config.User, node.Host),
-				config.TiKVCtl.Dest, "--db", path, "unsafe-recover",
-				"remove-fail-stores", "--promote-learner", "--all-regions", "-s", stores)
+	return r.forEachNode(ctx, func(ctx context.Context, node *Node) error {
+		// remove-fail-stores --promote-learner --all-regions
+		logger := nodeLog(StepPromote, node.Host, node.Port)
+		logger.Info("Promoting learners of TiKV server")
 
-			_, err := common.Run(cmd)
-			ch <- err
-		}(node)
-	}
+		cmd := r.backend.TiKVCtl(ctx, node, "unsafe-recover",
+			"remove-fail-stores", "--promote-learner", "--all-regions", "-s", stores)
 
-	for _, node := range config.Nodes {
-		if err := <-ch; err != nil {
-			log.Errorf("Fail to promote learners of TiKV server on %s:%v: %v", node.Host, node.Port, err)
-			return err
+		_, err := r.Run(logger, node.Host, cmd)
+		if err != nil {
+			logger.WithError(err).Error("Fail to promote learners of TiKV server")
 		}
-	}
-
-	return nil
+		return err
+	})
 }
 
+// RemoteTiKVCtl fetches the regions of a learner node with tikv-ctl run by
+// the backend.
 type RemoteTiKVCtl struct {
-	Controller string
-	DataDir    string
-	User       string
-	Host       string
-	SSHPort    int
+	Backend Backend
+	Node    *Node
+	Group   string
+	Audit   *audit.Log
 }
 
 func (c *RemoteTiKVCtl) Fetch(ctx context.Context) (*common.RegionInfos, error) {
-	log.Infof("fetching region infos from: %s", c.Host)
-	cmd := exec.CommandContext(ctx,
-		"ssh", "-p", fmt.Sprintf("%v", c.SSHPort), fmt.Sprintf("%s@%s", c.User, c.Host),
-		c.Controller, "--db", fmt.Sprintf("%s/db", c.DataDir), "raft", "region", "--all-regions")
+	host := c.Node.Host
+	logger := stepLog(StepFetch).WithFields(log.Fields{common.FieldHost: host, common.FieldGroup: c.Group})
+	logger.Info("Fetching region infos")
+	cmd := c.Backend.TiKVCtl(ctx, c.Node, "raft", "region", "--all-regions")
 
+	start := time.Now()
+	intent, err := c.Audit.Begin(host, StepFetch, cmd.Args, start)
+	if err != nil {
+		return nil, fmt.Errorf("fail to write audit log: %v", err)
+	}
 	resp, err := cmd.Output()
+	if auditErr := c.Audit.Finish(intent, host, StepFetch, cmd.Args, start, resp, err); auditErr != nil {
+		return nil, fmt.Errorf("fail to write audit log: %v", auditErr)
+	}
+	logger = logger.WithFields(log.Fields{
+		common.FieldCommand:  strings.Join(cmd.Args, " "),
+		common.FieldDuration: time.Since(start).String(),
+	})
 	if err != nil {
+		logger.WithError(err).Error("Fail to fetch region infos")
 		return nil, err
 	}
 
@@ -240,47 +327,105 @@ func (c *RemoteTiKVCtl) Fetch(ctx context.Context) (*common.RegionInfos, error)
 	}
 
 	for id := range infos.StateMap {
-		infos.StateMap[id].Host = c.Host
-		infos.StateMap[id].DataDir = c.DataDir
+		infos.StateMap[id].Host = host
+		infos.StateMap[id].DataDir = c.Node.DataDir
+		infos.StateMap[id].Group = c.Group
 	}
 
-	log.Infof("[done] fetching region infos from: %s", c.Host)
+	logger.WithFields(log.Fields{
+		"regions":    len(infos.StateMap),
+		"tombstones": infos.Tombstones,
+	}).Info("Fetched region infos")
 
 	return infos, nil
 }
 
-func (r *ClusterRescuer) UnsafeRecover(ctx context.Context) error {
+// confirmLoss shows the data likely lost by promoting the learners on out and
+// asks the operator to confirm it on in.
+func (r *ClusterRescuer) confirmLoss(in io.Reader, out io.Writer, kept []*common.RegionState, groups []string) error {
 	c := r.config
 
-	err := r.dropLogs(ctx)
+	var all []string
+	for _, group := range c.LearnerGroups {
+		all = append(all, group.Name)
+	}
+	history, err := rpo.ReadApplyHistory(c.RPOHistory, all)
 	if err != nil {
-		return err
+		return fmt.Errorf("rpo-history: %v", err)
 	}
 
+	estimate := EstimateLoss(history, kept, groups, c.FailureTime)
+	r.report.setLoss(estimate)
+	estimate.Print(out, 20)
+	stepLog(StepUnsafe).WithFields(log.Fields{
+		"failure_time": estimate.FailureTime,
+		"lost_regions": len(estimate.Regions),
+		"lost_entries": estimate.LostEntries,
+		"loss_window":  estimate.MaxWindow.String(),
+	}).Warn("Estimated data loss")
+
+	if c.AssumeYes {
+		return nil
+	}
+	return confirm(in, out, "Promote the learners and accept the data loss above?")
+}
+
+// UnsafeRecover resolves the conflicts of the learners and promotes them.
+// The regions are fetched before the raft logs are dropped, so that the
+// committed entries dropped are reported.
+func (r *ClusterRescuer) UnsafeRecover(ctx context.Context) error {
+	c := r.config
+
 	collector := common.NewRegionCollector()
 
-	var fetchers []common.Fetcher
-	for _, node := range c.Nodes {
-		fetcher := &RemoteTiKVCtl{
-			Controller: c.TiKVCtl.Dest,
-			DataDir:    fmt.Sprintf("%s/%s", node.DeployDir, node.DataDir),
-			User:       c.User,
-			Host:       node.Host,
-			SSHPort:    c.SSHPort,
+	var (
+		fetchers []common.Fetcher
+		groups   []string
+	)
+	for _, group := range c.Groups {
+		groups = append(groups, group.Name)
+		for _, node := range group.Nodes {
+			fetcher := &RemoteTiKVCtl{
+				Backend: r.backend,
+				Node:    node,
+				Group:   group.Name,
+				Audit:   r.audit,
+			}
+			fetchers = append(fetchers, fetcher)
 		}
-		fetchers = append(fetchers, fetcher)
 	}
 
-	log.Info("fetching region infos")
-	resolver := NewResolveConflicts()
+	stepLog(StepFetch).Info("Fetching region infos")
+	resolver := NewResolveConflicts(groups)
 
-	_, err = collector.Collect(ctx, fetchers, resolver)
+	_, err := collector.Collect(ctx, fetchers, resolver)
 	if err != nil {
 		return err
 	}
+	if err = resolver.Err(); err != nil {
+		return err
+	}
+
+	stepLog(StepResolve).Warn("Resolving region conflicts")
+	coverage := resolver.Coverage()
+	r.report.setResolution(resolver.Decisions(), coverage)
+	if n := coverage.UnappliedEntries(); n > 0 {
+		stepLog(StepResolve).WithFields(log.Fields{
+			"regions": len(coverage.Unapplied),
+			"entries": n,
+		}).Warn("Committed entries not applied by the learners are to be dropped")
+	}
+	if c.RPOHistory != "" {
+		if err = r.confirmLoss(os.Stdin, os.Stdout, resolver.Kept(), groups); err != nil {
+			return err
+		}
+	}
+
+	if err = r.dropLogs(ctx); err != nil {
+		return err
+	}
 
-	log.Warn("resolving region conflicts")
-	err = resolver.ResolveConflicts(ctx, c)
+	err = resolver.ResolveConflicts(ctx, r)
 	if err != nil {
 		return err
 	}
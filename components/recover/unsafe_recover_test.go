@@ -0,0 +1,171 @@
+package recover
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/iosmanthus/learner-recover/common"
+)
+
+func testRegion(id common.RegionId, host, start, end string, version int, applied uint64) *common.RegionState {
+	state := &common.RegionState{RegionId: id, Host: host, Group: common.DefaultLearnerGroup}
+	state.LocalState.Region.StartKey = start
+	state.LocalState.Region.EndKey = end
+	state.LocalState.Region.RegionEpoch.Version = version
+	state.ApplyState.AppliedIndex = applied
+	return state
+}
+
+func conf(state *common.RegionState, confVer uint64) *common.RegionState {
+	state.LocalState.Region.RegionEpoch.ConfVer = confVer
+	return state
+}
+
+func testItem(t *testing.T, state *common.RegionState) *Item {
+	item, err := newItem(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return item
+}
+
+func testInfos(states ...*common.RegionState) *common.RegionInfos {
+	infos := common.NewRegionInfos()
+	for _, state := range states {
+		infos.StateMap[state.RegionId] = state
+	}
+	return infos
+}
+
+func describe(states []*common.RegionState) string {
+	var s []string
+	for _, state := range states {
+		s = append(s, fmt.Sprintf("%v@%s", state.RegionId, state.Host))
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func TestResolveConflicts(t *testing.T) {
+	r := NewResolveConflicts([]string{common.DefaultLearnerGroup})
+	r.Merge(nil, testInfos(
+		testRegion(2, "a", "", "g", 5, 100),
+		testRegion(3, "a", "g", "m", 5, 100),
+		testRegion(4, "a", "m", "", 5, 100),
+	))
+	// Adjacent to the kept regions, no conflict.
+	r.Merge(nil, testInfos(testRegion(5, "b", "m", "", 5, 100)))
+	if len(r.Decisions()) != 1 || r.Decisions()[0].Reason != ReasonTie {
+		t.Fatalf("unexpected decisions %+v", r.Decisions())
+	}
+	// Merged from 2 and 3 with a newer epoch, both are dropped.
+	r.Merge(nil, testInfos(testRegion(2, "c", "", "m", 6, 90)))
+	// Overlaps the kept 2 on c with a stale epoch.
+	r.Merge(nil, testInfos(testRegion(2, "d", "", "g", 5, 200)))
+
+	if got := describe(r.Kept()); got != "2@c,5@b" {
+		t.Fatalf("unexpected kept regions %s", got)
+	}
+	if got := describe(r.conflicts); got != "2@a,2@d,3@a,4@a" {
+		t.Fatalf("unexpected conflicts %s", got)
+	}
+	if gaps := r.Coverage().Gaps; len(gaps) != 0 {
+		t.Fatalf("unexpected gaps %+v", gaps)
+	}
+}
+
+func TestResolveConflictsPrefer(t *testing.T) {
+	r := NewResolveConflicts([]string{common.DefaultLearnerGroup, "backup"})
+
+	a := testRegion(2, "a", "", "m", 5, 100)
+	b := testRegion(2, "b", "", "m", 5, 90)
+	b.LocalState.Region.RegionEpoch.ConfVer = 1
+	if ok, reason := r.prefer(testItem(t, a), testItem(t, b)); ok || reason != ReasonEpoch {
+		t.Fatalf("expect the newer conf_ver, got %v, %s", ok, reason)
+	}
+
+	// A snapshot being applied loses to anything.
+	b.LocalState.State = common.StateApplying
+	if ok, reason := r.prefer(testItem(t, a), testItem(t, b)); !ok || reason != ReasonApplying {
+		t.Fatalf("expect the applied replica, got %v, %s", ok, reason)
+	}
+
+	for _, c := range []struct {
+		name   string
+		a, b   *common.RegionState
+		ok     bool
+		reason string
+	}{
+		// The stale parent of a split loses to the child.
+		{"stale parent", testRegion(2, "a", "", "z", 1, 100), testRegion(3, "b", "m", "z", 2, 10), false, ReasonEpoch},
+		{"split child", testRegion(3, "a", "m", "z", 2, 10), testRegion(2, "b", "", "z", 1, 100), true, ReasonEpoch},
+		{"partial", testRegion(2, "a", "", "m", 5, 10), testRegion(3, "b", "g", "", 6, 1), false, ReasonEpoch},
+		// The applied indexes of different regions are not compared.
+		{"same version", testRegion(2, "a", "g", "m", 5, 10), testRegion(3, "b", "g", "m", 5, 100), true, ReasonTie},
+		{"conf_ver", testRegion(2, "a", "g", "m", 5, 10), conf(testRegion(3, "b", "g", "m", 5, 10), 4), true, ReasonTie},
+	} {
+		if ok, reason := r.prefer(testItem(t, c.a), testItem(t, c.b)); ok != c.ok || reason != c.reason {
+			t.Fatalf("%s: got %v, %s", c.name, ok, reason)
+		}
+	}
+	a, b = testRegion(2, "a", "", "m", 5, 10), testRegion(3, "b", "g", "", 5, 100)
+	a.Group = "backup"
+	if ok, reason := r.prefer(testItem(t, a), testItem(t, b)); ok || reason != ReasonRecoverFrom {
+		t.Fatalf("expect the earlier learner group, got %v, %s", ok, reason)
+	}
+}
+
+func TestResolveConflictsSplit(t *testing.T) {
+	parent := testRegion(2, "a", "", "", 1, 100)
+	left := testRegion(2, "c", "", "m", 2, 50)
+	right := testRegion(3, "b", "m", "", 2, 10)
+	// The split regions are kept whatever the order they are met.
+	for _, order := range [][]*common.RegionState{
+		{parent, right, left},
+		{right, parent, left},
+		{left, right, parent},
+	} {
+		r := NewResolveConflicts([]string{common.DefaultLearnerGroup})
+		for _, state := range order {
+			r.Merge(nil, testInfos(state))
+		}
+		if got := describe(r.Kept()); got != "2@c,3@b" {
+			t.Fatalf("unexpected kept regions %s", got)
+		}
+		if gaps := r.Coverage().Gaps; len(gaps) != 0 {
+			t.Fatalf("unexpected gaps %+v", gaps)
+		}
+	}
+}
+
+func TestResolveConflictsMalformedKey(t *testing.T) {
+	r := NewResolveConflicts([]string{common.DefaultLearnerGroup})
+	r.Merge(nil, testInfos(testRegion(2, "a", "", `t\9`, 5, 100)))
+	if err := r.Err(); err == nil || !strings.Contains(err.Error(), "region 2 on a: end key") {
+		t.Fatalf("expect the malformed key reported, got %v", err)
+	}
+	// The regions merged after the failure are ignored.
+	r.Merge(nil, testInfos(testRegion(3, "b", "", "", 5, 100)))
+	if len(r.Kept()) != 0 {
+		t.Fatalf("unexpected kept regions %s", describe(r.Kept()))
+	}
+}
+
+func TestResolveConflictsEscapedKeys(t *testing.T) {
+	r := NewResolveConflicts([]string{common.DefaultLearnerGroup})
+	// The escaped \200 is smaller than "a" as a string but larger as a byte.
+	r.Merge(nil, testInfos(
+		testRegion(2, "a", "", `t\200`, 5, 100),
+		testRegion(3, "a", `t\200`, "", 5, 100),
+	))
+	r.Merge(nil, testInfos(testRegion(4, "b", "ta", "tb", 4, 100)))
+
+	if got := describe(r.conflicts); got != "4@b" {
+		t.Fatalf("unexpected conflicts %s", got)
+	}
+	if d := r.Decisions(); len(d) != 1 || d[0].Kept.RegionID != 2 {
+		t.Fatalf("unexpected decisions %+v", d)
+	}
+}
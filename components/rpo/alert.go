@@ -0,0 +1,301 @@
+package rpo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/common"
+
+	"github.com/go-resty/resty/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+
+	MetricLag           = "lag"
+	MetricFetchFailures = "fetch-failures"
+)
+
+type AlertRule struct {
+	Name      string
+	Metric    string
+	Threshold float64
+	For       time.Duration
+}
+
+// isDurationMetric reports whether the metric is a lag, whose threshold is
+// written in Go duration syntax and compared in seconds.
+func isDurationMetric(metric string) bool {
+	return metric != MetricFetchFailures
+}
+
+// shortDuration formats 5m0s as 5m so it can be used in metric names.
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// Metrics returns the values which alert rules can refer to. Window statistics
+// are named after the percentile and the window, e.g. p99-5m.
+func (r *RPO) Metrics() map[string]float64 {
+	metrics := map[string]float64{
+		MetricLag: r.LagUpper.Seconds(),
+		"p50":     r.Percentiles.P50.Seconds(),
+		"p90":     r.Percentiles.P90.Seconds(),
+		"p99":     r.Percentiles.P99.Seconds(),
+	}
+	for _, w := range r.Windows {
+		window := shortDuration(w.Window)
+		metrics["p50-"+window] = w.P50.Seconds()
+		metrics["p90-"+window] = w.P90.Seconds()
+		metrics["p99-"+window] = w.P99.Seconds()
+		metrics["max-"+window] = w.Max.Seconds()
+	}
+	return metrics
+}
+
+type AlertEvent struct {
+	Group     string    `json:"group"`
+	Rule      string    `json:"rule"`
+	Metric    string    `json:"metric"`
+	Status    string    `json:"status"`
+	Value     string    `json:"value"`
+	Threshold string    `json:"threshold"`
+	Since     time.Time `json:"since"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, event *AlertEvent) error
+}
+
+type Webhook struct {
+	url      string
+	template *template.Template
+	client   *resty.Client
+}
+
+func NewWebhook(url, tmpl string, timeout time.Duration) (*Webhook, error) {
+	var t *template.Template
+	if tmpl != "" {
+		var err error
+		t, err = template.New("webhook").Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				data, err := json.Marshal(v)
+				return string(data), err
+			},
+		}).Parse(tmpl)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Webhook{
+		url:      url,
+		template: t,
+		client:   resty.New().SetTimeout(timeout),
+	}, nil
+}
+
+func (w *Webhook) Notify(ctx context.Context, event *AlertEvent) error {
+	var body []byte
+	if w.template == nil {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		body = data
+	} else {
+		buf := &bytes.Buffer{}
+		if err := w.template.Execute(buf, event); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	resp, err := w.client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetBody(body).
+		Post(w.url)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() < http.StatusOK || resp.StatusCode() >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook %s responds %s", w.url, resp.Status())
+	}
+	return nil
+}
+
+// errQueueFull is returned by AsyncNotifier if the events are delivered
+// slower than they are raised.
+var errQueueFull = errors.New("alert queue is full")
+
+// AsyncNotifier delivers the events through a queue in the background, so
+// that a slow webhook never stalls the sampling. Notify fails once the queue
+// is full, the alerter then keeps the latest event of the rule and retries
+// it later.
+type AsyncNotifier struct {
+	notifier Notifier
+	queue    chan *AlertEvent
+	done     chan struct{}
+}
+
+func NewAsyncNotifier(notifier Notifier, size int) *AsyncNotifier {
+	n := &AsyncNotifier{
+		notifier: notifier,
+		queue:    make(chan *AlertEvent, size),
+		done:     make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+func (n *AsyncNotifier) run() {
+	defer close(n.done)
+	for event := range n.queue {
+		if err := n.notifier.Notify(context.Background(), event); err != nil {
+			log.Errorf("Fail to notify alert %s of group %s: %v", event.Rule, event.Group, err)
+		}
+	}
+}
+
+func (n *AsyncNotifier) Notify(_ context.Context, event *AlertEvent) error {
+	select {
+	case n.queue <- event:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// Close delivers the events queued and stops, Notify must not be called
+// afterwards.
+func (n *AsyncNotifier) Close() {
+	close(n.queue)
+	<-n.done
+}
+
+type alertState struct {
+	since    time.Time
+	firing   bool
+	notified string
+	lastSent time.Time
+	pending  *AlertEvent
+}
+
+// Alerter evaluates the alert rules and sends an event when a rule starts or
+// stops firing. Events of the same rule are sent at most once per interval,
+// the latest state wins if the rule flaps in between.
+type Alerter struct {
+	group       string
+	rules       []*AlertRule
+	notifier    Notifier
+	minInterval time.Duration
+	states      map[string]*alertState
+}
+
+func NewAlerter(group string, rules []*AlertRule, notifier Notifier, minInterval time.Duration) *Alerter {
+	states := make(map[string]*alertState)
+	for _, rule := range rules {
+		states[rule.Name] = &alertState{notified: AlertResolved}
+	}
+	return &Alerter{
+		group:       group,
+		rules:       rules,
+		notifier:    notifier,
+		minInterval: minInterval,
+		states:      states,
+	}
+}
+
+func formatMetric(metric string, value float64) string {
+	if isDurationMetric(metric) {
+		return time.Duration(value * float64(time.Second)).String()
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+func (a *Alerter) Evaluate(ctx context.Context, now time.Time, metrics map[string]float64) {
+	for _, rule := range a.rules {
+		value, ok := metrics[rule.Metric]
+		if !ok {
+			continue
+		}
+
+		state := a.states[rule.Name]
+		event := &AlertEvent{
+			Group:     a.group,
+			Rule:      rule.Name,
+			Metric:    rule.Metric,
+			Value:     formatMetric(rule.Metric, value),
+			Threshold: formatMetric(rule.Metric, rule.Threshold),
+			Timestamp: now,
+		}
+
+		if value > rule.Threshold {
+			if state.since.IsZero() {
+				state.since = now
+			}
+			if !state.firing && now.Sub(state.since) >= rule.For {
+				state.firing = true
+				event.Status = AlertFiring
+				event.Since = state.since
+				state.pending = event
+			}
+		} else {
+			if state.firing {
+				state.firing = false
+				event.Status = AlertResolved
+				event.Since = state.since
+				state.pending = event
+			}
+			state.since = time.Time{}
+		}
+
+		a.flush(ctx, now, state)
+	}
+}
+
+func (a *Alerter) flush(ctx context.Context, now time.Time, state *alertState) {
+	event := state.pending
+	if event == nil || now.Sub(state.lastSent) < a.minInterval {
+		return
+	}
+
+	state.pending = nil
+	if event.Status == state.notified {
+		return
+	}
+
+	if err := a.notifier.Notify(ctx, event); err != nil {
+		log.Errorf("Fail to notify alert %s of group %s: %v", event.Rule, event.Group, err)
+		state.pending = event
+		state.lastSent = now
+		return
+	}
+	state.notified = event.Status
+	state.lastSent = now
+
+	log.WithFields(map[string]interface{}{
+		common.FieldGroup: event.Group,
+		"rule":            event.Rule,
+		"status":          event.Status,
+		"value":           event.Value,
+	}).Warn("Alert notified")
+}
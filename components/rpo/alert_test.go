@@ -0,0 +1,153 @@
+package rpo
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// events records the events notified as rule:status.
+type events struct {
+	mu   sync.Mutex
+	sent []string
+	// block holds Notify until it is closed, nil to return at once.
+	block chan struct{}
+}
+
+func (e *events) Notify(_ context.Context, event *AlertEvent) error {
+	if e.block != nil {
+		<-e.block
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sent = append(e.sent, event.Rule+":"+event.Status)
+	return nil
+}
+
+func (e *events) get() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string{}, e.sent...)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAlerterFiringAndResolve(t *testing.T) {
+	notifier := &events{}
+	rules := []*AlertRule{{Name: "slow", Metric: MetricLag, Threshold: 10, For: 2 * time.Second}}
+	a := NewAlerter("backup", rules, notifier, 0)
+
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	for i, lag := range []float64{20, 20, 20, 20, 5, 5} {
+		a.Evaluate(ctx, now.Add(time.Duration(i)*time.Second), map[string]float64{MetricLag: lag})
+	}
+	// Firing once the lag lasts for 2s, notified once while firing.
+	if got := notifier.get(); !equalStrings(got, []string{"slow:firing", "slow:resolved"}) {
+		t.Fatalf("unexpected events %v", got)
+	}
+
+	// A breach shorter than For is not notified.
+	a.Evaluate(ctx, now.Add(10*time.Second), map[string]float64{MetricLag: 20})
+	a.Evaluate(ctx, now.Add(11*time.Second), map[string]float64{MetricLag: 5})
+	if got := notifier.get(); len(got) != 2 {
+		t.Fatalf("unexpected events %v", got)
+	}
+}
+
+func TestAlerterDedup(t *testing.T) {
+	notifier := &events{}
+	rules := []*AlertRule{{Name: "failing", Metric: MetricFetchFailures, Threshold: 0}}
+	a := NewAlerter("backup", rules, notifier, time.Minute)
+
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	a.Evaluate(ctx, now, map[string]float64{MetricFetchFailures: 1})
+	// Flapping within the interval: the latest state equals the one sent.
+	a.Evaluate(ctx, now.Add(time.Second), map[string]float64{MetricFetchFailures: 0})
+	a.Evaluate(ctx, now.Add(2*time.Second), map[string]float64{MetricFetchFailures: 3})
+	a.Evaluate(ctx, now.Add(2*time.Minute), map[string]float64{MetricFetchFailures: 3})
+	if got := notifier.get(); !equalStrings(got, []string{"failing:firing"}) {
+		t.Fatalf("unexpected events %v", got)
+	}
+
+	// The last event was sent an interval ago, the resolve is sent at once.
+	a.Evaluate(ctx, now.Add(2*time.Minute+time.Second), map[string]float64{MetricFetchFailures: 0})
+	if got := notifier.get(); !equalStrings(got, []string{"failing:firing", "failing:resolved"}) {
+		t.Fatalf("unexpected events %v", got)
+	}
+}
+
+func TestAsyncNotifier(t *testing.T) {
+	slow := &events{block: make(chan struct{})}
+	n := NewAsyncNotifier(slow, 1)
+	rules := []*AlertRule{{Name: "slow", Metric: MetricLag, Threshold: 10}}
+	a := NewAlerter("backup", rules, n, 0)
+
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// The first event is taken by the blocked delivery, the second one
+		// is queued and the third one finds the queue full.
+		for i, lag := range []float64{20, 5, 20} {
+			a.Evaluate(ctx, now.Add(time.Duration(i)*time.Second), map[string]float64{MetricLag: lag})
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the alerter is blocked by the notifier")
+	}
+
+	close(slow.block)
+	for deadline := time.Now().Add(5 * time.Second); len(slow.get()) < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	// The event held back is retried by the alerter.
+	a.Evaluate(ctx, now.Add(3*time.Second), map[string]float64{MetricLag: 20})
+	n.Close()
+	if got := slow.get(); !equalStrings(got, []string{"slow:firing", "slow:resolved", "slow:firing"}) {
+		t.Fatalf("unexpected events %v", got)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	bodies := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		body := make(map[string]interface{})
+		json.Unmarshal(data, &body)
+		bodies <- body
+	}))
+	defer server.Close()
+
+	w, err := NewWebhook(server.URL, `{"text": "{{.Rule}} is {{.Status}}", "event": {{json .}}}`, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Notify(context.Background(), &AlertEvent{Rule: "slow", Status: AlertFiring}); err != nil {
+		t.Fatal(err)
+	}
+	body := <-bodies
+	if body["text"] != "slow is firing" || body["event"].(map[string]interface{})["rule"] != "slow" {
+		t.Fatalf("unexpected body %v", body)
+	}
+}
@@ -0,0 +1,281 @@
+package rpo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/components/key"
+)
+
+type RegionLag struct {
+	RegionId            common.RegionId
+	StartKey            string
+	EndKey              string
+	Store               string
+	LearnerAppliedIndex uint64
+	// LearnerCommitIndex is ahead of the applied index if the learner is
+	// slow to apply rather than to replicate.
+	LearnerCommitIndex uint64
+	VoterAppliedIndex  uint64
+	Lag                time.Duration
+	LagLower           time.Duration
+	LagUpper           time.Duration
+	SafeTime           time.Time
+}
+
+type _RegionLag struct {
+	RegionId            common.RegionId `json:"region-id"`
+	StartKey            string          `json:"start-key"`
+	EndKey              string          `json:"end-key"`
+	Range               string          `json:"range,omitempty"`
+	Store               string          `json:"store"`
+	LearnerAppliedIndex uint64          `json:"learner-applied-index"`
+	LearnerCommitIndex  uint64          `json:"learner-commit-index"`
+	VoterAppliedIndex   uint64          `json:"voter-applied-index"`
+	Lag                 string          `json:"lag"`
+	LagLower            string          `json:"lag-lower"`
+	LagUpper            string          `json:"lag-upper"`
+	SafeTime            time.Time       `json:"safe-time"`
+}
+
+// Range describes the TiDB data of the region.
+func (r *RegionLag) Range() string {
+	return key.DescribeRange(r.StartKey, r.EndKey)
+}
+
+func (r *RegionLag) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&_RegionLag{
+		RegionId:            r.RegionId,
+		StartKey:            r.StartKey,
+		EndKey:              r.EndKey,
+		Range:               r.Range(),
+		Store:               r.Store,
+		LearnerAppliedIndex: r.LearnerAppliedIndex,
+		LearnerCommitIndex:  r.LearnerCommitIndex,
+		VoterAppliedIndex:   r.VoterAppliedIndex,
+		Lag:                 r.Lag.String(),
+		LagLower:            r.LagLower.String(),
+		LagUpper:            r.LagUpper.String(),
+		SafeTime:            r.SafeTime,
+	})
+}
+
+func (r *RegionLag) UnmarshalJSON(data []byte) error {
+	t := &_RegionLag{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return err
+	}
+
+	var lags [3]time.Duration
+	for i, s := range []string{t.Lag, t.LagLower, t.LagUpper} {
+		lag, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		lags[i] = lag
+	}
+
+	*r = RegionLag{
+		RegionId:            t.RegionId,
+		StartKey:            t.StartKey,
+		EndKey:              t.EndKey,
+		Store:               t.Store,
+		LearnerAppliedIndex: t.LearnerAppliedIndex,
+		LearnerCommitIndex:  t.LearnerCommitIndex,
+		VoterAppliedIndex:   t.VoterAppliedIndex,
+		Lag:                 lags[0],
+		LagLower:            lags[1],
+		LagUpper:            lags[2],
+		SafeTime:            t.SafeTime,
+	}
+	return nil
+}
+
+// StoreLag aggregates the worst-case lag of the regions on a learner store.
+type StoreLag struct {
+	Store       string
+	Regions     int
+	MaxLag      time.Duration
+	AvgLag      time.Duration
+	WorstRegion common.RegionId
+}
+
+type _StoreLag struct {
+	Store       string          `json:"store"`
+	Regions     int             `json:"regions"`
+	MaxLag      string          `json:"max-lag"`
+	AvgLag      string          `json:"avg-lag"`
+	WorstRegion common.RegionId `json:"worst-region"`
+}
+
+func (s *StoreLag) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&_StoreLag{
+		Store:       s.Store,
+		Regions:     s.Regions,
+		MaxLag:      s.MaxLag.String(),
+		AvgLag:      s.AvgLag.String(),
+		WorstRegion: s.WorstRegion,
+	})
+}
+
+func (s *StoreLag) UnmarshalJSON(data []byte) error {
+	t := &_StoreLag{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return err
+	}
+
+	maxLag, err := time.ParseDuration(t.MaxLag)
+	if err != nil {
+		return err
+	}
+
+	avgLag, err := time.ParseDuration(t.AvgLag)
+	if err != nil {
+		return err
+	}
+
+	*s = StoreLag{
+		Store:       t.Store,
+		Regions:     t.Regions,
+		MaxLag:      maxLag,
+		AvgLag:      avgLag,
+		WorstRegion: t.WorstRegion,
+	}
+	return nil
+}
+
+// TableLag aggregates the worst-case lag of the regions of a TiDB table,
+// the tables are known only with a schema source.
+type TableLag struct {
+	TableID     int64
+	Table       string
+	Regions     int
+	MaxLag      time.Duration
+	WorstRegion common.RegionId
+}
+
+type _TableLag struct {
+	TableID     int64           `json:"table-id"`
+	Table       string          `json:"table"`
+	Regions     int             `json:"regions"`
+	MaxLag      string          `json:"max-lag"`
+	WorstRegion common.RegionId `json:"worst-region"`
+}
+
+func (t *TableLag) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&_TableLag{
+		TableID:     t.TableID,
+		Table:       t.Table,
+		Regions:     t.Regions,
+		MaxLag:      t.MaxLag.String(),
+		WorstRegion: t.WorstRegion,
+	})
+}
+
+func (t *TableLag) UnmarshalJSON(data []byte) error {
+	tmp := &_TableLag{}
+	if err := json.Unmarshal(data, tmp); err != nil {
+		return err
+	}
+
+	maxLag, err := time.ParseDuration(tmp.MaxLag)
+	if err != nil {
+		return err
+	}
+
+	*t = TableLag{
+		TableID:     tmp.TableID,
+		Table:       tmp.Table,
+		Regions:     tmp.Regions,
+		MaxLag:      maxLag,
+		WorstRegion: tmp.WorstRegion,
+	}
+	return nil
+}
+
+// Breakdown is the per-region, per-store and per-table view of the RPO.
+type Breakdown struct {
+	Regions []*RegionLag `json:"regions"`
+	Stores  []*StoreLag  `json:"stores"`
+	Tables  []*TableLag  `json:"tables,omitempty"`
+}
+
+func BreakdownFromFile(path string) (*Breakdown, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	breakdown := &Breakdown{}
+	if err = json.Unmarshal(data, breakdown); err != nil {
+		return nil, err
+	}
+
+	return breakdown, nil
+}
+
+// Sort orders the regions and the tables from the worst-case lag to the best
+// one and the stores by address.
+func (b *Breakdown) Sort() {
+	sort.Slice(b.Regions, func(i, j int) bool {
+		if b.Regions[i].LagUpper != b.Regions[j].LagUpper {
+			return b.Regions[i].LagUpper > b.Regions[j].LagUpper
+		}
+		return b.Regions[i].RegionId < b.Regions[j].RegionId
+	})
+	sort.Slice(b.Stores, func(i, j int) bool {
+		return b.Stores[i].Store < b.Stores[j].Store
+	})
+	sort.Slice(b.Tables, func(i, j int) bool {
+		if b.Tables[i].MaxLag != b.Tables[j].MaxLag {
+			return b.Tables[i].MaxLag > b.Tables[j].MaxLag
+		}
+		return b.Tables[i].TableID < b.Tables[j].TableID
+	})
+}
+
+// Worst returns the top n lagging regions, the breakdown must be sorted.
+func (b *Breakdown) Worst(n int) []*RegionLag {
+	if n > len(b.Regions) || n < 0 {
+		n = len(b.Regions)
+	}
+	return b.Regions[:n]
+}
+
+// WorstTables returns the top n lagging tables, the breakdown must be sorted.
+func (b *Breakdown) WorstTables(n int) []*TableLag {
+	if n > len(b.Tables) || n < 0 {
+		n = len(b.Tables)
+	}
+	return b.Tables[:n]
+}
+
+func (b *Breakdown) Region(id common.RegionId) *RegionLag {
+	for _, region := range b.Regions {
+		if region.RegionId == id {
+			return region
+		}
+	}
+	return nil
+}
+
+func (b *Breakdown) Store(store string) []*RegionLag {
+	var regions []*RegionLag
+	for _, region := range b.Regions {
+		if region.Store == store {
+			regions = append(regions, region)
+		}
+	}
+	return regions
+}
+
+func (b *Breakdown) Save(path string) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
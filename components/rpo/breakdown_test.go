@@ -0,0 +1,99 @@
+package rpo
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/common"
+)
+
+var epoch = time.Unix(1600000000, 0)
+
+// at returns the state of a region observed exactly at epoch+sec.
+func at(id common.RegionId, host string, index uint64, sec int) *common.RegionState {
+	state := &common.RegionState{RegionId: id, Host: host}
+	state.ApplyState.AppliedIndex = index
+	state.ApplyState.Timestamp = epoch.Add(time.Duration(sec) * time.Second)
+	return state
+}
+
+func infosOf(states ...*common.RegionState) *common.RegionInfos {
+	infos := &common.RegionInfos{StateMap: make(map[common.RegionId]*common.RegionState)}
+	for _, state := range states {
+		infos.StateMap[state.RegionId] = state
+	}
+	return infos
+}
+
+func TestObserveBreakdown(t *testing.T) {
+	history := NewApplyHistory()
+	history.Birth = epoch
+	history.Update(infosOf(at(1, "voter", 10, 0), at(2, "voter", 5, 0)))
+	history.Update(infosOf(at(1, "voter", 20, 1)))
+	history.Update(infosOf(at(1, "voter", 30, 2)))
+
+	config := DefaultConfig()
+	config.TopN = 1
+	g := newGenerator(config, history, nil)
+	group := g.group("")
+
+	a := infosOf(at(1, "a", 10, 3), at(2, "a", 5, 3))
+	b := infosOf(at(1, "b", 25, 3))
+	sample := &Sample{
+		RegionInfos: MaxApplyIndex{}.Merge(infosOf(at(1, "a", 10, 3), at(2, "a", 5, 3)), b),
+		Stores:      map[string]*common.RegionInfos{"b": b, "a": a},
+		Timestamp:   epoch.Add(3 * time.Second),
+	}
+	rpo, breakdown := g.observe(group, sample)
+
+	// Region 2 waits for the voters since epoch, region 1 on b since the
+	// voters are last seen at 20 and until they are seen at 30.
+	if len(breakdown.Regions) != 2 || breakdown.Regions[0].RegionId != 2 || breakdown.Regions[1].LagUpper != 2*time.Second {
+		t.Fatalf("unexpected regions %+v", breakdown.Regions)
+	}
+	if r := breakdown.Region(1); r.VoterAppliedIndex != 30 || r.LearnerAppliedIndex != 25 || r.Store != "b" || r.LagLower != time.Second {
+		t.Fatalf("unexpected region %+v", r)
+	}
+	if len(rpo.Worst) != 1 || rpo.Worst[0].RegionId != 2 || rpo.LagUpper != 3*time.Second {
+		t.Fatalf("unexpected worst regions %+v", rpo.Worst)
+	}
+
+	// The stores are sorted by address, a holds the slowest peer of region 1.
+	stores := breakdown.Stores
+	if len(stores) != 2 || stores[0].Store != "a" || stores[0].Regions != 2 || stores[0].MaxLag != 3*time.Second || stores[1].AvgLag != 2*time.Second {
+		t.Fatalf("unexpected stores %+v", stores)
+	}
+	if slowest := group.slowest[1]; slowest.Host != "a" {
+		t.Fatalf("unexpected slowest peer %+v", slowest)
+	}
+
+	path := filepath.Join(t.TempDir(), "breakdown.json")
+	if err := breakdown.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := BreakdownFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := loaded.Region(2); r == nil || r.LagUpper != 3*time.Second || len(loaded.Store("a")) != 1 || loaded.Stores[1].AvgLag != 2*time.Second {
+		t.Fatalf("unexpected breakdown loaded %+v", loaded)
+	}
+}
+
+func TestBreakdownWorst(t *testing.T) {
+	b := &Breakdown{
+		Regions: []*RegionLag{{RegionId: 3, LagUpper: time.Second}, {RegionId: 1, LagUpper: 2 * time.Second}, {RegionId: 2, LagUpper: time.Second}},
+		Tables:  []*TableLag{{TableID: 46, MaxLag: time.Second}, {TableID: 45, MaxLag: time.Second}},
+	}
+	b.Sort()
+	if got := b.Worst(2); len(got) != 2 || got[0].RegionId != 1 || got[1].RegionId != 2 {
+		t.Fatalf("unexpected worst regions %+v", got)
+	}
+	if got := b.Worst(-1); len(got) != 3 {
+		t.Fatalf("unexpected worst regions %+v", got)
+	}
+	if got := b.WorstTables(10); len(got) != 2 || got[0].TableID != 45 {
+		t.Fatalf("unexpected worst tables %+v", got)
+	}
+}
@@ -1,49 +1,224 @@
 package rpo
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/components/tables"
+	"github.com/iosmanthus/learner-recover/components/unified"
 
 	"github.com/pingcap/tiup/pkg/cluster/spec"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
+// Group is a learner group with the hosts of its learners.
+type Group struct {
+	Name     string
+	Learners []string
+}
+
 type Config struct {
-	Voters      []string
-	Learners    []string
-	TikvCtlPath string
-	HistoryPath string
-	Save        string
-	LastFor     time.Duration
+	Voters            []string
+	Groups            []*Group
+	Source            string
+	PD                string
+	StatusAddrs       map[string]string
+	StatusConcurrency int
+	// StatusBudget is the share of the sampling interval a status fetch
+	// may spend requesting the regions.
+	StatusBudget       float64
+	TikvCtlPath        string
+	HistoryPath        string
+	Save               string
+	Breakdown          string
+	TopN               int
+	Windows            []time.Duration
+	LastFor            time.Duration
+	Listen             string
+	SafePointRetention time.Duration
+	Record             string
+	// SchemaSource names the tables of the lagging regions if set.
+	SchemaSource *tables.Source
+	Sampling     struct {
+		VoterInterval   time.Duration
+		LearnerInterval time.Duration
+		PersistInterval time.Duration
+		// Adaptive is nil if the intervals are fixed.
+		Adaptive *AdaptiveOptions
+	}
+	Alerts struct {
+		Rules       []*AlertRule
+		MinInterval time.Duration
+		Webhook     struct {
+			URL      string
+			Template string
+			Timeout  time.Duration
+		}
+	}
 }
 
-func NewConfig(path string) (*Config, error) {
-	type _Config struct {
-		Topology      string            `yaml:"topology"`
-		LearnerLabels map[string]string `yaml:"learner-labels"`
-		TikvCtlPath   string            `yaml:"tikv-ctl"`
-		HistoryPath   string            `yaml:"history-path"`
-		Save          string            `yaml:"save"`
-		LastFor       string            `yaml:"last-for"`
+// GroupPath returns the output path of a learner group, the group name is
+// inserted before the extension if there are multiple groups.
+func (c *Config) GroupPath(path, group string) string {
+	return GroupPath(path, group, len(c.Groups))
+}
+
+// GroupPath returns the output path of a learner group out of the given
+// number of groups.
+func GroupPath(path, group string, groups int) string {
+	if groups <= 1 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(path, ext), group, ext)
+}
+
+// DefaultConfig is used to replay recorded samples without a config file.
+func DefaultConfig() *Config {
+	c := &Config{
+		TopN:               10,
+		Windows:            []time.Duration{time.Minute, 5 * time.Minute, time.Hour},
+		SafePointRetention: 24 * time.Hour,
 	}
+	c.Alerts.MinInterval = time.Minute
+	c.Sampling.VoterInterval = 500 * time.Millisecond
+	c.Sampling.LearnerInterval = 2 * time.Second
+	c.Sampling.PersistInterval = time.Second
+	return c
+}
 
-	data, err := ioutil.ReadFile(path)
+func newAlertRule(name, metric, threshold, lastFor string, windows []time.Duration) (*AlertRule, error) {
+	metrics := map[string]bool{MetricLag: true, MetricFetchFailures: true, "p50": true, "p90": true, "p99": true}
+	for _, w := range windows {
+		for _, prefix := range []string{"p50-", "p90-", "p99-", "max-"} {
+			metrics[prefix+shortDuration(w)] = true
+		}
+	}
+	if !metrics[metric] {
+		return nil, fmt.Errorf("unknown metric %q of alert rule %q", metric, name)
+	}
+
+	rule := &AlertRule{Name: name, Metric: metric}
+	if isDurationMetric(metric) {
+		d, err := time.ParseDuration(threshold)
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold of alert rule %q: %v", name, err)
+		}
+		rule.Threshold = d.Seconds()
+	} else {
+		v, err := strconv.ParseFloat(threshold, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold of alert rule %q: %v", name, err)
+		}
+		rule.Threshold = v
+	}
+
+	if lastFor != "" {
+		d, err := time.ParseDuration(lastFor)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration of alert rule %q: %v", name, err)
+		}
+		rule.For = d
+	}
+
+	return rule, nil
+}
+
+// _Config is the YAML of the config file.
+type _Config struct {
+	Topology          string                 `yaml:"topology"`
+	LearnerLabels     interface{}            `yaml:"learner-labels"`
+	LearnerGroups     map[string]interface{} `yaml:"learner-groups"`
+	Source            string                 `yaml:"source"`
+	StatusConcurrency int                    `yaml:"status-concurrency"`
+	StatusBudget      float64                `yaml:"status-budget"`
+	TikvCtlPath       string                 `yaml:"tikv-ctl"`
+	HistoryPath       string                 `yaml:"history-path"`
+	Save              string                 `yaml:"save"`
+	Breakdown         string                 `yaml:"breakdown"`
+	TopN              *int                   `yaml:"top-n"`
+	Windows           []string               `yaml:"windows"`
+	LastFor           string                 `yaml:"last-for"`
+	Listen            string                 `yaml:"listen"`
+	Record            string                 `yaml:"record"`
+	SchemaSource      *struct {
+		TiDB string `yaml:"tidb"`
+		Dump string `yaml:"dump"`
+	} `yaml:"schema-source"`
+	Sampling struct {
+		VoterInterval   string `yaml:"voter-interval"`
+		LearnerInterval string `yaml:"learner-interval"`
+		PersistInterval string `yaml:"persist-interval"`
+		Adaptive        *struct {
+			MinInterval  string  `yaml:"min-interval"`
+			MaxInterval  string  `yaml:"max-interval"`
+			LatencyRatio float64 `yaml:"latency-ratio"`
+			CPUThreshold float64 `yaml:"cpu-threshold"`
+			LagThreshold string  `yaml:"lag-threshold"`
+		} `yaml:"adaptive"`
+	} `yaml:"sampling"`
+	SafePointRetention string `yaml:"safe-point-retention"`
+	Alerts             struct {
+		Rules []struct {
+			Name      string `yaml:"name"`
+			Metric    string `yaml:"metric"`
+			Threshold string `yaml:"threshold"`
+			For       string `yaml:"for"`
+		} `yaml:"rules"`
+		MinInterval string `yaml:"min-interval"`
+		Webhook     struct {
+			URL      string `yaml:"url"`
+			Template string `yaml:"template"`
+			Timeout  string `yaml:"timeout"`
+		} `yaml:"webhook"`
+	} `yaml:"alerts"`
+}
+
+func NewConfig(path string) (*Config, error) {
+	data, err := unified.Load(path, unified.CommandRPO)
 	if err != nil {
 		return nil, err
 	}
 
 	c := &_Config{}
-	if err := yaml.Unmarshal(data, c); err != nil {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(c); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	err = common.CheckRequired("topology", c.Topology, "history-path", c.HistoryPath, "save", c.Save)
+	if err != nil {
 		return nil, err
 	}
 
 	lastFor, err := time.ParseDuration(c.LastFor)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid last-for: %v", err)
+	}
+
+	topN := 10
+	if c.TopN != nil {
+		topN = *c.TopN
+	}
+
+	if len(c.Windows) == 0 {
+		c.Windows = []string{"1m", "5m", "1h"}
+	}
+	var windows []time.Duration
+	for _, w := range c.Windows {
+		window, err := time.ParseDuration(w)
+		if err != nil {
+			return nil, fmt.Errorf("invalid windows: %v", err)
+		}
+		windows = append(windows, window)
 	}
 
 	topo := &spec.Specification{}
@@ -51,9 +226,55 @@ func NewConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	switch c.Source {
+	case "":
+		c.Source = SourceTiKVCtl
+	case SourceTiKVCtl, SourceStatus:
+	default:
+		return nil, fmt.Errorf("unknown region state source %q", c.Source)
+	}
+	if c.Source == SourceStatus && len(topo.PDServers) == 0 {
+		return nil, errors.New("no PD servers in the cluster, please check the topology file")
+	}
+	if c.StatusConcurrency <= 0 {
+		c.StatusConcurrency = 16
+	}
+	switch {
+	case c.StatusBudget == 0:
+		c.StatusBudget = 0.5
+	case c.StatusBudget < 0 || c.StatusBudget > 1:
+		return nil, fmt.Errorf("status-budget %v is not a share of the sampling interval in (0, 1]", c.StatusBudget)
+	}
+	if c.Source == SourceTiKVCtl {
+		if err = common.CheckRequired("tikv-ctl", c.TikvCtlPath); err != nil {
+			return nil, err
+		}
+		if err = common.CheckFileExists("tikv-ctl", c.TikvCtlPath); err != nil {
+			return nil, err
+		}
+	}
+
+	learnerGroups, err := common.NewLearnerGroups(c.LearnerLabels, c.LearnerGroups)
+	if err != nil {
+		return nil, err
+	}
+
+	var stores []map[string]string
+	for _, node := range topo.TiKVServers {
+		labels, err := node.Labels()
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, labels)
+	}
+	if err = common.CheckLearnerGroups(learnerGroups, stores); err != nil {
+		return nil, err
+	}
+
 	var (
-		voters   []string
-		learners []string
+		voters      []string
+		learners    = make(map[string][]string)
+		statusAddrs = make(map[string]string)
 	)
 
 	for _, node := range topo.TiKVServers {
@@ -63,9 +284,14 @@ func NewConfig(path string) (*Config, error) {
 		}
 
 		host := fmt.Sprintf("%s:%v", node.Host, node.Port)
+		statusAddrs[host] = fmt.Sprintf("%s:%v", node.Host, node.StatusPort)
 
-		if common.IsLabelsMatch(c.LearnerLabels, serverLabels) {
-			learners = append(learners, host)
+		group, err := common.MatchLearnerGroup(learnerGroups, serverLabels)
+		if err != nil {
+			return nil, err
+		}
+		if group != nil {
+			learners[group.Name] = append(learners[group.Name], host)
 		} else {
 			voters = append(voters, host)
 		}
@@ -74,16 +300,124 @@ func NewConfig(path string) (*Config, error) {
 	if len(voters) == 0 {
 		return nil, errors.New("no voters in the cluster, please check the topology file")
 	}
-	if len(learners) == 0 {
-		return nil, errors.New("no learners in the cluster, please check the topology file")
+	// A group without learners would be reported without any lag.
+	var groups []*Group
+	for _, group := range learnerGroups {
+		if len(learners[group.Name]) == 0 {
+			return nil, fmt.Errorf("learner group %s (%s) has no learners, please check the topology file", group.Name, group.Selector)
+		}
+		groups = append(groups, &Group{Name: group.Name, Learners: learners[group.Name]})
+	}
+
+	config := &Config{
+		Voters:            voters,
+		Groups:            groups,
+		Source:            c.Source,
+		StatusAddrs:       statusAddrs,
+		StatusConcurrency: c.StatusConcurrency,
+		StatusBudget:      c.StatusBudget,
+		TikvCtlPath:       c.TikvCtlPath,
+		HistoryPath:       c.HistoryPath,
+		Save:              c.Save,
+		Breakdown:         c.Breakdown,
+		TopN:              topN,
+		Windows:           windows,
+		LastFor:           lastFor,
+	}
+	if source := c.SchemaSource; source != nil {
+		config.SchemaSource = &tables.Source{TiDB: source.TiDB, Dump: source.Dump}
+	}
+
+	if len(topo.PDServers) > 0 {
+		pd := topo.PDServers[0]
+		config.PD = fmt.Sprintf("%s:%v", pd.Host, pd.ClientPort)
+	}
+
+	sampling := &config.Sampling
+	for _, d := range []struct {
+		key   string
+		value string
+		def   time.Duration
+		dest  *time.Duration
+	}{
+		{"sampling.voter-interval", c.Sampling.VoterInterval, 500 * time.Millisecond, &sampling.VoterInterval},
+		{"sampling.learner-interval", c.Sampling.LearnerInterval, 2 * time.Second, &sampling.LearnerInterval},
+		{"sampling.persist-interval", c.Sampling.PersistInterval, time.Second, &sampling.PersistInterval},
+	} {
+		*d.dest = d.def
+		if d.value != "" {
+			if *d.dest, err = time.ParseDuration(d.value); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", d.key, err)
+			}
+		}
+	}
+
+	if adaptive := c.Sampling.Adaptive; adaptive != nil {
+		options := &AdaptiveOptions{
+			MinInterval:  100 * time.Millisecond,
+			MaxInterval:  30 * time.Second,
+			LatencyRatio: adaptive.LatencyRatio,
+			CPUThreshold: adaptive.CPUThreshold,
+		}
+		if options.LatencyRatio <= 0 {
+			options.LatencyRatio = 0.5
+		}
+		for _, d := range []struct {
+			key   string
+			value string
+			dest  *time.Duration
+		}{
+			{"sampling.adaptive.min-interval", adaptive.MinInterval, &options.MinInterval},
+			{"sampling.adaptive.max-interval", adaptive.MaxInterval, &options.MaxInterval},
+			{"sampling.adaptive.lag-threshold", adaptive.LagThreshold, &options.LagThreshold},
+		} {
+			if d.value != "" {
+				if *d.dest, err = time.ParseDuration(d.value); err != nil {
+					return nil, fmt.Errorf("invalid %s: %v", d.key, err)
+				}
+			}
+		}
+		if options.MinInterval > options.MaxInterval {
+			return nil, errors.New("min-interval of adaptive sampling is larger than max-interval")
+		}
+		sampling.Adaptive = options
+	}
+
+	config.Listen = c.Listen
+	config.Record = c.Record
+	config.SafePointRetention = 24 * time.Hour
+	if c.SafePointRetention != "" {
+		if config.SafePointRetention, err = time.ParseDuration(c.SafePointRetention); err != nil {
+			return nil, fmt.Errorf("invalid safe-point-retention: %v", err)
+		}
+	}
+
+	for _, r := range c.Alerts.Rules {
+		rule, err := newAlertRule(r.Name, r.Metric, r.Threshold, r.For, windows)
+		if err != nil {
+			return nil, err
+		}
+		config.Alerts.Rules = append(config.Alerts.Rules, rule)
+	}
+	if len(config.Alerts.Rules) > 0 && c.Alerts.Webhook.URL == "" {
+		return nil, errors.New("alert rules are configured without a webhook")
+	}
+
+	config.Alerts.MinInterval = time.Minute
+	if c.Alerts.MinInterval != "" {
+		if config.Alerts.MinInterval, err = time.ParseDuration(c.Alerts.MinInterval); err != nil {
+			return nil, fmt.Errorf("invalid alerts.min-interval: %v", err)
+		}
+	}
+
+	config.Alerts.Webhook.URL = c.Alerts.Webhook.URL
+	config.Alerts.Webhook.Template = c.Alerts.Webhook.Template
+	config.Alerts.Webhook.Timeout = 5 * time.Second
+	if c.Alerts.Webhook.Timeout != "" {
+		if config.Alerts.Webhook.Timeout, err = time.ParseDuration(c.Alerts.Webhook.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid alerts.webhook.timeout: %v", err)
+		}
 	}
 
-	return &Config{
-		Voters:      voters,
-		Learners:    learners,
-		TikvCtlPath: c.TikvCtlPath,
-		HistoryPath: c.HistoryPath,
-		Save:        c.Save,
-		LastFor:     lastFor,
-	}, nil
+	return config, nil
 }
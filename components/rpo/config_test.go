@@ -0,0 +1,77 @@
+package rpo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testTopology = `global:
+  user: root
+pd_servers:
+  - host: 10.0.1.1
+tikv_servers:
+  - host: 10.0.1.1
+    config:
+      server.labels: {zone: primary}
+  - host: 10.0.2.1
+    config:
+      server.labels: {zone: backup-a}
+  - host: 10.0.2.2
+    config:
+      server.labels: {zone: backup-b}
+`
+
+// loadConfig loads an rpo config of the learner groups against testTopology.
+func loadConfig(t *testing.T, groups string) (*Config, error) {
+	dir := t.TempDir()
+	topology := filepath.Join(dir, "topology.yaml")
+	if err := ioutil.WriteFile(topology, []byte(testTopology), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "rpo.yaml")
+	config := fmt.Sprintf("topology: %s\nsource: status\nhistory-path: history\nsave: rpo.json\nlast-for: 1m\nlearner-groups:\n%s", topology, groups)
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return NewConfig(path)
+}
+
+func TestConfigLearnerGroups(t *testing.T) {
+	config, err := loadConfig(t, "  a: zone=backup-a\n  b: zone in (backup-b)\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Groups) != 2 || config.Groups[0].Learners[0] != "10.0.2.1:20160" || len(config.Groups[1].Learners) != 1 || len(config.Voters) != 1 {
+		t.Fatalf("unexpected groups %+v, voters %v", config.Groups, config.Voters)
+	}
+
+	for _, c := range []struct {
+		name   string
+		groups string
+		err    string
+	}{
+		// Both groups would otherwise be loaded, b reporting no lag at all.
+		{"overlap", "  a: zone in (backup-a, backup-b)\n  b: zone=backup-b\n", "matches both learner group a"},
+		{"empty", "  a: zone=backup-a\n  c: zone=backup-c\n", "learner group c (zone = backup-c) matches no TiKV node"},
+	} {
+		if _, err = loadConfig(t, c.groups); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("%s: expect %q, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestConfigStatusBudget(t *testing.T) {
+	config, err := loadConfig(t, "  a: zone=backup-a\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.StatusBudget != 0.5 {
+		t.Fatalf("unexpected status budget %v", config.StatusBudget)
+	}
+	if _, err = loadConfig(t, "  a: zone=backup-a\nstatus-budget: 1.5\n"); err == nil || !strings.Contains(err.Error(), "status-budget") {
+		t.Fatalf("expect the budget refused, got %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package rpo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/common"
+)
+
+func TestApplyHistoryQuery(t *testing.T) {
+	h := NewApplyHistory()
+	h.Birth = epoch
+	h.Update(infosOf(at(1, "voter", 10, 1)))
+	// Sampled again without progress, the entry is refreshed.
+	h.Update(infosOf(at(1, "voter", 10, 2)))
+	h.Update(infosOf(at(1, "voter", 20, 3)))
+
+	for _, c := range []struct {
+		index uint64
+		want  int
+	}{
+		{5, 2},
+		{10, 2},
+		{15, 3},
+		{20, 3},
+		// Ahead of the voters sampled, the latest entry is the best guess.
+		{25, 3},
+	} {
+		if got := h.Query(at(1, "", c.index, 0)); !got.Equal(epoch.Add(time.Duration(c.want) * time.Second)) {
+			t.Fatalf("query index %v: got %v, want epoch+%vs", c.index, got, c.want)
+		}
+	}
+	if got := h.Query(at(2, "", 1, 0)); !got.Equal(epoch) {
+		t.Fatalf("a region without history is reached at the birth, got %v", got)
+	}
+
+	if got := h.RPOQuery(at(1, "", 15, 0)); !got.Equal(epoch.Add(3 * time.Second)) {
+		t.Fatalf("unexpected RPO query %v", got)
+	}
+	// The entry before the one queried is kept to bound the lag.
+	if len(h.History[1]) != 2 || h.History[1][0].ApplyState.AppliedIndex != 10 {
+		t.Fatalf("unexpected history after trimming %v", h.History[1])
+	}
+}
+
+func TestApplyHistoryReopen(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "history")
+	h, err := OpenApplyHistory(dir, []string{"backup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	birth := h.Birth
+	h.Update(infosOf(at(1, "voter", 10, 1), at(2, "voter", 7, 1)))
+	h.Update(infosOf(at(1, "voter", 20, 2)))
+	h.Update(infosOf(at(1, "voter", 30, 3)))
+	h.Trim(at(1, "", 30, 0))
+	h.AddSafePoint(&SafePoint{Group: "backup", Timestamp: epoch.Add(2 * time.Second), SafeTime: epoch.Add(time.Second)}, time.Hour)
+	if err = h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = OpenApplyHistory(dir, []string{"backup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if !h.Birth.Equal(birth) {
+		t.Fatalf("unexpected birth %v, want %v", h.Birth, birth)
+	}
+	// The entries trimmed before they are persisted are never written.
+	if len(h.History[1]) != 2 || h.History[1][0].ApplyState.AppliedIndex != 20 || h.Latest(2).ApplyState.AppliedIndex != 7 {
+		t.Fatalf("unexpected history %v", h.History)
+	}
+	if points := h.SafePoints["backup"]; len(points) != 1 || !points[0].SafeTime.Equal(epoch.Add(time.Second)) {
+		t.Fatalf("unexpected safe points %v", points)
+	}
+}
+
+func TestApplyHistoryLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	legacy := NewApplyHistory()
+	legacy.Update(infosOf(at(3, "voter", 30, 1)))
+	if err := legacy.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := OpenApplyHistory(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+	if _, err = os.Stat(path + ".legacy"); err != nil {
+		t.Fatal(err)
+	}
+	if infos, err := ioutil.ReadDir(path); err != nil || len(infos) < 2 {
+		t.Fatalf("expect the history imported into segments: %v", err)
+	}
+
+	h, err = ReadApplyHistory(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest := h.Latest(common.RegionId(3)); latest == nil || latest.ApplyState.AppliedIndex != 30 {
+		t.Fatalf("unexpected history %v", h.History)
+	}
+}
+
+func TestApplyHistoryLagInterval(t *testing.T) {
+	h := NewApplyHistory()
+	h.Birth = epoch
+	voter := func(index uint64, sec int) *common.RegionState {
+		state := at(1, "voter", index, sec)
+		state.ApplyState.Received = state.ApplyState.Timestamp.Add(time.Second)
+		return state
+	}
+	h.Update(infosOf(voter(10, 0)))
+	h.Update(infosOf(voter(20, 4)))
+	h.Update(infosOf(voter(30, 8)))
+
+	for _, c := range []struct {
+		index        uint64
+		lower, upper int
+	}{
+		// Reached by the first entry, the voters may do it since the birth.
+		{10, 9, 10},
+		// Requested at 10 from epoch and seen at 20 by epoch+5s.
+		{15, 5, 10},
+		{20, 5, 10},
+		{30, 1, 6},
+		// Ahead of the voters requested at epoch+8s.
+		{35, 0, 2},
+	} {
+		learner := at(1, "learner", c.index, 10)
+		learner.ApplyState.Received = learner.ApplyState.Timestamp
+		lower, upper := h.LagInterval(learner)
+		if lower != time.Duration(c.lower)*time.Second || upper != time.Duration(c.upper)*time.Second {
+			t.Fatalf("index %v: unexpected interval [%v, %v], want [%vs, %vs]", c.index, lower, upper, c.lower, c.upper)
+		}
+	}
+
+	if lower, upper := h.LagInterval(at(2, "learner", 1, 3)); lower != 3*time.Second || upper != 3*time.Second {
+		t.Fatalf("unexpected interval of a region without history [%v, %v]", lower, upper)
+	}
+}
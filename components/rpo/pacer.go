@@ -0,0 +1,203 @@
+package rpo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// Pacer decides how long an UpdateWorker waits before the next fetch.
+type Pacer interface {
+	Next(ctx context.Context, elapsed time.Duration, err error) time.Duration
+}
+
+// FixedPacer starts a fetch every interval, a fetch longer than the interval
+// is followed by the next one immediately.
+type FixedPacer struct {
+	interval time.Duration
+}
+
+func NewFixedPacer(interval time.Duration) *FixedPacer {
+	return &FixedPacer{interval}
+}
+
+func (p *FixedPacer) Next(_ context.Context, elapsed time.Duration, _ error) time.Duration {
+	if elapsed >= p.interval {
+		return 0
+	}
+	return p.interval - elapsed
+}
+
+type AdaptiveOptions struct {
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	// Back off once a fetch takes longer than LatencyRatio of the interval.
+	LatencyRatio float64
+	// Back off once a TiKV process uses more CPU cores than CPUThreshold,
+	// disabled if zero.
+	CPUThreshold float64
+	// Tighten the interval once the worst-case lag exceeds LagThreshold.
+	LagThreshold time.Duration
+}
+
+// AdaptivePacer doubles the interval when TiKV is under pressure, halves it
+// when the lag grows and otherwise moves it back to the base interval.
+type AdaptivePacer struct {
+	base     time.Duration
+	options  *AdaptiveOptions
+	cpu      *CPUProbe
+	interval time.Duration
+	lag      int64
+}
+
+func NewAdaptivePacer(base time.Duration, options *AdaptiveOptions, cpu *CPUProbe) *AdaptivePacer {
+	return &AdaptivePacer{
+		base:     base,
+		options:  options,
+		cpu:      cpu,
+		interval: base,
+	}
+}
+
+// ObserveLag is called by the generator with the latest worst-case lag.
+func (p *AdaptivePacer) ObserveLag(lag time.Duration) {
+	atomic.StoreInt64(&p.lag, int64(lag))
+}
+
+func (p *AdaptivePacer) pressured(ctx context.Context, elapsed time.Duration, err error) bool {
+	if err != nil || float64(elapsed) > p.options.LatencyRatio*float64(p.interval) {
+		return true
+	}
+	if p.cpu == nil {
+		return false
+	}
+
+	usage, err := p.cpu.Usage(ctx)
+	if err != nil {
+		log.Warnf("Fail to probe TiKV CPU usage: %v", err)
+		return false
+	}
+	return usage > p.options.CPUThreshold
+}
+
+func (p *AdaptivePacer) Next(ctx context.Context, elapsed time.Duration, err error) time.Duration {
+	options := p.options
+	lag := time.Duration(atomic.LoadInt64(&p.lag))
+
+	interval := p.interval
+	switch {
+	case p.pressured(ctx, elapsed, err):
+		interval *= 2
+	case options.LagThreshold > 0 && lag > options.LagThreshold:
+		interval /= 2
+	case interval > p.base:
+		if interval /= 2; interval < p.base {
+			interval = p.base
+		}
+	case interval < p.base:
+		if interval *= 2; interval > p.base {
+			interval = p.base
+		}
+	}
+
+	if interval < options.MinInterval {
+		interval = options.MinInterval
+	}
+	if interval > options.MaxInterval {
+		interval = options.MaxInterval
+	}
+	if interval != p.interval {
+		log.WithFields(map[string]interface{}{
+			"from":    p.interval,
+			"to":      interval,
+			"elapsed": elapsed,
+			"lag":     lag,
+		}).Info("Sampling interval adjusted")
+		p.interval = interval
+	}
+
+	if elapsed >= interval {
+		return 0
+	}
+	return interval - elapsed
+}
+
+// CPUProbe reads process_cpu_seconds_total from the TiKV status servers and
+// reports the highest CPU usage in cores since the last probe.
+type CPUProbe struct {
+	addrs  []string
+	client *resty.Client
+
+	mu   sync.Mutex
+	last map[string]cpuSample
+}
+
+type cpuSample struct {
+	seconds float64
+	at      time.Time
+}
+
+func NewCPUProbe(addrs []string) *CPUProbe {
+	return &CPUProbe{
+		addrs:  addrs,
+		client: resty.New().SetTimeout(5 * time.Second),
+		last:   make(map[string]cpuSample),
+	}
+}
+
+func (p *CPUProbe) cpuSeconds(ctx context.Context, addr string) (float64, error) {
+	resp, err := p.client.R().SetContext(ctx).Get(fmt.Sprintf("http://%s/metrics", addr))
+	if err != nil {
+		return 0, err
+	}
+
+	parser := &expfmt.TextParser{}
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(resp.Body()))
+	if err != nil {
+		return 0, err
+	}
+
+	family, ok := families["process_cpu_seconds_total"]
+	if !ok || len(family.GetMetric()) == 0 {
+		return 0, fmt.Errorf("process_cpu_seconds_total not found on %s", addr)
+	}
+
+	metric := family.GetMetric()[0]
+	switch {
+	case metric.Counter != nil:
+		return metric.GetCounter().GetValue(), nil
+	case metric.Gauge != nil:
+		return metric.GetGauge().GetValue(), nil
+	default:
+		return metric.GetUntyped().GetValue(), nil
+	}
+}
+
+func (p *CPUProbe) Usage(ctx context.Context) (float64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	max := 0.0
+	for _, addr := range p.addrs {
+		seconds, err := p.cpuSeconds(ctx, addr)
+		if err != nil {
+			return 0, err
+		}
+
+		now := time.Now()
+		if last, ok := p.last[addr]; ok {
+			if usage := (seconds - last.seconds) / now.Sub(last.at).Seconds(); usage > max {
+				max = usage
+			}
+		}
+		p.last[addr] = cpuSample{seconds, now}
+	}
+	return max, nil
+}
@@ -0,0 +1,101 @@
+package rpo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFixedPacer(t *testing.T) {
+	p := NewFixedPacer(time.Second)
+	ctx := context.Background()
+	if wait := p.Next(ctx, 300*time.Millisecond, nil); wait != 700*time.Millisecond {
+		t.Fatalf("unexpected wait %v", wait)
+	}
+	if wait := p.Next(ctx, 2*time.Second, errors.New("timeout")); wait != 0 {
+		t.Fatalf("a slow fetch is followed at once, got %v", wait)
+	}
+}
+
+func TestAdaptivePacerBackoff(t *testing.T) {
+	options := &AdaptiveOptions{
+		MinInterval:  250 * time.Millisecond,
+		MaxInterval:  4 * time.Second,
+		LatencyRatio: 0.5,
+		LagThreshold: 10 * time.Second,
+	}
+	p := NewAdaptivePacer(time.Second, options, nil)
+	ctx := context.Background()
+	failure := errors.New("timeout")
+
+	next := func(elapsed time.Duration, err error) time.Duration {
+		p.Next(ctx, elapsed, err)
+		return p.interval
+	}
+	// Failures double the interval up to the max.
+	for i, want := range []time.Duration{2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if got := next(0, failure); got != want {
+			t.Fatalf("failure %v: interval %v, want %v", i, got, want)
+		}
+	}
+	// A fetch longer than half of the interval backs off as well.
+	p.interval = time.Second
+	if got := next(600*time.Millisecond, nil); got != 2*time.Second {
+		t.Fatalf("unexpected interval %v after a slow fetch", got)
+	}
+	// Healthy fetches move it back to the base.
+	for _, want := range []time.Duration{time.Second, time.Second} {
+		if got := next(10*time.Millisecond, nil); got != want {
+			t.Fatalf("interval %v, want %v", got, want)
+		}
+	}
+
+	// The lag tightens the interval down to the min, pressure still wins.
+	p.ObserveLag(time.Minute)
+	for _, want := range []time.Duration{500 * time.Millisecond, 250 * time.Millisecond, 250 * time.Millisecond} {
+		if got := next(0, nil); got != want {
+			t.Fatalf("interval %v under lag, want %v", got, want)
+		}
+	}
+	if got := next(0, failure); got != 500*time.Millisecond {
+		t.Fatalf("unexpected interval %v under lag and failure", got)
+	}
+	p.ObserveLag(0)
+	if got := next(0, nil); got != time.Second {
+		t.Fatalf("unexpected interval %v once the lag is gone", got)
+	}
+	if wait := p.Next(ctx, 300*time.Millisecond, nil); wait != 700*time.Millisecond {
+		t.Fatalf("unexpected wait %v", wait)
+	}
+}
+
+func TestAdaptivePacerCPU(t *testing.T) {
+	var seconds int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "# TYPE process_cpu_seconds_total counter\nprocess_cpu_seconds_total %d\n", atomic.LoadInt64(&seconds))
+	}))
+	defer server.Close()
+
+	probe := NewCPUProbe([]string{strings.TrimPrefix(server.URL, "http://")})
+	options := &AdaptiveOptions{MinInterval: time.Second, MaxInterval: time.Minute, LatencyRatio: 1, CPUThreshold: 4}
+	p := NewAdaptivePacer(time.Second, options, probe)
+	ctx := context.Background()
+
+	// The first probe has nothing to compare with.
+	p.Next(ctx, 0, nil)
+	if p.interval != time.Second {
+		t.Fatalf("unexpected interval %v", p.interval)
+	}
+	// Thousands of CPU seconds within the test are far beyond 4 cores.
+	atomic.StoreInt64(&seconds, 10000)
+	p.Next(ctx, 0, nil)
+	if p.interval != 2*time.Second {
+		t.Fatalf("unexpected interval %v under CPU pressure", p.interval)
+	}
+}
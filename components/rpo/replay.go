@@ -0,0 +1,159 @@
+package rpo
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/common"
+)
+
+const (
+	SampleVoter   = "voter"
+	SampleLearner = "learner"
+)
+
+// SampleRecord is a raw sample of the voters or the learners, written as a
+// line of JSON.
+type SampleRecord struct {
+	Kind      string                                             `json:"kind"`
+	Group     string                                             `json:"group,omitempty"`
+	Timestamp time.Time                                          `json:"timestamp"`
+	Stores    map[string]map[common.RegionId]*common.RegionState `json:"stores,omitempty"`
+	Error     string                                             `json:"error,omitempty"`
+}
+
+func (r *SampleRecord) sample() *Sample {
+	if r.Error != "" {
+		return &Sample{Group: r.Group, Error: errors.New(r.Error), Timestamp: r.Timestamp}
+	}
+
+	var hosts []string
+	for host := range r.Stores {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	merged := common.NewRegionInfos()
+	stores := make(map[string]*common.RegionInfos)
+	for _, host := range hosts {
+		infos := &common.RegionInfos{StateMap: r.Stores[host]}
+		stores[host] = infos
+		merged = MaxApplyIndex{}.Merge(merged, infos)
+	}
+
+	return &Sample{RegionInfos: merged, Group: r.Group, Stores: stores, Timestamp: r.Timestamp}
+}
+
+type Recorder struct {
+	f       *os.File
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := bufio.NewWriter(f)
+	return &Recorder{
+		f:       f,
+		writer:  writer,
+		encoder: json.NewEncoder(writer),
+	}, nil
+}
+
+func (r *Recorder) Record(kind string, sample *Sample) error {
+	record := &SampleRecord{Kind: kind, Group: sample.Group, Timestamp: sample.Timestamp}
+	if sample.Error != nil {
+		record.Error = sample.Error.Error()
+	} else {
+		record.Stores = make(map[string]map[common.RegionId]*common.RegionState)
+		for host, infos := range sample.Stores {
+			record.Stores[host] = infos.StateMap
+		}
+	}
+
+	if err := r.encoder.Encode(record); err != nil {
+		return err
+	}
+	return r.writer.Flush()
+}
+
+func (r *Recorder) Close() error {
+	if err := r.writer.Flush(); err != nil {
+		return err
+	}
+	return r.f.Close()
+}
+
+// ReplayEvent is written for every learner sample and alert during a replay.
+type ReplayEvent struct {
+	Timestamp time.Time   `json:"timestamp"`
+	RPO       *RPO        `json:"rpo,omitempty"`
+	Alert     *AlertEvent `json:"alert,omitempty"`
+}
+
+type replayNotifier struct {
+	encoder *json.Encoder
+}
+
+func (n *replayNotifier) Notify(_ context.Context, event *AlertEvent) error {
+	return n.encoder.Encode(&ReplayEvent{Timestamp: event.Timestamp, Alert: event})
+}
+
+// Replay runs the RPO computation over the recorded samples. The clock of the
+// generator follows the timestamps of the samples, so the output only depends
+// on the samples and the config.
+func Replay(ctx context.Context, config *Config, samples io.Reader, out io.Writer) error {
+	encoder := json.NewEncoder(out)
+
+	var notifier Notifier
+	if len(config.Alerts.Rules) > 0 {
+		notifier = &replayNotifier{encoder}
+	}
+
+	var clock time.Time
+	history := NewApplyHistory()
+	g := newGenerator(config, history, notifier)
+	g.now = func() time.Time {
+		return clock
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(samples))
+	for first := true; ; first = false {
+		record := &SampleRecord{}
+		if err := decoder.Decode(record); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		clock = record.Timestamp
+		if first {
+			history.Birth = clock
+		}
+
+		sample := record.sample()
+		switch record.Kind {
+		case SampleVoter:
+			g.onVoter(ctx, sample)
+		case SampleLearner:
+			rpo, _ := g.onLearner(ctx, sample)
+			if rpo == nil {
+				break
+			}
+			if err := encoder.Encode(&ReplayEvent{Timestamp: clock, RPO: rpo}); err != nil {
+				return err
+			}
+		}
+	}
+}
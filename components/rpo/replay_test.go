@@ -0,0 +1,53 @@
+package rpo
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// TestReplayGolden replays a recorded stream where learner a falls behind on
+// region 1 for a while, along with failed voter and learner samples.
+func TestReplayGolden(t *testing.T) {
+	config := DefaultConfig()
+	config.Groups = []*Group{{Name: "backup", Learners: []string{"a", "b"}}}
+	config.Windows = []time.Duration{10 * time.Second}
+	config.TopN = 1
+	rule, err := newAlertRule("slow", MetricLag, "3s", "", config.Windows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Alerts.Rules = []*AlertRule{rule}
+	config.Alerts.MinInterval = 0
+
+	samples, err := os.Open("testdata/samples.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer samples.Close()
+
+	out := &bytes.Buffer{}
+	if err = Replay(context.Background(), config, samples, out); err != nil {
+		t.Fatal(err)
+	}
+
+	const golden = "testdata/replay.golden"
+	if *update {
+		if err = ioutil.WriteFile(golden, out.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("replay output differs from %s, rerun with -update if it's expected:\n%s", golden, out.Bytes())
+	}
+}
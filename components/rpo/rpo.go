@@ -3,24 +3,53 @@ package rpo
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/components/tables"
 
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	historySegmentSize    = 64 << 20
+	historyCompactMinSize = 16 << 20
+	historyMeta           = "meta.json"
+	// alertQueueSize bounds the alert events waiting for the webhook.
+	alertQueueSize = 64
+	// readRetries bounds the reads of the history racing with compactions.
+	readRetries = 3
+)
+
 type ApplyHistory struct {
-	History map[common.RegionId][]*common.RegionState `json:"history"`
-	Birth   time.Time                                 `json:"birth"`
+	History    map[common.RegionId][]*common.RegionState `json:"history"`
+	Birth      time.Time                                 `json:"birth"`
+	SafePoints map[string][]*SafePoint                   `json:"safe-points"`
+
+	store *SegmentStore
+	// dirty maps a region to the position of its first entry not persisted yet.
+	dirty           map[common.RegionId]int
+	safePointsDirty map[string]int
+	safePoints      *safePointLog
 }
 
 func NewApplyHistory() *ApplyHistory {
 	return &ApplyHistory{
-		History: make(map[common.RegionId][]*common.RegionState),
-		Birth:   time.Now(),
+		History:         make(map[common.RegionId][]*common.RegionState),
+		Birth:           time.Now(),
+		SafePoints:      make(map[string][]*SafePoint),
+		dirty:           make(map[common.RegionId]int),
+		safePointsDirty: make(map[string]int),
 	}
 }
 
@@ -34,14 +63,148 @@ func FromFile(path string) (*ApplyHistory, error) {
 	if err = json.Unmarshal(data, history); err != nil {
 		return nil, err
 	}
+	history.dirty = make(map[common.RegionId]int)
+	history.SafePoints = make(map[string][]*SafePoint)
+	history.safePointsDirty = make(map[string]int)
 
 	return history, nil
 }
 
+// OpenApplyHistory loads the history persisted in the directory segment by
+// segment. A history file written by older versions is moved aside and
+// imported. The safe points of the groups no longer configured are dropped.
+func OpenApplyHistory(dir string, groups []string) (*ApplyHistory, error) {
+	var legacy *ApplyHistory
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		if legacy, err = FromFile(dir); err != nil {
+			return nil, err
+		}
+		if err = os.Rename(dir, dir+".legacy"); err != nil {
+			return nil, err
+		}
+		log.Warnf("Importing legacy history file, it is moved to %s.legacy", dir)
+	}
+
+	store, err := OpenSegmentStore(dir, historySegmentSize)
+	if err != nil {
+		return nil, err
+	}
+
+	h := NewApplyHistory()
+	h.store = store
+
+	meta := filepath.Join(dir, historyMeta)
+	if legacy != nil {
+		h.History = legacy.History
+		h.Birth = legacy.Birth
+		for id := range h.History {
+			h.dirty[id] = 0
+		}
+	} else if data, err := ioutil.ReadFile(meta); err == nil {
+		if err = json.Unmarshal(data, h); err != nil {
+			return nil, err
+		}
+	}
+
+	if legacy != nil || len(store.segments) == 0 {
+		data, err := json.Marshal(map[string]time.Time{"birth": h.Birth})
+		if err != nil {
+			return nil, err
+		}
+		if err = ioutil.WriteFile(meta, data, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = store.Replay(h.replay); err != nil {
+		return nil, err
+	}
+	if h.safePoints, h.SafePoints, err = openSafePointLog(dir, groupSet(groups)); err != nil {
+		return nil, err
+	}
+	for group, points := range h.SafePoints {
+		h.safePointsDirty[group] = len(points)
+	}
+
+	return h, h.Persist()
+}
+
+func groupSet(groups []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, group := range groups {
+		set[group] = true
+	}
+	return set
+}
+
+// ReadApplyHistory loads the history in the directory without writing to it,
+// for the readers other than the rpo command. A segment removed by the
+// compaction of a running rpo command is taken as a sign to read again.
+func ReadApplyHistory(dir string, groups []string) (*ApplyHistory, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return FromFile(dir)
+	}
+
+	for retry := 0; ; retry++ {
+		h, err := readApplyHistory(dir, groups)
+		if err == nil || !os.IsNotExist(err) || retry == readRetries {
+			return h, err
+		}
+		log.Warnf("History segments are compacted while reading, retrying: %v", err)
+	}
+}
+
+func readApplyHistory(dir string, groups []string) (*ApplyHistory, error) {
+	store, err := ReadSegmentStore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	h := NewApplyHistory()
+	if data, err := ioutil.ReadFile(filepath.Join(dir, historyMeta)); err == nil {
+		if err = json.Unmarshal(data, h); err != nil {
+			return nil, err
+		}
+	}
+	if err = store.Replay(h.replay); err != nil {
+		return nil, err
+	}
+	if h.SafePoints, _, _, err = readSafePoints(filepath.Join(dir, safePointsFile), groupSet(groups)); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *ApplyHistory) replay(r *Record) {
+	state := &common.RegionState{RegionId: r.RegionId}
+	state.ApplyState.AppliedIndex = r.AppliedIndex
+	state.ApplyState.Timestamp = time.Unix(0, r.Timestamp)
+	state.ApplyState.Received = time.Unix(0, r.Received)
+
+	history := h.History[r.RegionId]
+	if n := len(history); n > 0 && history[n-1].ApplyState.AppliedIndex == r.AppliedIndex {
+		history[n-1] = state
+	} else {
+		h.History[r.RegionId] = append(history, state)
+	}
+}
+
 func (h *ApplyHistory) Update(infos *common.RegionInfos) {
 	for id, state := range infos.StateMap {
 		history := h.History[id]
 		if len(history) == 0 || history[len(history)-1].ApplyState.AppliedIndex != state.ApplyState.AppliedIndex {
+			// The last entry is sealed with its final timestamp, write it again along with the new one.
+			if _, ok := h.dirty[id]; !ok {
+				pos := len(history) - 1
+				if pos < 0 {
+					pos = 0
+				}
+				h.dirty[id] = pos
+			}
 			h.History[id] = append(h.History[id], state)
 		} else {
 			h.History[id][len(history)-1] = state
@@ -49,11 +212,8 @@ func (h *ApplyHistory) Update(infos *common.RegionInfos) {
 	}
 }
 
-func (h *ApplyHistory) RPOQuery(q *common.RegionState) time.Time {
+func (h *ApplyHistory) search(q *common.RegionState) int {
 	history := h.History[q.RegionId]
-	if len(history) == 0 {
-		return h.Birth
-	}
 
 	var index int
 	for i, state := range history {
@@ -62,8 +222,99 @@ func (h *ApplyHistory) RPOQuery(q *common.RegionState) time.Time {
 			break
 		}
 	}
+	return index
+}
+
+// Query returns the time when the voters reached the applied index of q
+// without trimming the history.
+func (h *ApplyHistory) Query(q *common.RegionState) time.Time {
+	history := h.History[q.RegionId]
+	if len(history) == 0 {
+		return h.Birth
+	}
+	return history[h.search(q)].ApplyState.Timestamp
+}
+
+// QueryState returns the voter entry which reached the applied index of q,
+// nil if there is no history of the region.
+func (h *ApplyHistory) QueryState(q *common.RegionState) *common.RegionState {
+	history := h.History[q.RegionId]
+	if len(history) == 0 {
+		return nil
+	}
+	return history[h.search(q)]
+}
+
+// received returns the end of the observation window of the state, states
+// recorded by older versions are treated as exact.
+func received(state *common.RegionState) time.Time {
+	if state.ApplyState.Received.IsZero() {
+		return state.ApplyState.Timestamp
+	}
+	return state.ApplyState.Received
+}
+
+// LagInterval bounds the lag of the learner state q. The learner is observed
+// during [ls, le], the voters are short of its index when the previous entry
+// is requested at vs, which may be sampled as early as that, and reach it by
+// the entry received at ve, so the lag lies in [ls-ve, le-vs].
+func (h *ApplyHistory) LagInterval(q *common.RegionState) (lower, upper time.Duration) {
+	vs, ve := h.Birth, h.Birth
+	if history := h.History[q.RegionId]; len(history) > 0 {
+		index := h.search(q)
+		if index > 0 {
+			vs = history[index-1].ApplyState.Timestamp
+		}
+		ve = received(history[index])
+		// The voters are not seen at the index yet, they are ahead of the
+		// last entry at most.
+		if history[index].ApplyState.AppliedIndex < q.ApplyState.AppliedIndex {
+			vs, ve = history[index].ApplyState.Timestamp, q.ApplyState.Timestamp
+		}
+	}
+
+	lower = q.ApplyState.Timestamp.Sub(ve)
+	if lower < 0 {
+		lower = 0
+	}
+	upper = received(q).Sub(vs)
+	return
+}
+
+// Latest returns the most recent voter state of the region.
+func (h *ApplyHistory) Latest(id common.RegionId) *common.RegionState {
+	history := h.History[id]
+	if len(history) == 0 {
+		return nil
+	}
+	return history[len(history)-1]
+}
+
+// Trim drops the history of the region which is older than the given applied
+// index, the entry just before it is kept to bound the lag interval.
+func (h *ApplyHistory) Trim(q *common.RegionState) {
+	history := h.History[q.RegionId]
+	if len(history) == 0 {
+		return
+	}
+
+	index := h.search(q)
+	if index > 0 {
+		index--
+	}
 	h.History[q.RegionId] = history[index:]
-	return history[index].ApplyState.Timestamp
+	if pos, ok := h.dirty[q.RegionId]; ok {
+		if pos -= index; pos < 0 {
+			pos = 0
+		}
+		h.dirty[q.RegionId] = pos
+	}
+}
+
+func (h *ApplyHistory) RPOQuery(q *common.RegionState) time.Time {
+	ts := h.Query(q)
+	h.Trim(q)
+	return ts
 }
 
 func (h *ApplyHistory) Save(path string) error {
@@ -74,6 +325,86 @@ func (h *ApplyHistory) Save(path string) error {
 	return ioutil.WriteFile(path, data, 0644)
 }
 
+func newRecord(state *common.RegionState) *Record {
+	return &Record{
+		RegionId:     state.RegionId,
+		AppliedIndex: state.ApplyState.AppliedIndex,
+		Timestamp:    state.ApplyState.Timestamp.UnixNano(),
+		Received:     received(state).UnixNano(),
+	}
+}
+
+// Persist appends the entries changed since the last call to the store. The
+// store is compacted to the trimmed history once the dropped entries dominate.
+func (h *ApplyHistory) Persist() error {
+	if h.store == nil {
+		return nil
+	}
+
+	for id, pos := range h.dirty {
+		for _, state := range h.History[id][pos:] {
+			if err := h.store.Append(newRecord(state)); err != nil {
+				return err
+			}
+		}
+	}
+	h.dirty = make(map[common.RegionId]int)
+
+	if err := h.store.Sync(); err != nil {
+		return err
+	}
+
+	if h.safePoints != nil {
+		for group, points := range h.SafePoints {
+			if err := h.safePoints.append(points[h.safePointsDirty[group]:]); err != nil {
+				return err
+			}
+			h.safePointsDirty[group] = len(points)
+		}
+		if err := h.safePoints.sync(); err != nil {
+			return err
+		}
+		if err := h.safePoints.compact(h.SafePoints); err != nil {
+			return err
+		}
+	}
+
+	live := int64(0)
+	for _, history := range h.History {
+		live += int64(len(history)) * recordSize
+	}
+	if size := h.store.Size(); size < historyCompactMinSize || size < live*4 {
+		return nil
+	}
+
+	log.Infof("Compacting apply history from %v bytes to %v bytes", h.store.Size(), live)
+	return h.store.Compact(func(emit func(r *Record) error) error {
+		for _, history := range h.History {
+			for _, state := range history {
+				if err := emit(newRecord(state)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (h *ApplyHistory) Close() error {
+	if h.store == nil {
+		return nil
+	}
+	if err := h.Persist(); err != nil {
+		return err
+	}
+	if h.safePoints != nil {
+		if err := h.safePoints.close(); err != nil {
+			return err
+		}
+	}
+	return h.store.Close()
+}
+
 type MaxApplyIndex struct{}
 
 func (m MaxApplyIndex) Merge(a *common.RegionInfos, b *common.RegionInfos) *common.RegionInfos {
@@ -102,9 +433,18 @@ func (f *LocalTiKVCtl) Fetch(ctx context.Context) (*common.RegionInfos, error) {
 	applyTS := time.Now()
 	cmd := exec.CommandContext(ctx, f.controller, "--host", f.host, "raft", "region", "--all-regions")
 	resp, err := cmd.Output()
+	receivedTS := time.Now()
+	logger := log.WithFields(log.Fields{
+		common.FieldStep:     "sample",
+		common.FieldHost:     f.host,
+		common.FieldCommand:  strings.Join(cmd.Args, " "),
+		common.FieldDuration: receivedTS.Sub(applyTS).String(),
+	})
 	if err != nil {
+		logger.WithError(err).Warn("Fail to fetch region infos")
 		return nil, err
 	}
+	logger.Debug("Fetched region infos")
 
 	infos := &common.RegionInfos{}
 	if err = json.Unmarshal(resp, infos); err != nil {
@@ -112,97 +452,620 @@ func (f *LocalTiKVCtl) Fetch(ctx context.Context) (*common.RegionInfos, error) {
 	}
 
 	for id := range infos.StateMap {
+		infos.StateMap[id].Host = f.host
 		infos.StateMap[id].ApplyState.Timestamp = applyTS
+		infos.StateMap[id].ApplyState.Received = receivedTS
+	}
+
+	return infos, nil
+}
+
+type Sample struct {
+	*common.RegionInfos
+	// Group is the learner group sampled, empty for the voters.
+	Group     string
+	Stores    map[string]*common.RegionInfos
+	Timestamp time.Time
+	Error     error
+}
+
+type storeFetcher struct {
+	common.Fetcher
+	store string
+
+	mu     *sync.Mutex
+	stores map[string]*common.RegionInfos
+}
+
+func (f *storeFetcher) Fetch(ctx context.Context) (*common.RegionInfos, error) {
+	infos, err := f.Fetcher.Fetch(ctx)
+	if err != nil {
+		return nil, err
 	}
 
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stores[f.store] = infos
+
 	return infos, nil
 }
 
 type UpdateWorker struct {
-	controller string
-	hosts      []string
-	interval   time.Duration
+	group    string
+	hosts    []string
+	fetchers map[string]common.Fetcher
+	pacer    Pacer
 }
 
-func NewUpdateWorker(controller string, hosts []string, interval time.Duration) *UpdateWorker {
-	return &UpdateWorker{controller, hosts, interval}
+func NewUpdateWorker(group string, hosts []string, newFetcher func(host string) common.Fetcher, pacer Pacer) *UpdateWorker {
+	fetchers := make(map[string]common.Fetcher)
+	for _, host := range hosts {
+		fetchers[host] = newFetcher(host)
+	}
+	return &UpdateWorker{group, hosts, fetchers, pacer}
 }
 
-func (w *UpdateWorker) Run(ctx context.Context, ch chan<- common.Result) {
+func (w *UpdateWorker) Run(ctx context.Context, ch chan<- Sample) {
 	collector := common.NewRegionCollector()
 	for {
+		var (
+			fetchers []common.Fetcher
+			mu       = &sync.Mutex{}
+			stores   = make(map[string]*common.RegionInfos)
+			ts       = time.Now()
+		)
+		for _, host := range w.hosts {
+			fetcher := &storeFetcher{
+				Fetcher: w.fetchers[host],
+				store:   host,
+				mu:      mu,
+				stores:  stores,
+			}
+			fetchers = append(fetchers, fetcher)
+		}
+
+		sample := Sample{Group: w.group, Timestamp: ts}
+		infos, err := collector.Collect(ctx, fetchers, MaxApplyIndex{})
+		if err != nil {
+			sample.Error = err
+		} else {
+			sample.RegionInfos, sample.Stores = infos, stores
+		}
+
 		select {
 		case <-ctx.Done():
-			ch <- common.Result{Error: ctx.Err()}
 			return
-		default:
-			var fetchers []common.Fetcher
-			for _, host := range w.hosts {
-				fetcher := NewLocalTiKVCtl(w.controller, host)
-				fetchers = append(fetchers, fetcher)
-			}
+		case ch <- sample:
+		}
 
-			infos, err := collector.Collect(ctx, fetchers, MaxApplyIndex{})
-			if err != nil {
-				ch <- common.Result{Error: err}
-				break
-			}
-			ch <- common.Result{RegionInfos: infos}
-			time.Sleep(w.interval)
+		// The time spent on fetching is a part of the interval.
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.pacer.Next(ctx, time.Since(ts), err)):
 		}
 	}
 }
 
+// learnerGroup tracks the RPO of the learners in a group.
+type learnerGroup struct {
+	name     string
+	learners []string
+	series   *Series
+	alerter  *Alerter
+	pacer    Pacer
+
+	metrics  map[string]float64
+	failures int
+
+	// slowest maps a region to its learner peer with the lowest applied index
+	// in the latest sample, nil until the group is sampled.
+	slowest   map[common.RegionId]*common.RegionState
+	rpo       *RPO
+	breakdown *Breakdown
+}
+
 type Generator struct {
-	config  *Config
-	history *ApplyHistory
+	config   *Config
+	history  *ApplyHistory
+	notifier Notifier
+
+	groups        []*learnerGroup
+	voterFailures int
+	voterPacer    Pacer
+
+	now      func() time.Time
+	recorder *Recorder
+	// catalog names the tables of the regions, nil if no schema source is
+	// configured.
+	catalog *tables.Catalog
+
+	// mu guards the history and the latest results of the groups shared with
+	// the HTTP API.
+	mu sync.RWMutex
 }
 
-func NewGenerator(config *Config) *Generator {
-	var (
-		history *ApplyHistory
-		err     error
-	)
-	if history, err = FromFile(config.HistoryPath); err != nil {
-		history = NewApplyHistory()
+func NewGenerator(config *Config) (*Generator, error) {
+	var names []string
+	for _, group := range config.Groups {
+		names = append(names, group.Name)
 	}
-	return &Generator{
-		config:  config,
-		history: history,
+	history, err := OpenApplyHistory(config.HistoryPath, names)
+	if err != nil {
+		return nil, err
 	}
+
+	var hook *Webhook
+	if len(config.Alerts.Rules) > 0 {
+		webhook := config.Alerts.Webhook
+		if hook, err = NewWebhook(webhook.URL, webhook.Template, webhook.Timeout); err != nil {
+			return nil, err
+		}
+	}
+	catalog, err := tables.Load(context.Background(), config.SchemaSource)
+	if err != nil {
+		return nil, fmt.Errorf("schema-source: %v", err)
+	}
+	var recorder *Recorder
+	if config.Record != "" {
+		if recorder, err = NewRecorder(config.Record); err != nil {
+			return nil, err
+		}
+	}
+
+	// The webhook is delivered to in the background once nothing can fail.
+	var notifier Notifier
+	if hook != nil {
+		notifier = NewAsyncNotifier(hook, alertQueueSize)
+	}
+	g := newGenerator(config, history, notifier)
+	g.catalog, g.recorder = catalog, recorder
+	return g, nil
 }
 
+func newGenerator(config *Config, history *ApplyHistory, notifier Notifier) *Generator {
+	g := &Generator{
+		config:   config,
+		history:  history,
+		notifier: notifier,
+		now:      time.Now,
+	}
+	for _, group := range config.Groups {
+		g.addGroup(group.Name, group.Learners)
+	}
+	return g
+}
+
+func (g *Generator) addGroup(name string, learners []string) *learnerGroup {
+	var retention time.Duration
+	for _, window := range g.config.Windows {
+		if window > retention {
+			retention = window
+		}
+	}
+
+	group := &learnerGroup{
+		name:     name,
+		learners: learners,
+		series:   NewSeries(retention),
+		metrics:  make(map[string]float64),
+	}
+	if g.notifier != nil {
+		group.alerter = NewAlerter(name, g.config.Alerts.Rules, g.notifier, g.config.Alerts.MinInterval)
+	}
+	g.groups = append(g.groups, group)
+	return group
+}
+
+// group returns the learner group of the name. Samples recorded by older
+// versions carry no group and belong to the default group, groups unknown
+// to the config are created while replaying.
+func (g *Generator) group(name string) *learnerGroup {
+	if name == "" {
+		if len(g.groups) == 1 {
+			return g.groups[0]
+		}
+		name = common.DefaultLearnerGroup
+	}
+	for _, group := range g.groups {
+		if group.name == name {
+			return group
+		}
+	}
+	return g.addGroup(name, nil)
+}
+
+// lookup returns the group named in a query, it may be omitted if there is
+// only one group.
+func (g *Generator) lookup(name string) (*learnerGroup, error) {
+	if name == "" {
+		if len(g.groups) != 1 {
+			return nil, errors.New("group is required with multiple learner groups")
+		}
+		return g.groups[0], nil
+	}
+	for _, group := range g.groups {
+		if group.name == name {
+			return group, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown learner group %q", name)
+}
+
+func (g *Generator) newFetcher(host string) common.Fetcher {
+	config := g.config
+	if config.Source == SourceStatus {
+		interval := config.Sampling.LearnerInterval
+		for _, voter := range config.Voters {
+			if voter == host {
+				interval = config.Sampling.VoterInterval
+			}
+		}
+		budget := time.Duration(float64(interval) * config.StatusBudget)
+		return NewTiKVStatus(config.PD, host, config.StatusAddrs[host], config.StatusConcurrency, budget)
+	}
+	return NewLocalTiKVCtl(config.TikvCtlPath, host)
+}
+
+func (g *Generator) newPacer(base time.Duration, hosts []string) Pacer {
+	adaptive := g.config.Sampling.Adaptive
+	if adaptive == nil {
+		return NewFixedPacer(base)
+	}
+
+	var cpu *CPUProbe
+	if adaptive.CPUThreshold > 0 {
+		var addrs []string
+		for _, host := range hosts {
+			addrs = append(addrs, g.config.StatusAddrs[host])
+		}
+		cpu = NewCPUProbe(addrs)
+	}
+
+	return NewAdaptivePacer(base, adaptive, cpu)
+}
+
+func observeLag(pacer Pacer, lag time.Duration) {
+	if adaptive, ok := pacer.(*AdaptivePacer); ok {
+		adaptive.ObserveLag(lag)
+	}
+}
+
+func (g *Generator) evaluate(ctx context.Context, now time.Time, group *learnerGroup) {
+	if group.alerter == nil {
+		return
+	}
+
+	failures := g.voterFailures
+	if group.failures > failures {
+		failures = group.failures
+	}
+	group.metrics[MetricFetchFailures] = float64(failures)
+	group.alerter.Evaluate(ctx, now, group.metrics)
+}
+
+// RPO reports the lag together with its confidence interval, the upper
+// bound is the worst case and backs the percentiles, windows and alerts.
 type RPO struct {
-	Lag      time.Duration `json:"lag"`
-	SafeTime time.Time     `json:"safe-time"`
+	Group       string         `json:"group"`
+	Lag         time.Duration  `json:"lag"`
+	LagLower    time.Duration  `json:"lag-lower"`
+	LagUpper    time.Duration  `json:"lag-upper"`
+	SafeTime    time.Time      `json:"safe-time"`
+	Percentiles Percentiles    `json:"percentiles"`
+	Windows     []*WindowStats `json:"windows"`
+	Stores      []*StoreLag    `json:"stores"`
+	Worst       []*RegionLag   `json:"worst"`
+	// Tables are the most lagging TiDB tables.
+	Tables []*TableLag `json:"tables,omitempty"`
 }
 
 func (r *RPO) MarshalJSON() ([]byte, error) {
 	type _RPO struct {
-		Lag      string    `json:"lag"`
-		SafeTime time.Time `json:"safe-time"`
+		Group       string         `json:"group"`
+		Lag         string         `json:"lag"`
+		LagLower    string         `json:"lag-lower"`
+		LagUpper    string         `json:"lag-upper"`
+		SafeTime    time.Time      `json:"safe-time"`
+		Percentiles *Percentiles   `json:"percentiles"`
+		Windows     []*WindowStats `json:"windows"`
+		Stores      []*StoreLag    `json:"stores"`
+		Worst       []*RegionLag   `json:"worst"`
+		Tables      []*TableLag    `json:"tables,omitempty"`
 	}
 	t := &_RPO{
-		Lag:      r.Lag.String(),
-		SafeTime: r.SafeTime,
+		Group:       r.Group,
+		Lag:         r.Lag.String(),
+		LagLower:    r.LagLower.String(),
+		LagUpper:    r.LagUpper.String(),
+		SafeTime:    r.SafeTime,
+		Percentiles: &r.Percentiles,
+		Windows:     r.Windows,
+		Stores:      r.Stores,
+		Worst:       r.Worst,
+		Tables:      r.Tables,
 	}
 	return json.Marshal(t)
 }
 
+// sortedRegionIds keeps the computation deterministic when lags are equal.
+func sortedRegionIds(infos *common.RegionInfos) []common.RegionId {
+	ids := make([]common.RegionId, 0, len(infos.StateMap))
+	for id := range infos.StateMap {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// observe computes the RPO and the per-region breakdown of a learner sample
+// of the group.
+func (g *Generator) observe(group *learnerGroup, sample *Sample) (*RPO, *Breakdown) {
+	breakdown := &Breakdown{}
+
+	slowest := make(map[common.RegionId]*common.RegionState)
+	for store, infos := range sample.Stores {
+		storeLag := &StoreLag{Store: store}
+		total := time.Duration(0)
+		for _, id := range sortedRegionIds(infos) {
+			info := infos.StateMap[id]
+			_, lag := g.history.LagInterval(info)
+			storeLag.Regions++
+			total += lag
+			if lag >= storeLag.MaxLag {
+				storeLag.MaxLag = lag
+				storeLag.WorstRegion = id
+			}
+
+			if s, ok := slowest[id]; !ok || info.ApplyState.AppliedIndex < s.ApplyState.AppliedIndex {
+				slowest[id] = info
+			}
+		}
+		if storeLag.Regions > 0 {
+			storeLag.AvgLag = total / time.Duration(storeLag.Regions)
+		}
+		breakdown.Stores = append(breakdown.Stores, storeLag)
+	}
+
+	var (
+		max, maxLower, maxUpper time.Duration
+		safeTime                time.Time
+	)
+	lags := make([]time.Duration, 0, len(sample.StateMap))
+	tableLags := make(map[int64]*TableLag)
+	for _, id := range sortedRegionIds(sample.RegionInfos) {
+		info := sample.StateMap[id]
+		ts := g.history.Query(info)
+		lag := info.ApplyState.Timestamp.Sub(ts)
+		if lag >= max && ts.After(safeTime) {
+			max = lag
+			safeTime = ts
+		}
+
+		lower, upper := g.history.LagInterval(info)
+		lags = append(lags, upper)
+		if lower > maxLower {
+			maxLower = lower
+		}
+		if upper > maxUpper {
+			maxUpper = upper
+		}
+
+		regionLag := &RegionLag{
+			RegionId:            id,
+			StartKey:            info.LocalState.Region.StartKey,
+			EndKey:              info.LocalState.Region.EndKey,
+			Store:               info.Host,
+			LearnerAppliedIndex: info.ApplyState.AppliedIndex,
+			LearnerCommitIndex:  info.CommitIndex(),
+			Lag:                 lag,
+			LagLower:            lower,
+			LagUpper:            upper,
+			SafeTime:            ts,
+		}
+		if voter := g.history.Latest(id); voter != nil {
+			regionLag.VoterAppliedIndex = voter.ApplyState.AppliedIndex
+		}
+		breakdown.Regions = append(breakdown.Regions, regionLag)
+
+		for _, table := range g.catalog.Tables(regionLag.StartKey, regionLag.EndKey) {
+			tableLag, ok := tableLags[table.ID]
+			if !ok {
+				tableLag = &TableLag{TableID: table.ID, Table: table.String()}
+				tableLags[table.ID] = tableLag
+				breakdown.Tables = append(breakdown.Tables, tableLag)
+			}
+			tableLag.Regions++
+			if upper >= tableLag.MaxLag {
+				tableLag.MaxLag = upper
+				tableLag.WorstRegion = id
+			}
+		}
+
+		if _, ok := slowest[id]; !ok {
+			slowest[id] = info
+		}
+	}
+	group.slowest = slowest
+
+	group.series.Add(sample.Timestamp, maxUpper)
+	var windows []*WindowStats
+	for _, window := range g.config.Windows {
+		windows = append(windows, group.series.Window(sample.Timestamp, window))
+	}
+
+	breakdown.Sort()
+	return &RPO{
+		Group:       group.name,
+		Lag:         max,
+		LagLower:    maxLower,
+		LagUpper:    maxUpper,
+		SafeTime:    safeTime,
+		Percentiles: NewPercentiles(lags),
+		Windows:     windows,
+		Stores:      breakdown.Stores,
+		Worst:       breakdown.Worst(g.config.TopN),
+		Tables:      breakdown.WorstTables(g.config.TopN),
+	}, breakdown
+}
+
+// trim drops the history no learner group needs. It is trimmed to the slowest
+// learner peer of each region over all groups, so the lag of every peer can
+// still be queried next time.
+func (g *Generator) trim() {
+	slowest := make(map[common.RegionId]*common.RegionState)
+	for _, group := range g.groups {
+		// The history is kept until every group has been sampled.
+		if group.slowest == nil {
+			return
+		}
+		for id, info := range group.slowest {
+			if s, ok := slowest[id]; !ok || info.ApplyState.AppliedIndex < s.ApplyState.AppliedIndex {
+				slowest[id] = info
+			}
+		}
+	}
+
+	for _, info := range slowest {
+		g.history.Trim(info)
+	}
+}
+
+func (g *Generator) onVoter(ctx context.Context, sample *Sample) {
+	if err := sample.Error; err != nil {
+		log.Error(err)
+		g.voterFailures++
+		for _, group := range g.groups {
+			g.evaluate(ctx, g.now(), group)
+		}
+		return
+	}
+	g.voterFailures = 0
+
+	g.mu.Lock()
+	g.history.Update(sample.RegionInfos)
+	g.mu.Unlock()
+}
+
+// onLearner returns nil if the learners are failed to be sampled.
+func (g *Generator) onLearner(ctx context.Context, sample *Sample) (*RPO, *Breakdown) {
+	group := g.group(sample.Group)
+	if err := sample.Error; err != nil {
+		log.WithField(common.FieldGroup, group.name).WithError(err).Error("Fail to sample learner group")
+		group.failures++
+		g.evaluate(ctx, g.now(), group)
+		return nil, nil
+	}
+	group.failures = 0
+
+	g.mu.Lock()
+	rpo, breakdown := g.observe(group, sample)
+	g.trim()
+	g.history.AddSafePoint(&SafePoint{
+		Group:     group.name,
+		Timestamp: sample.Timestamp,
+		SafeTime:  rpo.SafeTime,
+		LagUpper:  rpo.LagUpper,
+	}, g.config.SafePointRetention)
+	group.rpo, group.breakdown = rpo, breakdown
+
+	// The voters are sampled as fast as the most lagging group needs.
+	maxLag := time.Duration(0)
+	for _, group := range g.groups {
+		if group.rpo != nil && group.rpo.LagUpper > maxLag {
+			maxLag = group.rpo.LagUpper
+		}
+	}
+	g.mu.Unlock()
+
+	observeLag(group.pacer, rpo.LagUpper)
+	observeLag(g.voterPacer, maxLag)
+	for k, v := range rpo.Metrics() {
+		group.metrics[k] = v
+	}
+	g.evaluate(ctx, sample.Timestamp, group)
+
+	return rpo, breakdown
+}
+
+func (g *Generator) record(kind string, sample *Sample) {
+	if g.recorder == nil || sample.Error == context.Canceled || sample.Error == context.DeadlineExceeded {
+		return
+	}
+	if err := g.recorder.Record(kind, sample); err != nil {
+		log.Error(err)
+	}
+}
+
+func (g *Generator) save(group *learnerGroup, rpo *RPO, breakdown *Breakdown) {
+	config := g.config
+	data, err := json.Marshal(rpo)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	err = ioutil.WriteFile(config.GroupPath(config.Save, group.name), data, 0644)
+	if err != nil {
+		log.Error(err)
+	}
+	if config.Breakdown != "" {
+		if err = breakdown.Save(config.GroupPath(config.Breakdown, group.name)); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
 func (g *Generator) Gen(ctx context.Context) error {
 	config := g.config
-	votersInfoUpdater := NewUpdateWorker(config.TikvCtlPath, config.Voters, time.Millisecond*500)
-	learnerInfosUpdater := NewUpdateWorker(config.TikvCtlPath, config.Learners, time.Second*2)
+	sampling := config.Sampling
+
+	g.voterPacer = g.newPacer(sampling.VoterInterval, config.Voters)
+	votersInfoUpdater := NewUpdateWorker("", config.Voters, g.newFetcher, g.voterPacer)
+	var learnerInfosUpdaters []*UpdateWorker
+	for _, group := range g.groups {
+		group.pacer = g.newPacer(sampling.LearnerInterval, group.learners)
+		learnerInfosUpdaters = append(learnerInfosUpdaters, NewUpdateWorker(group.name, group.learners, g.newFetcher, group.pacer))
+	}
 
-	voterCh := make(chan common.Result)
-	learnerCh := make(chan common.Result)
+	voterCh := make(chan Sample)
+	learnerCh := make(chan Sample)
 	persistCh := make(chan struct{})
 
 	ctx, cancel := context.WithTimeout(ctx, config.LastFor)
 	defer cancel()
 
+	defer func() {
+		if err := g.history.Close(); err != nil {
+			log.Error(err)
+		}
+		if g.recorder != nil {
+			if err := g.recorder.Close(); err != nil {
+				log.Error(err)
+			}
+		}
+		if notifier, ok := g.notifier.(*AsyncNotifier); ok {
+			notifier.Close()
+		}
+	}()
+
+	if config.Listen != "" {
+		server := &http.Server{Addr: config.Listen, Handler: g.Handler()}
+		go func() {
+			log.Infof("Serving RPO API on %s", config.Listen)
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Error(err)
+			}
+		}()
+		defer server.Close()
+	}
+
 	go votersInfoUpdater.Run(ctx, voterCh)
-	go learnerInfosUpdater.Run(ctx, learnerCh)
+	for _, updater := range learnerInfosUpdaters {
+		go updater.Run(ctx, learnerCh)
+	}
 
 	go func() {
 		for {
@@ -211,7 +1074,7 @@ func (g *Generator) Gen(ctx context.Context) error {
 				return
 			default:
 				persistCh <- struct{}{}
-				time.Sleep(time.Second * 1)
+				time.Sleep(sampling.PersistInterval)
 			}
 		}
 	}()
@@ -221,46 +1084,29 @@ func (g *Generator) Gen(ctx context.Context) error {
 		case <-ctx.Done():
 			return nil
 		case result := <-voterCh:
-			if err := result.Error; err != nil {
-				log.Error(err)
-				break
-			}
-			g.history.Update(result.RegionInfos)
+			g.record(SampleVoter, &result)
+			g.onVoter(ctx, &result)
 		case result := <-learnerCh:
-			if err := result.Error; err != nil {
-				log.Error(err)
-				break
-			}
-
-			max := time.Duration(0)
-			var safeTime time.Time
-			for _, info := range result.StateMap {
-				ts := g.history.RPOQuery(info)
-				if lag := info.ApplyState.Timestamp.Sub(ts); lag >= max && ts.After(safeTime) {
-					max = lag
-					safeTime = ts
-				}
-			}
-
-			rpo := &RPO{max, safeTime}
-			data, err := json.Marshal(rpo)
-			if err != nil {
-				log.Error(err)
+			g.record(SampleLearner, &result)
+			rpo, breakdown := g.onLearner(ctx, &result)
+			if rpo == nil {
 				break
 			}
 
-			err = ioutil.WriteFile(config.Save, data, 0644)
-			if err != nil {
-				log.Error(err)
-			}
+			g.save(g.group(result.Group), rpo, breakdown)
 			log.WithFields(map[string]interface{}{
-				"lag":      rpo.Lag,
-				"safeTime": rpo.SafeTime,
+				common.FieldGroup: rpo.Group,
+				"lag":             rpo.Lag,
+				"lag_upper":       rpo.LagUpper,
+				"p99":             rpo.Percentiles.P99,
+				"safe_time":       rpo.SafeTime,
 			}).Info("RPO updated")
 		case <-persistCh:
-			if err := g.history.Save(config.HistoryPath); err != nil {
+			g.mu.Lock()
+			if err := g.history.Persist(); err != nil {
 				log.Error(err)
 			}
+			g.mu.Unlock()
 		}
 	}
 }
@@ -0,0 +1,200 @@
+package rpo
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// safePointsFile keeps the safe points in the history directory apart
+	// from the region records of the segments, a JSON line each.
+	safePointsFile = "safe-points.jsonl"
+	// safePointsCompactMinLines is the least lines of the file compacted.
+	safePointsCompactMinLines = 4096
+)
+
+// SafePoint is the RPO of a learner group observed at a learner sample.
+type SafePoint struct {
+	Group     string        `json:"group"`
+	Timestamp time.Time     `json:"timestamp"`
+	SafeTime  time.Time     `json:"safe-time"`
+	LagUpper  time.Duration `json:"lag-upper"`
+}
+
+// readSafePoints reads the safe points of the groups in the file, a missing
+// file has none. The size of the complete lines is returned along with the
+// number of lines, a torn last line left by a crash or by a writer in the
+// middle of an append is ignored.
+func readSafePoints(path string, groups map[string]bool) (points map[string][]*SafePoint, lines int, size int64, err error) {
+	points = make(map[string][]*SafePoint)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return points, 0, 0, nil
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, 0, 0, err
+		}
+		if len(data) == 0 {
+			return points, lines, size, nil
+		}
+		if data[len(data)-1] != '\n' {
+			log.Warnf("Ignoring the torn last line %d of safe points %s", lines+1, path)
+			return points, lines, size, nil
+		}
+
+		point := &SafePoint{}
+		if err := json.Unmarshal(data, point); err != nil {
+			return nil, 0, 0, fmt.Errorf("safe points %s line %d: %v", path, lines+1, err)
+		}
+		lines++
+		size += int64(len(data))
+		if groups[point.Group] {
+			points[point.Group] = append(points[point.Group], point)
+		}
+	}
+}
+
+// safePointLog appends the safe points to the file in the history directory.
+type safePointLog struct {
+	path string
+	file *os.File
+	// lines counts the lines in the file, expired or not.
+	lines int
+}
+
+// openSafePointLog loads the safe points of the groups and opens the file
+// for appending, a torn last line is truncated.
+func openSafePointLog(dir string, groups map[string]bool) (*safePointLog, map[string][]*SafePoint, error) {
+	path := filepath.Join(dir, safePointsFile)
+	points, lines, size, err := readSafePoints(path, groups)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = file.Truncate(size); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return &safePointLog{path: path, file: file, lines: lines}, points, nil
+}
+
+func (l *safePointLog) append(points []*SafePoint) error {
+	var data []byte
+	for _, point := range points {
+		line, err := json.Marshal(point)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if _, err := l.file.Write(data); err != nil {
+		return err
+	}
+	l.lines += len(points)
+	return nil
+}
+
+func (l *safePointLog) sync() error {
+	return l.file.Sync()
+}
+
+// compact rewrites the file with the live safe points once the expired ones
+// dominate, the file is replaced at once so that a reader sees either.
+func (l *safePointLog) compact(points map[string][]*SafePoint) error {
+	live := 0
+	for _, group := range points {
+		live += len(group)
+	}
+	if l.lines < safePointsCompactMinLines || l.lines < live*4 {
+		return nil
+	}
+
+	var groups []string
+	for group := range points {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	tmp := l.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	compacted := &safePointLog{path: l.path, file: file}
+	for _, group := range groups {
+		if err = compacted.append(points[group]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, l.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	file, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	l.file, l.lines = file, live
+	return nil
+}
+
+func (l *safePointLog) close() error {
+	return l.file.Close()
+}
+
+// AddSafePoint records the RPO of a learner sample and drops the safe points
+// of the group older than the retention.
+func (h *ApplyHistory) AddSafePoint(point *SafePoint, retention time.Duration) {
+	points := append(h.SafePoints[point.Group], point)
+
+	expired := 0
+	for expired < len(points) && point.Timestamp.Sub(points[expired].Timestamp) > retention {
+		expired++
+	}
+	h.SafePoints[point.Group] = points[expired:]
+	if h.safePointsDirty[point.Group] -= expired; h.safePointsDirty[point.Group] < 0 {
+		h.safePointsDirty[point.Group] = 0
+	}
+}
+
+// SafePointAt returns the last safe point of the group observed no later than t.
+func (h *ApplyHistory) SafePointAt(group string, t time.Time) *SafePoint {
+	points := h.SafePoints[group]
+	i := sort.Search(len(points), func(i int) bool {
+		return points[i].Timestamp.After(t)
+	})
+	if i == 0 {
+		return nil
+	}
+	return points[i-1]
+}
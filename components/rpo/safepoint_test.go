@@ -0,0 +1,129 @@
+package rpo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/common"
+)
+
+func TestSafePointLog(t *testing.T) {
+	dir := t.TempDir()
+	// Full group names, and none taken for a region.
+	groups := []string{common.DefaultLearnerGroup, "zone-a", "zone a/b"}
+	h, err := OpenApplyHistory(dir, groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Unix(1000, 5)
+	for i, group := range groups {
+		ts := base.Add(time.Duration(i) * time.Second)
+		h.AddSafePoint(&SafePoint{Group: group, Timestamp: ts, SafeTime: ts.Add(-time.Second), LagUpper: 2*time.Second + 3}, time.Hour)
+	}
+	h.Update(infosOf(at(1, "voter", 10, 1)))
+	if err = h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A writer in the middle of an append, the group dropped is not read.
+	file, err := os.OpenFile(filepath.Join(dir, safePointsFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.WriteString(`{"group": "zone-a", "timest`); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	r, err := ReadApplyHistory(dir, groups[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.SafePoints) != 2 || len(r.History) != 1 {
+		t.Fatalf("unexpected history %v, safe points %v", r.History, r.SafePoints)
+	}
+	if point := r.SafePoints["zone a/b"]; len(point) != 1 || !point[0].SafeTime.Equal(base.Add(time.Second)) || point[0].LagUpper != 2*time.Second+3 {
+		t.Fatalf("unexpected safe points %+v", point)
+	}
+
+	// The torn line is truncated before appending.
+	if h, err = OpenApplyHistory(dir, groups); err != nil {
+		t.Fatal(err)
+	}
+	h.AddSafePoint(&SafePoint{Group: "zone-a", Timestamp: base.Add(time.Minute)}, time.Hour)
+	if err = h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if h, err = OpenApplyHistory(dir, groups); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if points := h.SafePoints["zone-a"]; len(points) != 2 || h.safePoints.lines != 4 {
+		t.Fatalf("unexpected safe points %v in %v lines", points, h.safePoints.lines)
+	}
+}
+
+func TestSafePointLogCompact(t *testing.T) {
+	dir := t.TempDir()
+	h, err := OpenApplyHistory(dir, []string{"zone-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	base := time.Unix(1000, 0)
+	for i := 0; i < safePointsCompactMinLines; i++ {
+		h.AddSafePoint(&SafePoint{Group: "zone-a", Timestamp: base.Add(time.Duration(i) * time.Second)}, time.Minute)
+		if i%50 == 0 || i == safePointsCompactMinLines-1 {
+			if err = h.Persist(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// The expired ones are dropped from the file.
+	points, lines, _, err := readSafePoints(filepath.Join(dir, safePointsFile), map[string]bool{"zone-a": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines != 61 || len(points["zone-a"]) != 61 || h.safePoints.lines != 61 {
+		t.Fatalf("unexpected %v lines of %v safe points", lines, len(points["zone-a"]))
+	}
+	if _, err = os.Stat(filepath.Join(dir, safePointsFile+".tmp")); !os.IsNotExist(err) {
+		t.Fatalf("the temporary file is left: %v", err)
+	}
+}
+
+func TestSafePointAt(t *testing.T) {
+	h := NewApplyHistory()
+	base := time.Unix(1000, 0)
+	// A safe point every 10s with a lag of 3s, kept for 30s.
+	for i := 0; i <= 6; i++ {
+		ts := base.Add(time.Duration(i) * 10 * time.Second)
+		h.AddSafePoint(&SafePoint{Group: "zone-a", Timestamp: ts, SafeTime: ts.Add(-3 * time.Second)}, 30*time.Second)
+	}
+	h.AddSafePoint(&SafePoint{Group: "zone-b", Timestamp: base, SafeTime: base}, time.Minute)
+
+	if points := h.SafePoints["zone-a"]; len(points) != 4 || !points[0].Timestamp.Equal(base.Add(30*time.Second)) {
+		t.Fatalf("unexpected safe points %v", points)
+	}
+	for _, c := range []struct {
+		at   time.Duration
+		want time.Duration
+	}{
+		{30 * time.Second, 27 * time.Second},
+		{45 * time.Second, 37 * time.Second},
+		{time.Hour, 57 * time.Second},
+	} {
+		point := h.SafePointAt("zone-a", base.Add(c.at))
+		if point == nil || !point.SafeTime.Equal(base.Add(c.want)) {
+			t.Fatalf("safe point at %v: got %v, want base+%v", c.at, point, c.want)
+		}
+	}
+	// Before the retained ones, or of an unknown group.
+	if point := h.SafePointAt("zone-a", base.Add(29*time.Second)); point != nil {
+		t.Fatalf("unexpected expired safe point %+v", point)
+	}
+	if point := h.SafePointAt("zone-c", base.Add(time.Hour)); point != nil {
+		t.Fatalf("unexpected safe point of unknown group %+v", point)
+	}
+}
@@ -0,0 +1,33 @@
+package rpo
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/iosmanthus/learner-recover/schema"
+)
+
+func TestSchema(t *testing.T) {
+	diff, err := schema.Diff(schema.KindRPO, reflect.TypeOf(_Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff) != 0 {
+		t.Fatalf("the schema drifts from the config:\n%v", diff)
+	}
+}
+
+func TestConfigUnknownKeys(t *testing.T) {
+	for _, c := range []struct {
+		extra, err string
+	}{
+		{"concurency: 8\n", "field concurency not found"},
+		{"sampling:\n  adaptive:\n    max-intreval: 1m\n", "field max-intreval not found"},
+		{"alerts:\n  rules:\n    - {name: lag, metric: lag, threshold: 1s, duration: 1m}\n", "field duration not found"},
+	} {
+		if _, err := loadConfig(t, "  a: zone=backup-a\n"+c.extra); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("expect %q, got %v", c.err, err)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package rpo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/iosmanthus/learner-recover/common"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	recordSize = 36
+
+	segmentSuffix  = ".seg"
+	snapshotSuffix = ".snap"
+)
+
+// Record is the on-disk form of an entry of the apply history.
+type Record struct {
+	RegionId     common.RegionId
+	AppliedIndex uint64
+	// Timestamp and Received in unix nanoseconds.
+	Timestamp int64
+	Received  int64
+}
+
+func (r *Record) encode(buf []byte) {
+	binary.BigEndian.PutUint64(buf[0:], uint64(r.RegionId))
+	binary.BigEndian.PutUint64(buf[8:], r.AppliedIndex)
+	binary.BigEndian.PutUint64(buf[16:], uint64(r.Timestamp))
+	binary.BigEndian.PutUint64(buf[24:], uint64(r.Received))
+	binary.BigEndian.PutUint32(buf[32:], crc32.ChecksumIEEE(buf[:32]))
+}
+
+func (r *Record) decode(buf []byte) error {
+	if crc32.ChecksumIEEE(buf[:32]) != binary.BigEndian.Uint32(buf[32:]) {
+		return errors.New("record checksum mismatch")
+	}
+	r.RegionId = common.RegionId(binary.BigEndian.Uint64(buf[0:]))
+	r.AppliedIndex = binary.BigEndian.Uint64(buf[8:])
+	r.Timestamp = int64(binary.BigEndian.Uint64(buf[16:]))
+	r.Received = int64(binary.BigEndian.Uint64(buf[24:]))
+	return nil
+}
+
+// SegmentStore is an append-only store of history records. Records are
+// appended to numbered segment files, a snapshot segment supersedes every
+// segment older than it.
+type SegmentStore struct {
+	dir         string
+	segmentSize int64
+
+	seq      uint64
+	segments []string
+	total    int64
+
+	current *os.File
+	writer  *bufio.Writer
+	size    int64
+
+	readOnly bool
+}
+
+var errReadOnly = errors.New("history segments are opened read-only")
+
+func segmentName(seq uint64, suffix string) string {
+	return fmt.Sprintf("%016d%s", seq, suffix)
+}
+
+// listSegments returns the segments in the directory sorted by sequence and
+// the position of the latest snapshot, the temporary files are skipped.
+func listSegments(dir string) (names, tmps []string, start int, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			tmps = append(tmps, name)
+			continue
+		}
+		if strings.HasSuffix(name, segmentSuffix) || strings.HasSuffix(name, snapshotSuffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		if strings.HasSuffix(name, snapshotSuffix) {
+			start = i
+		}
+	}
+	return names, tmps, start, nil
+}
+
+func OpenSegmentStore(dir string, segmentSize int64) (*SegmentStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	names, tmps, start, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range tmps {
+		os.Remove(filepath.Join(dir, name))
+	}
+	// Segments before the latest snapshot are left by an interrupted compaction.
+	for _, name := range names[:start] {
+		if err = os.Remove(filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+
+	return newSegmentStore(dir, segmentSize, names[start:], false)
+}
+
+// ReadSegmentStore opens the store for replaying only, nothing in the
+// directory is changed so it's safe along with a writer on the directory:
+// the segments dropped by a compaction meanwhile are listed again on replay.
+func ReadSegmentStore(dir string) (*SegmentStore, error) {
+	names, _, start, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	return newSegmentStore(dir, 0, names[start:], true)
+}
+
+func newSegmentStore(dir string, segmentSize int64, names []string, readOnly bool) (*SegmentStore, error) {
+	s := &SegmentStore{
+		dir:         dir,
+		segmentSize: segmentSize,
+		segments:    names,
+		readOnly:    readOnly,
+	}
+	for _, name := range names {
+		var seq uint64
+		if _, err := fmt.Sscanf(name, "%016d", &seq); err != nil {
+			return nil, err
+		}
+		s.seq = seq
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		s.total += info.Size()
+	}
+
+	return s, nil
+}
+
+// replayRetries bounds the times a read-only replay lists the segments
+// again after a compaction of the writer drops them.
+const replayRetries = 5
+
+// openSegments opens every live segment before any is read, so that the
+// records replayed are of one listing. The segments dropped by a concurrent
+// compaction are listed again for a read-only store.
+func (s *SegmentStore) openSegments() ([]*os.File, error) {
+	for retry := 0; ; retry++ {
+		var files []*os.File
+		var err error
+		for _, name := range s.segments {
+			var f *os.File
+			if f, err = os.Open(filepath.Join(s.dir, name)); err != nil {
+				break
+			}
+			files = append(files, f)
+		}
+		if err == nil {
+			return files, nil
+		}
+		for _, f := range files {
+			f.Close()
+		}
+		if !s.readOnly || !os.IsNotExist(err) || retry == replayRetries {
+			return nil, err
+		}
+
+		names, _, start, err := listSegments(s.dir)
+		if err != nil {
+			return nil, err
+		}
+		s.segments = names[start:]
+	}
+}
+
+// Replay streams every live record to fn in the order they were appended.
+func (s *SegmentStore) Replay(fn func(r *Record)) error {
+	files, err := s.openSegments()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	buf := make([]byte, recordSize)
+	for i, f := range files {
+		name := s.segments[i]
+		err := func() error {
+			reader := bufio.NewReader(f)
+			for {
+				if _, err := io.ReadFull(reader, buf); err != nil {
+					if err == io.ErrUnexpectedEOF {
+						log.Warnf("Ignoring the truncated tail of history segment %s", name)
+						return nil
+					}
+					if err == io.EOF {
+						return nil
+					}
+					return err
+				}
+
+				r := &Record{}
+				if err := r.decode(buf); err != nil {
+					return fmt.Errorf("history segment %s: %v", name, err)
+				}
+				fn(r)
+			}
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SegmentStore) rotate() error {
+	if err := s.closeCurrent(); err != nil {
+		return err
+	}
+
+	s.seq++
+	name := segmentName(s.seq, segmentSuffix)
+	f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	s.current = f
+	s.writer = bufio.NewWriter(f)
+	s.size = 0
+	s.segments = append(s.segments, name)
+	return nil
+}
+
+func (s *SegmentStore) Append(r *Record) error {
+	if s.readOnly {
+		return errReadOnly
+	}
+	if s.current == nil || s.size >= s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, recordSize)
+	r.encode(buf)
+	if _, err := s.writer.Write(buf); err != nil {
+		return err
+	}
+	s.size += recordSize
+	s.total += recordSize
+	return nil
+}
+
+func (s *SegmentStore) Sync() error {
+	if s.current == nil {
+		return nil
+	}
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	return s.current.Sync()
+}
+
+// Size returns the total size of the live segments in bytes.
+func (s *SegmentStore) Size() int64 {
+	return s.total
+}
+
+// Compact writes the records produced by snapshot into a snapshot segment
+// and drops every segment before it.
+func (s *SegmentStore) Compact(snapshot func(emit func(r *Record) error) error) error {
+	if s.readOnly {
+		return errReadOnly
+	}
+	if err := s.closeCurrent(); err != nil {
+		return err
+	}
+
+	s.seq++
+	name := segmentName(s.seq, snapshotSuffix)
+	tmp := filepath.Join(s.dir, name+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(f)
+	buf := make([]byte, recordSize)
+	var size int64
+	err = snapshot(func(r *Record) error {
+		r.encode(buf)
+		_, err := writer.Write(buf)
+		size += recordSize
+		return err
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err = os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+
+	for _, old := range s.segments {
+		if err = os.Remove(filepath.Join(s.dir, old)); err != nil {
+			return err
+		}
+	}
+	s.segments = []string{name}
+	s.total = size
+
+	return nil
+}
+
+func (s *SegmentStore) closeCurrent() error {
+	if s.current == nil {
+		return nil
+	}
+	if err := s.Sync(); err != nil {
+		return err
+	}
+	err := s.current.Close()
+	s.current = nil
+	s.writer = nil
+	return err
+}
+
+func (s *SegmentStore) Close() error {
+	return s.closeCurrent()
+}
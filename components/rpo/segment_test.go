@@ -0,0 +1,300 @@
+package rpo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/iosmanthus/learner-recover/common"
+)
+
+func appendRecords(t *testing.T, s *SegmentStore, from, to uint64) {
+	for i := from; i < to; i++ {
+		if err := s.Append(&Record{RegionId: common.RegionId(i % 3), AppliedIndex: i, Timestamp: int64(i), Received: int64(i) + 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func replayIndexes(t *testing.T, s *SegmentStore) []uint64 {
+	var indexes []uint64
+	err := s.Replay(func(r *Record) {
+		if r.Received != r.Timestamp+1 {
+			t.Fatalf("unexpected record %+v", r)
+		}
+		indexes = append(indexes, r.AppliedIndex)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return indexes
+}
+
+func files(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+func TestSegmentRollover(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSegmentStore(dir, 4*recordSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, s, 0, 10)
+	s.Close()
+
+	// 10 records of 4 per segment.
+	if names := files(t, dir); len(names) != 3 || names[2] != segmentName(3, segmentSuffix) {
+		t.Fatalf("unexpected segments %v", names)
+	}
+
+	s, err = OpenSegmentStore(dir, 4*recordSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Size() != 10*recordSize {
+		t.Fatalf("unexpected size %v", s.Size())
+	}
+	// Appending after a reopen starts a new segment.
+	appendRecords(t, s, 10, 12)
+	s.Close()
+	if got := replayIndexes(t, s); len(got) != 12 || got[0] != 0 || got[11] != 11 {
+		t.Fatalf("unexpected records %v", got)
+	}
+	if names := files(t, dir); len(names) != 4 {
+		t.Fatalf("unexpected segments %v", names)
+	}
+}
+
+func TestSegmentTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSegmentStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, s, 0, 3)
+	s.Close()
+
+	// A crash in the middle of a write leaves part of a record.
+	path := filepath.Join(dir, segmentName(1, segmentSuffix))
+	if err = os.Truncate(path, 3*recordSize-5); err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenSegmentStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := replayIndexes(t, s); len(got) != 2 {
+		t.Fatalf("unexpected records %v", got)
+	}
+}
+
+func TestSegmentChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSegmentStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, s, 0, 3)
+	s.Close()
+
+	path := filepath.Join(dir, segmentName(1, segmentSuffix))
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[recordSize+8] ^= 0xff
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenSegmentStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Replay(func(r *Record) {})
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expect a checksum mismatch, got %v", err)
+	}
+}
+
+func TestSegmentCompact(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSegmentStore(dir, 2*recordSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, s, 0, 5)
+	err = s.Compact(func(emit func(r *Record) error) error {
+		return emit(&Record{RegionId: 1, AppliedIndex: 4, Timestamp: 4, Received: 5})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, s, 5, 6)
+	s.Close()
+
+	if names := files(t, dir); len(names) != 2 || !strings.HasSuffix(names[0], snapshotSuffix) {
+		t.Fatalf("unexpected segments %v", names)
+	}
+	if got := replayIndexes(t, s); len(got) != 2 || got[0] != 4 || got[1] != 5 {
+		t.Fatalf("unexpected records %v", got)
+	}
+}
+
+func TestSegmentCrashMidCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSegmentStore(dir, 2*recordSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, s, 0, 4)
+	s.Close()
+
+	// Crashed before the rename, the segments are intact and the temporary
+	// snapshot is dropped.
+	tmp := filepath.Join(dir, segmentName(3, snapshotSuffix)+".tmp")
+	if err = ioutil.WriteFile(tmp, make([]byte, recordSize+3), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenSegmentStore(dir, 2*recordSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := replayIndexes(t, s); len(got) != 4 {
+		t.Fatalf("unexpected records %v", got)
+	}
+	if _, err = os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("temporary snapshot is left: %v", err)
+	}
+
+	// Crashed after the rename, the segments before the snapshot are
+	// superseded by it.
+	snap := &Record{RegionId: 1, AppliedIndex: 3, Timestamp: 3, Received: 4}
+	buf := make([]byte, recordSize)
+	snap.encode(buf)
+	if err = ioutil.WriteFile(filepath.Join(dir, segmentName(3, snapshotSuffix)), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenSegmentStore(dir, 2*recordSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := replayIndexes(t, s); len(got) != 1 || got[0] != 3 {
+		t.Fatalf("unexpected records %v", got)
+	}
+	if names := files(t, dir); len(names) != 1 {
+		t.Fatalf("unexpected segments %v", names)
+	}
+}
+
+func TestSegmentReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSegmentStore(dir, 2*recordSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, s, 0, 4)
+	s.Close()
+
+	// The rpo command is writing the snapshot of a compaction.
+	tmp := filepath.Join(dir, segmentName(3, snapshotSuffix)+".tmp")
+	if err = ioutil.WriteFile(tmp, make([]byte, recordSize+3), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := ReadSegmentStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := replayIndexes(t, r); len(got) != 4 {
+		t.Fatalf("unexpected records %v", got)
+	}
+	if names := files(t, dir); len(names) != 3 {
+		t.Fatalf("the compaction in progress is disturbed: %v", names)
+	}
+	if err = r.Append(&Record{}); err != errReadOnly {
+		t.Fatalf("expect the append refused, got %v", err)
+	}
+
+	// The snapshot is renamed, the old segments are not removed yet.
+	snap := &Record{RegionId: 1, AppliedIndex: 3, Timestamp: 3, Received: 4}
+	buf := make([]byte, recordSize)
+	snap.encode(buf)
+	if err = ioutil.WriteFile(filepath.Join(dir, segmentName(3, snapshotSuffix)), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = ReadSegmentStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := replayIndexes(t, r); len(got) != 1 || got[0] != 3 {
+		t.Fatalf("unexpected records %v", got)
+	}
+	if names := files(t, dir); len(names) != 3 {
+		t.Fatalf("the segments left to the compaction are removed: %v", names)
+	}
+
+	if _, err = ReadApplyHistory(filepath.Join(dir, "missing"), nil); !os.IsNotExist(err) {
+		t.Fatalf("expect the missing history reported, got %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Fatal("the missing history is created by a reader")
+	}
+}
+
+func TestSegmentReadOnlyCompacted(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSegmentStore(dir, 2*recordSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	appendRecords(t, s, 0, 4)
+
+	r, err := ReadSegmentStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The writer compacts the segments listed by the reader.
+	err = s.Compact(func(emit func(r *Record) error) error {
+		return emit(&Record{RegionId: 1, AppliedIndex: 3, Timestamp: 3, Received: 4})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := replayIndexes(t, r); len(got) != 1 || got[0] != 3 {
+		t.Fatalf("unexpected records %v", got)
+	}
+
+	// The segments opened are read even if they are dropped meanwhile.
+	appendRecords(t, s, 4, 6)
+	if r, err = ReadSegmentStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	var indexes []uint64
+	err = r.Replay(func(record *Record) {
+		if indexes = append(indexes, record.AppliedIndex); len(indexes) == 1 {
+			if err := s.Compact(func(emit func(r *Record) error) error { return nil }); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if err != nil || len(indexes) != 3 {
+		t.Fatalf("unexpected records %v, %v", indexes, err)
+	}
+}
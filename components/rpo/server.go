@@ -0,0 +1,225 @@
+package rpo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/common"
+
+	"github.com/go-resty/resty/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	PathRPO      = "/api/v1/rpo"
+	PathRegions  = "/api/v1/regions"
+	PathSafeTime = "/api/v1/safe-time"
+	PathHistory  = "/api/v1/history"
+)
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err = w.Write(data); err != nil {
+		log.Warn(err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// Handler serves the latest RPO, the per-region lag and the queries on the
+// apply history.
+func (g *Generator) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(PathRPO, g.serveRPO)
+	mux.HandleFunc(PathRegions, g.serveRegions)
+	mux.HandleFunc(PathSafeTime, g.serveSafeTime)
+	mux.HandleFunc(PathHistory, g.serveHistory)
+	return mux
+}
+
+// serveRPO returns the RPO of the group in the query, or of all groups if
+// it is omitted.
+func (g *Generator) serveRPO(w http.ResponseWriter, r *http.Request) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if name := r.URL.Query().Get("group"); name != "" {
+		group, err := g.lookup(name)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		if group.rpo == nil {
+			writeError(w, http.StatusServiceUnavailable, fmt.Errorf("RPO of group %s is not computed yet", name))
+			return
+		}
+		writeJSON(w, http.StatusOK, group.rpo)
+		return
+	}
+
+	var rpos []*RPO
+	for _, group := range g.groups {
+		if group.rpo != nil {
+			rpos = append(rpos, group.rpo)
+		}
+	}
+	if len(rpos) == 0 {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("RPO is not computed yet"))
+		return
+	}
+	if len(g.groups) == 1 {
+		writeJSON(w, http.StatusOK, rpos[0])
+		return
+	}
+	writeJSON(w, http.StatusOK, rpos)
+}
+
+func (g *Generator) serveRegions(w http.ResponseWriter, r *http.Request) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	q := r.URL.Query()
+	group, err := g.lookup(q.Get("group"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	breakdown := group.breakdown
+	if breakdown == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("RPO of group %s is not computed yet", group.name))
+		return
+	}
+
+	switch {
+	case q.Get("region") != "":
+		id, err := strconv.ParseUint(q.Get("region"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		region := breakdown.Region(common.RegionId(id))
+		if region == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("region %v not found", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, []*RegionLag{region})
+	case q.Get("store") != "":
+		writeJSON(w, http.StatusOK, breakdown.Store(q.Get("store")))
+	default:
+		top := -1
+		if q.Get("top") != "" {
+			var err error
+			if top, err = strconv.Atoi(q.Get("top")); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, breakdown.Worst(top))
+	}
+}
+
+func (g *Generator) serveSafeTime(w http.ResponseWriter, r *http.Request) {
+	at := time.Now()
+	q := r.URL.Query()
+	if s := q.Get("at"); s != "" {
+		var err error
+		if at, err = time.Parse(time.RFC3339, s); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	group, err := g.lookup(q.Get("group"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	point := g.history.SafePointAt(group.name, at)
+	if point == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no safe point of group %s recorded before %v", group.name, at))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"group":     group.name,
+		"at":        at,
+		"timestamp": point.Timestamp,
+		"safe-time": point.SafeTime,
+		"lag-upper": point.LagUpper.String(),
+	})
+}
+
+func (g *Generator) serveHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id, err := strconv.ParseUint(q.Get("region"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid region: %v", err))
+		return
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	// Without an applied index, the whole history of the region is returned.
+	if q.Get("index") == "" {
+		writeJSON(w, http.StatusOK, g.history.History[common.RegionId(id)])
+		return
+	}
+
+	index, err := strconv.ParseUint(q.Get("index"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid index: %v", err))
+		return
+	}
+
+	state := &common.RegionState{RegionId: common.RegionId(id)}
+	state.ApplyState.AppliedIndex = index
+	voter := g.history.QueryState(state)
+	if voter == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no history of region %v", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, voter)
+}
+
+// Client queries the HTTP API of a running rpo command.
+type Client struct {
+	addr   string
+	client *resty.Client
+}
+
+func NewClient(addr string) *Client {
+	return &Client{
+		addr:   addr,
+		client: resty.New().SetTimeout(10 * time.Second),
+	}
+}
+
+func (c *Client) Query(ctx context.Context, path string, params map[string]string) ([]byte, error) {
+	resp, err := c.client.R().
+		SetContext(ctx).
+		SetQueryParams(params).
+		Get(fmt.Sprintf("http://%s%s", c.addr, path))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status(), resp.Body())
+	}
+	return resp.Body(), nil
+}
@@ -0,0 +1,118 @@
+package rpo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serve requests the path of the handler and decodes the JSON response.
+func serve(t *testing.T, server *httptest.Server, path string, v interface{}) int {
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("%s responds %s", path, data)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		t.Fatalf("%s responds %s: %v", path, data, err)
+	}
+	return resp.StatusCode
+}
+
+func TestHandler(t *testing.T) {
+	config := DefaultConfig()
+	config.Groups = []*Group{{Name: "zone-a", Learners: []string{"a"}}, {Name: "zone-b", Learners: []string{"b"}}}
+	history := NewApplyHistory()
+	history.Birth = epoch
+	history.Update(infosOf(at(1, "voter", 10, 0)))
+	history.Update(infosOf(at(1, "voter", 20, 1)))
+	history.AddSafePoint(&SafePoint{Group: "zone-a", Timestamp: epoch.Add(2 * time.Second), SafeTime: epoch, LagUpper: 2 * time.Second}, time.Hour)
+
+	g := newGenerator(config, history, nil)
+	server := httptest.NewServer(g.Handler())
+	defer server.Close()
+
+	body := map[string]interface{}{}
+	if code := serve(t, server, PathRPO, &body); code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status %v before RPO is computed", code)
+	}
+
+	a := g.group("zone-a")
+	a.rpo = &RPO{Group: "zone-a", LagUpper: 2 * time.Second}
+	a.breakdown = &Breakdown{Regions: []*RegionLag{{RegionId: 1, Store: "a", LagUpper: 2 * time.Second}, {RegionId: 2, Store: "a", LagUpper: time.Second}}}
+	a.breakdown.Sort()
+
+	if code := serve(t, server, PathRPO+"?group=zone-a", &body); code != http.StatusOK || body["lag-upper"] != "2s" {
+		t.Fatalf("unexpected RPO %v %v", code, body)
+	}
+	var rpos []map[string]interface{}
+	if code := serve(t, server, PathRPO, &rpos); code != http.StatusOK || len(rpos) != 1 {
+		t.Fatalf("unexpected RPOs %v %v", code, rpos)
+	}
+	if code := serve(t, server, PathRPO+"?group=zone-c", &body); code != http.StatusNotFound {
+		t.Fatalf("unexpected status %v of unknown group", code)
+	}
+
+	for _, c := range []struct {
+		query string
+		code  int
+		n     int
+	}{
+		{"?group=zone-a", http.StatusOK, 2},
+		{"?group=zone-a&top=1", http.StatusOK, 1},
+		{"?group=zone-a&region=2", http.StatusOK, 1},
+		{"?group=zone-a&store=a", http.StatusOK, 2},
+		{"?group=zone-a&region=3", http.StatusNotFound, 0},
+		{"?group=zone-a&top=x", http.StatusBadRequest, 0},
+		// The group is required with multiple groups.
+		{"", http.StatusBadRequest, 0},
+		{"?group=zone-b", http.StatusServiceUnavailable, 0},
+	} {
+		var (
+			raw     json.RawMessage
+			regions []map[string]interface{}
+		)
+		code := serve(t, server, PathRegions+c.query, &raw)
+		if code == http.StatusOK {
+			json.Unmarshal(raw, &regions)
+		}
+		if code != c.code || len(regions) != c.n {
+			t.Fatalf("%s: unexpected regions %v %v", c.query, code, regions)
+		}
+	}
+
+	when := epoch.Add(time.Minute).Format(time.RFC3339)
+	if code := serve(t, server, PathSafeTime+"?group=zone-a&at="+when, &body); code != http.StatusOK || body["lag-upper"] != "2s" {
+		t.Fatalf("unexpected safe time %v %v", code, body)
+	}
+	if code := serve(t, server, PathSafeTime+"?group=zone-b&at="+when, &body); code != http.StatusNotFound {
+		t.Fatalf("unexpected safe time of group without safe points %v %v", code, body)
+	}
+	if code := serve(t, server, PathSafeTime+"?group=zone-a&at=yesterday", &body); code != http.StatusBadRequest {
+		t.Fatalf("unexpected status %v of invalid time", code)
+	}
+
+	var states []map[string]interface{}
+	if code := serve(t, server, PathHistory+"?region=1", &states); code != http.StatusOK || len(states) != 2 {
+		t.Fatalf("unexpected history %v %v", code, states)
+	}
+	if code := serve(t, server, PathHistory+"?region=1&index=15", &body); code != http.StatusOK {
+		t.Fatalf("unexpected voter state %v %v", code, body)
+	}
+	if code := serve(t, server, PathHistory+"?region=9&index=15", &body); code != http.StatusNotFound {
+		t.Fatalf("unexpected status %v of region without history", code)
+	}
+	if code := serve(t, server, PathHistory+"?region=x", &body); code != http.StatusBadRequest {
+		t.Fatalf("unexpected status %v of invalid region", code)
+	}
+}
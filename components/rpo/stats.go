@@ -0,0 +1,122 @@
+package rpo
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+)
+
+type Percentiles struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+type _Percentiles struct {
+	P50 string `json:"p50"`
+	P90 string `json:"p90"`
+	P99 string `json:"p99"`
+	Max string `json:"max"`
+}
+
+func (p *Percentiles) toJSON() _Percentiles {
+	return _Percentiles{
+		P50: p.P50.String(),
+		P90: p.P90.String(),
+		P99: p.P99.String(),
+		Max: p.Max.String(),
+	}
+}
+
+func (p *Percentiles) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.toJSON())
+}
+
+// NewPercentiles computes the nearest-rank percentiles of the lags.
+func NewPercentiles(lags []time.Duration) Percentiles {
+	if len(lags) == 0 {
+		return Percentiles{}
+	}
+
+	sorted := make([]time.Duration, len(lags))
+	copy(sorted, lags)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	rank := func(p float64) time.Duration {
+		i := int(math.Ceil(p*float64(len(sorted)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return sorted[i]
+	}
+
+	return Percentiles{
+		P50: rank(0.50),
+		P90: rank(0.90),
+		P99: rank(0.99),
+		Max: sorted[len(sorted)-1],
+	}
+}
+
+type WindowStats struct {
+	Window  time.Duration
+	Samples int
+	Percentiles
+}
+
+func (w *WindowStats) MarshalJSON() ([]byte, error) {
+	type _WindowStats struct {
+		Window  string `json:"window"`
+		Samples int    `json:"samples"`
+		_Percentiles
+	}
+	return json.Marshal(&_WindowStats{
+		Window:       w.Window.String(),
+		Samples:      w.Samples,
+		_Percentiles: w.Percentiles.toJSON(),
+	})
+}
+
+type point struct {
+	ts  time.Time
+	lag time.Duration
+}
+
+// Series is the local time series of the RPO lag kept by the generator.
+type Series struct {
+	points    []point
+	retention time.Duration
+}
+
+func NewSeries(retention time.Duration) *Series {
+	return &Series{retention: retention}
+}
+
+func (s *Series) Add(ts time.Time, lag time.Duration) {
+	s.points = append(s.points, point{ts, lag})
+
+	expired := 0
+	for expired < len(s.points) && ts.Sub(s.points[expired].ts) > s.retention {
+		expired++
+	}
+	s.points = s.points[expired:]
+}
+
+// Window returns the statistics of the lags recorded during the window ending at now.
+func (s *Series) Window(now time.Time, window time.Duration) *WindowStats {
+	var lags []time.Duration
+	for _, p := range s.points {
+		if now.Sub(p.ts) <= window {
+			lags = append(lags, p.lag)
+		}
+	}
+	return &WindowStats{
+		Window:      window,
+		Samples:     len(lags),
+		Percentiles: NewPercentiles(lags),
+	}
+}
@@ -0,0 +1,59 @@
+package rpo
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestNewPercentiles(t *testing.T) {
+	var lags []time.Duration
+	// 100ms, 200ms, ..., 10s, shuffled by the stride.
+	for i := 0; i < 100; i++ {
+		lags = append(lags, time.Duration((i*37)%100+1)*100*time.Millisecond)
+	}
+	p := NewPercentiles(lags)
+	if p.P50 != 5*time.Second || p.P90 != 9*time.Second || p.P99 != 9900*time.Millisecond || p.Max != 10*time.Second {
+		t.Fatalf("unexpected percentiles %+v", p)
+	}
+	if lags[1] != 3800*time.Millisecond {
+		t.Fatal("the lags are sorted in place")
+	}
+
+	if p = NewPercentiles([]time.Duration{time.Second}); p.P50 != time.Second || p.P99 != time.Second {
+		t.Fatalf("unexpected percentiles of one lag %+v", p)
+	}
+	if p = NewPercentiles(nil); p != (Percentiles{}) {
+		t.Fatalf("unexpected percentiles of no lags %+v", p)
+	}
+}
+
+func TestSeriesWindow(t *testing.T) {
+	s := NewSeries(time.Minute)
+	now := time.Unix(1000, 0)
+	for i := 0; i <= 90; i += 10 {
+		s.Add(now.Add(time.Duration(i)*time.Second), time.Duration(i)*time.Millisecond)
+	}
+	now = now.Add(90 * time.Second)
+
+	// The points older than the retention are dropped.
+	if len(s.points) != 7 || s.points[0].lag != 30*time.Millisecond {
+		t.Fatalf("unexpected points %v", s.points)
+	}
+
+	w := s.Window(now, 20*time.Second)
+	if w.Samples != 3 || w.P50 != 80*time.Millisecond || w.Max != 90*time.Millisecond {
+		t.Fatalf("unexpected window %+v", w)
+	}
+	if w = s.Window(now.Add(time.Hour), 20*time.Second); w.Samples != 0 || w.Max != 0 {
+		t.Fatalf("unexpected empty window %+v", w)
+	}
+
+	data, err := json.Marshal(s.Window(now, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data); got != `{"window":"1m0s","samples":7,"p50":"60ms","p90":"90ms","p99":"90ms","max":"90ms"}` {
+		t.Fatalf("unexpected JSON %s", got)
+	}
+}
@@ -0,0 +1,246 @@
+package rpo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/components/key"
+
+	"github.com/go-resty/resty/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SourceTiKVCtl = "tikv-ctl"
+	SourceStatus  = "status"
+)
+
+// regionMeta is the region returned by the TiKV status server.
+type regionMeta struct {
+	ID          uint64 `json:"id"`
+	StartKey    []byte `json:"start_key"`
+	EndKey      []byte `json:"end_key"`
+	RegionEpoch struct {
+		ConfVer uint64 `json:"conf_ver"`
+		Version int    `json:"version"`
+	} `json:"region_epoch"`
+	Peers     []*common.Peer `json:"peers"`
+	RaftApply struct {
+		AppliedIndex uint64 `json:"applied_index"`
+		CommitIndex  uint64 `json:"commit_index"`
+	} `json:"raft_apply"`
+}
+
+// TiKVStatus fetches the applied index of every region on a store from the
+// status server of TiKV, the regions of the store are listed by PD. The
+// status server serves one region a request, so a fetch stops requesting
+// once it spends its budget: the regions left carry their previous states
+// and are requested first by the next fetch.
+type TiKVStatus struct {
+	pd          string
+	host        string
+	status      string
+	concurrency int
+	budget      time.Duration
+	client      *resty.Client
+
+	storeID uint64
+	// next is the position in the regions listed the next fetch starts at.
+	next int
+	// last is the latest state of every region fetched.
+	last map[common.RegionId]*common.RegionState
+}
+
+// NewTiKVStatus returns the fetcher of the store at host, a fetch requests
+// the regions for at most budget, or all of them if budget is 0.
+func NewTiKVStatus(pd, host, status string, concurrency int, budget time.Duration) *TiKVStatus {
+	return &TiKVStatus{
+		pd:          pd,
+		host:        host,
+		status:      status,
+		concurrency: concurrency,
+		budget:      budget,
+		client:      resty.New(),
+		last:        make(map[common.RegionId]*common.RegionState),
+	}
+}
+
+func (f *TiKVStatus) get(ctx context.Context, url string, v interface{}) (int, error) {
+	resp, err := f.client.R().SetContext(ctx).Get(url)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return resp.StatusCode(), fmt.Errorf("%s responds %s", url, resp.Status())
+	}
+	return resp.StatusCode(), json.Unmarshal(resp.Body(), v)
+}
+
+func (f *TiKVStatus) resolveStoreID(ctx context.Context) error {
+	if f.storeID != 0 {
+		return nil
+	}
+
+	stores := &struct {
+		Stores []struct {
+			Store struct {
+				ID      uint64 `json:"id"`
+				Address string `json:"address"`
+			} `json:"store"`
+		} `json:"stores"`
+	}{}
+	if _, err := f.get(ctx, fmt.Sprintf("http://%s/pd/api/v1/stores", f.pd), stores); err != nil {
+		return err
+	}
+
+	for _, store := range stores.Stores {
+		if store.Store.Address == f.host {
+			f.storeID = store.Store.ID
+			return nil
+		}
+	}
+	return fmt.Errorf("store %s not found in PD", f.host)
+}
+
+func (f *TiKVStatus) Fetch(ctx context.Context) (*common.RegionInfos, error) {
+	if err := f.resolveStoreID(ctx); err != nil {
+		return nil, err
+	}
+
+	regions := &struct {
+		Regions []struct {
+			ID uint64 `json:"id"`
+		} `json:"regions"`
+	}{}
+	_, err := f.get(ctx, fmt.Sprintf("http://%s/pd/api/v1/regions/store/%v", f.pd, f.storeID), regions)
+	if err != nil {
+		return nil, err
+	}
+
+	// The regions are requested from where the last fetch stopped, until
+	// the budget is spent. The requests in flight are still waited for, so
+	// every fetch makes progress.
+	n := len(regions.Regions)
+	if f.next >= n {
+		f.next = 0
+	}
+	begin := time.Now()
+	ids := make(chan uint64)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		defer close(ids)
+		for i := 0; i < n; i++ {
+			if f.budget > 0 && time.Since(begin) >= f.budget {
+				return
+			}
+			select {
+			case ids <- regions.Regions[(f.next+i)%n].ID:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// At most concurrency requests are in flight against the status server,
+	// the rest are abandoned once one of them fails.
+	workers := f.concurrency
+	if workers > n {
+		workers = n
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		taken    int
+		infos    = common.NewRegionInfos()
+		wg       = &sync.WaitGroup{}
+	)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				mu.Lock()
+				taken++
+				mu.Unlock()
+
+				meta := &regionMeta{}
+				start := time.Now()
+				code, err := f.get(ctx, fmt.Sprintf("http://%s/region/%v", f.status, id), meta)
+				end := time.Now()
+				// The region may be moved out of the store after it's listed.
+				if code == http.StatusNotFound {
+					continue
+				}
+
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+				} else if meta.RaftApply.AppliedIndex != 0 {
+					state := &common.RegionState{
+						RegionId: common.RegionId(meta.ID),
+						Host:     f.host,
+					}
+					state.ApplyState.AppliedIndex = meta.RaftApply.AppliedIndex
+					state.RaftState.HardState.Commit = meta.RaftApply.CommitIndex
+					state.ApplyState.Timestamp = start
+					state.ApplyState.Received = end
+					state.LocalState.Region.StartKey = key.Escape(meta.StartKey)
+					state.LocalState.Region.EndKey = key.Escape(meta.EndKey)
+					state.LocalState.Region.ID = meta.ID
+					state.LocalState.Region.RegionEpoch.Version = meta.RegionEpoch.Version
+					state.LocalState.Region.RegionEpoch.ConfVer = meta.RegionEpoch.ConfVer
+					state.LocalState.Region.Peers = meta.Peers
+					infos.StateMap[state.RegionId] = state
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	// The regions not requested keep the states of the last fetches, which
+	// are older and so only widen the lag intervals.
+	if n > 0 {
+		f.next = (f.next + taken) % n
+	}
+	last := make(map[common.RegionId]*common.RegionState, n)
+	for _, region := range regions.Regions {
+		id := common.RegionId(region.ID)
+		state, ok := infos.StateMap[id]
+		if !ok {
+			if state, ok = f.last[id]; ok {
+				infos.StateMap[id] = state
+			}
+		}
+		if ok {
+			last[id] = state
+		}
+	}
+	f.last = last
+	if taken < n {
+		log.WithFields(log.Fields{
+			common.FieldHost: f.host,
+			"requested":      taken,
+			"regions":        n,
+			"budget":         f.budget,
+		}).Debug("Status fetch spent its budget, the regions left keep their last states")
+	}
+	return infos, nil
+}
@@ -0,0 +1,154 @@
+package rpo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/common"
+)
+
+// statusServer serves both the PD API and the TiKV status server of store
+// 1, it records the most requests of regions in flight at once.
+type statusServer struct {
+	regions int
+	// missing responds 404 for the region, failing responds 500.
+	missing, failing uint64
+
+	mu       sync.Mutex
+	inflight int
+	peak     int
+	served   int
+}
+
+func (s *statusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/pd/api/v1/stores":
+		fmt.Fprint(w, `{"stores": [{"store": {"id": 7, "address": "other:20160"}}, {"store": {"id": 1, "address": "learner:20160"}}]}`)
+	case r.URL.Path == "/pd/api/v1/regions/store/1":
+		var ids []string
+		for i := 1; i <= s.regions; i++ {
+			ids = append(ids, fmt.Sprintf(`{"id": %d}`, i))
+		}
+		fmt.Fprintf(w, `{"regions": [%s]}`, strings.Join(ids, ","))
+	case strings.HasPrefix(r.URL.Path, "/region/"):
+		s.mu.Lock()
+		s.inflight++
+		s.served++
+		if s.inflight > s.peak {
+			s.peak = s.inflight
+		}
+		s.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		s.mu.Lock()
+		s.inflight--
+		s.mu.Unlock()
+
+		var id uint64
+		fmt.Sscanf(r.URL.Path, "/region/%d", &id)
+		switch id {
+		case s.missing:
+			http.NotFound(w, r)
+		case s.failing:
+			http.Error(w, "busy", http.StatusInternalServerError)
+		default:
+			fmt.Fprintf(w, `{"id": %d, "start_key": "", "end_key": "", "region_epoch": {"conf_ver": 2, "version": 3}, "raft_apply": {"applied_index": %d, "commit_index": %d}}`, id, id*10, id*10+1)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestTiKVStatusFetch(t *testing.T) {
+	stub := &statusServer{regions: 20, missing: 3}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	f := NewTiKVStatus(addr, "learner:20160", addr, 4, 0)
+	infos, err := f.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.storeID != 1 {
+		t.Fatalf("unexpected store id %v", f.storeID)
+	}
+	// The region moved out of the store is skipped.
+	if len(infos.StateMap) != 19 || infos.StateMap[3] != nil {
+		t.Fatalf("unexpected regions %v", infos.StateMap)
+	}
+	state := infos.StateMap[5]
+	if state.Host != "learner:20160" || state.ApplyState.AppliedIndex != 50 || state.RaftState.HardState.Commit != 51 || state.LocalState.Region.RegionEpoch.Version != 3 {
+		t.Fatalf("unexpected state %+v", state)
+	}
+	if state.ApplyState.Received.Before(state.ApplyState.Timestamp) {
+		t.Fatalf("received before requested %+v", state.ApplyState)
+	}
+	if stub.peak > 4 {
+		t.Fatalf("%v requests in flight, want at most 4", stub.peak)
+	}
+}
+
+func TestTiKVStatusFetchError(t *testing.T) {
+	stub := &statusServer{regions: 50, failing: 1}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	if _, err := NewTiKVStatus(addr, "learner:20160", addr, 1, 0).Fetch(context.Background()); err == nil {
+		t.Fatal("expect the failure of region 1")
+	}
+	// The regions left are not requested once one fails.
+	if stub.served != 1 {
+		t.Fatalf("%v regions requested after the failure", stub.served)
+	}
+
+	if _, err := NewTiKVStatus(addr, "unknown:20160", addr, 1, 0).Fetch(context.Background()); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expect the store not found, got %v", err)
+	}
+}
+
+func TestTiKVStatusFetchBudget(t *testing.T) {
+	stub := &statusServer{regions: 20}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	// A region takes 5ms, a fetch requests a few of them.
+	f := NewTiKVStatus(addr, "learner:20160", addr, 1, 12*time.Millisecond)
+	infos, err := f.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := stub.served
+	if first == 0 || first >= 20 || len(infos.StateMap) != first || infos.StateMap[1] == nil {
+		t.Fatalf("%v regions requested, %v fetched", first, len(infos.StateMap))
+	}
+	region1 := infos.StateMap[1]
+
+	// The next fetch goes on with the regions left, the regions requested
+	// keep their states.
+	if infos, err = f.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stub.served == first || infos.StateMap[common.RegionId(first+1)] == nil {
+		t.Fatalf("the regions left are not requested, %v requested", stub.served)
+	}
+	if stub.served < 20 && infos.StateMap[1] != region1 {
+		t.Fatalf("the state of region 1 is not kept")
+	}
+
+	for i := 0; i < 20 && len(infos.StateMap) < 20; i++ {
+		if infos, err = f.Fetch(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(infos.StateMap) != 20 {
+		t.Fatalf("unexpected regions %v", len(infos.StateMap))
+	}
+}
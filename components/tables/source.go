@@ -0,0 +1,163 @@
+package tables
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// FromTiDB loads the tables and their partitions from the status API of a
+// TiDB server, host:port of the status port.
+func FromTiDB(ctx context.Context, status string) (*Catalog, error) {
+	client := resty.New()
+	get := func(path string, v interface{}) error {
+		resp, err := client.R().SetContext(ctx).Get(fmt.Sprintf("http://%s%s", status, path))
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode() != http.StatusOK {
+			return fmt.Errorf("TiDB %s%s responds %s", status, path, resp.Status())
+		}
+		return json.Unmarshal(resp.Body(), v)
+	}
+
+	type name struct {
+		O string `json:"O"`
+	}
+	var dbs []struct {
+		Name name `json:"db_name"`
+	}
+	if err := get("/schema", &dbs); err != nil {
+		return nil, err
+	}
+
+	var tables []*Table
+	for _, db := range dbs {
+		var infos []struct {
+			ID        int64 `json:"id"`
+			Name      name  `json:"name"`
+			Partition *struct {
+				Definitions []struct {
+					ID   int64 `json:"id"`
+					Name name  `json:"name"`
+				} `json:"definitions"`
+			} `json:"partition"`
+		}
+		if err := get("/schema/"+url.PathEscape(db.Name.O), &infos); err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			tables = append(tables, &Table{ID: info.ID, DB: db.Name.O, Name: info.Name.O})
+			if info.Partition == nil {
+				continue
+			}
+			for _, p := range info.Partition.Definitions {
+				tables = append(tables, &Table{ID: p.ID, DB: db.Name.O, Name: info.Name.O, Partition: p.Name.O})
+			}
+		}
+	}
+	return newCatalog(tables), nil
+}
+
+// Columns of the information_schema dump.
+const (
+	ColumnSchema      = "TABLE_SCHEMA"
+	ColumnTable       = "TABLE_NAME"
+	ColumnTableID     = "TIDB_TABLE_ID"
+	ColumnPartition   = "PARTITION_NAME"
+	ColumnPartitionID = "TIDB_PARTITION_ID"
+)
+
+// FromDump loads the tables from a CSV or TSV dump of information_schema
+// with a header, e.g. the output of mysql --batch:
+//
+//	SELECT t.TABLE_SCHEMA, t.TABLE_NAME, t.TIDB_TABLE_ID, p.PARTITION_NAME, p.TIDB_PARTITION_ID
+//	FROM information_schema.tables t LEFT JOIN information_schema.partitions p
+//	USING (TABLE_SCHEMA, TABLE_NAME)
+//
+// The partition columns are optional, NULL or empty for the tables not
+// partitioned.
+func FromDump(path string) (*Catalog, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tables, err := readDump(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return newCatalog(tables), nil
+}
+
+func readDump(r io.Reader) ([]*Table, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(strings.NewReader(string(data)))
+	if header := strings.SplitN(string(data), "\n", 2)[0]; strings.Contains(header, "\t") {
+		reader.Comma = '\t'
+		reader.LazyQuotes = true
+	}
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("missing header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, column := range header {
+		columns[strings.ToUpper(strings.TrimSpace(column))] = i
+	}
+	for _, column := range []string{ColumnSchema, ColumnTable, ColumnTableID} {
+		if _, ok := columns[column]; !ok {
+			return nil, fmt.Errorf("missing column %s", column)
+		}
+	}
+	field := func(record []string, column string) string {
+		i, ok := columns[column]
+		if !ok || i >= len(record) || record[i] == "NULL" {
+			return ""
+		}
+		return record[i]
+	}
+
+	var tables []*Table
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		t := &Table{DB: field(record, ColumnSchema), Name: field(record, ColumnTable)}
+		if t.ID, err = strconv.ParseInt(field(record, ColumnTableID), 10, 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid %s: %v", line, ColumnTableID, err)
+		}
+		tables = append(tables, t)
+
+		id := field(record, ColumnPartitionID)
+		if id == "" {
+			continue
+		}
+		p := &Table{DB: t.DB, Name: t.Name, Partition: field(record, ColumnPartition)}
+		if p.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid %s: %v", line, ColumnPartitionID, err)
+		}
+		tables = append(tables, p)
+	}
+	return tables, nil
+}
@@ -0,0 +1,193 @@
+// Package tables maps the table IDs decoded from the region keys to the TiDB
+// databases and tables, so that the reports tell the tables affected.
+package tables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/iosmanthus/learner-recover/components/key"
+)
+
+// Source is where the schema is loaded from, either the status address of a
+// TiDB server or a dump of information_schema.
+type Source struct {
+	TiDB string
+	Dump string
+}
+
+type Table struct {
+	ID   int64
+	DB   string
+	Name string
+	// Partition is the partition name if ID is a partition of the table.
+	Partition string
+}
+
+// Known reports whether the table is found in the schema.
+func (t *Table) Known() bool {
+	return t.Name != ""
+}
+
+func (t *Table) String() string {
+	switch {
+	case !t.Known():
+		return fmt.Sprintf("table %d", t.ID)
+	case t.Partition != "":
+		return fmt.Sprintf("%s.%s partition %s", t.DB, t.Name, t.Partition)
+	default:
+		return fmt.Sprintf("%s.%s", t.DB, t.Name)
+	}
+}
+
+// Catalog is the tables by their IDs. A nil catalog knows no tables, the
+// tables are reported by their IDs then.
+type Catalog struct {
+	tables map[int64]*Table
+	// ids are the sorted IDs of the tables.
+	ids []int64
+}
+
+func newCatalog(tables []*Table) *Catalog {
+	c := &Catalog{tables: make(map[int64]*Table)}
+	for _, t := range tables {
+		if _, ok := c.tables[t.ID]; !ok {
+			c.ids = append(c.ids, t.ID)
+		}
+		c.tables[t.ID] = t
+	}
+	sort.Slice(c.ids, func(i, j int) bool { return c.ids[i] < c.ids[j] })
+	return c
+}
+
+// Load loads the catalog from the source, it returns nil for a nil source.
+func Load(ctx context.Context, source *Source) (*Catalog, error) {
+	switch {
+	case source == nil:
+		return nil, nil
+	case source.TiDB != "" && source.Dump != "":
+		return nil, errors.New("only one of tidb and dump is allowed in schema-source")
+	case source.TiDB != "":
+		return FromTiDB(ctx, source.TiDB)
+	case source.Dump != "":
+		return FromDump(source.Dump)
+	}
+	return nil, errors.New("either tidb or dump is required in schema-source")
+}
+
+// Len returns the number of tables and partitions known.
+func (c *Catalog) Len() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.ids)
+}
+
+// Table returns the table of the ID, which is unknown if it is missing.
+func (c *Catalog) Table(id int64) *Table {
+	if c != nil {
+		if t, ok := c.tables[id]; ok {
+			return t
+		}
+	}
+	return &Table{ID: id}
+}
+
+// Tables returns the tables with data in a key range printed by tikv-ctl.
+// The tables strictly inside the range are known from the catalog only, the
+// ones split by the boundaries are always returned.
+func (c *Catalog) Tables(start, end string) []*Table {
+	s, e := key.Decode(start), key.Decode(end)
+
+	// The table prefixes sort by the table IDs, the keys before them hold no
+	// table and the keys after them neither.
+	from, to := int64(math.MinInt64), int64(math.MaxInt64)
+	switch {
+	case isTable(s):
+		from = s.TableID
+	case start != "" && key.Compare(start, "t") >= 0:
+		return nil
+	}
+	switch {
+	case isTable(e) && e.Kind == key.KindTable:
+		// The range ends right before the table.
+		if e.TableID == math.MinInt64 {
+			return nil
+		}
+		to = e.TableID - 1
+	case isTable(e):
+		to = e.TableID
+	case end != "" && key.Compare(end, "t") <= 0:
+		return nil
+	}
+	if from > to {
+		return nil
+	}
+
+	var tables []*Table
+	if isTable(s) {
+		tables = append(tables, c.Table(from))
+	}
+	if c != nil {
+		i := sort.Search(len(c.ids), func(i int) bool { return c.ids[i] >= from })
+		for ; i < len(c.ids) && c.ids[i] <= to; i++ {
+			if id := c.ids[i]; !isTable(s) || id != from {
+				tables = append(tables, c.tables[id])
+			}
+		}
+	}
+	if isTable(e) && to == e.TableID && (len(tables) == 0 || tables[len(tables)-1].ID != to) {
+		tables = append(tables, c.Table(to))
+	}
+	return tables
+}
+
+func isTable(k *key.Key) bool {
+	switch k.Kind {
+	case key.KindTable, key.KindRecord, key.KindIndex:
+		return true
+	}
+	return false
+}
+
+// AffectedTable is a table with data in the key ranges of a report.
+type AffectedTable struct {
+	*Table
+	// Ranges counts the key ranges by their kinds, e.g. the regions dropped.
+	Ranges map[string]int
+}
+
+// Affected collects the tables of the key ranges added.
+type Affected struct {
+	catalog *Catalog
+	tables  map[int64]*AffectedTable
+}
+
+func NewAffected(catalog *Catalog) *Affected {
+	return &Affected{catalog: catalog, tables: make(map[int64]*AffectedTable)}
+}
+
+// Add adds the tables of a key range of the kind.
+func (a *Affected) Add(kind, start, end string) {
+	for _, t := range a.catalog.Tables(start, end) {
+		affected, ok := a.tables[t.ID]
+		if !ok {
+			affected = &AffectedTable{Table: t, Ranges: make(map[string]int)}
+			a.tables[t.ID] = affected
+		}
+		affected.Ranges[kind]++
+	}
+}
+
+// Tables returns the tables affected in the order of their IDs.
+func (a *Affected) Tables() []*AffectedTable {
+	tables := make([]*AffectedTable, 0, len(a.tables))
+	for _, t := range a.tables {
+		tables = append(tables, t)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].ID < tables[j].ID })
+	return tables
+}
@@ -0,0 +1,129 @@
+package tables
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/iosmanthus/learner-recover/components/key"
+)
+
+const dump = "TABLE_SCHEMA\tTABLE_NAME\tTIDB_TABLE_ID\tPARTITION_NAME\tTIDB_PARTITION_ID\n" +
+	"shop\tusers\t30\tNULL\tNULL\n" +
+	"shop\torders\t45\tp0\t46\n" +
+	"shop\torders\t45\tp1\t47\n" +
+	"mysql\tuser\t5\tNULL\tNULL\n"
+
+func tableKey(id int64) string {
+	return key.Escape(key.EncodeBytes(key.EncodeInt([]byte("t"), id)))
+}
+
+func rowKey(id, handle int64) string {
+	k := append(key.EncodeInt([]byte("t"), id), "_r"...)
+	return key.Escape(key.EncodeBytes(key.EncodeInt(k, handle)))
+}
+
+func names(tables []*Table) string {
+	var s []string
+	for _, t := range tables {
+		s = append(s, t.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+func TestReadDump(t *testing.T) {
+	tables, err := readDump(strings.NewReader(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newCatalog(tables)
+	if c.Len() != 5 {
+		t.Fatalf("unexpected tables %s", names(tables))
+	}
+	if got := c.Table(47).String(); got != "shop.orders partition p1" {
+		t.Fatalf("unexpected partition %s", got)
+	}
+	if got := c.Table(99); got.Known() || got.String() != "table 99" {
+		t.Fatalf("unexpected unknown table %s", got)
+	}
+
+	// CSV without the partition columns.
+	tables, err = readDump(strings.NewReader("table_schema,table_name,tidb_table_id\nshop,users,30\n"))
+	if err != nil || names(tables) != "shop.users" {
+		t.Fatalf("unexpected tables %s, %v", names(tables), err)
+	}
+	if _, err = readDump(strings.NewReader("TABLE_SCHEMA,TABLE_NAME\nshop,users\n")); err == nil {
+		t.Fatal("expect the table ID to be required")
+	}
+}
+
+func TestCatalogTables(t *testing.T) {
+	tables, err := readDump(strings.NewReader(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newCatalog(tables)
+
+	for _, test := range []struct {
+		start, end string
+		want       string
+	}{
+		{rowKey(45, 10), rowKey(45, 20), "shop.orders"},
+		{tableKey(30), tableKey(45), "shop.users"},
+		{rowKey(30, 10), rowKey(46, 1), "shop.users, shop.orders, shop.orders partition p0"},
+		{"", tableKey(30), "mysql.user"},
+		{rowKey(47, 1), "", "shop.orders partition p1"},
+		// Raw keys outside the table keys.
+		{"", "m", ""},
+		{"u", "", ""},
+	} {
+		if got := names(c.Tables(test.start, test.end)); got != test.want {
+			t.Fatalf("tables of [%s, %s): got %s, want %s", test.start, test.end, got, test.want)
+		}
+	}
+
+	// The tables split by the boundaries are known without a catalog.
+	var nilCatalog *Catalog
+	if got := names(nilCatalog.Tables(rowKey(30, 10), rowKey(46, 1))); got != "table 30, table 46" {
+		t.Fatalf("unexpected tables %s", got)
+	}
+}
+
+func TestAffected(t *testing.T) {
+	affected := NewAffected(nil)
+	affected.Add("gap", rowKey(45, 1), rowKey(45, 2))
+	affected.Add("gap", rowKey(45, 3), tableKey(46))
+	affected.Add("loss", tableKey(30), tableKey(31))
+
+	tables := affected.Tables()
+	if len(tables) != 2 || tables[0].ID != 30 || tables[1].Ranges["gap"] != 2 {
+		t.Fatalf("unexpected affected tables %+v", tables)
+	}
+}
+
+func TestFromTiDB(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/schema":
+			json.NewEncoder(w).Encode([]interface{}{map[string]interface{}{"id": 2, "db_name": map[string]string{"O": "Shop", "L": "shop"}}})
+		case "/schema/Shop":
+			w.Write([]byte(`[{"id": 45, "name": {"O": "orders", "L": "orders"},
+				"partition": {"definitions": [{"id": 46, "name": {"O": "p0", "L": "p0"}}]}},
+				{"id": 30, "name": {"O": "users", "L": "users"}, "partition": null}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	c, err := Load(context.Background(), &Source{TiDB: strings.TrimPrefix(server.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names([]*Table{c.Table(30), c.Table(45), c.Table(46)}); got != "Shop.users, Shop.orders, Shop.orders partition p0" {
+		t.Fatalf("unexpected tables %s", got)
+	}
+}
@@ -0,0 +1,45 @@
+package unified
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/iosmanthus/learner-recover/schema"
+)
+
+func TestSchema(t *testing.T) {
+	diff, err := schema.Diff(schema.KindUnified, reflect.TypeOf(Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff) != 0 {
+		t.Fatalf("the schema drifts from the config:\n%v", diff)
+	}
+}
+
+func TestUnknownKeys(t *testing.T) {
+	for _, c := range []struct {
+		config, err string
+	}{
+		{testConfig + "rpo-history: history\n", "field rpo-history not found"},
+		{testConfig + "recover:\n  reprot: report\n", "field reprot not found"},
+		{"cluster:\n  nmae: backup\n", "field nmae not found"},
+	} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := ioutil.WriteFile(path, []byte(c.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path, CommandRecover); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("expect %q, got %v", c.err, err)
+		}
+	}
+
+	// The rpo paths of recover are known and default to the rpo section.
+	legacy := loadWith(t, testConfig+"recover:\n  rpo-history: history\n", CommandRecover)
+	if legacy["rpo-history"] != "history" || legacy["rpo-output"] != "rpo.json" {
+		t.Fatalf("unexpected legacy config %v", legacy)
+	}
+}
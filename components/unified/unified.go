@@ -0,0 +1,366 @@
+// Package unified loads learner-recover.yaml, the single config file shared
+// by all commands, and translates it to the legacy config of a command.
+package unified
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	CommandFetch   = "fetch"
+	CommandRecover = "recover"
+	CommandRPO     = "rpo"
+
+	// DefaultPath is loaded if a command is given no config file.
+	DefaultPath = "learner-recover.yaml"
+	// EnvPrefix prefixes the environment variables overriding the unified
+	// config, e.g. LEARNER_RECOVER_RPO__LAST_FOR=5m sets rpo.last-for.
+	EnvPrefix = "LEARNER_RECOVER_"
+	// EnvConfig names the config file used instead of DefaultPath.
+	EnvConfig = EnvPrefix + "CONFIG"
+)
+
+// Overrides are set by --set key.path=value and applied on top of the file
+// and the environment variables.
+var Overrides []string
+
+type Config struct {
+	Cluster struct {
+		Name     string `yaml:"name"`
+		Version  string `yaml:"version"`
+		Topology string `yaml:"topology"`
+		// Backend is tiup or kubernetes, see the recover command.
+		Backend string `yaml:"backend"`
+	} `yaml:"cluster"`
+	Learners struct {
+		Labels interface{}            `yaml:"labels"`
+		Groups map[string]interface{} `yaml:"groups"`
+	} `yaml:"learners"`
+	Tools struct {
+		TiKVCtl     string `yaml:"tikv-ctl"`
+		TiKVCtlDest string `yaml:"tikv-ctl-dest"`
+		PDRecover   string `yaml:"pd-recover"`
+	} `yaml:"tools"`
+	SSH struct {
+		User string `yaml:"user"`
+		Port int    `yaml:"port"`
+	} `yaml:"ssh"`
+	Fetch struct {
+		Save     string `yaml:"save"`
+		Interval string `yaml:"interval"`
+		LastFor  string `yaml:"last-for"`
+		Timeout  string `yaml:"timeout"`
+	} `yaml:"fetch"`
+	Recover struct {
+		NewTopology     string   `yaml:"new-topology"`
+		JoinTopology    string   `yaml:"join-topology"`
+		ClusterTimeout  string   `yaml:"cluster-timeout"`
+		RecoverInfoFile string   `yaml:"recover-info-file"`
+		RecoverFrom     []string `yaml:"recover-from"`
+		AuditLog        string   `yaml:"audit-log"`
+		Report          string   `yaml:"report"`
+		FailureTime     string   `yaml:"failure-time"`
+		ReplayPlacement *bool    `yaml:"replay-placement"`
+		// RPOOutput and RPOHistory default to rpo.save and rpo.history-path.
+		RPOOutput  string `yaml:"rpo-output"`
+		RPOHistory string `yaml:"rpo-history"`
+	} `yaml:"recover"`
+	// Kubernetes locates the TidbCluster recovered by the kubernetes backend,
+	// it is checked by the recover command.
+	Kubernetes yaml.Node `yaml:"kubernetes"`
+	// RPO holds the keys of rpo.yaml other than the shared ones, they are
+	// checked by the rpo command.
+	RPO map[string]yaml.Node `yaml:"rpo"`
+	// SchemaSource names the tables in the reports of recover and rpo.
+	SchemaSource yaml.Node `yaml:"schema-source"`
+}
+
+// isUnified tells a unified config by its cluster section.
+func isUnified(doc *yaml.Node) bool {
+	return lookup(doc, "cluster") != nil
+}
+
+// lookup returns the value of the key in the mapping node, nil if missing.
+func lookup(doc *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		if doc.Content[i].Value == key {
+			return doc.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// Load reads the config file of the command, the default file is used if the
+// path is empty. A unified config is translated to the legacy config of the
+// command, the overrides are applied to either format.
+//
+// The document is kept as YAML nodes until it is decoded, so a scalar keeps
+// its text, e.g. version: 6.10 is not read back as 6.1.
+func Load(path, command string) ([]byte, error) {
+	if path == "" {
+		if path = os.Getenv(EnvConfig); path == "" {
+			path = DefaultPath
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	root := &yaml.Node{}
+	if err = yaml.Unmarshal(data, root); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	doc := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if len(root.Content) != 0 {
+		doc = root.Content[0]
+	}
+	if doc.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: expect a mapping of config keys", path)
+	}
+
+	// Environment variables are named after the unified sections, so they
+	// only apply to the unified config.
+	var target reflect.Type
+	unified := isUnified(doc)
+	if unified {
+		target = reflect.TypeOf(Config{})
+		if err = applyEnv(doc, target, os.Environ()); err != nil {
+			return nil, err
+		}
+	}
+	for _, override := range Overrides {
+		kv := strings.SplitN(override, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid override %q, expect key.path=value", override)
+		}
+		if err = set(doc, target, kv[0], kv[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	if data, err = yaml.Marshal(doc); err != nil {
+		return nil, err
+	}
+	if !unified {
+		return data, nil
+	}
+
+	c := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(c); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	legacy, err := c.Legacy(command)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(legacy)
+}
+
+func applyEnv(doc *yaml.Node, target reflect.Type, environ []string) error {
+	sort.Strings(environ)
+	for _, env := range environ {
+		kv := strings.SplitN(env, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], EnvPrefix) || kv[0] == EnvConfig {
+			continue
+		}
+
+		key := strings.ToLower(strings.TrimPrefix(kv[0], EnvPrefix))
+		key = strings.ReplaceAll(strings.ReplaceAll(key, "__", "."), "_", "-")
+		if err := set(doc, target, key, kv[1]); err != nil {
+			return fmt.Errorf("%s: %v", kv[0], err)
+		}
+	}
+	return nil
+}
+
+// untyped tells if the dotted key of the target type is decoded into an
+// interface{}, where a scalar would be resolved to a number or a bool. A key
+// of no known type is decoded by the legacy config of a command, which is
+// typed.
+func untyped(target reflect.Type, path []string) bool {
+	if target == nil {
+		return false
+	}
+	for _, k := range path {
+		switch target.Kind() {
+		case reflect.Interface:
+			return true
+		case reflect.Map:
+			target = target.Elem()
+		case reflect.Struct:
+			found := false
+			for i := 0; i < target.NumField(); i++ {
+				f := target.Field(i)
+				if strings.Split(f.Tag.Get("yaml"), ",")[0] == k {
+					target, found = f.Type, true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return target.Kind() == reflect.Interface
+}
+
+// set assigns the value, parsed as YAML, to the dotted key of the document.
+// A scalar keeps its text for the typed field it is decoded into, and is a
+// string unless the field is typed.
+func set(doc *yaml.Node, target reflect.Type, key, value string) error {
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(value), root); err != nil {
+		return fmt.Errorf("invalid value of %s: %v", key, err)
+	}
+	v := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null"}
+	if len(root.Content) != 0 {
+		v = root.Content[0]
+	}
+
+	path := strings.Split(key, ".")
+	if v.Kind == yaml.ScalarNode && untyped(target, path) {
+		v.Tag = "!!str"
+	}
+	for i, k := range path[:len(path)-1] {
+		child := lookup(doc, k)
+		if child == nil {
+			child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: k}, child)
+		} else if child.Kind == yaml.ScalarNode && child.Tag == "!!null" {
+			*child = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		if child.Kind != yaml.MappingNode {
+			return fmt.Errorf("can't set %s: %s is not a section", key, strings.Join(path[:i+1], "."))
+		}
+		doc = child
+	}
+
+	k := path[len(path)-1]
+	if child := lookup(doc, k); child != nil {
+		*child = *v
+	} else {
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: k}, v)
+	}
+	return nil
+}
+
+// Legacy returns the legacy config of the command.
+func (c *Config) Legacy(command string) (map[string]interface{}, error) {
+	legacy := make(map[string]interface{})
+	put := func(key string, value interface{}) {
+		switch v := value.(type) {
+		case string:
+			if v == "" {
+				return
+			}
+		case int:
+			if v == 0 {
+				return
+			}
+		case []string:
+			if len(v) == 0 {
+				return
+			}
+		case map[string]interface{}:
+			if len(v) == 0 {
+				return
+			}
+		case yaml.Node:
+			if v.Kind == 0 || v.Tag == "!!null" || v.Kind == yaml.MappingNode && len(v.Content) == 0 {
+				return
+			}
+			value = &v
+		case nil:
+			return
+		}
+		legacy[key] = value
+	}
+
+	recoverInfo := c.Recover.RecoverInfoFile
+	if recoverInfo == "" {
+		recoverInfo = c.Fetch.Save
+	}
+
+	switch command {
+	case CommandFetch:
+		put("save", c.Fetch.Save)
+		put("topology", c.Cluster.Topology)
+		put("learner-labels", c.Learners.Labels)
+		put("learner-groups", c.Learners.Groups)
+		put("interval", c.Fetch.Interval)
+		put("last-for", c.Fetch.LastFor)
+		put("timeout", c.Fetch.Timeout)
+	case CommandRecover:
+		put("backend", c.Cluster.Backend)
+		put("kubernetes", c.Kubernetes)
+		put("cluster-version", c.Cluster.Version)
+		put("cluster-name", c.Cluster.Name)
+		put("old-topology", c.Cluster.Topology)
+		put("new-topology", c.Recover.NewTopology)
+		put("join-topology", c.Recover.JoinTopology)
+		put("cluster-timeout", c.Recover.ClusterTimeout)
+		put("recover-info-file", recoverInfo)
+		put("zone-labels", c.Learners.Labels)
+		put("learner-groups", c.Learners.Groups)
+		put("recover-from", c.Recover.RecoverFrom)
+		put("tikv-ctl", map[string]interface{}{"src": c.Tools.TiKVCtl, "dest": c.Tools.TiKVCtlDest})
+		put("pd-recover-path", c.Tools.PDRecover)
+		put("audit-log", c.Recover.AuditLog)
+		put("report", c.Recover.Report)
+		put("failure-time", c.Recover.FailureTime)
+		if c.Recover.ReplayPlacement != nil {
+			put("replay-placement", *c.Recover.ReplayPlacement)
+		}
+		put("schema-source", c.SchemaSource)
+		rpoOutput, rpoHistory := c.Recover.RPOOutput, c.Recover.RPOHistory
+		if save := c.RPO["save"]; rpoOutput == "" && save.Kind == yaml.ScalarNode {
+			rpoOutput = save.Value
+		}
+		if history := c.RPO["history-path"]; rpoHistory == "" && history.Kind == yaml.ScalarNode {
+			rpoHistory = history.Value
+		}
+		put("rpo-output", rpoOutput)
+		put("rpo-history", rpoHistory)
+		ssh := make(map[string]interface{})
+		if c.SSH.User != "" {
+			ssh["user"] = c.SSH.User
+		}
+		if c.SSH.Port != 0 {
+			ssh["port"] = c.SSH.Port
+		}
+		put("ssh", ssh)
+	case CommandRPO:
+		for k, v := range c.RPO {
+			switch k {
+			case "topology", "learner-labels", "learner-groups", "tikv-ctl", "schema-source":
+				return nil, fmt.Errorf("rpo.%s is shared, please set it in the cluster, learners, tools or schema-source section", k)
+			}
+			v := v
+			legacy[k] = &v
+		}
+		put("topology", c.Cluster.Topology)
+		put("learner-labels", c.Learners.Labels)
+		put("learner-groups", c.Learners.Groups)
+		put("tikv-ctl", c.Tools.TiKVCtl)
+		put("schema-source", c.SchemaSource)
+	default:
+		return nil, fmt.Errorf("unknown command %q", command)
+	}
+	return legacy, nil
+}
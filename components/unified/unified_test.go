@@ -0,0 +1,149 @@
+package unified
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const testConfig = `cluster:
+  name: backup
+  version: 6.10
+  topology: old.yaml
+learners:
+  labels:
+    zone: backup
+fetch:
+  save: info.json
+rpo:
+  save: rpo.json
+`
+
+// loadText loads the config for the command with the overrides.
+func loadText(t *testing.T, config, command string, overrides ...string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	Overrides = overrides
+	defer func() { Overrides = nil }()
+
+	data, err := Load(path, command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// loadWith loads the config like loadText and decodes the legacy config.
+func loadWith(t *testing.T, config, command string, overrides ...string) map[string]interface{} {
+	legacy := make(map[string]interface{})
+	if err := yaml.Unmarshal([]byte(loadText(t, config, command, overrides...)), &legacy); err != nil {
+		t.Fatal(err)
+	}
+	return legacy
+}
+
+func TestSetKeepsText(t *testing.T) {
+	legacy := loadWith(t, testConfig, CommandRecover,
+		"recover.failure-time=2021-08-01T10:00:00Z",
+		"ssh.port=2222",
+		"recover.replay-placement=true",
+		"learners.labels.rack=1.10",
+		"schema-source.dump=007",
+	)
+	for k, want := range map[string]interface{}{
+		// The file and the overrides keep the text of a string field.
+		"cluster-version": "6.10",
+		"failure-time":    "2021-08-01T10:00:00Z",
+		// Typed fields are decoded by their type.
+		"ssh":              map[string]interface{}{"port": 2222},
+		"replay-placement": true,
+		// A label is untyped, so it is a string rather than a number.
+		"zone-labels":   map[string]interface{}{"zone": "backup", "rack": "1.10"},
+		"schema-source": map[string]interface{}{"dump": 7},
+		"rpo-output":    "rpo.json",
+	} {
+		if !reflect.DeepEqual(legacy[k], want) {
+			t.Fatalf("%s: got %#v, want %#v", k, legacy[k], want)
+		}
+	}
+
+	// The keys of the rpo section are decoded by the rpo command.
+	legacy = loadWith(t, testConfig, CommandRPO, "rpo.concurrency=8", "rpo.last-for=5m", "rpo.alerts.webhook.template=1.0")
+	alerts := map[string]interface{}{"webhook": map[string]interface{}{"template": 1.0}}
+	if legacy["concurrency"] != 8 || legacy["last-for"] != "5m" || !reflect.DeepEqual(legacy["alerts"], alerts) {
+		t.Fatalf("unexpected rpo config %v", legacy)
+	}
+	if text := loadText(t, testConfig, CommandRPO, "rpo.alerts.webhook.template=1.0"); !strings.Contains(text, "template: 1.0\n") {
+		t.Fatalf("the text of the rpo key is not kept:\n%s", text)
+	}
+
+	// A legacy config is decoded by the command as it is.
+	legacy = loadWith(t, "cluster-version: 6.10\n", CommandRecover, "cluster-name=1e3", "ssh.port=22")
+	text := loadText(t, "cluster-version: 6.10\n", CommandRecover, "cluster-name=1e3")
+	if !strings.Contains(text, "cluster-version: 6.10\n") || !strings.Contains(text, "cluster-name: 1e3\n") {
+		t.Fatalf("the text of the legacy config is not kept:\n%s", text)
+	}
+	if !reflect.DeepEqual(legacy["ssh"], map[string]interface{}{"port": 22}) {
+		t.Fatalf("unexpected legacy config %v", legacy)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(testConfig), doc); err != nil {
+		t.Fatal(err)
+	}
+	environ := []string{
+		EnvPrefix + "CLUSTER__VERSION=6.20",
+		EnvPrefix + "RPO__LAST_FOR=5m",
+		EnvConfig + "=other.yaml",
+		"HOME=/root",
+	}
+	if err := applyEnv(doc.Content[0], reflect.TypeOf(Config{}), environ); err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{}
+	if err := doc.Decode(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Cluster.Version != "6.20" || c.RPO["last-for"].Value != "5m" || c.RPO["save"].Value != "rpo.json" {
+		t.Fatalf("unexpected config %+v", c)
+	}
+}
+
+func TestSetErrors(t *testing.T) {
+	for _, c := range []struct {
+		key, value string
+		err        string
+	}{
+		{"cluster.name.first", "a", "cluster.name is not a section"},
+		{"cluster.name", "[a", "invalid value of cluster.name"},
+	} {
+		doc := &yaml.Node{}
+		if err := yaml.Unmarshal([]byte(testConfig), doc); err != nil {
+			t.Fatal(err)
+		}
+		if err := set(doc.Content[0], reflect.TypeOf(Config{}), c.key, c.value); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("%s=%s: expect %q, got %v", c.key, c.value, c.err, err)
+		}
+	}
+
+	// An empty section is replaced by the key.
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte("cluster:\nssh:\n"), doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := set(doc.Content[0], reflect.TypeOf(Config{}), "ssh.user", "tidb"); err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{}
+	if err := doc.Decode(c); err != nil || c.SSH.User != "tidb" {
+		t.Fatalf("unexpected config %+v %v", c.SSH, err)
+	}
+}
@@ -0,0 +1,80 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type node struct {
+	Ref        string           `json:"$ref"`
+	Properties map[string]*node `json:"properties"`
+	Items      *node            `json:"items"`
+}
+
+var yamlNode = reflect.TypeOf(yaml.Node{})
+
+// Diff compares the keys of the schema of the kind with the yaml fields of
+// the config struct decoding it, and returns the keys found on one side only,
+// e.g. "sampling.adaptive.max-interval: not in the schema". The schemas are
+// published apart from the code, the tests of the config loaders keep them
+// in sync with Diff.
+func Diff(kind string, config reflect.Type) ([]string, error) {
+	data, err := Get(kind)
+	if err != nil {
+		return nil, err
+	}
+	root := &struct {
+		node
+		Definitions map[string]*node `json:"definitions"`
+	}{}
+	if err = json.Unmarshal(data, root); err != nil {
+		return nil, fmt.Errorf("%s schema: %v", kind, err)
+	}
+
+	var diff []string
+	var walk func(s *node, t reflect.Type, path string)
+	walk = func(s *node, t reflect.Type, path string) {
+		if s.Ref != "" {
+			s = root.Definitions[strings.TrimPrefix(s.Ref, "#/definitions/")]
+		}
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		switch {
+		case t.Kind() == reflect.Slice && s.Items != nil:
+			walk(s.Items, t.Elem(), path)
+			return
+		case t.Kind() != reflect.Struct || t == yamlNode:
+			// Free-form values are checked by their decoders.
+			return
+		}
+
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			if key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]; key != "" && key != "-" {
+				fields[key] = t.Field(i).Type
+			}
+		}
+		for key, field := range fields {
+			if p, ok := s.Properties[key]; ok {
+				walk(p, field, path+key+".")
+			} else {
+				diff = append(diff, path+key+": not in the schema")
+			}
+		}
+		for key := range s.Properties {
+			if _, ok := fields[key]; !ok {
+				diff = append(diff, path+key+": not decoded")
+			}
+		}
+	}
+	walk(&root.node, config, "")
+
+	sort.Strings(diff)
+	return diff, nil
+}
@@ -0,0 +1,29 @@
+// Package schema publishes the JSON Schemas of the config files.
+package schema
+
+import (
+	"embed"
+	"fmt"
+)
+
+const (
+	KindRecover = "recover"
+	KindInfo    = "info"
+	KindRPO     = "rpo"
+	// KindUnified is the learner-recover.yaml shared by all commands.
+	KindUnified = "learner-recover"
+)
+
+//go:embed *.schema.json
+var schemas embed.FS
+
+// Kinds lists the config kinds with a schema.
+var Kinds = []string{KindRecover, KindInfo, KindRPO, KindUnified}
+
+func Get(kind string) ([]byte, error) {
+	data, err := schemas.ReadFile(kind + ".schema.json")
+	if err != nil {
+		return nil, fmt.Errorf("unknown config kind %q", kind)
+	}
+	return data, nil
+}
@@ -0,0 +1,416 @@
+// Package e2e runs the learner-recover binary against the fake cluster of the
+// test harness.
+package e2e
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/common"
+	"github.com/iosmanthus/learner-recover/test/harness"
+)
+
+const clusterScenario = "testdata/cluster.yaml"
+
+var backup = map[string]string{"zone": "backup"}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	harness.Cleanup()
+	os.Exit(code)
+}
+
+func newHarness(t *testing.T) *harness.Harness {
+	if testing.Short() {
+		t.Skip("end-to-end tests are skipped in short mode")
+	}
+	h := harness.New(t, clusterScenario)
+	h.Topologies(backup)
+	return h
+}
+
+func fetch(t *testing.T, h *harness.Harness) *common.RecoverInfo {
+	h.WriteFile("fetch.yaml", `save: recover-info.json
+topology: old.yaml
+learner-labels:
+  zone: backup
+interval: 100ms
+last-for: 300ms
+timeout: 1s
+`)
+	h.MustRun("fetch", "-c", "fetch.yaml")
+
+	data, err := ioutil.ReadFile(h.Path("recover-info.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &common.RecoverInfo{}
+	if err = json.Unmarshal(data, info); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestFetch(t *testing.T) {
+	h := newHarness(t)
+	info := fetch(t, h)
+
+	if info.ClusterID != h.Scenario.ClusterID || info.AllocID != h.Scenario.AllocID+math.MaxUint32 {
+		t.Fatalf("unexpected cluster ID %s and alloc ID %v", info.ClusterID, info.AllocID)
+	}
+	if !equalIDs(info.StoreIDs, []uint64{1, 4, 5}) || !equalIDs(info.LearnerStoreIDs[common.DefaultLearnerGroup], []uint64{6, 7, 8}) {
+		t.Fatalf("unexpected stores %v, learners %v", info.StoreIDs, info.LearnerStoreIDs)
+	}
+	if r := info.Replication; r == nil || r.MaxReplicas != 3 || r.LocationLabels != "zone,host" || !r.PlacementEnabled() {
+		t.Fatalf("unexpected replication config %+v", r)
+	}
+	if len(info.PlacementRules) != 2 || info.PlacementRules[1].Role != common.RuleRoleLearner {
+		t.Fatalf("unexpected placement rules %+v", info.PlacementRules)
+	}
+	if m := info.ReplicationMode; m == nil || m.Mode != common.ModeDRAutoSync || m.DRAutoSync.DR != "backup" {
+		t.Fatalf("unexpected replication mode %+v", m)
+	}
+}
+
+func TestFetchPDDown(t *testing.T) {
+	h := newHarness(t)
+	h.Update(func(s *harness.Scenario) { s.PD.Down = true })
+
+	// The IDs from Prometheus are saved without the stores.
+	info := fetch(t, h)
+	if info.ClusterID != h.Scenario.ClusterID || len(info.StoreIDs) != 0 {
+		t.Fatalf("unexpected recover info %+v", info)
+	}
+
+	// The stores are filled in once PD is back.
+	h.Update(func(s *harness.Scenario) { s.PD.Down = false })
+	if info = fetch(t, h); !equalIDs(info.StoreIDs, []uint64{1, 4, 5}) {
+		t.Fatalf("unexpected stores %v", info.StoreIDs)
+	}
+}
+
+// lagUpper returns the upper bound of the RPO saved, 0 if nothing is saved.
+func lagUpper(t *testing.T, h *harness.Harness) time.Duration {
+	data, err := ioutil.ReadFile(h.Path("rpo.json"))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &struct {
+		LagUpper string `json:"lag-upper"`
+	}{}
+	if err = json.Unmarshal(data, result); err != nil {
+		t.Fatal(err)
+	}
+	lag, err := time.ParseDuration(result.LagUpper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lag
+}
+
+func runRPO(t *testing.T, h *harness.Harness) time.Duration {
+	h.WriteFile("rpo.yaml", `topology: old.yaml
+learner-labels:
+  zone: backup
+source: tikv-ctl
+tikv-ctl: `+h.Executable(harness.ProgramTiKVCtl)+`
+schema-source:
+  tidb: `+h.Scenario.TiDB.Address+`
+last-for: 2s
+history-path: history
+save: rpo.json
+sampling:
+  voter-interval: 100ms
+  learner-interval: 200ms
+  persist-interval: 100ms
+`)
+	h.MustRun("rpo", "-c", "rpo.yaml")
+	return lagUpper(t, h)
+}
+
+// lagTables returns the tables in the RPO saved.
+func lagTables(t *testing.T, h *harness.Harness) []string {
+	data, err := ioutil.ReadFile(h.Path("rpo.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &struct {
+		Tables []struct {
+			Table string `json:"table"`
+		} `json:"tables"`
+	}{}
+	if err = json.Unmarshal(data, result); err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	for _, table := range result.Tables {
+		tables = append(tables, table.Table)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+func TestRPO(t *testing.T) {
+	h := newHarness(t)
+	// The learners apply slower than the voters.
+	if lag := runRPO(t, h); lag <= 0 {
+		t.Fatalf("expect the learners to lag, got %v", lag)
+	}
+	// The tables are named by the status API of TiDB.
+	if got := strings.Join(lagTables(t, h), ", "); got != "shop.orders, shop.users" {
+		t.Fatalf("unexpected tables %s", got)
+	}
+	for _, address := range []string{"10.0.1.1:20160", "10.0.2.1:20160", "10.0.2.3:20160"} {
+		if h.ReadState().Samples[address] == 0 {
+			t.Fatalf("store %s is never sampled", address)
+		}
+	}
+}
+
+func TestRPOFailedHost(t *testing.T) {
+	h := newHarness(t)
+	h.Update(func(s *harness.Scenario) {
+		s.Failures = append(s.Failures, &harness.Failure{
+			Program: harness.ProgramTiKVCtl,
+			Host:    "10.0.2.3:20160",
+			Times:   3,
+			Message: "[ERROR] failed to connect to 10.0.2.3:20160: Connection refused",
+		})
+	})
+
+	// The group is estimated once the learner is back.
+	if lag := runRPO(t, h); lag <= 0 {
+		t.Fatalf("expect the learners to lag, got %v", lag)
+	}
+	if state := h.ReadState(); state.Failed[0] != 3 || state.Samples["10.0.2.3:20160"] == 0 {
+		t.Fatalf("unexpected samples %v", state.Samples)
+	}
+}
+
+func TestRPOLearnerDown(t *testing.T) {
+	h := newHarness(t)
+	h.Update(func(s *harness.Scenario) {
+		s.Failures = append(s.Failures, &harness.Failure{
+			Program: harness.ProgramTiKVCtl,
+			Host:    "10.0.2.3:20160",
+			Message: "[ERROR] failed to connect to 10.0.2.3:20160: Connection refused",
+		})
+	})
+
+	// The regions of a learner down may be the most lagging ones, no RPO
+	// is estimated without them.
+	if lag := runRPO(t, h); lag != 0 {
+		t.Fatalf("expect no RPO, got %v", lag)
+	}
+	if state := h.ReadState(); state.Samples["10.0.1.1:20160"] == 0 || state.Failed[0] == 0 {
+		t.Fatalf("unexpected samples %v", state.Samples)
+	}
+}
+
+func writeRecoverConfig(h *harness.Harness) {
+	h.WriteFile("tables.tsv", "TABLE_SCHEMA\tTABLE_NAME\tTIDB_TABLE_ID\nshop\tusers\t30\nshop\torders\t45\n")
+	h.WriteFile("recover.yaml", `cluster-version: v5.1.0
+cluster-name: backup
+old-topology: old.yaml
+new-topology: new.yaml
+join-topology: join.yaml
+recover-info-file: recover-info.json
+zone-labels:
+  zone: backup
+tikv-ctl:
+  src: `+h.Executable(harness.ProgramTiKVCtl)+`
+  dest: /root/tikv-ctl
+pd-recover-path: `+h.Executable(harness.ProgramPDRecover)+`
+replay-placement: true
+cluster-timeout: 5s
+audit-log: audit.log
+report: report
+schema-source:
+  dump: tables.tsv
+`)
+}
+
+// tombstones returns the tombstone calls as host: regions.
+func tombstones(h *harness.Harness) []string {
+	var calls []string
+	for _, call := range h.Calls(harness.ProgramSSH) {
+		if n := len(call.Args); n > 3 && call.Args[n-4] == "tombstone" {
+			calls = append(calls, call.Host+": "+call.Args[n-1])
+		}
+	}
+	return calls
+}
+
+func tiupCalls(h *harness.Harness) []string {
+	var calls []string
+	for _, call := range h.Calls(harness.ProgramTiUP) {
+		if call.Args[1] != "display" {
+			calls = append(calls, call.Args[1])
+		}
+	}
+	return calls
+}
+
+func TestRecover(t *testing.T) {
+	h := newHarness(t)
+	fetch(t, h)
+	writeRecoverConfig(h)
+	h.MustRun("recover", "-c", "recover.yaml", "--yes")
+
+	state := h.ReadState()
+	learners := []string{"10.0.2.1:20160", "10.0.2.2:20160", "10.0.2.3:20160"}
+	for _, address := range learners {
+		if !state.Stopped[address] || !state.DroppedLogs[address] || state.Promoted[address] != "1,4,5" {
+			t.Fatalf("learner %s is not recovered: %+v", address, state)
+		}
+	}
+	if state.Stopped["10.0.1.1:20160"] {
+		t.Fatal("a voter is stopped")
+	}
+
+	// The stale epoch and the smaller applied index are dropped.
+	if got := strings.Join(tombstones(h), ", "); got != "10.0.2.2: 2, 10.0.2.1: 3" && got != "10.0.2.1: 3, 10.0.2.2: 2" {
+		t.Fatalf("unexpected tombstones %s", got)
+	}
+	if state.PDRecovered != 1 {
+		t.Fatalf("pd-recover is run %v times", state.PDRecovered)
+	}
+	if got := strings.Join(tiupCalls(h), ","); got != "deploy,start,restart,scale-out" {
+		t.Fatalf("unexpected tiup calls %s", got)
+	}
+	if c := state.Clusters["backup"]; c == nil || len(c.Instances) != 4 {
+		t.Fatalf("unexpected cluster %+v", c)
+	}
+
+	report, err := ioutil.ReadFile(h.Path("report.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"Result: succeeded",
+		// Region 9 of 10.0.2.3 is left by a merge.
+		"1 tombstoned replicas skipped",
+		"5 entries committed but not applied",
+		"region 3 (table 45, row 1000 to ∞)",
+		// Region 2 of 10.0.2.2 is dropped and region 3 has entries dropped.
+		"| shop.users | 30 | 1 | 0 | 0 | 0 |",
+		"| shop.orders | 45 | 2 | 0 | 1 | 0 |",
+		"rule pd/default of 3 voters moved from zone in (master) to zone in (backup)",
+		"rule pd/backup of 3 learners dropped",
+	} {
+		if !strings.Contains(string(report), s) {
+			t.Fatalf("report without %q\n%s", s, report)
+		}
+	}
+	h.MustRun("audit", "verify", "audit.log")
+
+	// The voters are placed in zone backup, which becomes the primary.
+	var rules []*common.PlacementRule
+	if err = json.Unmarshal([]byte(h.Server.Posted("/pd/api/v1/config/rules")), &rules); err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].Role != common.RuleRoleVoter || !rules[0].Matches(map[string]string{"zone": "backup"}) {
+		t.Fatalf("unexpected rules posted %+v", rules)
+	}
+	mode := &common.ReplicationMode{}
+	if err = json.Unmarshal([]byte(h.Server.Posted("/pd/api/v1/config/replication-mode")), mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode.Mode != common.ModeMajority || mode.DRAutoSync.Primary != "backup" || mode.DRAutoSync.DR != "master" {
+		t.Fatalf("unexpected replication mode posted %+v", mode)
+	}
+	if posted := h.Server.Posted("/pd/api/v1/config/replicate"); !strings.Contains(posted, `"location-labels":"zone,host"`) {
+		t.Fatalf("unexpected replication config posted %s", posted)
+	}
+}
+
+func TestRecoverFailedHost(t *testing.T) {
+	h := newHarness(t)
+	fetch(t, h)
+	writeRecoverConfig(h)
+	h.Update(func(s *harness.Scenario) {
+		s.Failures = append(s.Failures, &harness.Failure{
+			Program: harness.ProgramSSH,
+			Host:    "10.0.2.2",
+			Message: "ssh: connect to host 10.0.2.2 port 22: Connection refused",
+			Exit:    255,
+		})
+	})
+
+	if out, err := h.Run("recover", "-c", "recover.yaml", "--yes"); err == nil {
+		t.Fatalf("expect recover to fail\n%s", out)
+	}
+
+	// Nothing is done to the data before all learners are stopped.
+	state := h.ReadState()
+	if len(state.DroppedLogs) != 0 || len(state.Promoted) != 0 || len(tiupCalls(h)) != 0 {
+		t.Fatalf("recover goes on after a failed host: %+v", state)
+	}
+	report, err := ioutil.ReadFile(h.Path("report.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(report), "**failed**") {
+		t.Fatalf("unexpected report\n%s", report)
+	}
+}
+
+func TestRecoverHalfCompleted(t *testing.T) {
+	h := newHarness(t)
+	fetch(t, h)
+	writeRecoverConfig(h)
+	// The first run stops after the learners are promoted and the cluster
+	// is deployed.
+	h.Update(func(s *harness.Scenario) {
+		s.Failures = append(s.Failures, &harness.Failure{
+			Program: harness.ProgramPDRecover,
+			Times:   1,
+			Message: "context deadline exceeded",
+		})
+	})
+	if out, err := h.Run("recover", "-c", "recover.yaml", "--yes"); err == nil {
+		t.Fatalf("expect recover to fail\n%s", out)
+	}
+	if got := strings.Join(tiupCalls(h), ","); got != "deploy,start" {
+		t.Fatalf("unexpected tiup calls %s", got)
+	}
+	first := len(tombstones(h))
+
+	// The rerun finds the conflicts resolved and the cluster deployed.
+	h.MustRun("recover", "-c", "recover.yaml", "--yes")
+	if got := len(tombstones(h)); got != first {
+		t.Fatalf("conflicts are tombstoned again, %v calls", got)
+	}
+	if got := strings.Join(tiupCalls(h), ","); got != "deploy,start,start,restart,scale-out" {
+		t.Fatalf("unexpected tiup calls %s", got)
+	}
+	if state := h.ReadState(); state.PDRecovered != 1 {
+		t.Fatalf("pd-recover succeeded %v times", state.PDRecovered)
+	}
+	h.MustRun("audit", "verify", "audit.log")
+}
+
+func equalIDs(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[uint64]bool)
+	for _, id := range a {
+		seen[id] = true
+	}
+	for _, id := range b {
+		if !seen[id] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,475 @@
+package harness
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iosmanthus/learner-recover/components/cluster"
+)
+
+// exitError ends a fake executable with the code, the message is printed to
+// stderr.
+type exitError struct {
+	code    int
+	message string
+}
+
+func (e *exitError) Error() string {
+	return e.message
+}
+
+func fail(code int, format string, args ...interface{}) error {
+	return &exitError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// fake is a call of a fake executable.
+type fake struct {
+	scenario *Scenario
+	state    *State
+	stdout   io.Writer
+}
+
+// Main runs the fake executable named program with the scenario and the
+// state taken from the environment, it returns the exit code.
+func Main(program string, args []string, stdout, stderr io.Writer) int {
+	code, err := run(program, args, stdout)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+	}
+	return code
+}
+
+func run(program string, args []string, stdout io.Writer) (int, error) {
+	dir := os.Getenv(EnvState)
+	if dir == "" {
+		return 2, fmt.Errorf("%s is not set", EnvState)
+	}
+	scenario, err := LoadScenario(os.Getenv(EnvScenario))
+	if err != nil {
+		return 2, err
+	}
+
+	lock, err := lockState(dir)
+	if err != nil {
+		return 2, err
+	}
+	defer lock.Unlock()
+
+	state, err := ReadState(dir)
+	if err != nil {
+		return 2, err
+	}
+
+	f := &fake{scenario: scenario, state: state, stdout: stdout}
+	host := callHost(program, args)
+	if err = appendCall(dir, &Call{Program: program, Host: host, Args: args}); err != nil {
+		return 2, err
+	}
+
+	err = f.injectFailure(program, host, args)
+	if err == nil {
+		switch program {
+		case ProgramSSH:
+			err = f.ssh(args)
+		case ProgramSCP:
+			err = f.scp(args)
+		case ProgramTiUP:
+			err = f.tiup(args)
+		case ProgramTiKVCtl:
+			err = f.tikvCtl("", args)
+		case ProgramPDRecover:
+			err = f.pdRecover(args)
+		default:
+			err = fail(127, "%s: command not found", program)
+		}
+	}
+
+	if werr := writeState(dir, f.state); werr != nil {
+		return 2, werr
+	}
+	if err != nil {
+		if e, ok := err.(*exitError); ok {
+			return e.code, e
+		}
+		return 1, err
+	}
+	return 0, nil
+}
+
+// callHost returns the remote host of ssh and scp and the address of
+// tikv-ctl --host, matched by the failures.
+func callHost(program string, args []string) string {
+	switch program {
+	case ProgramSSH:
+		for _, arg := range args {
+			if i := strings.Index(arg, "@"); i >= 0 {
+				return arg[i+1:]
+			}
+		}
+	case ProgramSCP:
+		if len(args) > 0 {
+			dest := args[len(args)-1]
+			if i := strings.Index(dest, "@"); i >= 0 {
+				return strings.SplitN(dest[i+1:], ":", 2)[0]
+			}
+		}
+	case ProgramTiKVCtl:
+		for i, arg := range args {
+			if arg == "--host" && i+1 < len(args) {
+				return args[i+1]
+			}
+		}
+	}
+	return ""
+}
+
+func (f *fake) injectFailure(program, host string, args []string) error {
+	for i, failure := range f.scenario.Failures {
+		if !failure.Match(program, host, args) {
+			continue
+		}
+		if failure.Times > 0 && f.state.Failed[i] >= failure.Times {
+			continue
+		}
+		f.state.Failed[i]++
+		code := failure.Exit
+		if code == 0 {
+			code = 1
+		}
+		return fail(code, "%s", failure.Message)
+	}
+	return nil
+}
+
+// ssh runs the remote commands of the recovery: systemctl and tikv-ctl sent
+// by scp.
+func (f *fake) ssh(args []string) error {
+	var host string
+	for len(args) > 0 && host == "" {
+		switch arg := args[0]; {
+		case arg == "-p":
+			args = args[1:]
+		case strings.Contains(arg, "@"):
+			host = arg[strings.Index(arg, "@")+1:]
+		}
+		args = args[1:]
+	}
+	if host == "" || len(args) == 0 {
+		return fail(255, "usage: ssh [-p port] user@host command")
+	}
+
+	if args[0] == "sudo" && len(args) == 5 && args[1] == "systemctl" && args[2] == "disable" && args[3] == "--now" {
+		port := strings.TrimSuffix(strings.TrimPrefix(args[4], "tikv-"), ".service")
+		address := fmt.Sprintf("%s:%s", host, port)
+		if f.scenario.Store(address) == nil {
+			return fail(1, "Failed to disable unit: Unit file %s does not exist.", args[4])
+		}
+		f.state.Stopped[address] = true
+		return nil
+	}
+
+	if !f.state.Copied[host+":"+args[0]] {
+		return fail(127, "bash: %s: No such file or directory", args[0])
+	}
+	return f.tikvCtl(host, args[1:])
+}
+
+func (f *fake) scp(args []string) error {
+	if len(args) < 2 {
+		return fail(1, "usage: scp [-P port] source target")
+	}
+	dest := args[len(args)-1]
+	i := strings.Index(dest, "@")
+	if i < 0 {
+		return fail(1, "scp: target %s is not remote", dest)
+	}
+	if _, err := os.Stat(args[len(args)-2]); err != nil {
+		return fail(1, "%v", err)
+	}
+	f.state.Copied[dest[i+1:]] = true
+	return nil
+}
+
+// tikvCtl serves tikv-ctl --host of running stores, and tikv-ctl --db of the
+// stopped stores on the host.
+func (f *fake) tikvCtl(host string, args []string) error {
+	if len(args) < 2 {
+		return fail(1, "usage: tikv-ctl --host address|--db path command")
+	}
+
+	var store *Store
+	switch args[0] {
+	case "--host":
+		if store = f.scenario.Store(args[1]); store == nil || f.state.Stopped[store.Address] {
+			return fail(1, "[ERROR] failed to connect to %s: Connection refused", args[1])
+		}
+		f.state.Samples[store.Address]++
+	case "--db":
+		if store = f.scenario.StoreByDB(host, args[1]); store == nil {
+			return fail(1, "[ERROR] IO error: No such file or directory: %s/CURRENT", args[1])
+		}
+		if !f.state.Stopped[store.Address] {
+			return fail(1, "[ERROR] IO error: While lock file: %s/LOCK: Resource temporarily unavailable", args[1])
+		}
+	default:
+		return fail(1, "unknown option %s", args[0])
+	}
+
+	command := strings.Join(args[2:], " ")
+	switch {
+	case command == "raft region --all-regions":
+		return f.regions(store)
+	case command == "unsafe-recover drop-unapplied-raftlog --all-regions":
+		f.state.DroppedLogs[store.Address] = true
+		fmt.Fprintln(f.stdout, "success")
+		return nil
+	case strings.HasPrefix(command, "unsafe-recover remove-fail-stores --promote-learner --all-regions -s "):
+		f.state.Promoted[store.Address] = args[len(args)-1]
+		fmt.Fprintln(f.stdout, "success")
+		return nil
+	case strings.HasPrefix(command, "tombstone --force -r "):
+		return f.tombstone(store, args[len(args)-1])
+	}
+	return fail(1, "unknown command %s", command)
+}
+
+type peer struct {
+	ID      uint64 `json:"id"`
+	StoreID uint64 `json:"store_id"`
+	Role    string `json:"role"`
+}
+
+// peers returns the peers of the region on all the stores.
+func (f *fake) peers(id uint64) []*peer {
+	var peers []*peer
+	for _, store := range f.scenario.Stores {
+		for _, region := range store.Regions {
+			if region.ID != id {
+				continue
+			}
+			role := "Voter"
+			if store.Learner {
+				role = "Learner"
+			}
+			peers = append(peers, &peer{ID: id*1000 + store.ID, StoreID: store.ID, Role: role})
+		}
+	}
+	return peers
+}
+
+// regions prints the region_infos of the store like tikv-ctl, the applied
+// indexes advance with the samples.
+func (f *fake) regions(store *Store) error {
+	type regionState struct {
+		RegionID  uint64 `json:"region_id"`
+		RaftState struct {
+			HardState struct {
+				Term   uint64 `json:"term"`
+				Vote   uint64 `json:"vote"`
+				Commit uint64 `json:"commit"`
+			} `json:"hard_state"`
+			LastIndex uint64 `json:"last_index"`
+		} `json:"raft_local_state"`
+		ApplyState struct {
+			AppliedIndex uint64 `json:"applied_index"`
+		} `json:"raft_apply_state"`
+		LocalState struct {
+			Region struct {
+				ID          uint64 `json:"id"`
+				StartKey    string `json:"start_key"`
+				EndKey      string `json:"end_key"`
+				RegionEpoch struct {
+					ConfVer uint64 `json:"conf_ver"`
+					Version int    `json:"version"`
+				} `json:"region_epoch"`
+				Peers []*peer `json:"peers"`
+			} `json:"region"`
+			State string `json:"state"`
+		} `json:"region_local_state"`
+	}
+
+	infos := make(map[string]*regionState)
+	for _, region := range store.Regions {
+		state := &regionState{RegionID: region.ID}
+		applied := region.AppliedIndex + region.Step*uint64(f.state.Samples[store.Address])
+		state.ApplyState.AppliedIndex = applied
+		state.RaftState.HardState.Term = 6
+		state.RaftState.HardState.Commit = applied + region.Unapplied
+		state.RaftState.LastIndex = applied + region.Unapplied
+		if f.state.DroppedLogs[store.Address] {
+			state.RaftState.HardState.Commit = applied
+			state.RaftState.LastIndex = applied
+		}
+
+		local := &state.LocalState
+		local.Region.ID = region.ID
+		local.Region.StartKey = region.StartKey
+		local.Region.EndKey = region.EndKey
+		local.Region.RegionEpoch.ConfVer = region.ConfVer
+		local.Region.RegionEpoch.Version = region.Version
+		local.Region.Peers = f.peers(region.ID)
+		local.State = region.State
+		if local.State == "" {
+			local.State = "Normal"
+		}
+		if f.state.Tombstoned(store.Address, region.ID) {
+			local.State = "Tombstone"
+		}
+		infos[strconv.FormatUint(region.ID, 10)] = state
+	}
+	return json.NewEncoder(f.stdout).Encode(map[string]interface{}{"region_infos": infos})
+}
+
+func (f *fake) tombstone(store *Store, ids string) error {
+	for _, s := range strings.Split(ids, ",") {
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return fail(1, "invalid region id %s", s)
+		}
+		found := false
+		for _, region := range store.Regions {
+			found = found || region.ID == id
+		}
+		if !found || f.state.Tombstoned(store.Address, id) {
+			return fail(1, "region %v not found", id)
+		}
+		f.state.Tombstones[store.Address] = append(f.state.Tombstones[store.Address], id)
+	}
+	fmt.Fprintln(f.stdout, "success!")
+	return nil
+}
+
+// pdRecover checks the cluster ID and the health of PD.
+func (f *fake) pdRecover(args []string) error {
+	flags := flag.NewFlagSet(ProgramPDRecover, flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	endpoints := flags.String("endpoints", "http://127.0.0.1:2379", "")
+	clusterID := flags.String("cluster-id", "", "")
+	allocID := flags.Uint64("alloc-id", 0, "")
+	if err := flags.Parse(args); err != nil {
+		return fail(1, "%v", err)
+	}
+
+	if *clusterID != f.scenario.ClusterID {
+		return fail(1, "cluster id %s mismatches %s", *clusterID, f.scenario.ClusterID)
+	}
+	if *allocID <= f.scenario.AllocID {
+		return fail(1, "alloc id %v is too small", *allocID)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(*endpoints + "/pd/api/v1/health")
+	if err != nil {
+		return fail(1, "%v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fail(1, "PD is unhealthy: %s", resp.Status)
+	}
+
+	f.state.PDRecovered++
+	fmt.Fprintln(f.stdout, "recover success! please restart the PD cluster")
+	return nil
+}
+
+// tiup serves tiup cluster deploy, start, restart, scale-out and display.
+func (f *fake) tiup(args []string) error {
+	if len(args) < 3 || args[0] != "cluster" {
+		return fail(1, "usage: tiup cluster command [-y] name ...")
+	}
+	op := args[1]
+	args = args[2:]
+	if args[0] == "-y" {
+		args = args[1:]
+	}
+	name := args[0]
+	c := f.state.Clusters[name]
+	if c == nil && op != "deploy" {
+		return fail(1, "Error: Cluster %s not found", name)
+	}
+
+	switch op {
+	case "deploy":
+		if len(args) != 3 {
+			return fail(1, "usage: tiup cluster deploy name version topology")
+		}
+		if c != nil {
+			return fail(1, "Error: Cluster name '%s' is duplicated", name)
+		}
+		instances, err := cluster.TopologyInstances(args[2])
+		if err != nil {
+			return fail(1, "Error: %v", err)
+		}
+		for _, inst := range instances {
+			inst.Status = "Down"
+		}
+		f.state.Clusters[name] = &cluster.Cluster{Name: name, Version: args[1], Instances: instances}
+	case "start", "restart":
+		for _, inst := range c.Instances {
+			inst.Status = "Up"
+		}
+	case "scale-out":
+		if len(args) != 2 {
+			return fail(1, "usage: tiup cluster scale-out name topology")
+		}
+		instances, err := cluster.TopologyInstances(args[1])
+		if err != nil {
+			return fail(1, "Error: %v", err)
+		}
+		for _, inst := range instances {
+			if c.Instance(inst.ID) != nil {
+				return fail(1, "Error: port conflict for %s", inst.ID)
+			}
+			inst.Status = "Up"
+			c.Instances = append(c.Instances, inst)
+		}
+	case "display":
+		return f.display(c)
+	default:
+		return fail(1, "unknown command %s", op)
+	}
+	return nil
+}
+
+func (f *fake) display(c *cluster.Cluster) error {
+	type instance struct {
+		ID        string `json:"id"`
+		Role      string `json:"role"`
+		Host      string `json:"host"`
+		Status    string `json:"status"`
+		DataDir   string `json:"data_dir"`
+		DeployDir string `json:"deploy_dir"`
+	}
+	display := struct {
+		Meta struct {
+			Type    string `json:"cluster_type"`
+			Name    string `json:"cluster_name"`
+			Version string `json:"cluster_version"`
+		} `json:"cluster_meta"`
+		Instances []*instance `json:"instances"`
+	}{}
+	display.Meta.Type = "tidb"
+	display.Meta.Name = c.Name
+	display.Meta.Version = c.Version
+	for _, inst := range c.Instances {
+		display.Instances = append(display.Instances, &instance{
+			ID:        inst.ID,
+			Role:      inst.Role,
+			Host:      inst.Host,
+			Status:    inst.Status,
+			DataDir:   inst.DataDir,
+			DeployDir: inst.DeployDir,
+		})
+	}
+
+	fmt.Fprintf(f.stdout, "Starting component `cluster`: tiup-cluster display %s --format json\n", c.Name)
+	return json.NewEncoder(f.stdout).Encode(display)
+}
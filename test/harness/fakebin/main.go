@@ -0,0 +1,14 @@
+// Command fakebin is the fake ssh, scp, tiup, tikv-ctl and pd-recover of the
+// test harness, the program is picked by the name it is run as.
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/iosmanthus/learner-recover/test/harness"
+)
+
+func main() {
+	os.Exit(harness.Main(filepath.Base(os.Args[0]), os.Args[1:], os.Stdout, os.Stderr))
+}
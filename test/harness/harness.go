@@ -0,0 +1,252 @@
+package harness
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	module  = "github.com/iosmanthus/learner-recover"
+	fakebin = module + "/test/harness/fakebin"
+	// Binary is the name of the learner-recover binary in the bin directory.
+	Binary = "learner-recover"
+)
+
+var build struct {
+	once sync.Once
+	dir  string
+	err  error
+}
+
+// Build builds learner-recover and the fake executables once per test
+// binary, it returns the directory of the executables.
+func Build() (string, error) {
+	build.once.Do(func() {
+		build.dir, build.err = ioutil.TempDir("", "learner-recover-harness")
+		if build.err != nil {
+			return
+		}
+		gobin := filepath.Join(runtime.GOROOT(), "bin", "go")
+		fake := filepath.Join(build.dir, "fakebin")
+		for _, target := range [][2]string{
+			{filepath.Join(build.dir, Binary), module},
+			{fake, fakebin},
+		} {
+			cmd := exec.Command(gobin, "build", "-o", target[0], target[1])
+			if out, err := cmd.CombinedOutput(); err != nil {
+				build.err = fmt.Errorf("go build %s: %v\n%s", target[1], err, out)
+				return
+			}
+		}
+		for _, program := range Programs {
+			if build.err = os.Symlink(fake, filepath.Join(build.dir, program)); build.err != nil {
+				return
+			}
+		}
+	})
+	return build.dir, build.err
+}
+
+// Cleanup removes the executables built, it is called by TestMain.
+func Cleanup() {
+	if build.dir != "" {
+		os.RemoveAll(build.dir)
+	}
+}
+
+// Harness runs learner-recover against the fake cluster of a scenario in a
+// temporary directory.
+type Harness struct {
+	Scenario *Scenario
+	Server   *Server
+	// Dir is the working directory of the commands, holding the scenario,
+	// the topologies and the outputs.
+	Dir string
+	// State is the state directory of the fake executables.
+	State string
+	Bin   string
+
+	t testing.TB
+}
+
+// New starts the fake cluster of the scenario file.
+func New(t testing.TB, path string) *Harness {
+	t.Helper()
+	bin, err := Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scenario, err := LoadScenario(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &Harness{
+		Scenario: scenario,
+		Server:   NewServer(scenario),
+		Dir:      t.TempDir(),
+		Bin:      bin,
+		t:        t,
+	}
+	t.Cleanup(h.Server.Close)
+	h.State = filepath.Join(h.Dir, "state")
+	if err = os.Mkdir(h.State, 0755); err != nil {
+		t.Fatal(err)
+	}
+	h.saveScenario()
+	return h
+}
+
+func (h *Harness) saveScenario() {
+	if err := h.Scenario.Save(h.Path("scenario.yaml")); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// Update changes the scenario for the following commands.
+func (h *Harness) Update(f func(scenario *Scenario)) {
+	h.Server.Update(f)
+	h.saveScenario()
+}
+
+// Path returns the path of a file in the working directory.
+func (h *Harness) Path(name string) string {
+	return filepath.Join(h.Dir, name)
+}
+
+// WriteFile writes a file of the working directory and returns its path.
+func (h *Harness) WriteFile(name, content string) string {
+	path := h.Path(name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		h.t.Fatal(err)
+	}
+	return path
+}
+
+// Topologies writes the topology of the cluster to old.yaml, the topology of
+// the rebuilt PD to new.yaml, and the learners matching the labels to
+// join.yaml, moved to other ports.
+func (h *Harness) Topologies(learners map[string]string) {
+	s := h.Scenario
+	pd := strings.Split(s.PD.Address, ":")
+	prom := strings.Split(s.Prometheus.Address, ":")
+
+	old := &bytes.Buffer{}
+	fmt.Fprintf(old, "global:\n  user: root\n  ssh_port: 22\n")
+	fmt.Fprintf(old, "pd_servers:\n  - host: %s\n    client_port: %s\n    deploy_dir: /deploy/pd\n", pd[0], pd[1])
+	fmt.Fprintf(old, "tikv_servers:\n")
+	join := &bytes.Buffer{}
+	fmt.Fprintf(join, "tikv_servers:\n")
+	for _, store := range s.Stores {
+		writeTiKV(old, store, store.Port(), store.DeployDir)
+		if matchLabels(store.Labels, learners) {
+			writeTiKV(join, store, store.Port()+1000, store.DeployDir+"-join")
+		}
+	}
+	fmt.Fprintf(old, "monitoring_servers:\n  - host: %s\n    port: %s\n    deploy_dir: /deploy/prometheus\n", prom[0], prom[1])
+	h.WriteFile("old.yaml", old.String())
+	h.WriteFile("join.yaml", join.String())
+
+	h.WriteFile("new.yaml", fmt.Sprintf(`global:
+  user: root
+  ssh_port: 22
+pd_servers:
+  - host: %s
+    client_port: %s
+    deploy_dir: /deploy/pd-new
+`, pd[0], pd[1]))
+}
+
+func writeTiKV(w *bytes.Buffer, store *Store, port int, deployDir string) {
+	fmt.Fprintf(w, "  - host: %s\n    port: %v\n    status_port: %v\n    deploy_dir: %s\n    data_dir: %s\n",
+		store.Host(), port, port+20, deployDir, store.DataDir)
+	if len(store.Labels) == 0 {
+		return
+	}
+	var keys []string
+	for k := range store.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "    config:\n      server.labels:\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "        %s: %s\n", k, store.Labels[k])
+	}
+}
+
+func matchLabels(labels, selector map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Run runs learner-recover with the arguments in the working directory, the
+// fake executables first in $PATH. It returns the combined output.
+func (h *Harness) Run(args ...string) (string, error) {
+	cmd := exec.Command(filepath.Join(h.Bin, Binary), args...)
+	cmd.Dir = h.Dir
+	cmd.Env = append(os.Environ(),
+		"PATH="+h.Bin+string(os.PathListSeparator)+os.Getenv("PATH"),
+		EnvScenario+"="+h.Path("scenario.yaml"),
+		EnvState+"="+h.State,
+	)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// MustRun runs learner-recover and fails the test if it fails.
+func (h *Harness) MustRun(args ...string) string {
+	h.t.Helper()
+	out, err := h.Run(args...)
+	if err != nil {
+		h.t.Fatalf("learner-recover %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return out
+}
+
+// Executable returns the path of a fake executable.
+func (h *Harness) Executable(program string) string {
+	return filepath.Join(h.Bin, program)
+}
+
+// Calls returns the calls of the fake executables, of the programs if any
+// are given.
+func (h *Harness) Calls(programs ...string) []*Call {
+	calls, err := ReadCalls(h.State)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if len(programs) == 0 {
+		return calls
+	}
+	var filtered []*Call
+	for _, call := range calls {
+		for _, program := range programs {
+			if call.Program == program {
+				filtered = append(filtered, call)
+			}
+		}
+	}
+	return filtered
+}
+
+// ReadState returns the state of the fake cluster.
+func (h *Harness) ReadState() *State {
+	s, err := ReadState(h.State)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return s
+}
@@ -0,0 +1,194 @@
+// Package harness runs learner-recover end to end on a single box. Fake
+// ssh, scp, tiup, tikv-ctl and pd-recover executables and a fake
+// PD/Prometheus server play a cluster described by a scenario file.
+package harness
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Environment of the fake executables.
+const (
+	// EnvScenario is the path of the scenario file.
+	EnvScenario = "HARNESS_SCENARIO"
+	// EnvState is the directory keeping the state of the fake cluster
+	// across the calls, e.g. the stopped stores and the tiup clusters.
+	EnvState = "HARNESS_STATE"
+)
+
+// Programs faked by the harness.
+const (
+	ProgramSSH       = "ssh"
+	ProgramSCP       = "scp"
+	ProgramTiUP      = "tiup"
+	ProgramTiKVCtl   = "tikv-ctl"
+	ProgramPDRecover = "pd-recover"
+)
+
+var Programs = []string{ProgramSSH, ProgramSCP, ProgramTiUP, ProgramTiKVCtl, ProgramPDRecover}
+
+// Scenario describes the fake cluster.
+type Scenario struct {
+	// ClusterID is reported by pd_cluster_metadata and expected by
+	// pd-recover.
+	ClusterID string `yaml:"cluster-id"`
+	// AllocID is the value of pd_cluster_id, the fetched alloc ID adds
+	// MaxUint32 to it.
+	AllocID uint64 `yaml:"alloc-id"`
+	// PD, Prometheus and the status API of TiDB are served by the fake
+	// server, their addresses are filled in when it starts.
+	PD         Endpoint `yaml:"pd"`
+	Prometheus Endpoint `yaml:"prometheus"`
+	TiDB       Endpoint `yaml:"tidb"`
+	Stores     []*Store `yaml:"stores"`
+	// Replication is the replication settings served by the fake PD.
+	Replication Replication `yaml:"replication"`
+	// Tables are the TiDB tables of the cluster.
+	Tables []*Table `yaml:"tables"`
+	// Failures fail the matching calls of the fake executables.
+	Failures []*Failure `yaml:"failures"`
+}
+
+type Endpoint struct {
+	Address string `yaml:"address"`
+	// Down makes the endpoint answer 503.
+	Down bool `yaml:"down"`
+}
+
+// Store is a TiKV server, reached by its address with tikv-ctl --host and by
+// its host and data directory over SSH.
+type Store struct {
+	ID uint64 `yaml:"id"`
+	// Address is host:port.
+	Address   string            `yaml:"address"`
+	DeployDir string            `yaml:"deploy-dir"`
+	DataDir   string            `yaml:"data-dir"`
+	Labels    map[string]string `yaml:"labels"`
+	// Learner makes the peers of the store learners.
+	Learner bool      `yaml:"learner"`
+	Regions []*Region `yaml:"regions"`
+}
+
+func (s *Store) Host() string {
+	host, _, _ := net.SplitHostPort(s.Address)
+	return host
+}
+
+func (s *Store) Port() int {
+	_, port, _ := net.SplitHostPort(s.Address)
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// DB is the path of the RocksDB of the store, as passed to tikv-ctl --db.
+func (s *Store) DB() string {
+	return fmt.Sprintf("%s/%s/db", s.DeployDir, s.DataDir)
+}
+
+// Region is a region replica of a store. The applied index advances by Step
+// every time the store is sampled with tikv-ctl --host. The peers of the
+// region are on the stores with the same region ID.
+type Region struct {
+	ID           uint64 `yaml:"id"`
+	StartKey     string `yaml:"start-key"`
+	EndKey       string `yaml:"end-key"`
+	Version      int    `yaml:"version"`
+	ConfVer      uint64 `yaml:"conf-ver"`
+	AppliedIndex uint64 `yaml:"applied-index"`
+	Step         uint64 `yaml:"step"`
+	// Unapplied is the number of entries committed but not applied.
+	Unapplied uint64 `yaml:"unapplied"`
+	// State defaults to Normal.
+	State string `yaml:"state"`
+}
+
+// Replication is the replication config, the placement rules and the
+// replication mode of PD. The rules and the mode are kept as PD serves them.
+type Replication struct {
+	// MaxReplicas defaults to 3.
+	MaxReplicas    int                      `yaml:"max-replicas"`
+	LocationLabels string                   `yaml:"location-labels"`
+	Rules          []map[string]interface{} `yaml:"rules"`
+	// Mode defaults to the majority mode.
+	Mode map[string]interface{} `yaml:"mode"`
+}
+
+type Table struct {
+	ID   int64  `yaml:"id"`
+	DB   string `yaml:"db"`
+	Name string `yaml:"name"`
+}
+
+// Failure fails the calls of Program matching Host and Args.
+type Failure struct {
+	Program string `yaml:"program"`
+	// Host is the remote host of ssh and scp, the address of tikv-ctl
+	// --host, or empty for any.
+	Host string `yaml:"host"`
+	// Args is a substring of the space joined arguments, empty for any.
+	Args string `yaml:"args"`
+	// Times is the number of calls to fail, 0 fails them all.
+	Times   int    `yaml:"times"`
+	Message string `yaml:"message"`
+	Exit    int    `yaml:"exit"`
+}
+
+// Match reports whether the failure applies to the call.
+func (f *Failure) Match(program, host string, args []string) bool {
+	if f.Program != program {
+		return false
+	}
+	if f.Host != "" && f.Host != host {
+		return false
+	}
+	return strings.Contains(strings.Join(args, " "), f.Args)
+}
+
+// LoadScenario reads a scenario file.
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Scenario{}
+	if err = yaml.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Save writes the scenario file.
+func (s *Scenario) Save(path string) error {
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Store returns the store with the address, nil if missing.
+func (s *Scenario) Store(address string) *Store {
+	for _, store := range s.Stores {
+		if store.Address == address {
+			return store
+		}
+	}
+	return nil
+}
+
+// StoreByDB returns the store on the host with the RocksDB path, nil if
+// missing.
+func (s *Scenario) StoreByDB(host, db string) *Store {
+	for _, store := range s.Stores {
+		if store.Host() == host && store.DB() == db {
+			return store
+		}
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package harness
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a fake PD, a fake Prometheus and the status API of a fake TiDB
+// of the scenario, on their own listeners so that they are told apart.
+type Server struct {
+	PD         *httptest.Server
+	Prometheus *httptest.Server
+	TiDB       *httptest.Server
+
+	mu       sync.Mutex
+	scenario *Scenario
+	requests []string
+	// posted are the last bodies posted to the PD config by their paths.
+	posted map[string]string
+}
+
+// NewServer starts the servers and fills in their addresses in the
+// scenario.
+func NewServer(scenario *Scenario) *Server {
+	s := &Server{scenario: scenario, posted: make(map[string]string)}
+
+	pd := http.NewServeMux()
+	pd.HandleFunc("/pd/api/v1/stores", s.stores)
+	pd.HandleFunc("/pd/api/v1/health", s.health)
+	pd.HandleFunc("/pd/api/v1/config/replicate", s.replicate)
+	pd.HandleFunc("/pd/api/v1/config/rules", s.rules)
+	pd.HandleFunc("/pd/api/v1/config/replication-mode", s.replicationMode)
+	s.PD = httptest.NewServer(s.serve(func() *Endpoint { return &s.scenario.PD }, pd))
+
+	prom := http.NewServeMux()
+	prom.HandleFunc("/api/v1/query", s.query)
+	s.Prometheus = httptest.NewServer(s.serve(func() *Endpoint { return &s.scenario.Prometheus }, prom))
+
+	tidb := http.NewServeMux()
+	tidb.HandleFunc("/schema", s.databases)
+	tidb.HandleFunc("/schema/", s.tables)
+	s.TiDB = httptest.NewServer(s.serve(func() *Endpoint { return &s.scenario.TiDB }, tidb))
+
+	scenario.PD.Address = s.PD.Listener.Addr().String()
+	scenario.Prometheus.Address = s.Prometheus.Listener.Addr().String()
+	scenario.TiDB.Address = s.TiDB.Listener.Addr().String()
+	return s
+}
+
+func (s *Server) Close() {
+	s.PD.Close()
+	s.Prometheus.Close()
+	s.TiDB.Close()
+}
+
+// Update changes the scenario served, e.g. to bring PD down.
+func (s *Server) Update(f func(scenario *Scenario)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s.scenario)
+}
+
+// Requests returns the requests served so far, e.g. "GET /pd/api/v1/stores".
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+// Posted returns the last body posted to the PD config path, e.g.
+// "/pd/api/v1/config/rules", empty if nothing is posted.
+func (s *Server) Posted(path string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.posted[path]
+}
+
+// post records the body posted to the PD config, the settings served are
+// left unchanged.
+func (s *Server) post(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil || !json.Valid(data) {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.posted[r.URL.Path] = string(data)
+	s.mu.Unlock()
+	writeJSON(w, "The config is updated.")
+}
+
+func (s *Server) serve(endpoint func() *Endpoint, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+		down := endpoint().Down
+		s.mu.Unlock()
+
+		if down {
+			http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+type label struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func (s *Server) stores(w http.ResponseWriter, _ *http.Request) {
+	type store struct {
+		Store struct {
+			ID        uint64  `json:"id"`
+			Address   string  `json:"address"`
+			Labels    []label `json:"labels"`
+			StateName string  `json:"state_name"`
+		} `json:"store"`
+		Status struct {
+			RegionCount int `json:"region_count"`
+			LeaderCount int `json:"leader_count"`
+		} `json:"status"`
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stores []*store
+	for _, st := range s.scenario.Stores {
+		info := &store{}
+		info.Store.ID = st.ID
+		info.Store.Address = st.Address
+		info.Store.StateName = "Up"
+		for k, v := range st.Labels {
+			info.Store.Labels = append(info.Store.Labels, label{Key: k, Value: v})
+		}
+		info.Status.RegionCount = len(st.Regions)
+		stores = append(stores, info)
+	}
+	writeJSON(w, map[string]interface{}{"count": len(stores), "stores": stores})
+}
+
+func (s *Server) health(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, []map[string]interface{}{{
+		"name":        "pd-0",
+		"member_id":   1,
+		"client_urls": []string{s.PD.URL},
+		"health":      true,
+	}})
+}
+
+func (s *Server) replicate(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		s.post(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	replication := s.scenario.Replication
+	maxReplicas := replication.MaxReplicas
+	if maxReplicas == 0 {
+		maxReplicas = 3
+	}
+	writeJSON(w, map[string]interface{}{
+		"max-replicas":           maxReplicas,
+		"location-labels":        replication.LocationLabels,
+		"enable-placement-rules": fmt.Sprintf("%v", len(replication.Rules) > 0),
+	})
+}
+
+func (s *Server) rules(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		s.post(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.scenario.Replication.Rules) == 0 {
+		http.Error(w, "placement rules feature is disabled", http.StatusPreconditionFailed)
+		return
+	}
+	writeJSON(w, s.scenario.Replication.Rules)
+}
+
+func (s *Server) replicationMode(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		s.post(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mode := s.scenario.Replication.Mode
+	if mode == nil {
+		mode = map[string]interface{}{"replication-mode": "majority"}
+	}
+	writeJSON(w, mode)
+}
+
+type name struct {
+	O string `json:"O"`
+	L string `json:"L"`
+}
+
+func newName(s string) name {
+	return name{O: s, L: strings.ToLower(s)}
+}
+
+// databases lists the databases of the tables like /schema of TiDB.
+func (s *Server) databases(w http.ResponseWriter, _ *http.Request) {
+	type db struct {
+		ID   int64 `json:"id"`
+		Name name  `json:"db_name"`
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dbs := []*db{}
+	seen := make(map[string]bool)
+	for _, t := range s.scenario.Tables {
+		if !seen[t.DB] {
+			seen[t.DB] = true
+			dbs = append(dbs, &db{ID: int64(len(dbs) + 1), Name: newName(t.DB)})
+		}
+	}
+	writeJSON(w, dbs)
+}
+
+// tables lists the tables of a database like /schema/{db} of TiDB.
+func (s *Server) tables(w http.ResponseWriter, r *http.Request) {
+	type table struct {
+		ID   int64 `json:"id"`
+		Name name  `json:"name"`
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db := strings.TrimPrefix(r.URL.Path, "/schema/")
+	tables := []*table{}
+	for _, t := range s.scenario.Tables {
+		if t.DB == db {
+			tables = append(tables, &table{ID: t.ID, Name: newName(t.Name)})
+		}
+	}
+	if len(tables) == 0 {
+		http.Error(w, "[schema:1049]Unknown database '"+db+"'", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, tables)
+}
+
+// query answers the instant queries of pd_cluster_metadata and
+// pd_cluster_id.
+func (s *Server) query(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	clusterID, allocID := s.scenario.ClusterID, s.scenario.AllocID
+	s.mu.Unlock()
+
+	ts := float64(time.Now().Unix())
+	var result []interface{}
+	switch q := r.FormValue("query"); q {
+	case "pd_cluster_metadata":
+		result = append(result, map[string]interface{}{
+			"metric": map[string]string{"__name__": q, "type": "cluster" + clusterID},
+			"value":  []interface{}{ts, "1"},
+		})
+	case "pd_cluster_id":
+		result = append(result, map[string]interface{}{
+			"metric": map[string]string{"__name__": q, "type": "idalloc"},
+			"value":  []interface{}{ts, fmt.Sprintf("%v", allocID)},
+		})
+	}
+	if result == nil {
+		result = []interface{}{}
+	}
+	writeJSON(w, map[string]interface{}{
+		"status": "success",
+		"data":   map[string]interface{}{"resultType": "vector", "result": result},
+	})
+}
@@ -0,0 +1,146 @@
+package harness
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/iosmanthus/learner-recover/components/cluster"
+
+	"github.com/gofrs/flock"
+)
+
+const (
+	stateFile = "state.json"
+	callsFile = "calls.jsonl"
+	lockFile  = "state.lock"
+)
+
+// State is what the fake executables did to the cluster, kept across the
+// calls and the runs of a test.
+type State struct {
+	// Copied lists the files sent by scp as host:path.
+	Copied map[string]bool `json:"copied"`
+	// Stopped lists the addresses of the stores stopped by systemctl.
+	Stopped map[string]bool `json:"stopped"`
+	// Samples counts the tikv-ctl --host calls of every store.
+	Samples map[string]int `json:"samples"`
+	// DroppedLogs lists the stores whose unapplied raft logs are dropped.
+	DroppedLogs map[string]bool `json:"dropped-logs"`
+	// Promoted maps the stores to the failed stores passed to
+	// remove-fail-stores --promote-learner.
+	Promoted map[string]string `json:"promoted"`
+	// Tombstones maps the stores to their tombstoned regions.
+	Tombstones map[string][]uint64 `json:"tombstones"`
+	// PDRecovered counts the successful pd-recover calls.
+	PDRecovered int `json:"pd-recovered"`
+	// Clusters are the clusters deployed by tiup.
+	Clusters map[string]*cluster.Cluster `json:"clusters"`
+	// Failed counts the calls failed by every failure of the scenario.
+	Failed map[int]int `json:"failed"`
+}
+
+func newState() *State {
+	return &State{
+		Copied:      make(map[string]bool),
+		Stopped:     make(map[string]bool),
+		Samples:     make(map[string]int),
+		DroppedLogs: make(map[string]bool),
+		Promoted:    make(map[string]string),
+		Tombstones:  make(map[string][]uint64),
+		Clusters:    make(map[string]*cluster.Cluster),
+		Failed:      make(map[int]int),
+	}
+}
+
+// Tombstoned reports whether the region of the store is tombstoned.
+func (s *State) Tombstoned(address string, region uint64) bool {
+	for _, id := range s.Tombstones[address] {
+		if id == region {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadState reads the state in the directory, empty if nothing is done yet.
+func ReadState(dir string) (*State, error) {
+	s := newState()
+	data, err := ioutil.ReadFile(filepath.Join(dir, stateFile))
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func writeState(dir string, s *State) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, stateFile), data, 0644)
+}
+
+// lockState serializes the fake executables run in parallel.
+func lockState(dir string) (*flock.Flock, error) {
+	lock := flock.New(filepath.Join(dir, lockFile))
+	return lock, lock.Lock()
+}
+
+// Call is a call of a fake executable.
+type Call struct {
+	Program string   `json:"program"`
+	Host    string   `json:"host,omitempty"`
+	Args    []string `json:"args"`
+}
+
+func (c *Call) String() string {
+	return c.Program + " " + strings.Join(c.Args, " ")
+}
+
+func appendCall(dir string, call *Call) error {
+	f, err := os.OpenFile(filepath.Join(dir, callsFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := json.Marshal(call)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// ReadCalls reads the calls of the fake executables in the directory, in the
+// order they are made.
+func ReadCalls(dir string) ([]*Call, error) {
+	f, err := os.Open(filepath.Join(dir, callsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var calls []*Call
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		call := &Call{}
+		if err = json.Unmarshal(scanner.Bytes(), call); err != nil {
+			return nil, err
+		}
+		calls = append(calls, call)
+	}
+	return calls, scanner.Err()
+}